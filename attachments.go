@@ -0,0 +1,335 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Метаданные вложения сообщения
+type messageAttachment struct {
+	ID           int    `json:"id"`
+	Kind         string `json:"kind"` // file или voice
+	FileName     string `json:"file_name"`
+	Size         int64  `json:"size"`
+	MimeType     string `json:"mime_type"`
+	Width        int    `json:"width,omitempty"`         // Размеры изображения
+	Height       int    `json:"height,omitempty"`        //
+	Blurhash     string `json:"blurhash,omitempty"`      // Размытое превью до загрузки
+	HasThumbnail bool   `json:"has_thumbnail,omitempty"` // Миниатюра доступна через /download-file?size=thumb
+	DurationMs   int    `json:"duration_ms,omitempty"`   // Длительность голосового сообщения
+	Waveform     []int  `json:"waveform,omitempty"`      // Волна громкости голосового сообщения (0..31)
+}
+
+const maxMessageAttachments = 10 // Вложений в одном сообщении (альбом)
+
+var errInvalidAttachments = errors.New("invalid attachments")
+
+// Загруженный файл, ожидающий отправки вместе с сообщением
+type pendingAttachment struct {
+	UploadID string
+	Kind     string
+	FileName string
+	BlobKey  string
+	Size     int64
+	MimeType string
+	Meta     blobMetadata
+}
+
+// Сведения о содержимом, сохранённые при обработке (изображения и голосовые сообщения)
+type blobMetadata struct {
+	Width        sql.NullInt64
+	Height       sql.NullInt64
+	Blurhash     sql.NullString
+	HasThumbnail bool
+	DurationMs   sql.NullInt64
+	Waveform     []byte
+}
+
+// Столбцы blobMetadata для запросов с присоединённой таблицей blobs b
+const blobMetadataColumns = `b.width, b.height, b.blurhash,
+               EXISTS (SELECT 1 FROM blob_variants v WHERE v.blob_key = b.key AND v.variant = 'thumb'),
+               b.duration_ms, b.waveform`
+
+func (m *blobMetadata) scanTargets() []interface{} {
+	return []interface{}{&m.Width, &m.Height, &m.Blurhash, &m.HasThumbnail, &m.DurationMs, &m.Waveform}
+}
+
+func (m blobMetadata) applyTo(a *messageAttachment) {
+	a.Width = int(m.Width.Int64)
+	a.Height = int(m.Height.Int64)
+	a.Blurhash = m.Blurhash.String
+	a.HasThumbnail = m.HasThumbnail
+	a.DurationMs = int(m.DurationMs.Int64)
+	a.Waveform = waveformValues(m.Waveform)
+}
+
+// Имя файла, переданное клиентом, без пути. Клиенты под Windows присылают путь с обратными
+// косыми чертами, поэтому оба разделителя приводятся к одному до выделения последней части
+func clientFileName(name string) string {
+	name = path.Base(strings.ReplaceAll(strings.TrimSpace(name), "\\", "/"))
+	if name == "." || name == ".." || name == "/" {
+		return "file"
+	}
+	return name
+}
+
+// Определение MIME-типа файла: по расширению имени, иначе по содержимому
+func detectMimeType(fileName string, data []byte) string {
+	if byExt := mime.TypeByExtension(strings.ToLower(filepath.Ext(fileName))); byExt != "" {
+		return byExt
+	}
+	return http.DetectContentType(data)
+}
+
+// Типы, которые браузер может безопасно показать без скачивания
+func isInlineMimeType(mimeType string) bool {
+	mediaType, _, _ := mime.ParseMediaType(mimeType)
+	if mediaType == "image/svg+xml" {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "image/") || strings.HasPrefix(mediaType, "audio/") ||
+		strings.HasPrefix(mediaType, "video/") || mediaType == "application/pdf"
+}
+
+// Загрузка вложений для набора сообщений (удалённые для всех сообщения вложений не показывают)
+func loadMessageAttachments(db *sql.DB, messageIDs []int) (map[int][]messageAttachment, error) {
+	result := make(map[int][]messageAttachment)
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+
+	rows, err := db.Query(`
+        SELECT f.message_id, f.id, f.kind, f.file_name, f.file_size, COALESCE(f.mime_type, 'application/octet-stream'),
+               `+blobMetadataColumns+`
+        FROM message_files f
+        JOIN messages m ON m.id = f.message_id
+        LEFT JOIN blobs b ON b.key = f.blob_key
+        WHERE f.message_id = ANY($1) AND NOT m.is_deleted
+        ORDER BY f.message_id, f.id`, pq.Array(intsToInt64(messageIDs)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			messageID  int
+			attachment messageAttachment
+			meta       blobMetadata
+		)
+		targets := append([]interface{}{&messageID, &attachment.ID, &attachment.Kind, &attachment.FileName, &attachment.Size, &attachment.MimeType},
+			meta.scanTargets()...)
+		if err := rows.Scan(targets...); err != nil {
+			log.Printf("Ошибка чтения вложения: %v", err)
+			continue
+		}
+		meta.applyTo(&attachment)
+		result[messageID] = append(result[messageID], attachment)
+	}
+	return result, rows.Err()
+}
+
+// downloadFileHandler отдаёт вложение участнику чата сообщения.
+// Поддерживает Range-запросы; ?inline=1 открывает изображения, аудио, видео и PDF в браузере,
+// ?size=thumb отдаёт миниатюру изображения
+func downloadFileHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fileID, err := strconv.Atoi(r.URL.Query().Get("file_id"))
+	if err != nil {
+		http.Error(w, "Invalid file_id", http.StatusBadRequest)
+		return
+	}
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user_id", http.StatusBadRequest)
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var (
+		fileName   string
+		mimeType   sql.NullString
+		fileData   []byte
+		blobKey    sql.NullString
+		uploadedAt time.Time
+	)
+	// Файл доступен только участникам чата, пока сообщение не удалено и видно пользователю
+	err = db.QueryRow(`
+        SELECT f.file_name, f.mime_type, f.file_data, f.blob_key, f.uploaded_at
+        FROM message_files f
+        JOIN messages m ON m.id = f.message_id
+        JOIN participants p ON p.chat_id = m.chat_id AND p.user_id = $2
+        WHERE f.id = $1
+          AND NOT m.is_deleted
+          AND (p.history_cleared_at IS NULL OR m.created_at > p.history_cleared_at)
+          AND NOT EXISTS (SELECT 1 FROM deleted_messages dm WHERE dm.message_id = m.id AND dm.user_id = $2)`,
+		fileID, userID,
+	).Scan(&fileName, &mimeType, &fileData, &blobKey, &uploadedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка получения файла %d: %v", fileID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	contentType := mimeType.String
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	if r.URL.Query().Get("size") == "thumb" {
+		var thumbKey string
+		if blobKey.Valid {
+			err = db.QueryRow("SELECT variant_key FROM blob_variants WHERE blob_key = $1 AND variant = 'thumb'", blobKey.String).Scan(&thumbKey)
+			if err != nil && err != sql.ErrNoRows {
+				log.Printf("Ошибка получения миниатюры файла %d: %v", fileID, err)
+			}
+		}
+		if thumbKey == "" {
+			http.Error(w, "Thumbnail not found", http.StatusNotFound)
+			return
+		}
+		blobKey.String = thumbKey
+		contentType = "image/jpeg"
+		fileName = strings.TrimSuffix(fileName, filepath.Ext(fileName)) + "_thumb.jpg"
+	}
+	disposition := "attachment"
+	if r.URL.Query().Get("inline") == "1" && isInlineMimeType(contentType) {
+		disposition = "inline"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": fileName}))
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	// ServeContent обрабатывает Range, If-Modified-Since и HEAD
+	if blobKey.Valid {
+		serveBlob(w, r, blobKey.String, uploadedAt)
+		return
+	}
+	http.ServeContent(w, r, "", uploadedAt, bytes.NewReader(fileData))
+}
+
+// Прикрепить файл к уже отправленному сообщению может его автор или участник чата
+func canAttachToMessage(db queryRower, messageID, userID int) (bool, error) {
+	var allowed bool
+	err := db.QueryRow(`
+        SELECT EXISTS (
+            SELECT 1 FROM messages m
+            WHERE m.id = $1 AND NOT m.is_deleted
+              AND (m.user_id = $2 OR EXISTS (SELECT 1 FROM participants p WHERE p.chat_id = m.chat_id AND p.user_id = $2))
+        )`, messageID, userID).Scan(&allowed)
+	return allowed, err
+}
+
+// Блокировка загруженных пользователем файлов, которые будут прикреплены к новому сообщению.
+// Все указанные файлы должны существовать, принадлежать пользователю и ещё не быть отправлены
+func lockPendingAttachments(db dbExecutor, userID int, uploadIDs []string) ([]pendingAttachment, error) {
+	if len(uploadIDs) == 0 {
+		return nil, nil
+	}
+	if len(uploadIDs) > maxMessageAttachments {
+		return nil, errInvalidAttachments
+	}
+
+	rows, err := db.Query(`
+        SELECT u.id, u.kind, u.file_name, u.blob_key, u.length, COALESCE(u.mime_type, 'application/octet-stream'),
+               `+blobMetadataColumns+`
+        FROM uploads u
+        LEFT JOIN blobs b ON b.key = u.blob_key
+        WHERE u.id = ANY($1) AND u.user_id = $2 AND u.status = 'completed'
+        FOR UPDATE OF u`, pq.Array(uploadIDs), userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	found := make(map[string]pendingAttachment)
+	for rows.Next() {
+		var p pendingAttachment
+		targets := append([]interface{}{&p.UploadID, &p.Kind, &p.FileName, &p.BlobKey, &p.Size, &p.MimeType}, p.Meta.scanTargets()...)
+		if err := rows.Scan(targets...); err != nil {
+			return nil, err
+		}
+		found[p.UploadID] = p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Порядок вложений задаёт клиент; повторы и чужие файлы не допускаются
+	pending := make([]pendingAttachment, 0, len(uploadIDs))
+	for _, id := range uploadIDs {
+		p, ok := found[id]
+		if !ok {
+			return nil, errInvalidAttachments
+		}
+		// Голосовое сообщение отправляется отдельно от других файлов
+		if p.Kind == attachmentKindVoice && len(uploadIDs) > 1 {
+			return nil, errInvalidAttachments
+		}
+		delete(found, id)
+		pending = append(pending, p)
+	}
+	return pending, nil
+}
+
+// Прикрепление заблокированных файлов к сохранённому сообщению
+func attachPendingFiles(db dbExecutor, messageID int, pending []pendingAttachment) ([]messageAttachment, error) {
+	var attachments []messageAttachment
+	for _, p := range pending {
+		attachment := messageAttachment{Kind: p.Kind, FileName: p.FileName, Size: p.Size, MimeType: p.MimeType}
+		p.Meta.applyTo(&attachment)
+		err := db.QueryRow(
+			"INSERT INTO message_files (message_id, kind, file_name, blob_key, file_size, mime_type) VALUES ($1, $2, $3, $4, $5, $6) RETURNING id",
+			messageID, p.Kind, p.FileName, p.BlobKey, p.Size, p.MimeType,
+		).Scan(&attachment.ID)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := db.Exec("UPDATE uploads SET status = 'attached', message_id = $2 WHERE id = $1", p.UploadID, messageID); err != nil {
+			return nil, err
+		}
+		attachments = append(attachments, attachment)
+	}
+	return attachments, nil
+}
+
+// Несколько фотографий или видео в одном сообщении образуют альбом, голосовое вложение — голосовое сообщение
+func attachmentsMessageType(pending []pendingAttachment) string {
+	if len(pending) == 1 && pending[0].Kind == attachmentKindVoice {
+		return "voice"
+	}
+	if len(pending) < 2 {
+		return ""
+	}
+	for _, p := range pending {
+		if !strings.HasPrefix(p.MimeType, "image/") && !strings.HasPrefix(p.MimeType, "video/") {
+			return ""
+		}
+	}
+	return "album"
+}
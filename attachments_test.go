@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestClientFileName(t *testing.T) {
+	cases := map[string]string{
+		"photo.jpg":                       "photo.jpg",
+		"  report.pdf ":                   "report.pdf",
+		"/home/user/notes.txt":            "notes.txt",
+		`C:\Users\user\Desktop\notes.txt`: "notes.txt",
+		`..\..\etc\passwd`:                "passwd",
+		"dir/sub\\mixed.png":              "mixed.png",
+		"":                                "file",
+		"/":                               "file",
+		`\`:                               "file",
+		"..":                              "file",
+		`folder\..`:                       "file",
+	}
+	for input, want := range cases {
+		if got := clientFileName(input); got != want {
+			t.Errorf("clientFileName(%q) = %q, want %q", input, got, want)
+		}
+	}
+}
@@ -0,0 +1,1122 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
+)
+
+// Боты: учётные записи users.is_bot с владельцем-человеком и токеном доступа.
+// Бот получает обновления (новые и изменённые сообщения в своих чатах, нажатия кнопок)
+// долгим опросом getUpdates или доставкой на свой вебхук и действует через методы /bot/<method>
+const (
+	botAPIPath = "/bot/"
+
+	botUpdateMessage       = "message"
+	botUpdateEditedMessage = "edited_message"
+	botUpdateCallbackQuery = "callback_query"
+	botUpdateCommand       = "command"
+
+	maxBotsPerOwner       = 20
+	maxBotDescription     = 512
+	maxBotUpdatesBatch    = 100
+	maxLongPollTimeout    = 50 // Секунд ожидания обновлений в getUpdates
+	botUpdateRetention    = 24 * time.Hour
+	botPushInterval       = 5 * time.Second
+	maxBotCommands        = 100
+	maxBotCommandDesc     = 256
+	maxKeyboardButtons    = 100
+	maxKeyboardButtonText = 64
+	maxCallbackData       = 64 // Байт данных кнопки
+	maxCallbackAnswer     = 200
+)
+
+var (
+	errBotUnauthorized    = errors.New("invalid bot token")
+	errInvalidReplyMarkup = errors.New("invalid reply markup")
+
+	// Имя пользователя бота оканчивается на bot, чтобы бота можно было отличить от человека
+	botUsernamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{1,28}[Bb][Oo][Tt]$`)
+	botCommandPattern  = regexp.MustCompile(`^[a-z0-9_]{1,32}$`)
+)
+
+// Кнопка под сообщением: отправляет боту callback_data или открывает ссылку
+type inlineButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data,omitempty"`
+	URL          string `json:"url,omitempty"`
+}
+
+// Клавиатура из рядов кнопок под сообщением бота
+type inlineKeyboard struct {
+	InlineKeyboard [][]inlineButton `json:"inline_keyboard"`
+}
+
+// Команда бота для подсказок клиенту
+type botCommand struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+}
+
+// Бот в том виде, в котором он показывается владельцу; токен возвращается только при выпуске
+type botAccount struct {
+	ID          int       `json:"id"`
+	Username    string    `json:"username"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	OwnerID     int       `json:"owner_id"`
+	WebhookURL  string    `json:"webhook_url,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Token       string    `json:"token,omitempty"`
+}
+
+// Сериализация клавиатуры для колонки JSONB (nil — без кнопок)
+func replyMarkupJSON(markup *inlineKeyboard) interface{} {
+	if markup == nil {
+		return nil
+	}
+	data, _ := json.Marshal(markup)
+	return string(data)
+}
+
+// Проверка клавиатуры: у каждой кнопки текст и ровно одно действие
+func validateInlineKeyboard(markup *inlineKeyboard) error {
+	if markup == nil {
+		return nil
+	}
+	total := 0
+	for _, row := range markup.InlineKeyboard {
+		if len(row) == 0 {
+			return errInvalidReplyMarkup
+		}
+		for _, button := range row {
+			total++
+			text := strings.TrimSpace(button.Text)
+			if text == "" || utf8.RuneCountInString(text) > maxKeyboardButtonText || !utf8.ValidString(text) {
+				return errInvalidReplyMarkup
+			}
+			if (button.CallbackData == "") == (button.URL == "") {
+				return errInvalidReplyMarkup
+			}
+			if len(button.CallbackData) > maxCallbackData || (button.URL != "" && !validWebhookURL(button.URL)) {
+				return errInvalidReplyMarkup
+			}
+		}
+	}
+	if total == 0 || total > maxKeyboardButtons {
+		return errInvalidReplyMarkup
+	}
+	return nil
+}
+
+// Есть ли на клавиатуре кнопка с такими данными
+func (markup *inlineKeyboard) hasCallbackData(data string) bool {
+	for _, row := range markup.InlineKeyboard {
+		for _, button := range row {
+			if button.CallbackData != "" && button.CallbackData == data {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Сигналы о новых обновлениях для ожидающих getUpdates
+var botUpdateSignals sync.Map // ID бота → chan struct{}
+
+// Сигнал фоновой доставке обновлений на вебхуки ботов
+var botPushWake = make(chan struct{}, 1)
+
+func botUpdateSignal(botID int) chan struct{} {
+	ch, _ := botUpdateSignals.LoadOrStore(botID, make(chan struct{}, 1))
+	return ch.(chan struct{})
+}
+
+func notifyBot(botID int) {
+	select {
+	case botUpdateSignal(botID) <- struct{}{}:
+	default:
+	}
+	select {
+	case botPushWake <- struct{}{}:
+	default:
+	}
+}
+
+// Постановка обновления в очередь ботам среди участников (кроме отправителя)
+func queueBotUpdates(db *sql.DB, participantIDs []int, senderID int, kind string, data interface{}) {
+	if len(participantIDs) == 0 {
+		return
+	}
+	payload, err := json.Marshal(map[string]interface{}{kind: data})
+	if err != nil {
+		log.Printf("Боты: ошибка сериализации обновления %s: %v", kind, err)
+		return
+	}
+	rows, err := db.Query(`
+        INSERT INTO bot_updates (bot_user_id, payload)
+        SELECT b.user_id, $3::jsonb FROM bots b
+        WHERE b.user_id = ANY($1) AND b.user_id <> $2
+        RETURNING bot_user_id`, pq.Array(intsToInt64(participantIDs)), senderID, string(payload))
+	if err != nil {
+		log.Printf("Боты: ошибка постановки обновления %s: %v", kind, err)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var botID int
+		if rows.Scan(&botID) == nil {
+			notifyBot(botID)
+		}
+	}
+}
+
+// Обновление для ботов — участников чата
+func queueChatBotUpdates(db *sql.DB, chatID, senderID int, kind string, data interface{}) {
+	participantIDs, err := getChatParticipantIDs(db, chatID)
+	if err != nil {
+		log.Printf("Боты: ошибка получения участников чата %d: %v", chatID, err)
+		return
+	}
+	queueBotUpdates(db, participantIDs, senderID, kind, data)
+}
+
+// Токен бота: "<id>:<секрет>"; в БД хранится только хеш
+func newBotToken(botID int) (string, error) {
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d:%s", botID, secret), nil
+}
+
+// Бот по заголовку Authorization: Bearer <token>
+func authenticateBot(db queryRower, r *http.Request) (int, error) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return 0, errBotUnauthorized
+	}
+	var botID int
+	err := db.QueryRow("SELECT user_id FROM bots WHERE token_hash = $1", secretTokenHash(strings.TrimPrefix(header, "Bearer "))).Scan(&botID)
+	if err == sql.ErrNoRows {
+		return 0, errBotUnauthorized
+	}
+	return botID, err
+}
+
+// Бот по ID; owner — для проверки, что бот принадлежит пользователю (0 — без проверки)
+func loadBotAccount(db queryRower, botID, ownerID int) (botAccount, error) {
+	var (
+		bot         botAccount
+		name        sql.NullString
+		description sql.NullString
+		webhookURL  sql.NullString
+	)
+	err := db.QueryRow(`
+        SELECT u.id, u.username, u.name, b.description, b.owner_id, b.webhook_url, b.created_at
+        FROM bots b JOIN users u ON u.id = b.user_id
+        WHERE b.user_id = $1 AND ($2 = 0 OR b.owner_id = $2)`, botID, ownerID,
+	).Scan(&bot.ID, &bot.Username, &name, &description, &bot.OwnerID, &webhookURL, &bot.CreatedAt)
+	bot.Name, bot.Description, bot.WebhookURL = name.String, description.String, webhookURL.String
+	return bot, err
+}
+
+// Боты владельца (GET ?user_id), создание (POST {user_id, username, name, description})
+// и отзыв (DELETE ?user_id&bot_id). После отзыва учётная запись остаётся в истории сообщений
+func botsHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	switch r.Method {
+	case "GET":
+		ownerID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+		if err != nil {
+			http.Error(w, "User ID is required", http.StatusBadRequest)
+			return
+		}
+		rows, err := db.Query("SELECT user_id FROM bots WHERE owner_id = $1 ORDER BY created_at", ownerID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if rows.Scan(&id) == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+
+		bots := []botAccount{}
+		for _, id := range ids {
+			if bot, err := loadBotAccount(db, id, ownerID); err == nil {
+				bots = append(bots, bot)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(bots)
+
+	case "POST":
+		var data struct {
+			UserID      int    `json:"user_id"`
+			Username    string `json:"username"`
+			Name        string `json:"name"`
+			Description string `json:"description"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		data.Name = strings.TrimSpace(sanitizeMessageText(data.Name))
+		data.Description = strings.TrimSpace(sanitizeMessageText(data.Description))
+		if !botUsernamePattern.MatchString(data.Username) {
+			http.Error(w, "Bot username must end with \"bot\"", http.StatusBadRequest)
+			return
+		}
+		if data.Name == "" || utf8.RuneCountInString(data.Name) > maxIncomingWebhookName || utf8.RuneCountInString(data.Description) > maxBotDescription {
+			http.Error(w, "Invalid name or description", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		// Владелец — существующий человек, а не другой бот
+		var count int
+		err = tx.QueryRow(`
+            SELECT (SELECT COUNT(*) FROM bots WHERE owner_id = u.id)
+            FROM users u WHERE u.id = $1 AND NOT u.is_bot`, data.UserID).Scan(&count)
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if count >= maxBotsPerOwner {
+			http.Error(w, "Too many bots", http.StatusConflict)
+			return
+		}
+
+		var botID int
+		err = tx.QueryRow(`
+            INSERT INTO users (username, password, name, is_bot)
+            VALUES ($1, '!', $2, TRUE)
+            ON CONFLICT (username) DO NOTHING
+            RETURNING id`, data.Username, data.Name,
+		).Scan(&botID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Username is already taken", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		token, err := newBotToken(botID)
+		if err != nil {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		_, err = tx.Exec(`
+            INSERT INTO bots (user_id, owner_id, description, token_hash)
+            VALUES ($1, $2, NULLIF($3, ''), $4)`, botID, data.UserID, data.Description, secretTokenHash(token))
+		if err != nil {
+			log.Printf("Ошибка создания бота: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		bot, err := loadBotAccount(db, botID, data.UserID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		bot.Token = token
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(bot)
+
+	case "DELETE":
+		ownerID, errUser := strconv.Atoi(r.URL.Query().Get("user_id"))
+		botID, errBot := strconv.Atoi(r.URL.Query().Get("bot_id"))
+		if errUser != nil || errBot != nil {
+			http.Error(w, "User ID and bot ID are required", http.StatusBadRequest)
+			return
+		}
+		result, err := db.Exec("DELETE FROM bots WHERE user_id = $1 AND owner_id = $2", botID, ownerID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Bot not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Выпуск нового токена бота владельцем; прежний токен перестаёт действовать
+func botTokenHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var data struct {
+		UserID int `json:"user_id"`
+		BotID  int `json:"bot_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	token, err := newBotToken(data.BotID)
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	result, err := db.Exec("UPDATE bots SET token_hash = $3 WHERE user_id = $1 AND owner_id = $2", data.BotID, data.UserID, secretTokenHash(token))
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		http.Error(w, "Bot not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"bot_id": data.BotID, "token": token})
+}
+
+// Команды бота для подсказок (GET ?bot_id)
+func botCommandsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	botID, err := strconv.Atoi(r.URL.Query().Get("bot_id"))
+	if err != nil {
+		http.Error(w, "Bot ID is required", http.StatusBadRequest)
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	commands, err := loadBotCommands(db, botID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(commands)
+}
+
+func loadBotCommands(db *sql.DB, botID int) ([]botCommand, error) {
+	rows, err := db.Query("SELECT command, description FROM bot_commands WHERE bot_user_id = $1 ORDER BY position", botID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	commands := []botCommand{}
+	for rows.Next() {
+		var c botCommand
+		if err := rows.Scan(&c.Command, &c.Description); err == nil {
+			commands = append(commands, c)
+		}
+	}
+	return commands, rows.Err()
+}
+
+// Ответ метода Bot API
+func writeBotResult(w http.ResponseWriter, result interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// Методы Bot API: /bot/<method>, токен в заголовке Authorization: Bearer <token>, параметры — JSON в теле
+func botAPIHandler(w http.ResponseWriter, r *http.Request) {
+	method := strings.TrimPrefix(r.URL.Path, botAPIPath)
+	if method != "getMe" && r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	botID, err := authenticateBot(db, r)
+	if errors.Is(err, errBotUnauthorized) {
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	switch method {
+	case "getMe":
+		bot, err := loadBotAccount(db, botID, 0)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		writeBotResult(w, bot)
+	case "getUpdates":
+		botGetUpdates(w, r, db, botID)
+	case "setWebhook":
+		botSetWebhook(w, r, db, botID)
+	case "sendMessage":
+		botSendMessage(w, r, db, botID)
+	case "editMessage":
+		botEditMessage(w, r, db, botID)
+	case "deleteMessage":
+		var data struct {
+			MessageID int `json:"message_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		chatID, err := deleteMessageForEveryone(db, data.MessageID, botID)
+		if errors.Is(err, errNotMessageAuthor) {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		writeBotResult(w, map[string]interface{}{"message_id": data.MessageID, "chat_id": chatID})
+	case "setCommands":
+		botSetCommands(w, r, db, botID)
+	case "getCommands":
+		commands, err := loadBotCommands(db, botID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		writeBotResult(w, commands)
+	case "answerCallbackQuery":
+		botAnswerCallbackQuery(w, r, db, botID)
+	case "sendEphemeral":
+		botSendEphemeral(w, r, db, botID)
+	default:
+		http.Error(w, "Unknown method", http.StatusNotFound)
+	}
+}
+
+// Долгий опрос обновлений: offset подтверждает получение всех обновлений с меньшим ID,
+// timeout — сколько секунд ждать новых обновлений, если очередь пуста
+func botGetUpdates(w http.ResponseWriter, r *http.Request, db *sql.DB, botID int) {
+	var params struct {
+		Offset  int64 `json:"offset"`
+		Limit   int   `json:"limit"`
+		Timeout int   `json:"timeout"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil && err != io.EOF {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if params.Limit <= 0 || params.Limit > maxBotUpdatesBatch {
+		params.Limit = maxBotUpdatesBatch
+	}
+	if params.Timeout < 0 || params.Timeout > maxLongPollTimeout {
+		params.Timeout = maxLongPollTimeout
+	}
+
+	// Обновления доставляются либо вебхуком, либо опросом
+	var hasWebhook bool
+	if err := db.QueryRow("SELECT webhook_url IS NOT NULL FROM bots WHERE user_id = $1", botID).Scan(&hasWebhook); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if hasWebhook {
+		http.Error(w, "Webhook is active, updates are delivered there", http.StatusConflict)
+		return
+	}
+
+	if params.Offset > 0 {
+		if _, err := db.Exec("DELETE FROM bot_updates WHERE bot_user_id = $1 AND id < $2", botID, params.Offset); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Пока запрос ждёт обновлений, соединения с БД закрыты: долгие опросы многих ботов
+	// не должны занимать соединения. После сигнала или таймаута подключение открывается заново
+	// (повторное закрытие переданного db вызывающим безопасно)
+	defer func() { db.Close() }()
+	deadline := time.NewTimer(time.Duration(params.Timeout) * time.Second)
+	defer deadline.Stop()
+	for {
+		updates, err := loadBotUpdates(db, botID, params.Limit)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if len(updates) > 0 || params.Timeout == 0 {
+			writeBotResult(w, updates)
+			return
+		}
+		db.Close()
+		select {
+		case <-botUpdateSignal(botID):
+		case <-deadline.C:
+			params.Timeout = 0
+		case <-r.Context().Done():
+			return
+		}
+		if db, err = connectDB(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+}
+
+// Очередь обновлений бота; update_id — порядковый номер для подтверждения
+func loadBotUpdates(db *sql.DB, botID, limit int) ([]json.RawMessage, error) {
+	rows, err := db.Query(`
+        SELECT jsonb_build_object('update_id', id) || payload
+        FROM bot_updates WHERE bot_user_id = $1
+        ORDER BY id LIMIT $2`, botID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	updates := []json.RawMessage{}
+	for rows.Next() {
+		var update []byte
+		if err := rows.Scan(&update); err == nil {
+			updates = append(updates, update)
+		}
+	}
+	return updates, rows.Err()
+}
+
+// Адрес для доставки обновлений (пустой — вернуться к getUpdates).
+// Обновления подписываются так же, как исходящие вебхуки; секрет возвращается в ответе
+func botSetWebhook(w http.ResponseWriter, r *http.Request, db *sql.DB, botID int) {
+	var data struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if data.URL == "" {
+		_, err := db.Exec(`
+            UPDATE bots SET webhook_url = NULL, webhook_secret = NULL, push_failures = 0, next_push_at = NULL, last_push_error = NULL
+            WHERE user_id = $1`, botID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		writeBotResult(w, map[string]interface{}{"webhook_url": nil})
+		return
+	}
+	if webhookClient == nil {
+		http.Error(w, "Webhooks are disabled on this server", http.StatusServiceUnavailable)
+		return
+	}
+	if !validWebhookURL(data.URL) {
+		http.Error(w, "Invalid URL", http.StatusBadRequest)
+		return
+	}
+	secret, err := newWebhookSecret()
+	if err != nil {
+		http.Error(w, "Internal error", http.StatusInternalServerError)
+		return
+	}
+	_, err = db.Exec(`
+        UPDATE bots SET webhook_url = $2, webhook_secret = $3, push_failures = 0, next_push_at = NULL, last_push_error = NULL
+        WHERE user_id = $1`, botID, data.URL, secret)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	notifyBot(botID)
+	writeBotResult(w, map[string]interface{}{"webhook_url": data.URL, "secret": secret})
+}
+
+// Отправка сообщения ботом через общий путь сохранения и рассылки
+func botSendMessage(w http.ResponseWriter, r *http.Request, db *sql.DB, botID int) {
+	var data struct {
+		ChatID           int             `json:"chat_id"`
+		Text             string          `json:"text"`
+		ParseMode        string          `json:"parse_mode"`
+		Entities         []messageEntity `json:"entities"`
+		ReplyToMessageID *int            `json:"reply_to_message_id"`
+		ReplyMarkup      *inlineKeyboard `json:"reply_markup"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if err := validateInlineKeyboard(data.ReplyMarkup); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(data.Text) == "" {
+		http.Error(w, "Text is required", http.StatusBadRequest)
+		return
+	}
+	if ok, err := isChatParticipant(db, data.ChatID, botID); err != nil || !ok {
+		http.Error(w, "Bot is not a member of this chat", http.StatusForbidden)
+		return
+	}
+
+	messageID, err := sendChatMessage(chatMessage{
+		ChatID:          data.ChatID,
+		UserID:          botID,
+		Text:            data.Text,
+		ParseMode:       data.ParseMode,
+		Entities:        data.Entities,
+		ParentMessageID: data.ReplyToMessageID,
+		ReplyMarkup:     data.ReplyMarkup,
+	}, nil)
+	if err != nil {
+		if isMessageValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to send message", http.StatusInternalServerError)
+		return
+	}
+	writeBotResult(w, map[string]interface{}{"message_id": messageID, "chat_id": data.ChatID})
+}
+
+// Изменение текста и/или кнопок сообщения бота
+func botEditMessage(w http.ResponseWriter, r *http.Request, db *sql.DB, botID int) {
+	var data struct {
+		MessageID   int             `json:"message_id"`
+		Text        string          `json:"text"`
+		ParseMode   string          `json:"parse_mode"`
+		Entities    []messageEntity `json:"entities"`
+		ReplyMarkup *inlineKeyboard `json:"reply_markup"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if data.Text == "" && data.ReplyMarkup == nil {
+		http.Error(w, "Text or reply markup is required", http.StatusBadRequest)
+		return
+	}
+	// Пустая клавиатура убирает кнопки
+	if data.ReplyMarkup != nil && len(data.ReplyMarkup.InlineKeyboard) > 0 {
+		if err := validateInlineKeyboard(data.ReplyMarkup); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	var chatID int
+	err := db.QueryRow("SELECT chat_id FROM messages WHERE id = $1 AND user_id = $2 AND NOT is_deleted", data.MessageID, botID).Scan(&chatID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Message not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if data.Text != "" {
+		if _, err := editChatMessage(db, data.MessageID, botID, data.Text, data.ParseMode, data.Entities); err != nil {
+			if isMessageValidationError(err) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			http.Error(w, "Failed to edit message", http.StatusInternalServerError)
+			return
+		}
+	}
+	if data.ReplyMarkup != nil {
+		markup := data.ReplyMarkup
+		if len(markup.InlineKeyboard) == 0 {
+			markup = nil
+		}
+		if _, err := db.Exec("UPDATE messages SET reply_markup = $2::jsonb WHERE id = $1", data.MessageID, replyMarkupJSON(markup)); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if participantIDs, err := getChatParticipantIDs(db, chatID); err == nil {
+			broadcastToUsers(participantIDs, map[string]interface{}{
+				"type":         "reply_markup_updated",
+				"chat_id":      chatID,
+				"message_id":   data.MessageID,
+				"reply_markup": markup,
+			})
+		}
+	}
+	writeBotResult(w, map[string]interface{}{"message_id": data.MessageID, "chat_id": chatID})
+}
+
+// Замена списка команд бота
+func botSetCommands(w http.ResponseWriter, r *http.Request, db *sql.DB, botID int) {
+	var data struct {
+		Commands []botCommand `json:"commands"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if len(data.Commands) > maxBotCommands {
+		http.Error(w, "Too many commands", http.StatusBadRequest)
+		return
+	}
+	seen := make(map[string]bool)
+	for i, c := range data.Commands {
+		c.Command = strings.TrimPrefix(c.Command, "/")
+		c.Description = strings.TrimSpace(sanitizeMessageText(c.Description))
+		if !botCommandPattern.MatchString(c.Command) || seen[c.Command] ||
+			c.Description == "" || utf8.RuneCountInString(c.Description) > maxBotCommandDesc {
+			http.Error(w, "Invalid command", http.StatusBadRequest)
+			return
+		}
+		seen[c.Command] = true
+		data.Commands[i] = c
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM bot_commands WHERE bot_user_id = $1", botID); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	for i, c := range data.Commands {
+		_, err := tx.Exec(`
+            INSERT INTO bot_commands (bot_user_id, command, description, position)
+            VALUES ($1, $2, $3, $4)`, botID, c.Command, c.Description, i)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	writeBotResult(w, data.Commands)
+}
+
+// Ответ на нажатие кнопки: нажавший пользователь получает уведомление callback_answer.
+// Ответить можно один раз
+func botAnswerCallbackQuery(w http.ResponseWriter, r *http.Request, db *sql.DB, botID int) {
+	var data struct {
+		CallbackQueryID string `json:"callback_query_id"`
+		Text            string `json:"text"`
+		ShowAlert       bool   `json:"show_alert"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	data.Text = strings.TrimSpace(sanitizeMessageText(data.Text))
+	if utf8.RuneCountInString(data.Text) > maxCallbackAnswer {
+		http.Error(w, "Text is too long", http.StatusBadRequest)
+		return
+	}
+
+	var userID, messageID, chatID int
+	err := db.QueryRow(`
+        UPDATE callback_queries SET answered_at = CURRENT_TIMESTAMP
+        WHERE id = $1 AND bot_user_id = $2 AND answered_at IS NULL
+        RETURNING user_id, message_id, chat_id`, data.CallbackQueryID, botID,
+	).Scan(&userID, &messageID, &chatID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Callback query not found or already answered", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	broadcastToUsers([]int{userID}, map[string]interface{}{
+		"type":              "callback_answer",
+		"callback_query_id": data.CallbackQueryID,
+		"chat_id":           chatID,
+		"message_id":        messageID,
+		"text":              data.Text,
+		"show_alert":        data.ShowAlert,
+	})
+	writeBotResult(w, map[string]interface{}{"callback_query_id": data.CallbackQueryID})
+}
+
+// Ответ, который видит только один участник чата (например, на команду бота); в истории не сохраняется
+func botSendEphemeral(w http.ResponseWriter, r *http.Request, db *sql.DB, botID int) {
+	var data struct {
+		ChatID int    `json:"chat_id"`
+		UserID int    `json:"user_id"`
+		Text   string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	data.Text = strings.TrimSpace(sanitizeMessageText(data.Text))
+	if data.Text == "" || utf8.RuneCountInString(data.Text) > maxEphemeralText {
+		http.Error(w, "Invalid text", http.StatusBadRequest)
+		return
+	}
+
+	var bothParticipants bool
+	err := db.QueryRow(`
+        SELECT COUNT(*) = 2 FROM participants
+        WHERE chat_id = $1 AND user_id IN ($2, $3)`, data.ChatID, botID, data.UserID,
+	).Scan(&bothParticipants)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !bothParticipants || data.UserID == botID {
+		http.Error(w, "Bot and user must be members of this chat", http.StatusForbidden)
+		return
+	}
+	sendEphemeralMessage(data.UserID, data.ChatID, botID, data.Text)
+	writeBotResult(w, map[string]interface{}{"chat_id": data.ChatID, "user_id": data.UserID})
+}
+
+// Нажатие кнопки под сообщением бота (команда WebSocket callback_query {user_id, message_id, data})
+func handleCallbackQueryCommand(conn *websocket.Conn, message []byte) {
+	var cmd struct {
+		UserID    int    `json:"user_id"`
+		MessageID int    `json:"message_id"`
+		Data      string `json:"data"`
+	}
+	if err := json.Unmarshal(message, &cmd); err != nil {
+		log.Printf("Ошибка парсинга команды callback_query: %v", err)
+		return
+	}
+	reject := func(reason string) {
+		conn.WriteJSON(map[string]interface{}{
+			"type":       "callback_query_rejected",
+			"message_id": cmd.MessageID,
+			"error":      reason,
+		})
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("DB error: %v", err)
+		return
+	}
+	defer db.Close()
+
+	// Кнопка должна быть на сообщении бота, а пользователь — участником чата
+	var (
+		chatID, botID int
+		markupJSON    []byte
+		username      string
+		name          sql.NullString
+	)
+	err = db.QueryRow(`
+        SELECT m.chat_id, m.user_id, m.reply_markup, u.username, u.name
+        FROM messages m
+        JOIN bots b ON b.user_id = m.user_id
+        JOIN participants p ON p.chat_id = m.chat_id AND p.user_id = $2
+        JOIN users u ON u.id = $2
+        WHERE m.id = $1 AND NOT m.is_deleted AND m.reply_markup IS NOT NULL`, cmd.MessageID, cmd.UserID,
+	).Scan(&chatID, &botID, &markupJSON, &username, &name)
+	if err != nil {
+		log.Printf("Нажатие кнопки отклонено: user %d, message %d: %v", cmd.UserID, cmd.MessageID, err)
+		reject("message not found")
+		return
+	}
+	var markup inlineKeyboard
+	if err := json.Unmarshal(markupJSON, &markup); err != nil || !markup.hasCallbackData(cmd.Data) {
+		reject("unknown button")
+		return
+	}
+
+	queryID, err := newUploadID()
+	if err != nil {
+		return
+	}
+	_, err = db.Exec(`
+        INSERT INTO callback_queries (id, bot_user_id, message_id, chat_id, user_id, data)
+        VALUES ($1, $2, $3, $4, $5, $6)`, queryID, botID, cmd.MessageID, chatID, cmd.UserID, cmd.Data)
+	if err != nil {
+		log.Printf("Ошибка сохранения нажатия кнопки: %v", err)
+		return
+	}
+	queueBotUpdates(db, []int{botID}, 0, botUpdateCallbackQuery, map[string]interface{}{
+		"id":      queryID,
+		"from":    map[string]interface{}{"id": cmd.UserID, "username": username, "name": name.String},
+		"message": map[string]interface{}{"id": cmd.MessageID, "chat_id": chatID},
+		"data":    cmd.Data,
+	})
+	conn.WriteJSON(map[string]interface{}{
+		"type":              "callback_query_sent",
+		"callback_query_id": queryID,
+		"message_id":        cmd.MessageID,
+	})
+}
+
+// Фоновая доставка обновлений ботам с вебхуком и очистка старых обновлений
+func startBotUpdatePusher() {
+	go func() {
+		ticker := time.NewTicker(botPushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-botPushWake:
+			}
+			pushBotUpdates()
+		}
+	}()
+}
+
+func pushBotUpdates() {
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("Боты: ошибка подключения к БД: %v", err)
+		return
+	}
+	defer db.Close()
+
+	// Неполученные обновления и неотвеченные нажатия хранятся ограниченное время
+	retention := int(botUpdateRetention.Seconds())
+	if _, err := db.Exec("DELETE FROM bot_updates WHERE created_at < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'", retention); err != nil {
+		log.Printf("Боты: ошибка очистки обновлений: %v", err)
+	}
+	if _, err := db.Exec("DELETE FROM callback_queries WHERE created_at < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'", retention); err != nil {
+		log.Printf("Боты: ошибка очистки нажатий кнопок: %v", err)
+	}
+	if webhookClient == nil {
+		return
+	}
+
+	rows, err := db.Query(`
+        SELECT b.user_id, b.webhook_url, b.webhook_secret, b.push_failures
+        FROM bots b
+        WHERE b.webhook_url IS NOT NULL
+          AND (b.next_push_at IS NULL OR b.next_push_at <= CURRENT_TIMESTAMP)
+          AND EXISTS (SELECT 1 FROM bot_updates u WHERE u.bot_user_id = b.user_id)`)
+	if err != nil {
+		log.Printf("Боты: ошибка выборки ботов с вебхуком: %v", err)
+		return
+	}
+	type target struct {
+		botID, failures int
+		url, secret     string
+	}
+	var targets []target
+	for rows.Next() {
+		var t target
+		if err := rows.Scan(&t.botID, &t.url, &t.secret, &t.failures); err == nil {
+			targets = append(targets, t)
+		}
+	}
+	rows.Close()
+
+	var wg sync.WaitGroup
+	for _, t := range targets {
+		wg.Add(1)
+		go func(t target) {
+			defer wg.Done()
+			pushBotUpdatesTo(db, t.botID, t.url, t.secret, t.failures)
+		}(t)
+	}
+	wg.Wait()
+}
+
+// Доставка обновлений одного бота по порядку. При ошибке доставка откладывается
+// с экспоненциальной задержкой, обновления остаются в очереди
+func pushBotUpdatesTo(db *sql.DB, botID int, url, secret string, failures int) {
+	rows, err := db.Query(`
+        SELECT id, jsonb_build_object('update_id', id) || payload
+        FROM bot_updates WHERE bot_user_id = $1
+        ORDER BY id LIMIT $2`, botID, maxBotUpdatesBatch)
+	if err != nil {
+		log.Printf("Боты: ошибка загрузки обновлений бота %d: %v", botID, err)
+		return
+	}
+	type update struct {
+		id   int
+		body []byte
+	}
+	var updates []update
+	for rows.Next() {
+		var u update
+		if err := rows.Scan(&u.id, &u.body); err == nil {
+			updates = append(updates, u)
+		}
+	}
+	rows.Close()
+
+	for _, u := range updates {
+		if _, _, err := sendWebhook(webhookClient, url, secret, u.id, "bot_update", u.body); err != nil {
+			failures++
+			_, dbErr := db.Exec(`
+                UPDATE bots SET push_failures = $2, last_push_error = $3,
+                    next_push_at = CURRENT_TIMESTAMP + $4 * INTERVAL '1 millisecond'
+                WHERE user_id = $1`, botID, failures, err.Error(), webhookRetryDelay(failures).Milliseconds())
+			if dbErr != nil {
+				log.Printf("Боты: ошибка сохранения состояния доставки бота %d: %v", botID, dbErr)
+			}
+			return
+		}
+		if _, err := db.Exec("DELETE FROM bot_updates WHERE id = $1", u.id); err != nil {
+			log.Printf("Боты: ошибка удаления доставленного обновления %d: %v", u.id, err)
+			return
+		}
+	}
+	if failures > 0 {
+		db.Exec("UPDATE bots SET push_failures = 0, last_push_error = NULL, next_push_at = NULL WHERE user_id = $1", botID)
+	}
+}
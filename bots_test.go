@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestValidateInlineKeyboard(t *testing.T) {
+	if err := validateInlineKeyboard(nil); err != nil {
+		t.Fatalf("no keyboard: %v", err)
+	}
+	valid := &inlineKeyboard{InlineKeyboard: [][]inlineButton{
+		{{Text: "Да", CallbackData: "yes"}, {Text: "Нет", CallbackData: "no"}},
+		{{Text: "Сайт", URL: "https://example.com"}},
+	}}
+	if err := validateInlineKeyboard(valid); err != nil {
+		t.Fatalf("valid keyboard: %v", err)
+	}
+
+	many := make([]inlineButton, maxKeyboardButtons+1)
+	for i := range many {
+		many[i] = inlineButton{Text: "x", CallbackData: "x"}
+	}
+	invalid := map[string][][]inlineButton{
+		"no buttons":       {},
+		"empty row":        {{}, {{Text: "a", CallbackData: "a"}}},
+		"no text":          {{{Text: " ", CallbackData: "a"}}},
+		"long text":        {{{Text: strings.Repeat("я", maxKeyboardButtonText+1), CallbackData: "a"}}},
+		"no action":        {{{Text: "a"}}},
+		"two actions":      {{{Text: "a", CallbackData: "a", URL: "https://example.com"}}},
+		"long data":        {{{Text: "a", CallbackData: strings.Repeat("d", maxCallbackData+1)}}},
+		"javascript url":   {{{Text: "a", URL: "javascript:alert(1)"}}},
+		"too many buttons": {many},
+	}
+	for name, rows := range invalid {
+		if err := validateInlineKeyboard(&inlineKeyboard{InlineKeyboard: rows}); !errors.Is(err, errInvalidReplyMarkup) {
+			t.Errorf("%s: %v", name, err)
+		}
+	}
+}
+
+func TestInlineKeyboardHasCallbackData(t *testing.T) {
+	markup := &inlineKeyboard{InlineKeyboard: [][]inlineButton{
+		{{Text: "Сайт", URL: "https://example.com"}},
+		{{Text: "Да", CallbackData: "yes"}},
+	}}
+	if !markup.hasCallbackData("yes") || markup.hasCallbackData("no") || markup.hasCallbackData("") {
+		t.Fatal("hasCallbackData matched the wrong buttons")
+	}
+	if replyMarkupJSON(nil) != nil {
+		t.Fatal("message without keyboard stores markup")
+	}
+	if got := replyMarkupJSON(markup); !strings.Contains(got.(string), `"callback_data":"yes"`) {
+		t.Fatalf("replyMarkupJSON = %v", got)
+	}
+}
+
+// Бот находится по хешу токена; неизвестный или отсутствующий токен неотличимы
+func TestAuthenticateBot(t *testing.T) {
+	token, err := newBotToken(7)
+	if err != nil || !strings.HasPrefix(token, "7:") {
+		t.Fatalf("newBotToken = %q, %v", token, err)
+	}
+	db, fake := newFakeDB(t)
+	fake.on("FROM bots WHERE token_hash = $1", func(args []driver.Value) fakeResult {
+		if args[0] == secretTokenHash(token) {
+			return fakeRow(int64(7))
+		}
+		return fakeResult{}
+	})
+
+	for _, header := range []string{"", token, "Bearer 7:wrong"} {
+		req := httptest.NewRequest("POST", botAPIPath+"getMe", nil)
+		req.Header.Set("Authorization", header)
+		if _, err := authenticateBot(db, req); !errors.Is(err, errBotUnauthorized) {
+			t.Errorf("Authorization %q: %v", header, err)
+		}
+	}
+	req := httptest.NewRequest("POST", botAPIPath+"getMe", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	if botID, err := authenticateBot(db, req); err != nil || botID != 7 {
+		t.Fatalf("valid token: %d, %v", botID, err)
+	}
+}
+
+// Обновление ставится в очередь ботам-участникам и будит ожидающий getUpdates
+func TestQueueBotUpdates(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.on("INSERT INTO bot_updates", func([]driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{{int64(9001)}}}
+	})
+	signal := botUpdateSignal(9001)
+
+	queueBotUpdates(db, nil, 1, botUpdateMessage, nil)
+	if len(fake.queries("INSERT INTO bot_updates")) != 0 {
+		t.Fatal("update queued for an empty chat")
+	}
+
+	queueBotUpdates(db, []int{1, 9001}, 1, botUpdateMessage, map[string]int{"message_id": 100})
+	q := fake.queries("INSERT INTO bot_updates")
+	if len(q) != 1 || q[0].args[1] != int64(1) || q[0].args[2] != `{"message":{"message_id":100}}` {
+		t.Fatalf("queued update: %+v", q)
+	}
+	select {
+	case <-signal:
+	default:
+		t.Fatal("waiting bot not notified")
+	}
+}
+
+func TestBotGetUpdates(t *testing.T) {
+	getUpdates := func(hasWebhook bool, body string) (*httptest.ResponseRecorder, *fakeDB) {
+		db, fake := newFakeDB(t)
+		fake.on("webhook_url IS NOT NULL", func([]driver.Value) fakeResult {
+			return fakeRow(hasWebhook)
+		})
+		fake.on("ORDER BY id LIMIT $2", func([]driver.Value) fakeResult {
+			return fakeResult{rows: [][]driver.Value{{[]byte(`{"update_id":5,"message":{}}`)}}}
+		})
+		rec := httptest.NewRecorder()
+		botGetUpdates(rec, httptest.NewRequest("POST", botAPIPath+"getUpdates", strings.NewReader(body)), db, 7)
+		return rec, fake
+	}
+
+	if rec, _ := getUpdates(true, ""); rec.Code != http.StatusConflict {
+		t.Fatalf("with webhook: status %d", rec.Code)
+	}
+	if rec, _ := getUpdates(false, "{"); rec.Code != http.StatusBadRequest {
+		t.Fatalf("invalid body: status %d", rec.Code)
+	}
+
+	rec, fake := getUpdates(false, `{"offset":5,"limit":1000}`)
+	var updates []map[string]interface{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &updates); err != nil || len(updates) != 1 || updates[0]["update_id"] != float64(5) {
+		t.Fatalf("updates: %s, %v", rec.Body, err)
+	}
+	if confirmed := fake.queries("DELETE FROM bot_updates"); len(confirmed) != 1 || confirmed[0].args[1] != int64(5) {
+		t.Fatalf("offset not confirmed: %+v", confirmed)
+	}
+	if loaded := fake.queries("ORDER BY id LIMIT $2"); loaded[0].args[1] != int64(maxBotUpdatesBatch) {
+		t.Fatalf("limit not capped: %v", loaded[0].args)
+	}
+}
+
+func TestBotSetCommands(t *testing.T) {
+	invalid := []string{
+		`{`,
+		`{"commands":[{"command":"Start","description":"a"}]}`,
+		`{"commands":[{"command":"start","description":" "}]}`,
+		`{"commands":[{"command":"start","description":"a"},{"command":"/start","description":"b"}]}`,
+		`{"commands":[{"command":"start","description":"` + strings.Repeat("a", maxBotCommandDesc+1) + `"}]}`,
+	}
+	for _, body := range invalid {
+		db, fake := newFakeDB(t)
+		rec := httptest.NewRecorder()
+		botSetCommands(rec, httptest.NewRequest("POST", botAPIPath+"setCommands", strings.NewReader(body)), db, 7)
+		if rec.Code != http.StatusBadRequest || len(fake.queries("bot_commands")) != 0 {
+			t.Errorf("%.60s: status %d", body, rec.Code)
+		}
+	}
+
+	db, fake := newFakeDB(t)
+	rec := httptest.NewRecorder()
+	body := `{"commands":[{"command":"/help","description":" Справка "},{"command":"start","description":"Начать"}]}`
+	botSetCommands(rec, httptest.NewRequest("POST", botAPIPath+"setCommands", strings.NewReader(body)), db, 7)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("valid commands: status %d", rec.Code)
+	}
+	inserted := fake.queries("INSERT INTO bot_commands")
+	if len(fake.queries("DELETE FROM bot_commands")) != 1 || len(inserted) != 2 || len(fake.queries("COMMIT")) != 1 {
+		t.Fatal("command list not replaced in one transaction")
+	}
+	if inserted[0].args[1] != "help" || inserted[0].args[2] != "Справка" || inserted[1].args[3] != int64(1) {
+		t.Fatalf("stored commands: %v, %v", inserted[0].args, inserted[1].args)
+	}
+}
+
+// Ответ на нажатие получает только нажавший пользователь, и только один раз
+func TestBotAnswerCallbackQuery(t *testing.T) {
+	answered := false
+	db, fake := newFakeDB(t)
+	fake.on("UPDATE callback_queries", func(args []driver.Value) fakeResult {
+		if answered || args[0] != "cb1" || args[1] != int64(7) {
+			return fakeResult{}
+		}
+		answered = true
+		return fakeRow(int64(2), int64(100), int64(10))
+	})
+	presser := connectTestClient(t, 2, 0)
+
+	answer := func(body string) int {
+		rec := httptest.NewRecorder()
+		botAnswerCallbackQuery(rec, httptest.NewRequest("POST", botAPIPath+"answerCallbackQuery", strings.NewReader(body)), db, 7)
+		return rec.Code
+	}
+	if code := answer(`{"callback_query_id":"cb1","text":"` + strings.Repeat("a", maxCallbackAnswer+1) + `"}`); code != http.StatusBadRequest {
+		t.Fatalf("long answer: status %d", code)
+	}
+	if code := answer(`{"callback_query_id":"cb1","text":"Готово","show_alert":true}`); code != http.StatusOK {
+		t.Fatalf("answer: status %d", code)
+	}
+	event := readTestEvent(t, presser)
+	if event["type"] != "callback_answer" || event["text"] != "Готово" || event["show_alert"] != true || event["message_id"] != float64(100) {
+		t.Fatalf("callback_answer event: %v", event)
+	}
+	if code := answer(`{"callback_query_id":"cb1","text":"Ещё раз"}`); code != http.StatusNotFound {
+		t.Fatalf("second answer: status %d", code)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Проверка, что пользователь является участником чата
+func isChatParticipant(db queryRower, chatID, userID int) (bool, error) {
+	var exists bool
+	err := db.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM participants WHERE chat_id = $1 AND user_id = $2)",
+		chatID, userID,
+	).Scan(&exists)
+	return exists, err
+}
+
+// deleteChatHandler удаляет чат у себя или у всех участников
+func deleteChatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var data struct {
+		ChatID      int  `json:"chat_id"`
+		UserID      int  `json:"user_id"`
+		ForEveryone bool `json:"for_everyone"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var (
+		isGroup   bool
+		createdBy sql.NullInt64
+	)
+	err = db.QueryRow(`
+        SELECT c.is_group, gc.created_by
+        FROM chats c
+        JOIN participants p ON p.chat_id = c.id AND p.user_id = $2
+        LEFT JOIN group_chats gc ON gc.chat_id = c.id
+        WHERE c.id = $1`, data.ChatID, data.UserID).Scan(&isGroup, &createdBy)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка получения чата %d: %v", data.ChatID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	if !data.ForEveryone {
+		// Скрываем чат и его историю только для текущего пользователя
+		var hiddenAt time.Time
+		err = db.QueryRow(`
+            UPDATE participants
+            SET hidden_at = CURRENT_TIMESTAMP,
+                history_cleared_at = CURRENT_TIMESTAMP,
+                unread_count = 0
+            WHERE chat_id = $1 AND user_id = $2
+            RETURNING hidden_at`, data.ChatID, data.UserID).Scan(&hiddenAt)
+		if err != nil {
+			log.Printf("Ошибка скрытия чата %d для пользователя %d: %v", data.ChatID, data.UserID, err)
+			http.Error(w, "Failed to delete chat", http.StatusInternalServerError)
+			return
+		}
+
+		broadcastToUsers([]int{data.UserID}, map[string]interface{}{
+			"type":           "chat_deleted",
+			"chat_id":        data.ChatID,
+			"for_everyone":   false,
+			"deleted_at":     hiddenAt.Format(time.RFC3339),
+			"deleted_by":     data.UserID,
+			"history_hidden": true,
+		})
+
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Chat deleted for user"))
+		return
+	}
+
+	// Удалить у всех может любой участник личного чата или владелец группы
+	if isGroup && (!createdBy.Valid || int(createdBy.Int64) != data.UserID) {
+		http.Error(w, "Only the group owner can delete the group for everyone", http.StatusForbidden)
+		return
+	}
+
+	// Участников запоминаем до удаления, чтобы разослать им уведомление
+	participantIDs, err := getChatParticipantIDs(db, data.ChatID)
+	if err != nil {
+		log.Printf("Ошибка получения участников чата %d: %v", data.ChatID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// Сообщения, участники, файлы и реакции удаляются каскадно через внешние ключи
+	if _, err := db.Exec("DELETE FROM chats WHERE id = $1", data.ChatID); err != nil {
+		log.Printf("Ошибка удаления чата %d: %v", data.ChatID, err)
+		http.Error(w, "Failed to delete chat", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Чат %d удалён для всех пользователем %d", data.ChatID, data.UserID)
+
+	broadcastToUsers(participantIDs, map[string]interface{}{
+		"type":         "chat_deleted",
+		"chat_id":      data.ChatID,
+		"for_everyone": true,
+		"deleted_at":   time.Now().Format(time.RFC3339),
+		"deleted_by":   data.UserID,
+	})
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Chat deleted for everyone"))
+}
+
+// clearHistoryHandler очищает историю чата для текущего пользователя
+func clearHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var data struct {
+		ChatID int `json:"chat_id"`
+		UserID int `json:"user_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// Сообщения не удаляются: сохраняем момент, раньше которого история не показывается
+	var clearedAt time.Time
+	err = db.QueryRow(`
+        UPDATE participants
+        SET history_cleared_at = CURRENT_TIMESTAMP,
+            unread_count = 0
+        WHERE chat_id = $1 AND user_id = $2
+        RETURNING history_cleared_at`, data.ChatID, data.UserID).Scan(&clearedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка очистки истории чата %d для пользователя %d: %v", data.ChatID, data.UserID, err)
+		http.Error(w, "Failed to clear history", http.StatusInternalServerError)
+		return
+	}
+
+	broadcastToUsers([]int{data.UserID}, map[string]interface{}{
+		"type":       "chat_history_cleared",
+		"chat_id":    data.ChatID,
+		"cleared_at": clearedAt.Format(time.RFC3339),
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"chat_id":    data.ChatID,
+		"cleared_at": clearedAt,
+	})
+}
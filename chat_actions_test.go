@@ -0,0 +1,50 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Некорректные запросы на удаление чата и очистку истории отклоняются до обращения к БД
+func TestChatActionHandlersValidation(t *testing.T) {
+	handlers := map[string]http.HandlerFunc{
+		"deleteChat":   deleteChatHandler,
+		"clearHistory": clearHistoryHandler,
+	}
+	for name, handler := range handlers {
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/"+name, nil))
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s GET: status %d", name, rec.Code)
+		}
+
+		rec = httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("POST", "/"+name, strings.NewReader(`{"chat_id":"1"`)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s with a broken body: status %d", name, rec.Code)
+		}
+	}
+}
+
+func TestIsChatParticipant(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.on("FROM participants WHERE chat_id = $1 AND user_id = $2", func(args []driver.Value) fakeResult {
+		return fakeRow(args[0] == int64(10) && args[1] == int64(1))
+	})
+	cases := []struct {
+		chatID, userID int
+		want           bool
+	}{
+		{10, 1, true},
+		{10, 2, false},
+		{11, 1, false},
+	}
+	for _, c := range cases {
+		if got, err := isChatParticipant(db, c.chatID, c.userID); err != nil || got != c.want {
+			t.Errorf("isChatParticipant(%d, %d) = %v, %v; want %v", c.chatID, c.userID, got, err, c.want)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strings"
+
+	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
+)
+
+const (
+	maxVCardSize    = 4096 // Максимальный размер vCard в байтах
+	maxContactName  = 255
+	maxContactPhone = 50
+)
+
+// Карточка контакта в сообщении: зарегистрированный пользователь или произвольная vCard
+type messageContact struct {
+	UserID   *int   `json:"user_id,omitempty"`
+	Name     string `json:"name"`
+	Username string `json:"username,omitempty"`
+	Phone    string `json:"phone,omitempty"`
+	VCard    string `json:"vcard,omitempty"`
+}
+
+// Команда WebSocket send_contact
+type contactCommand struct {
+	ChatID        int    `json:"chat_id"`
+	UserID        int    `json:"user_id"`
+	ContactUserID int    `json:"contact_user_id"`
+	VCard         string `json:"vcard"`
+}
+
+// Разбор vCard: имя (FN, иначе N) и первый телефон. Строки продолжения объединяются по RFC 6350
+func parseVCard(vcard string) (name, phone string, ok bool) {
+	vcard = strings.ReplaceAll(strings.ReplaceAll(vcard, "\r\n", "\n"), "\n ", "")
+	lines := strings.Split(strings.TrimSpace(vcard), "\n")
+	if len(lines) < 3 || !strings.EqualFold(strings.TrimSpace(lines[0]), "BEGIN:VCARD") ||
+		!strings.EqualFold(strings.TrimSpace(lines[len(lines)-1]), "END:VCARD") {
+		return "", "", false
+	}
+
+	var structuredName string
+	for _, line := range lines[1 : len(lines)-1] {
+		colon := strings.Index(line, ":")
+		if colon <= 0 {
+			continue
+		}
+		// Параметры свойства (TEL;TYPE=cell) не важны
+		property := strings.ToUpper(strings.SplitN(line[:colon], ";", 2)[0])
+		value := strings.TrimSpace(line[colon+1:])
+		switch property {
+		case "FN":
+			if name == "" {
+				name = value
+			}
+		case "N":
+			if structuredName == "" {
+				parts := strings.Split(value, ";")
+				if len(parts) > 1 {
+					structuredName = strings.TrimSpace(parts[1] + " " + parts[0])
+				} else {
+					structuredName = value
+				}
+			}
+		case "TEL":
+			if phone == "" {
+				phone = strings.TrimPrefix(value, "tel:")
+			}
+		}
+	}
+	if name == "" {
+		name = structuredName
+	}
+	name = strings.TrimSpace(sanitizeMessageText(name))
+	phone = strings.TrimSpace(sanitizeMessageText(phone))
+	if name == "" || len([]rune(name)) > maxContactName || len(phone) > maxContactPhone {
+		return "", "", false
+	}
+	return name, phone, true
+}
+
+// Отправка карточки контакта
+func handleSendContactCommand(conn *websocket.Conn, message []byte) {
+	var cmd contactCommand
+	if err := json.Unmarshal(message, &cmd); err != nil {
+		log.Printf("Ошибка парсинга команды send_contact: %v", err)
+		return
+	}
+	reject := func(reason string) {
+		conn.WriteJSON(map[string]interface{}{
+			"type":    "message_rejected",
+			"chat_id": cmd.ChatID,
+			"error":   reason,
+		})
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("DB error: %v", err)
+		return
+	}
+	defer db.Close()
+
+	if ok, err := isChatParticipant(db, cmd.ChatID, cmd.UserID); err != nil || !ok {
+		log.Printf("Unauthorized contact attempt: user %d, chat %d", cmd.UserID, cmd.ChatID)
+		return
+	}
+	if err := checkMemberMuted(db, cmd.ChatID, cmd.UserID); err != nil {
+		reject(err.Error())
+		return
+	}
+
+	// Нужен ровно один источник: пользователь мессенджера или vCard
+	var (
+		contactUserID sql.NullInt64
+		name, phone   string
+	)
+	switch {
+	case cmd.ContactUserID != 0 && cmd.VCard == "":
+		err := db.QueryRow("SELECT name FROM users WHERE id = $1", cmd.ContactUserID).Scan(&name)
+		if err != nil {
+			log.Printf("Контакт %d не найден: %v", cmd.ContactUserID, err)
+			reject("contact not found")
+			return
+		}
+		contactUserID = sql.NullInt64{Int64: int64(cmd.ContactUserID), Valid: true}
+	case cmd.ContactUserID == 0 && cmd.VCard != "" && len(cmd.VCard) <= maxVCardSize:
+		var ok bool
+		if name, phone, ok = parseVCard(cmd.VCard); !ok {
+			reject("invalid contact")
+			return
+		}
+	default:
+		reject("invalid contact")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Transaction error: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	// Текст сообщения — имя контакта, чтобы сообщение было понятно в списке чатов
+	msg := chatMessage{ChatID: cmd.ChatID, UserID: cmd.UserID, Text: name, MessageType: "contact"}
+	stored, err := storeChatMessage(tx, msg)
+	if err != nil {
+		log.Printf("Ошибка сохранения сообщения с контактом: %v", err)
+		return
+	}
+	_, err = tx.Exec(`
+        INSERT INTO message_contacts (message_id, contact_user_id, name, phone, vcard)
+        VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''))`,
+		stored.ID, contactUserID, name, phone, cmd.VCard,
+	)
+	if err != nil {
+		log.Printf("Ошибка сохранения контакта: %v", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		return
+	}
+
+	contacts, err := loadMessageContacts(db, []int{stored.ID})
+	if err != nil || contacts[stored.ID] == nil {
+		log.Printf("Ошибка загрузки контакта %d: %v", stored.ID, err)
+		return
+	}
+	stored.Extra = map[string]interface{}{"contact": contacts[stored.ID]}
+	broadcastChatMessage(db, stored, msg, conn)
+}
+
+// Загрузка карточек контактов; для пользователей мессенджера показываются актуальные имя и username
+func loadMessageContacts(db *sql.DB, messageIDs []int) (map[int]*messageContact, error) {
+	result := make(map[int]*messageContact)
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+
+	rows, err := db.Query(`
+        SELECT c.message_id, c.contact_user_id, COALESCE(u.name, c.name), COALESCE(u.username, ''),
+               COALESCE(c.phone, ''), COALESCE(c.vcard, '')
+        FROM message_contacts c
+        JOIN messages m ON m.id = c.message_id
+        LEFT JOIN users u ON u.id = c.contact_user_id
+        WHERE c.message_id = ANY($1) AND NOT m.is_deleted`, pq.Array(intsToInt64(messageIDs)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			messageID int
+			userID    sql.NullInt64
+			contact   messageContact
+		)
+		if err := rows.Scan(&messageID, &userID, &contact.Name, &contact.Username, &contact.Phone, &contact.VCard); err != nil {
+			log.Printf("Ошибка чтения контакта: %v", err)
+			continue
+		}
+		if userID.Valid {
+			id := int(userID.Int64)
+			contact.UserID = &id
+		}
+		result[messageID] = &contact
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseVCard(t *testing.T) {
+	cases := []struct {
+		vcard       string
+		name, phone string
+	}{
+		{"BEGIN:VCARD\r\nVERSION:4.0\r\nFN:Иван Петров\r\nTEL;TYPE=cell:+7 999 123-45-67\r\nEND:VCARD", "Иван Петров", "+7 999 123-45-67"},
+		{"begin:vcard\nN:Петров;Иван;;;\nTEL;VALUE=uri:tel:+79991234567\nTEL:+70000000000\nend:vcard", "Иван Петров", "+79991234567"},
+		{"BEGIN:VCARD\nFN:Очень длинное\n  имя\nEND:VCARD", "Очень длинное имя", ""},
+	}
+	for _, c := range cases {
+		name, phone, ok := parseVCard(c.vcard)
+		if !ok || name != c.name || phone != c.phone {
+			t.Errorf("parseVCard(%q) = %q, %q, %v; want %q, %q", c.vcard, name, phone, ok, c.name, c.phone)
+		}
+	}
+
+	for _, bad := range []string{
+		"",
+		"FN:Иван",
+		"BEGIN:VCARD\nTEL:+7999\nEND:VCARD",
+		"BEGIN:VCARD\nFN:Иван\n",
+		"BEGIN:VCARD\nFN:" + strings.Repeat("я", maxContactName+1) + "\nEND:VCARD",
+		"BEGIN:VCARD\nFN:Иван\nTEL:" + strings.Repeat("1", maxContactPhone+1) + "\nEND:VCARD",
+	} {
+		if _, _, ok := parseVCard(bad); ok {
+			t.Errorf("parseVCard(%q) accepted", bad)
+		}
+	}
+}
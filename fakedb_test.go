@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// Поддельный драйвер database/sql для проверки логики, завязанной на запросы, без PostgreSQL.
+// Ответ выбирается по первому правилу, фрагмент которого содержится в тексте запроса;
+// на остальные запросы возвращается пустой результат
+type fakeDB struct {
+	mu       sync.Mutex
+	rules    []fakeRule
+	executed []fakeQuery
+}
+
+type fakeRule struct {
+	fragment string
+	respond  func(args []driver.Value) fakeResult
+}
+
+// Выполненный запрос с аргументами
+type fakeQuery struct {
+	query string
+	args  []driver.Value
+}
+
+// Ответ на запрос: строки результата или число изменённых строк
+type fakeResult struct {
+	rows     [][]driver.Value
+	affected int64
+	err      error
+}
+
+func fakeRow(values ...driver.Value) fakeResult {
+	return fakeResult{rows: [][]driver.Value{values}, affected: 1}
+}
+
+var (
+	fakeDrivers   sync.Map
+	fakeDriverSeq atomic.Int64
+	fakeRegister  sync.Once
+)
+
+func newFakeDB(t *testing.T) (*sql.DB, *fakeDB) {
+	t.Helper()
+	fakeRegister.Do(func() { sql.Register("fakedb", fakeDriver{}) })
+	fake := &fakeDB{}
+	name := fmt.Sprintf("fake-%d", fakeDriverSeq.Add(1))
+	fakeDrivers.Store(name, fake)
+	db, err := sql.Open("fakedb", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		fakeDrivers.Delete(name)
+	})
+	return db, fake
+}
+
+// Ответ на запросы, содержащие fragment. Правила проверяются в порядке добавления
+func (f *fakeDB) on(fragment string, respond func(args []driver.Value) fakeResult) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = append(f.rules, fakeRule{fragment: fragment, respond: respond})
+}
+
+// Выполненные запросы, содержащие fragment
+func (f *fakeDB) queries(fragment string) []fakeQuery {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var found []fakeQuery
+	for _, q := range f.executed {
+		if strings.Contains(q.query, fragment) {
+			found = append(found, q)
+		}
+	}
+	return found
+}
+
+func (f *fakeDB) run(query string, args []driver.Value) fakeResult {
+	f.mu.Lock()
+	f.executed = append(f.executed, fakeQuery{query: query, args: args})
+	var respond func([]driver.Value) fakeResult
+	for _, rule := range f.rules {
+		if strings.Contains(query, rule.fragment) {
+			respond = rule.respond
+			break
+		}
+	}
+	f.mu.Unlock()
+	if respond == nil {
+		return fakeResult{}
+	}
+	return respond(args)
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(name string) (driver.Conn, error) {
+	fake, ok := fakeDrivers.Load(name)
+	if !ok {
+		return nil, fmt.Errorf("fake database %s is closed", name)
+	}
+	return &fakeConn{db: fake.(*fakeDB)}, nil
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{db: c.db, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	c.db.run("BEGIN", nil)
+	return fakeTx{db: c.db}, nil
+}
+
+type fakeTx struct{ db *fakeDB }
+
+func (tx fakeTx) Commit() error {
+	return tx.db.run("COMMIT", nil).err
+}
+
+func (tx fakeTx) Rollback() error {
+	return tx.db.run("ROLLBACK", nil).err
+}
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	result := s.db.run(s.query, args)
+	if result.err != nil {
+		return nil, result.err
+	}
+	return driver.RowsAffected(result.affected), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	result := s.db.run(s.query, args)
+	if result.err != nil {
+		return nil, result.err
+	}
+	return &fakeRows{rows: result.rows}, nil
+}
+
+type fakeRows struct {
+	rows [][]driver.Value
+	next int
+}
+
+func (r *fakeRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return nil
+	}
+	columns := make([]string, len(r.rows[0]))
+	for i := range columns {
+		columns[i] = fmt.Sprintf("column%d", i)
+	}
+	return columns
+}
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.next >= len(r.rows) {
+		return io.EOF
+	}
+	copy(dest, r.rows[r.next])
+	r.next++
+	return nil
+}
@@ -3,7 +3,7 @@ module MessengerServer
 go 1.24
 
 require (
-	github.com/gorilla/websocket v1.5.3 // indirect
-	github.com/lib/pq v1.10.9 // indirect
-	golang.org/x/crypto v0.34.0 // indirect
+	github.com/gorilla/websocket v1.5.3
+	github.com/lib/pq v1.10.9
+	golang.org/x/crypto v0.34.0
 )
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Общий интерфейс для *sql.DB и *sql.Tx, чтобы вспомогательные функции работали внутри транзакции и без неё
+type queryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// Проверка, что пользователь может управлять группой: администратор или создатель, который
+// всё ещё состоит в группе
+func canManageGroup(db queryRower, chatID, userID int) (bool, error) {
+	var allowed bool
+	err := db.QueryRow(`
+        SELECT EXISTS (
+            SELECT 1 FROM participants p
+            LEFT JOIN group_chats gc ON gc.chat_id = p.chat_id
+            WHERE p.chat_id = $1 AND p.user_id = $2 AND (p.is_admin OR gc.created_by = $2)
+        )`, chatID, userID).Scan(&allowed)
+	return allowed, err
+}
+
+// Вставка системного сообщения в чат
+func insertSystemMessage(db queryRower, chatID int, content string) (int, time.Time, error) {
+	var (
+		messageID int
+		createdAt time.Time
+	)
+	err := db.QueryRow(
+		"INSERT INTO messages (chat_id, content, is_system) VALUES ($1, $2, true) RETURNING id, created_at",
+		chatID, content,
+	).Scan(&messageID, &createdAt)
+	return messageID, createdAt, err
+}
+
+// Формирование объекта системного сообщения для рассылки
+func systemMessagePayload(chatID, messageID int, content string, createdAt time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"id":         messageID,
+		"chat_id":    chatID,
+		"user_id":    nil,
+		"text":       content,
+		"created_at": createdAt.Format(time.RFC3339),
+		"is_system":  true,
+		"isMe":       false,
+	}
+}
+
+// ETag изображения группы строится по номеру версии
+func groupImageETag(chatID, version int) string {
+	return fmt.Sprintf("\"group-%d-v%d\"", chatID, version)
+}
+
+// Данные группы после изменения (ответ updateGroupHandler и событие group_updated)
+func groupInfoPayload(chatID int, name, description string, imageVersion int, hasImage bool, updatedBy int) map[string]interface{} {
+	return map[string]interface{}{
+		"chat_id":       chatID,
+		"name":          name,
+		"description":   description,
+		"has_image":     hasImage,
+		"image_version": imageVersion,
+		"image_etag":    groupImageETag(chatID, imageVersion),
+		"updated_by":    updatedBy,
+	}
+}
+
+// updateGroupHandler обновляет название, описание и аватар группы
+func updateGroupHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Изображение передаётся через multipart, остальные поля допускаются и в обычной форме
+	err := r.ParseMultipartForm(10 << 20)
+	if err != nil && err != http.ErrNotMultipart {
+		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		return
+	}
+
+	chatID, err := strconv.Atoi(r.FormValue("chat_id"))
+	if err != nil {
+		http.Error(w, "Invalid chat_id", http.StatusBadRequest)
+		return
+	}
+	userID, err := strconv.Atoi(r.FormValue("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user_id", http.StatusBadRequest)
+		return
+	}
+
+	// Обновляются только переданные поля
+	_, nameSet := r.Form["name"]
+	_, descriptionSet := r.Form["description"]
+	name := strings.TrimSpace(r.FormValue("name"))
+	description := strings.TrimSpace(r.FormValue("description"))
+	removeImage := r.FormValue("remove_image") == "true"
+
+	if nameSet && name == "" {
+		http.Error(w, "Group name cannot be empty", http.StatusBadRequest)
+		return
+	}
+	if len(name) > 255 {
+		http.Error(w, "Group name is too long", http.StatusBadRequest)
+		return
+	}
+
+	file, fileHeader, err := r.FormFile("image")
+	if err == nil {
+		defer file.Close()
+	}
+	imageSet := err == nil && fileHeader.Size > 0
+
+	if !nameSet && !descriptionSet && !imageSet && !removeImage {
+		http.Error(w, "Nothing to update", http.StatusBadRequest)
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	allowed, err := canManageGroup(db, chatID, userID)
+	if err != nil {
+		log.Printf("Ошибка проверки прав на группу %d: %v", chatID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !allowed {
+		http.Error(w, "Only group admins can edit group info", http.StatusForbidden)
+		return
+	}
+
+	// Новое фото сохраняется в хранилище после проверки прав, но до транзакции, в группе хранится только ключ
+	var imageKey sql.NullString
+	if imageSet {
+		blob, err := storeAvatarImage(db, file, fileHeader.Filename)
+		if err != nil {
+			writeImageError(w, err)
+			return
+		}
+		imageKey = sql.NullString{String: blob.Key, Valid: true}
+	}
+
+	var actorName string
+	if err := db.QueryRow("SELECT username FROM users WHERE id = $1", userID).Scan(&actorName); err != nil {
+		actorName = "Unknown"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Transaction failed to start", http.StatusInternalServerError)
+		return
+	}
+
+	var (
+		oldName        string
+		oldDescription sql.NullString
+		oldHasImage    bool
+	)
+	err = tx.QueryRow(`
+        SELECT name, description, image IS NOT NULL OR image_key IS NOT NULL
+        FROM group_chats WHERE chat_id = $1 FOR UPDATE`, chatID,
+	).Scan(&oldName, &oldDescription, &oldHasImage)
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			http.Error(w, "Group not found", http.StatusNotFound)
+		} else {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// Тексты системных сообщений об изменениях
+	var notices []string
+	if nameSet && name != oldName {
+		notices = append(notices, fmt.Sprintf("%s изменил(а) название группы на «%s»", actorName, name))
+	} else {
+		nameSet = false
+	}
+	if descriptionSet && description != oldDescription.String {
+		notices = append(notices, fmt.Sprintf("%s изменил(а) описание группы", actorName))
+	} else {
+		descriptionSet = false
+	}
+	// Удаление фото у группы без фото ничего не меняет
+	removeImage = removeImage && !imageSet && oldHasImage
+	if imageSet {
+		notices = append(notices, fmt.Sprintf("%s обновил(а) фото группы", actorName))
+	} else if removeImage {
+		notices = append(notices, fmt.Sprintf("%s удалил(а) фото группы", actorName))
+	}
+
+	if len(notices) == 0 {
+		tx.Rollback()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	var (
+		newName        string
+		newDescription sql.NullString
+		imageVersion   int
+		hasImage       bool
+	)
+	err = tx.QueryRow(`
+        UPDATE group_chats
+        SET name = CASE WHEN $2 THEN $3 ELSE name END,
+            description = CASE WHEN $4 THEN $5 ELSE description END,
+            image = CASE WHEN $6 OR $8 THEN NULL ELSE image END,
+            image_key = CASE WHEN $6 THEN $7 WHEN $8 THEN NULL ELSE image_key END,
+            image_version = CASE WHEN $6 OR $8 THEN image_version + 1 ELSE image_version END,
+            updated_at = CURRENT_TIMESTAMP
+        WHERE chat_id = $1
+        RETURNING name, description, image_version, image IS NOT NULL OR image_key IS NOT NULL`,
+		chatID, nameSet, name, descriptionSet, description, imageSet, imageKey, removeImage,
+	).Scan(&newName, &newDescription, &imageVersion, &hasImage)
+	if err != nil {
+		tx.Rollback()
+		log.Printf("Ошибка обновления группы %d: %v", chatID, err)
+		http.Error(w, "Failed to update group", http.StatusInternalServerError)
+		return
+	}
+
+	var systemMessages []map[string]interface{}
+	for _, notice := range notices {
+		messageID, createdAt, err := insertSystemMessage(tx, chatID, notice)
+		if err != nil {
+			tx.Rollback()
+			http.Error(w, "Failed to create system message", http.StatusInternalServerError)
+			return
+		}
+		systemMessages = append(systemMessages, systemMessagePayload(chatID, messageID, notice, createdAt))
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Transaction commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	participantIDs, err := getChatParticipantIDs(db, chatID)
+	if err != nil {
+		log.Printf("Ошибка получения участников чата %d: %v", chatID, err)
+	}
+
+	groupData := groupInfoPayload(chatID, newName, newDescription.String, imageVersion, hasImage, userID)
+
+	// Сначала системные сообщения, затем событие с новыми данными группы
+	for _, msg := range systemMessages {
+		broadcastToUsers(participantIDs, msg)
+	}
+	event := map[string]interface{}{"type": "group_updated"}
+	for key, value := range groupData {
+		event[key] = value
+	}
+	broadcastToUsers(participantIDs, event)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(groupData)
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Некорректные запросы отклоняются до обращения к БД
+func TestUpdateGroupHandlerValidation(t *testing.T) {
+	cases := []struct {
+		name   string
+		method string
+		form   url.Values
+		status int
+	}{
+		{"GET", "GET", nil, http.StatusMethodNotAllowed},
+		{"no chat", "POST", url.Values{"user_id": {"1"}, "name": {"Группа"}}, http.StatusBadRequest},
+		{"no user", "POST", url.Values{"chat_id": {"1"}, "name": {"Группа"}}, http.StatusBadRequest},
+		{"empty name", "POST", url.Values{"chat_id": {"1"}, "user_id": {"1"}, "name": {"  "}}, http.StatusBadRequest},
+		{"long name", "POST", url.Values{"chat_id": {"1"}, "user_id": {"1"}, "name": {strings.Repeat("я", 128)}}, http.StatusBadRequest},
+		{"nothing to update", "POST", url.Values{"chat_id": {"1"}, "user_id": {"1"}}, http.StatusBadRequest},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "/updateGroup", strings.NewReader(c.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		updateGroupHandler(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("%s: status %d, want %d", c.name, rec.Code, c.status)
+		}
+	}
+}
+
+// Новая версия изображения меняет ETag, чтобы клиенты не показывали закешированное старое фото
+func TestGroupInfoPayload(t *testing.T) {
+	before := groupInfoPayload(7, "Группа", "", 1, true, 3)
+	after := groupInfoPayload(7, "Группа", "", 2, true, 3)
+	if before["image_etag"] != `"group-7-v1"` || before["image_etag"] == after["image_etag"] {
+		t.Fatalf("image etags %v and %v", before["image_etag"], after["image_etag"])
+	}
+	if groupImageETag(7, 1) == groupImageETag(8, 1) {
+		t.Fatal("etag does not depend on the group")
+	}
+
+	created := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	message := systemMessagePayload(7, 100, "bob изменил(а) описание группы", created)
+	if message["is_system"] != true || message["user_id"] != nil || message["created_at"] != "2026-01-02T03:04:05Z" {
+		t.Fatalf("system message payload: %v", message)
+	}
+}
@@ -1,12 +1,15 @@
 package main
 
 import (
+	"crypto/md5"
 	"database/sql"
 	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/bcrypt"
@@ -22,18 +25,6 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	name := r.FormValue("name")
 	bio := r.FormValue("bio")
 
-	// Обработка файла изображения
-	var imageBytes []byte
-	file, _, err := r.FormFile("image")
-	if err == nil {
-		defer file.Close()
-		imageBytes, err = io.ReadAll(file)
-		if err != nil {
-			http.Error(w, "Error reading image", http.StatusBadRequest)
-			return
-		}
-	}
-
 	// Валидация обязательных полей
 	if username == "" || name == "" {
 		http.Error(w, "Username and name are required", http.StatusBadRequest)
@@ -53,21 +44,27 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
-	// Сохраняем пользователя в базе данных
-	var image interface{}
-	if len(imageBytes) > 0 {
-		image = imageBytes
-	} else {
-		image = nil // Сохраняем NULL, если фото нет
+	// Обработка файла изображения: аватар сохраняется в хранилище, в БД — только ключ
+	var imageKey interface{} // NULL, если фото нет
+	file, handler, err := r.FormFile("image")
+	if err == nil && handler.Size > 0 {
+		defer file.Close()
+		blob, err := storeAvatarImage(db, file, handler.Filename)
+		if err != nil {
+			writeImageError(w, err)
+			return
+		}
+		imageKey = blob.Key
 	}
 
+	// Сохраняем пользователя в базе данных
 	_, err = db.Exec(
-		"INSERT INTO users (username, password, name, bio, image) VALUES ($1, $2, $3, $4, $5)",
+		"INSERT INTO users (username, password, name, bio, image_key) VALUES ($1, $2, $3, $4, $5)",
 		username,
 		string(hashedPassword),
 		name,
 		bio,
-		image,
+		imageKey,
 	)
 
 	if err != nil {
@@ -95,8 +92,8 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 		userID         int
 	)
 
-	// Добавляем получение ID пользователя
-	err = db.QueryRow("SELECT id, password FROM users WHERE username = $1", username).Scan(&userID, &storedPassword)
+	// Добавляем получение ID пользователя; боты входят только по токену
+	err = db.QueryRow("SELECT id, password FROM users WHERE username = $1 AND NOT is_bot", username).Scan(&userID, &storedPassword)
 	if err != nil {
 		http.Error(w, "Пользователь не найден", http.StatusUnauthorized)
 		return
@@ -135,6 +132,7 @@ func usersHandler(w http.ResponseWriter, r *http.Request) {
         SELECT u.id, u.username 
         FROM users u
         WHERE u.id != $1 
+        AND (NOT u.is_bot OR EXISTS (SELECT 1 FROM bots b WHERE b.user_id = u.id))
         AND NOT EXISTS (
             SELECT 1 
             FROM participants p1
@@ -163,8 +161,14 @@ func usersHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(users)
 }
 
+// userImageHandler отдаёт аватар пользователя; ?size=small|medium|large выбирает уменьшенную копию
 func userImageHandler(w http.ResponseWriter, r *http.Request) {
 	userID := r.URL.Query().Get("id")
+	size := r.URL.Query().Get("size")
+	if !validAvatarSize(size) {
+		http.Error(w, "Invalid size", http.StatusBadRequest)
+		return
+	}
 
 	db, err := connectDB()
 	if err != nil {
@@ -173,14 +177,38 @@ func userImageHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
-	var imageBytes []byte
-	err = db.QueryRow("SELECT image FROM users WHERE id = $1", userID).Scan(&imageBytes)
-	if err != nil || len(imageBytes) == 0 {
+	var (
+		imageBytes []byte
+		imageKey   sql.NullString
+		storedAt   sql.NullTime
+	)
+	err = db.QueryRow(`
+		SELECT u.image, u.image_key, b.created_at
+		FROM users u
+		LEFT JOIN blobs b ON b.key = u.image_key
+		WHERE u.id = $1`, userID).Scan(&imageBytes, &imageKey, &storedAt)
+	if err != nil || (len(imageBytes) == 0 && !imageKey.Valid) {
 		w.WriteHeader(http.StatusNoContent) // Возвращаем 204, если фото нет
 		return
 	}
 
-	w.Header().Set("Content-Type", "image/jpeg")
+	// Ключ объекта — хеш содержимого, поэтому он же служит строгим ETag
+	if imageKey.Valid {
+		key, mimeType := imageVariantKey(db, imageKey.String, size)
+		etag := `"` + key[strings.LastIndex(key, "/")+1:] + `"`
+		if writeImageCacheHeaders(w, r, etag, imageVersionToken(imageKey, sql.NullString{}), storedAt.Time) {
+			return
+		}
+		w.Header().Set("Content-Type", mimeType)
+		serveBlob(w, r, key, storedAt.Time)
+		return
+	}
+	// Данные, ещё не перенесённые из БД командой migrate-blobs
+	legacyHash := fmt.Sprintf("%x", md5.Sum(imageBytes))
+	if writeImageCacheHeaders(w, r, `"`+legacyHash+`"`, imageVersionToken(imageKey, sql.NullString{String: legacyHash, Valid: true}), time.Time{}) {
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(imageBytes))
 	w.Write(imageBytes)
 }
 
@@ -247,6 +275,16 @@ func messagesHandler(w http.ResponseWriter, r *http.Request) {
             m.is_forwarded, 
             m.original_sender_id, 
             m.original_chat_id,
+            m.expires_at,
+            m.message_type,
+            CASE
+                WHEN m.is_deleted THEN NULL
+                ELSE m.entities
+            END AS entities,
+            CASE
+                WHEN m.is_deleted THEN NULL
+                ELSE m.reply_markup
+            END AS reply_markup,
             u.name AS sender_name,
             pm.content AS parent_content,
             pu.username AS parent_sender,
@@ -258,8 +296,12 @@ func messagesHandler(w http.ResponseWriter, r *http.Request) {
         LEFT JOIN messages pm ON m.parent_message_id = pm.id
         LEFT JOIN users pu ON pm.user_id = pu.id
         LEFT JOIN users ou ON m.original_sender_id = ou.id
+        LEFT JOIN participants cp 
+            ON cp.chat_id = m.chat_id AND cp.user_id = $1
         WHERE m.chat_id = $2 
             AND dm.message_id IS NULL
+            AND (cp.history_cleared_at IS NULL OR m.created_at > cp.history_cleared_at)
+            AND (m.expires_at IS NULL OR m.expires_at > CURRENT_TIMESTAMP)
         ORDER BY m.created_at ASC`
 	// Выполняем запрос
 	rows, err := db.Query(query, currentUserID, chatID)
@@ -270,7 +312,10 @@ func messagesHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer rows.Close()
 	// Обрабатываем результаты
-	var messages []map[string]interface{}
+	var (
+		messages   []map[string]interface{}
+		messageIDs []int
+	)
 	for rows.Next() {
 		// Объявляем переменные для всех полей
 		var (
@@ -283,6 +328,10 @@ func messagesHandler(w http.ResponseWriter, r *http.Request) {
 			isForwarded        bool
 			originalSender     sql.NullInt64
 			originalChat       sql.NullInt64
+			expiresAt          sql.NullTime
+			messageType        string
+			entities           []byte
+			replyMarkup        []byte
 			senderName         sql.NullString
 			parentContent      sql.NullString
 			parentSender       sql.NullString
@@ -291,8 +340,8 @@ func messagesHandler(w http.ResponseWriter, r *http.Request) {
 		// Сканируем строку результата
 		if err := rows.Scan(
 			&id, &content, &createdAt, &userID, &isSystem,
-			&parentMessageID, &isForwarded, &originalSender, &originalChat,
-			&senderName, &parentContent, &parentSender, &originalSenderName,
+			&parentMessageID, &isForwarded, &originalSender, &originalChat, &expiresAt, &messageType, &entities,
+			&replyMarkup, &senderName, &parentContent, &parentSender, &originalSenderName,
 		); err != nil {
 			log.Printf("Ошибка чтения строки результата: %v", err)
 			continue
@@ -318,12 +367,115 @@ func messagesHandler(w http.ResponseWriter, r *http.Request) {
 			"original_sender_id":   originalSender.Int64,
 			"original_chat_id":     originalChat.Int64,
 			"original_sender_name": originalSenderName.String,
+			"message_type":         messageType,
 		}
 
 		if senderName.Valid {
 			messageData["sender_name"] = senderName.String
 		}
+		if expiresAt.Valid {
+			messageData["expires_at"] = expiresAt.Time
+		}
+		if len(entities) > 0 {
+			messageData["entities"] = json.RawMessage(entities)
+		}
+		if len(replyMarkup) > 0 {
+			messageData["reply_markup"] = json.RawMessage(replyMarkup)
+		}
 		messages = append(messages, messageData)
+		messageIDs = append(messageIDs, id)
+	}
+
+	// Упоминания загружаются одним запросом для всех сообщений
+	mentions, err := loadMessageMentions(db, messageIDs)
+	if err != nil {
+		log.Printf("Ошибка загрузки упоминаний: %v", err)
+	}
+	for i, messageData := range messages {
+		if list, ok := mentions[messageIDs[i]]; ok {
+			messageData["mentions"] = list
+		}
+	}
+	// Метаданные вложений без содержимого файлов
+	attachments, err := loadMessageAttachments(db, messageIDs)
+	if err != nil {
+		log.Printf("Ошибка загрузки вложений: %v", err)
+	}
+	for i, messageData := range messages {
+		if list, ok := attachments[messageIDs[i]]; ok {
+			messageData["attachments"] = list
+		}
+	}
+	// Сводка реакций с отметкой реакций текущего пользователя
+	reactions, err := loadReactionSummaries(db, messageIDs, currentUserID)
+	if err != nil {
+		log.Printf("Ошибка загрузки реакций: %v", err)
+	}
+	for i, messageData := range messages {
+		if list, ok := reactions[messageIDs[i]]; ok {
+			messageData["reactions"] = list
+		}
+	}
+	// Прослушивание голосовых сообщений: отметка текущего пользователя или список прослушавших для автора
+	listens, err := loadVoiceListens(db, messageIDs, currentUserID)
+	if err != nil {
+		log.Printf("Ошибка загрузки прослушиваний: %v", err)
+	}
+	for i, messageData := range messages {
+		if state, ok := listens[messageIDs[i]]; ok {
+			if state.ListenedBy != nil {
+				messageData["listened_by"] = state.ListenedBy
+			} else {
+				messageData["listened"] = state.Listened
+			}
+		}
+	}
+	// Местоположения и карточки контактов
+	locations, err := loadMessageLocations(db, messageIDs)
+	if err != nil {
+		log.Printf("Ошибка загрузки местоположений: %v", err)
+	}
+	contacts, err := loadMessageContacts(db, messageIDs)
+	if err != nil {
+		log.Printf("Ошибка загрузки контактов: %v", err)
+	}
+	for i, messageData := range messages {
+		if location, ok := locations[messageIDs[i]]; ok {
+			messageData["location"] = location
+		}
+		if contact, ok := contacts[messageIDs[i]]; ok {
+			messageData["contact"] = contact
+		}
+	}
+	// Стикеры
+	stickers, err := loadMessageStickers(db, messageIDs)
+	if err != nil {
+		log.Printf("Ошибка загрузки стикеров: %v", err)
+	}
+	for i, messageData := range messages {
+		if s, ok := stickers[messageIDs[i]]; ok {
+			messageData["sticker"] = s
+		}
+	}
+	// Превью ссылок
+	previews, err := loadLinkPreviews(db, messageIDs)
+	if err != nil {
+		log.Printf("Ошибка загрузки превью ссылок: %v", err)
+	}
+	for i, messageData := range messages {
+		if preview, ok := previews[messageIDs[i]]; ok {
+			messageData["link_preview"] = preview
+		}
+	}
+	// Опросы с результатами и выбором текущего пользователя
+	polls, err := loadPollResults(db, messageIDs, currentUserID)
+	if err != nil {
+		log.Printf("Ошибка загрузки опросов: %v", err)
+	}
+	for i, messageData := range messages {
+		if poll, ok := polls[messageIDs[i]]; ok {
+			messageData["poll"] = poll
+		}
 	}
 	log.Printf("Загружено сообщений: %d", len(messages))
 
@@ -349,43 +501,30 @@ func addReactionHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer db.Close()
-	// Вставляем или обновляем реакцию
-	_, err = db.Exec(
-		"INSERT INTO message_reactions (message_id, user_id, reaction) VALUES ($1, $2, $3) ON CONFLICT (message_id, user_id) DO UPDATE SET reaction = $3",
-		data.MessageID,
-		data.UserID,
-		data.Reaction,
-	)
+	// Добавляем реакцию; сверх лимита чата снимаются самые старые реакции пользователя
+	chatID, added, removed, err := addMessageReaction(db, data.MessageID, data.UserID, data.Reaction)
 	if err != nil {
-		http.Error(w, "Failed to add reaction", http.StatusInternalServerError)
+		writeReactionError(w, err)
 		return
 	}
 
-	// Отправляем реакцию всем подключенным клиентам
-	reactionMessage := map[string]interface{}{
-		"type":       "reaction",
-		"message_id": data.MessageID,
-		"user_id":    data.UserID,
-		"reaction":   data.Reaction,
+	// Отправляем изменения только участникам чата
+	for _, reaction := range removed {
+		broadcastReaction(db, chatID, data.MessageID, data.UserID, "removed", reaction)
 	}
-
-	clientsMu.Lock()
-	for client := range clients {
-		err := client.WriteJSON(reactionMessage)
-		if err != nil {
-			log.Println("Ошибка при отправке реакции:", err)
-			client.Close()
-			delete(clients, client)
-		}
+	if added {
+		broadcastReaction(db, chatID, data.MessageID, data.UserID, "added", strings.TrimSpace(data.Reaction))
 	}
-	clientsMu.Unlock()
 
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Reaction added successfully"))
 }
 
 func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
-	r.ParseMultipartForm(10 << 20) // 10 MB
+	if err := r.ParseMultipartForm(10 << 20); err != nil { // 10 MB
+		http.Error(w, "Unable to parse form", http.StatusBadRequest)
+		return
+	}
 
 	file, handler, err := r.FormFile("file")
 	if err != nil {
@@ -394,15 +533,22 @@ func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	fileBytes, err := io.ReadAll(file)
+	userID, err := strconv.Atoi(r.FormValue("user_id"))
 	if err != nil {
-		http.Error(w, "Unable to read file", http.StatusInternalServerError)
+		http.Error(w, "User ID is required", http.StatusBadRequest)
 		return
 	}
-
-	messageID := r.FormValue("message_id")
-	if messageID == "" {
-		http.Error(w, "Message ID is required", http.StatusBadRequest)
+	// Без message_id файл становится вложением, ожидающим отправки с сообщением (attachment_ids)
+	var messageID int
+	if raw := r.FormValue("message_id"); raw != "" {
+		if messageID, err = strconv.Atoi(raw); err != nil {
+			http.Error(w, "Invalid message ID", http.StatusBadRequest)
+			return
+		}
+	}
+	kind, ok := parseAttachmentKind(r.FormValue("kind"))
+	if !ok {
+		http.Error(w, "Invalid kind", http.StatusBadRequest)
 		return
 	}
 
@@ -413,11 +559,80 @@ func uploadFileHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
+	if messageID != 0 {
+		allowed, err := canAttachToMessage(db, messageID, userID)
+		if err != nil {
+			log.Printf("Ошибка проверки доступа к сообщению %d: %v", messageID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+	}
+	// Любой загруженный файл учитывается в квотах так же, как загрузка по протоколу
+	if err := checkUploadQuota(db, userID, handler.Size); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	// Файл передаётся в хранилище потоком, без загрузки в память целиком
+	blob, err := storeBlob(db, file, maxAttachmentSize, handler.Filename)
+	if errors.Is(err, errBlobTooLarge) {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка сохранения файла: %v", err)
+		http.Error(w, "Unable to read file", http.StatusInternalServerError)
+		return
+	}
+	// Голосовые сообщения проверяются и получают длительность и волну; изображения очищаются
+	// от метаданных, для них строятся миниатюра и превью
+	if kind == attachmentKindVoice {
+		blob, err = processVoiceAttachment(db, blob)
+	} else {
+		blob, err = processImageAttachment(db, blob, handler.Filename)
+	}
+	if errors.Is(err, errInvalidVoice) {
+		http.Error(w, "Voice message must be Opus/OGG or M4A audio", http.StatusUnsupportedMediaType)
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка обработки вложения: %v", err)
+		http.Error(w, "Unable to process file", http.StatusInternalServerError)
+		return
+	}
+
+	fileName := clientFileName(handler.Filename)
+	if messageID == 0 {
+		attachmentID, expiresAt, err := createPendingAttachment(db, userID, kind, fileName, blob)
+		if err != nil {
+			log.Printf("Ошибка сохранения вложения: %v", err)
+			http.Error(w, "Failed to upload file", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"attachment_id": attachmentID,
+			"kind":          kind,
+			"file_name":     fileName,
+			"size":          blob.Size,
+			"mime_type":     blob.MimeType,
+			"expires_at":    expiresAt,
+		})
+		return
+	}
+
 	_, err = db.Exec(
-		"INSERT INTO message_files (message_id, file_name, file_data) VALUES ($1, $2, $3)",
+		"INSERT INTO message_files (message_id, kind, file_name, blob_key, file_size, mime_type) VALUES ($1, $2, $3, $4, $5, $6)",
 		messageID,
-		handler.Filename,
-		fileBytes,
+		kind,
+		fileName,
+		blob.Key,
+		blob.Size,
+		blob.MimeType,
 	)
 	if err != nil {
 		http.Error(w, "Failed to upload file", http.StatusInternalServerError)
@@ -495,15 +710,16 @@ func userProfileHandler(w http.ResponseWriter, r *http.Request) {
 		name             string
 		username         string
 		bio              string
-		imageBytes       []byte
+		imageKey         sql.NullString
+		legacyImageHash  sql.NullString
 		registrationDate time.Time
 	)
 
 	err = db.QueryRow(`
-		SELECT name, username, bio, image, created_at 
+		SELECT name, username, bio, image_key, CASE WHEN image_key IS NULL THEN md5(image) END, created_at 
 		FROM users 
 		WHERE id = $1
-	`, userID).Scan(&name, &username, &bio, &imageBytes, &registrationDate)
+	`, userID).Scan(&name, &username, &bio, &imageKey, &legacyImageHash, &registrationDate)
 
 	if err != nil {
 		if err == sql.ErrNoRows {
@@ -514,12 +730,13 @@ func userProfileHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Формируем JSON-ответ
+	// Вместо данных изображения — адрес с версией, который клиент может кешировать
+	id, _ := strconv.Atoi(userID)
 	response := map[string]interface{}{
 		"name":             name,
 		"username":         username,
 		"bio":              bio,
-		"image":            imageBytes,                            // Возвращаем бинарные данные изображения
+		"image_url":        userImageURL(id, imageVersionToken(imageKey, legacyImageHash)),
 		"registrationDate": registrationDate.Format("2006-01-02"), // Форматируем дату
 	}
 	//log.Printf("Зpppp [%s]", response)
@@ -551,7 +768,7 @@ func allUsersHandler(w http.ResponseWriter, r *http.Request) {
 	rows, err := db.Query(`
         SELECT id, username 
         FROM users 
-        WHERE id != $1
+        WHERE id != $1 AND (NOT is_bot OR EXISTS (SELECT 1 FROM bots b WHERE b.user_id = users.id))
     `, currentUserID)
 
 	if err != nil {
@@ -581,11 +798,13 @@ func allUsersHandler(w http.ResponseWriter, r *http.Request) {
 func forwardMessage(w http.ResponseWriter, r *http.Request) {
 	// Декодируем JSON-запрос
 	var data struct {
-		ChatID         int    `json:"chat_id"`
-		UserID         int    `json:"user_id"`
-		Text           string `json:"text"`
-		OriginalSender *int   `json:"original_sender_id"` // Изменяем на указатель
-		OriginalChat   *int   `json:"original_chat_id"`   // Изменяем на указатель
+		ChatID         int             `json:"chat_id"`
+		UserID         int             `json:"user_id"`
+		Text           string          `json:"text"`
+		OriginalSender *int            `json:"original_sender_id"` // Изменяем на указатель
+		OriginalChat   *int            `json:"original_chat_id"`   // Изменяем на указатель
+		ParseMode      string          `json:"parse_mode"`
+		Entities       []messageEntity `json:"entities"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
 		log.Printf("Ошибка декодирования тела запроса: %v", err)
@@ -600,6 +819,14 @@ func forwardMessage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Пересылаемый текст проходит ту же проверку, что и обычные сообщения
+	text, entities, err := prepareMessageText(data.Text, data.ParseMode, data.Entities)
+	if err != nil {
+		http.Error(w, "Invalid message: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	data.Text = text
+
 	db, err := connectDB()
 	if err != nil {
 		log.Printf("Ошибка подключения к БД: %v", err)
@@ -620,10 +847,13 @@ func forwardMessage(w http.ResponseWriter, r *http.Request) {
 	}
 	// Вставляем пересланное сообщение
 	var messageID int
+	var expiresAt sql.NullTime
 	err = db.QueryRow(`
-	  INSERT INTO messages (chat_id, user_id, content, is_forwarded, original_sender_id, original_chat_id)
-	  VALUES ($1, $2, $3, true, $4, $5) RETURNING id
-	`, data.ChatID, data.UserID, data.Text, originalSender, originalChat).Scan(&messageID)
+	  INSERT INTO messages (chat_id, user_id, content, is_forwarded, original_sender_id, original_chat_id, expires_at, entities)
+	  SELECT $1, $2, $3, true, $4, $5, `+messageExpirySQL+`, $6::jsonb
+	  FROM chats c WHERE c.id = $1
+	  RETURNING id, expires_at
+	`, data.ChatID, data.UserID, data.Text, originalSender, originalChat, entitiesJSON(entities)).Scan(&messageID, &expiresAt)
 	if err != nil {
 		log.Printf("Ошибка вставки сообщения в БД: %v", err)
 		http.Error(w, "Failed to insert message", http.StatusInternalServerError)
@@ -631,6 +861,15 @@ func forwardMessage(w http.ResponseWriter, r *http.Request) {
 	}
 	log.Printf("Сообщение успешно вставлено с ID: %d", messageID)
 
+	mentions, err := storeMessageMentions(db, messageID, data.ChatID, data.UserID, data.Text, nil)
+	if err != nil {
+		log.Printf("Ошибка сохранения упоминаний: %v", err)
+	}
+	entities, err = attachMentionEntities(db, messageID, entities, mentions)
+	if err != nil {
+		log.Printf("Ошибка сохранения сущностей упоминаний: %v", err)
+	}
+
 	var originalSenderName string
 	if originalSender.Valid {
 		err = db.QueryRow("SELECT username FROM users WHERE id = $1", originalSender.Int64).Scan(&originalSenderName)
@@ -658,6 +897,15 @@ func forwardMessage(w http.ResponseWriter, r *http.Request) {
 	if originalChat.Valid {
 		message["original_chat_id"] = originalChat.Int64
 	}
+	if expiresAt.Valid {
+		message["expires_at"] = expiresAt.Time.Format(time.RFC3339)
+	}
+	if len(mentions) > 0 {
+		message["mentions"] = mentions
+	}
+	if len(entities) > 0 {
+		message["entities"] = entities
+	}
 
 	clientsMu.Lock()
 	log.Printf("Рассылка пересланного сообщения клиентам в чате %d", data.ChatID)
@@ -673,6 +921,16 @@ func forwardMessage(w http.ResponseWriter, r *http.Request) {
 	}
 	clientsMu.Unlock()
 
+	if len(mentions) > 0 {
+		var senderName string
+		db.QueryRow("SELECT username FROM users WHERE id = $1", data.UserID).Scan(&senderName)
+		participantIDs, err := getChatParticipantIDs(db, data.ChatID)
+		if err != nil {
+			log.Printf("Ошибка получения участников чата: %v", err)
+		}
+		broadcastMentions(mentions, participantIDs, data.ChatID, messageID, data.UserID, senderName, data.Text)
+	}
+
 	log.Printf("Пересылка сообщения успешно завершена")
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte("Message forwarded successfully"))
@@ -696,7 +954,7 @@ func resetUnreadHandler(w http.ResponseWriter, r *http.Request) {
 	defer db.Close()
 
 	_, err = db.Exec(
-		"UPDATE participants SET unread_count = 0 WHERE chat_id = $1 AND user_id = $2",
+		"UPDATE participants SET unread_count = 0, unread_mentions = 0 WHERE chat_id = $1 AND user_id = $2",
 		data.ChatID, data.UserID,
 	)
 	if err != nil {
@@ -758,8 +1016,14 @@ func getGroupParticipantsCountHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(response)
 }
 
+// groupImageHandler отдаёт фото группы; ?size=small|medium|large выбирает уменьшенную копию
 func groupImageHandler(w http.ResponseWriter, r *http.Request) {
 	chatID := r.URL.Query().Get("chat_id")
+	size := r.URL.Query().Get("size")
+	if !validAvatarSize(size) {
+		http.Error(w, "Invalid size", http.StatusBadRequest)
+		return
+	}
 
 	db, err := connectDB()
 	if err != nil {
@@ -768,13 +1032,35 @@ func groupImageHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
-	var imageBytes []byte
-	err = db.QueryRow("SELECT image FROM group_chats WHERE chat_id = $1", chatID).Scan(&imageBytes)
-	if err != nil || len(imageBytes) == 0 {
+	var (
+		imageBytes   []byte
+		imageKey     sql.NullString
+		imageVersion int
+		updatedAt    sql.NullTime
+	)
+	err = db.QueryRow("SELECT image, image_key, image_version, updated_at FROM group_chats WHERE chat_id = $1", chatID).Scan(&imageBytes, &imageKey, &imageVersion, &updatedAt)
+	if err != nil || (len(imageBytes) == 0 && !imageKey.Valid) {
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	w.Header().Set("Content-Type", "image/jpeg")
+	// Версия изображения меняется при каждом обновлении фото группы
+	id, _ := strconv.Atoi(chatID)
+	etag := groupImageETag(id, imageVersion)
+	if size != "" {
+		etag = strings.TrimSuffix(etag, `"`) + "-" + size + `"`
+	}
+	w.Header().Set("X-Image-Version", strconv.Itoa(imageVersion))
+	if writeImageCacheHeaders(w, r, etag, strconv.Itoa(imageVersion), updatedAt.Time) {
+		return
+	}
+
+	if imageKey.Valid {
+		key, mimeType := imageVariantKey(db, imageKey.String, size)
+		w.Header().Set("Content-Type", mimeType)
+		serveBlob(w, r, key, updatedAt.Time)
+		return
+	}
+	w.Header().Set("Content-Type", http.DetectContentType(imageBytes))
 	w.Write(imageBytes)
 }
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	maxImagePixels      = 40_000_000 // Максимум пикселей декодируемого изображения (защита от «бомб»)
+	maxImageProcessSize = 30 << 20   // Вложения большего размера не обрабатываются
+	avatarMaxSide       = 1280       // Основной размер аватара после нормализации
+	thumbnailMaxSide    = 320        // Миниатюра вложения
+	imageJPEGQuality    = 88
+	blurhashComponentsX = 4
+	blurhashComponentsY = 3
+)
+
+// Размеры аватаров, доступные через параметр size
+var avatarSizes = []struct {
+	name    string
+	maxSide int
+}{
+	{"small", 96},
+	{"medium", 256},
+	{"large", 640},
+}
+
+var errNotAnImage = errors.New("not a supported image")
+
+// Поддерживаемые форматы определяются по содержимому, а не по имени файла
+func sniffImageType(data []byte) (string, bool) {
+	switch mimeType := http.DetectContentType(data); mimeType {
+	case "image/jpeg", "image/png", "image/gif":
+		return mimeType, true
+	default:
+		return mimeType, false
+	}
+}
+
+// Декодирование изображения с проверкой размеров и учётом EXIF-ориентации
+func decodeImage(data []byte) (image.Image, string, error) {
+	mimeType, ok := sniffImageType(data)
+	if !ok {
+		return nil, "", errNotAnImage
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, "", errNotAnImage
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > maxImagePixels {
+		return nil, "", errNotAnImage
+	}
+
+	var img image.Image
+	switch mimeType {
+	case "image/jpeg":
+		img, err = jpeg.Decode(bytes.NewReader(data))
+	case "image/png":
+		img, err = png.Decode(bytes.NewReader(data))
+	case "image/gif":
+		img, err = gif.Decode(bytes.NewReader(data))
+	}
+	if err != nil {
+		return nil, "", errNotAnImage
+	}
+	if mimeType == "image/jpeg" {
+		img = applyOrientation(img, jpegOrientation(data))
+	}
+	return img, mimeType, nil
+}
+
+// Значение тега Orientation (0x0112) из EXIF-блока JPEG; 1, если тега нет
+func jpegOrientation(data []byte) int {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 1
+	}
+	pos := 2
+	for pos+4 <= len(data) {
+		if data[pos] != 0xFF {
+			return 1
+		}
+		marker := data[pos+1]
+		// Начало данных изображения — дальше метаданных нет
+		if marker == 0xDA || marker == 0xD9 {
+			return 1
+		}
+		length := int(binary.BigEndian.Uint16(data[pos+2:]))
+		if length < 2 || pos+2+length > len(data) {
+			return 1
+		}
+		segment := data[pos+4 : pos+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return exifOrientation(segment[6:])
+		}
+		pos += 2 + length
+	}
+	return 1
+}
+
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[ifd:]))
+	for i := 0; i < count; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == 0x0112 {
+			value := int(order.Uint16(tiff[entry+8:]))
+			if value >= 1 && value <= 8 {
+				return value
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// Поворот и отражение изображения согласно EXIF-ориентации
+func applyOrientation(img image.Image, orientation int) image.Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	src := toNRGBA(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // Отражение по горизонтали
+				dx, dy = w-1-x, y
+			case 3: // Поворот на 180°
+				dx, dy = w-1-x, h-1-y
+			case 4: // Отражение по вертикали
+				dx, dy = x, h-1-y
+			case 5: // Транспонирование
+				dx, dy = y, x
+			case 6: // Поворот на 90° по часовой
+				dx, dy = h-1-y, x
+			case 7: // Поперечное транспонирование
+				dx, dy = h-1-y, w-1-x
+			case 8: // Поворот на 90° против часовой
+				dx, dy = y, w-1-x
+			}
+			si := src.PixOffset(x, y)
+			di := dst.PixOffset(dx, dy)
+			copy(dst.Pix[di:di+4], src.Pix[si:si+4])
+		}
+	}
+	return dst
+}
+
+func toNRGBA(img image.Image) *image.NRGBA {
+	if n, ok := img.(*image.NRGBA); ok && n.Rect.Min == (image.Point{}) {
+		return n
+	}
+	b := img.Bounds()
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	return dst
+}
+
+// Уменьшение изображения так, чтобы большая сторона не превышала maxSide (усреднением по площади)
+func resizeToFit(img image.Image, maxSide int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w <= maxSide && h <= maxSide {
+		return img
+	}
+	dw, dh := maxSide, maxSide
+	if w > h {
+		dh = int(math.Max(1, math.Round(float64(h)*float64(maxSide)/float64(w))))
+	} else {
+		dw = int(math.Max(1, math.Round(float64(w)*float64(maxSide)/float64(h))))
+	}
+	return resizeArea(toNRGBA(img), dw, dh)
+}
+
+func resizeArea(src *image.NRGBA, dw, dh int) *image.NRGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	dst := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy0, sy1 := y*sh/dh, (y+1)*sh/dh
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < dw; x++ {
+			sx0, sx1 := x*sw/dw, (x+1)*sw/dw
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+			// Цвет усредняется с учётом прозрачности
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				i := src.PixOffset(sx0, sy)
+				for sx := sx0; sx < sx1; sx++ {
+					pa := uint64(src.Pix[i+3])
+					r += uint64(src.Pix[i]) * pa
+					g += uint64(src.Pix[i+1]) * pa
+					bl += uint64(src.Pix[i+2]) * pa
+					a += pa
+					n++
+					i += 4
+				}
+			}
+			di := dst.PixOffset(x, y)
+			if a > 0 {
+				dst.Pix[di] = uint8(r / a)
+				dst.Pix[di+1] = uint8(g / a)
+				dst.Pix[di+2] = uint8(bl / a)
+			}
+			dst.Pix[di+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// Кодирование в JPEG; прозрачные области заливаются белым. Метаданные исходного файла не переносятся
+func encodeJPEG(img image.Image) ([]byte, error) {
+	b := img.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(flat, flat.Bounds(), &image.Uniform{C: color.White}, image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, b.Min, draw.Over)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, flat, &jpeg.Options{Quality: imageJPEGQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Сохранение уменьшенной копии изображения как варианта исходного объекта
+func storeImageVariant(db dbExecutor, sourceKey, variant string, img image.Image, maxSide int) error {
+	resized := resizeToFit(img, maxSide)
+	data, err := encodeJPEG(resized)
+	if err != nil {
+		return err
+	}
+	blob, err := storeBlobBytes(db, data, variant+".jpg")
+	if err != nil {
+		return err
+	}
+	b := resized.Bounds()
+	_, err = db.Exec(`
+        INSERT INTO blob_variants (blob_key, variant, variant_key, width, height)
+        VALUES ($1, $2, $3, $4, $5)
+        ON CONFLICT (blob_key, variant) DO UPDATE SET variant_key = $3, width = $4, height = $5`,
+		sourceKey, variant, blob.Key, b.Dx(), b.Dy())
+	return err
+}
+
+// Сохранение размеров и превью-хеша изображения
+func storeImageMetadata(db dbExecutor, key string, img image.Image) error {
+	b := img.Bounds()
+	_, err := db.Exec("UPDATE blobs SET width = $2, height = $3, blurhash = $4 WHERE key = $1",
+		key, b.Dx(), b.Dy(), encodeBlurhash(resizeToFit(img, 64), blurhashComponentsX, blurhashComponentsY))
+	return err
+}
+
+// Обработка аватара пользователя или группы: только изображения, пересжатие без EXIF
+// и набор уменьшенных копий. Возвращается нормализованный объект
+func storeAvatarImage(db dbExecutor, r io.Reader, fileName string) (blobInfo, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxAvatarSize+1))
+	if err != nil {
+		return blobInfo{}, err
+	}
+	if len(data) > maxAvatarSize {
+		return blobInfo{}, errBlobTooLarge
+	}
+	img, _, err := decodeImage(data)
+	if err != nil {
+		return blobInfo{}, err
+	}
+
+	normalized := resizeToFit(img, avatarMaxSide)
+	encoded, err := encodeJPEG(normalized)
+	if err != nil {
+		return blobInfo{}, err
+	}
+	blob, err := storeBlobBytes(db, encoded, "avatar.jpg")
+	if err != nil {
+		return blobInfo{}, err
+	}
+	if err := storeImageMetadata(db, blob.Key, normalized); err != nil {
+		return blobInfo{}, err
+	}
+	for _, size := range avatarSizes {
+		if err := storeImageVariant(db, blob.Key, size.name, normalized, size.maxSide); err != nil {
+			return blobInfo{}, err
+		}
+	}
+	return blob, nil
+}
+
+// Обработка изображения-вложения: удаление метаданных (EXIF с геолокацией и т.п.),
+// размеры, превью-хеш и миниатюра. Возвращает объект, который нужно прикрепить к сообщению
+func processImageAttachment(db dbExecutor, blob blobInfo, fileName string) (blobInfo, error) {
+	if !strings.HasPrefix(blob.MimeType, "image/") || blob.Size > maxImageProcessSize {
+		return blob, nil
+	}
+	object, err := blobStorage.Open(blob.Key)
+	if err != nil {
+		return blob, err
+	}
+	data, err := io.ReadAll(object)
+	object.Close()
+	if err != nil {
+		return blob, err
+	}
+
+	img, mimeType, err := decodeImage(data)
+	if errors.Is(err, errNotAnImage) {
+		// Файл с расширением картинки, но другим содержимым отдаётся как обычный файл
+		_, err = db.Exec("UPDATE blobs SET mime_type = $2 WHERE key = $1", blob.Key, "application/octet-stream")
+		blob.MimeType = "application/octet-stream"
+		return blob, err
+	}
+	if err != nil {
+		return blob, err
+	}
+
+	// Любое изображение пересохраняется: в копию попадают только пиксели
+	encoded, err := stripImageMetadata(data, img, mimeType)
+	if err != nil {
+		return blob, err
+	}
+	if blob, err = storeBlobBytes(db, encoded, fileName); err != nil {
+		return blob, err
+	}
+
+	if err := storeImageMetadata(db, blob.Key, img); err != nil {
+		return blob, err
+	}
+	if err := storeImageVariant(db, blob.Key, "thumb", img, thumbnailMaxSide); err != nil {
+		return blob, err
+	}
+	return blob, nil
+}
+
+// Копия изображения в исходном формате без метаданных: EXIF, XMP, ICC и комментариев JPEG (APPn, COM),
+// вспомогательных блоков PNG (eXIf, tEXt, iTXt и т.п.), расширений-комментариев GIF.
+// Ориентация JPEG уже применена к img; анимация GIF сохраняется
+func stripImageMetadata(data []byte, img image.Image, mimeType string) ([]byte, error) {
+	var buf bytes.Buffer
+	switch mimeType {
+	case "image/jpeg":
+		return encodeJPEG(img)
+	case "image/png":
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+	case "image/gif":
+		animation, err := gif.DecodeAll(bytes.NewReader(data))
+		if err != nil {
+			return nil, errNotAnImage
+		}
+		if err := gif.EncodeAll(&buf, animation); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errNotAnImage
+	}
+	return buf.Bytes(), nil
+}
+
+// Ответ клиенту при ошибке обработки аватара
+func writeImageError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errNotAnImage):
+		http.Error(w, "Only JPEG, PNG and GIF images are supported", http.StatusBadRequest)
+	case errors.Is(err, errBlobTooLarge):
+		http.Error(w, "Image too large", http.StatusRequestEntityTooLarge)
+	default:
+		log.Printf("Ошибка сохранения изображения: %v", err)
+		http.Error(w, "Error reading image", http.StatusBadRequest)
+	}
+}
+
+// Ключ и MIME-тип уменьшенной копии изображения, если она есть (иначе исходного объекта)
+func imageVariantKey(db queryRower, key, variant string) (string, string) {
+	var variantKey, mimeType string
+	err := db.QueryRow(`
+        SELECT b.key, COALESCE(b.mime_type, 'application/octet-stream')
+        FROM blobs b
+        WHERE b.key = COALESCE((SELECT variant_key FROM blob_variants WHERE blob_key = $1 AND variant = $2), $1)`,
+		key, variant).Scan(&variantKey, &mimeType)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Ошибка получения варианта %s объекта %s: %v", variant, key, err)
+		}
+		return key, "application/octet-stream"
+	}
+	return variantKey, mimeType
+}
+
+// Допустимые значения параметра size для изображений профиля и группы
+func validAvatarSize(size string) bool {
+	if size == "" {
+		return true
+	}
+	for _, s := range avatarSizes {
+		if s.name == size {
+			return true
+		}
+	}
+	return false
+}
+
+// Токен версии аватара для URL: часть хеша содержимого, для данных в БД — md5, вычисленный запросом.
+// Пустая строка, если изображения нет
+func imageVersionToken(imageKey, legacyHash sql.NullString) string {
+	switch {
+	case imageKey.Valid:
+		hash := imageKey.String[strings.LastIndex(imageKey.String, "/")+1:]
+		if len(hash) > 16 {
+			hash = hash[:16]
+		}
+		return hash
+	case legacyHash.Valid:
+		return legacyHash.String[:16]
+	default:
+		return ""
+	}
+}
+
+// Адрес аватара пользователя с токеном версии: при смене фото меняется и адрес
+func userImageURL(userID int, version string) string {
+	if version == "" {
+		return ""
+	}
+	return fmt.Sprintf("/user/image?id=%d&v=%s", userID, version)
+}
+
+// Адрес фото группы с номером версии
+func groupImageURL(chatID, version int) string {
+	return fmt.Sprintf("/group/image?chat_id=%d&v=%d", chatID, version)
+}
+
+// Заголовки кеширования изображения. Адрес с актуальной версией кешируется бессрочно,
+// без версии — с обязательной проверкой. Возвращает true, если клиенту отправлен 304
+func writeImageCacheHeaders(w http.ResponseWriter, r *http.Request, etag, version string, modTime time.Time) bool {
+	w.Header().Set("ETag", etag)
+	if !modTime.IsZero() {
+		w.Header().Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if v := r.URL.Query().Get("v"); v != "" && v == version {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "public, no-cache")
+	}
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// Проверка If-None-Match: список тегов через запятую или «*»; слабое сравнение, как требует RFC 9110
+func etagMatches(header, etag string) bool {
+	if header == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Blurhash — короткая строка, из которой клиент строит размытое превью до загрузки изображения
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func encodeBase83(value, length int) string {
+	var sb strings.Builder
+	for i := 1; i <= length; i++ {
+		digit := (value / int(math.Pow(83, float64(length-i)))) % 83
+		sb.WriteByte(base83Chars[digit])
+	}
+	return sb.String()
+}
+
+func srgbToLinear(v uint8) float64 {
+	f := float64(v) / 255
+	if f <= 0.04045 {
+		return f / 12.92
+	}
+	return math.Pow((f+0.055)/1.055, 2.4)
+}
+
+func linearToSRGB(v float64) int {
+	v = math.Max(0, math.Min(1, v))
+	if v <= 0.0031308 {
+		return int(v*12.92*255 + 0.5)
+	}
+	return int((1.055*math.Pow(v, 1/2.4)-0.055)*255 + 0.5)
+}
+
+func signPow(v, exp float64) float64 {
+	return math.Copysign(math.Pow(math.Abs(v), exp), v)
+}
+
+func encodeBlurhash(img image.Image, xComponents, yComponents int) string {
+	src := toNRGBA(img)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	factors := make([][3]float64, xComponents*yComponents)
+	for j := 0; j < yComponents; j++ {
+		for i := 0; i < xComponents; i++ {
+			normalisation := 2.0
+			if i == 0 && j == 0 {
+				normalisation = 1
+			}
+			var r, g, b float64
+			for y := 0; y < h; y++ {
+				for x := 0; x < w; x++ {
+					basis := math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) * math.Cos(math.Pi*float64(j)*float64(y)/float64(h))
+					p := src.PixOffset(x, y)
+					r += basis * srgbToLinear(src.Pix[p])
+					g += basis * srgbToLinear(src.Pix[p+1])
+					b += basis * srgbToLinear(src.Pix[p+2])
+				}
+			}
+			scale := normalisation / float64(w*h)
+			factors[j*xComponents+i] = [3]float64{r * scale, g * scale, b * scale}
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(encodeBase83((xComponents-1)+(yComponents-1)*9, 1))
+
+	maxValue := 1.0
+	if len(factors) > 1 {
+		actualMax := 0.0
+		for _, f := range factors[1:] {
+			for _, c := range f {
+				actualMax = math.Max(actualMax, math.Abs(c))
+			}
+		}
+		quantisedMax := int(math.Max(0, math.Min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantisedMax+1) / 166
+		sb.WriteString(encodeBase83(quantisedMax, 1))
+	} else {
+		sb.WriteString(encodeBase83(0, 1))
+	}
+
+	dc := factors[0]
+	sb.WriteString(encodeBase83(linearToSRGB(dc[0])<<16+linearToSRGB(dc[1])<<8+linearToSRGB(dc[2]), 4))
+	for _, f := range factors[1:] {
+		quant := func(v float64) int {
+			return int(math.Max(0, math.Min(18, math.Floor(signPow(v/maxValue, 0.5)*9+9.5))))
+		}
+		sb.WriteString(encodeBase83(quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2))
+	}
+	return sb.String()
+}
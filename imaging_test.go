@@ -0,0 +1,323 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Тестовое изображение w×h с различимыми пикселями
+func testImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x * 40), G: uint8(y * 40), B: 200, A: 255})
+		}
+	}
+	return img
+}
+
+// Блок TIFF (EXIF) с единственным тегом Orientation
+func testTIFF(order binary.ByteOrder, orientation uint16) []byte {
+	tiff := make([]byte, 26)
+	if order == binary.LittleEndian {
+		copy(tiff, "II")
+	} else {
+		copy(tiff, "MM")
+	}
+	order.PutUint16(tiff[2:], 42)
+	order.PutUint32(tiff[4:], 8)
+	order.PutUint16(tiff[8:], 1)
+	order.PutUint16(tiff[10:], 0x0112)
+	order.PutUint16(tiff[12:], 3)
+	order.PutUint32(tiff[14:], 1)
+	order.PutUint16(tiff[18:], orientation)
+	return tiff
+}
+
+// PNG с геолокацией в блоках eXIf и tEXt перед данными изображения
+func testGeotaggedPNG(t *testing.T) []byte {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, testImage(4, 3)); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	idat := bytes.Index(data, []byte("IDAT")) - 4
+	chunk := func(kind string, payload []byte) []byte {
+		out := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+		out = append(out, kind...)
+		out = append(out, payload...)
+		return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(append([]byte(kind), payload...)))
+	}
+	var tagged []byte
+	tagged = append(tagged, data[:idat]...)
+	tagged = append(tagged, chunk("eXIf", append(testTIFF(binary.BigEndian, 1), "GPS 55.7558N 37.6173E"...))...)
+	tagged = append(tagged, chunk("tEXt", []byte("GPSPosition\x0055.7558 N, 37.6173 E"))...)
+	tagged = append(tagged, data[idat:]...)
+	return tagged
+}
+
+// JPEG с EXIF-ориентацией и комментарием
+func testOrientedJPEG(t *testing.T, orientation uint16) []byte {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, testImage(4, 2), nil); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	segment := func(marker byte, payload []byte) []byte {
+		out := []byte{0xFF, marker}
+		out = binary.BigEndian.AppendUint16(out, uint16(len(payload)+2))
+		return append(out, payload...)
+	}
+	tagged := append([]byte{}, data[:2]...)
+	tagged = append(tagged, segment(0xE1, append([]byte("Exif\x00\x00"), testTIFF(binary.LittleEndian, orientation)...))...)
+	tagged = append(tagged, segment(0xFE, []byte("GPS 55.7558N 37.6173E"))...)
+	return append(tagged, data[2:]...)
+}
+
+func TestExifOrientation(t *testing.T) {
+	cases := []struct {
+		name string
+		tiff []byte
+		want int
+	}{
+		{"little endian", testTIFF(binary.LittleEndian, 6), 6},
+		{"big endian", testTIFF(binary.BigEndian, 8), 8},
+		{"out of range", testTIFF(binary.BigEndian, 9), 1},
+		{"truncated", testTIFF(binary.BigEndian, 6)[:16], 1},
+		{"bad byte order", append([]byte("XX"), testTIFF(binary.BigEndian, 6)[2:]...), 1},
+		{"empty", nil, 1},
+	}
+	for _, c := range cases {
+		if got := exifOrientation(c.tiff); got != c.want {
+			t.Errorf("%s: exifOrientation = %d, want %d", c.name, got, c.want)
+		}
+	}
+
+	noTag := testTIFF(binary.BigEndian, 6)
+	binary.BigEndian.PutUint16(noTag[10:], 0x010F)
+	if got := exifOrientation(noTag); got != 1 {
+		t.Errorf("without Orientation tag: %d, want 1", got)
+	}
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	if got := jpegOrientation(testOrientedJPEG(t, 6)); got != 6 {
+		t.Fatalf("jpegOrientation = %d, want 6", got)
+	}
+	if got := jpegOrientation([]byte("\x89PNG\r\n")); got != 1 {
+		t.Fatalf("not a JPEG: %d, want 1", got)
+	}
+	// Повреждённая длина сегмента не выводит за пределы данных
+	broken := testOrientedJPEG(t, 6)
+	broken[4], broken[5] = 0xFF, 0xFF
+	if got := jpegOrientation(broken); got != 1 {
+		t.Fatalf("broken segment: %d, want 1", got)
+	}
+
+	img, mimeType, err := decodeImage(testOrientedJPEG(t, 6))
+	if err != nil || mimeType != "image/jpeg" {
+		t.Fatalf("decodeImage: %v, %s", err, mimeType)
+	}
+	if b := img.Bounds(); b.Dx() != 2 || b.Dy() != 4 {
+		t.Fatalf("orientation 6 not applied: %v", b)
+	}
+}
+
+func TestStripImageMetadataPNG(t *testing.T) {
+	data := testGeotaggedPNG(t)
+	img, mimeType, err := decodeImage(data)
+	if err != nil {
+		t.Fatalf("geotagged PNG rejected: %v", err)
+	}
+	stripped, err := stripImageMetadata(data, img, mimeType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leak := range []string{"eXIf", "tEXt", "GPS"} {
+		if bytes.Contains(stripped, []byte(leak)) {
+			t.Fatalf("%s survived re-encoding", leak)
+		}
+	}
+	clean, err := png.Decode(bytes.NewReader(stripped))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if clean.Bounds() != img.Bounds() || clean.At(3, 2) != img.At(3, 2) {
+		t.Fatal("PNG pixels changed")
+	}
+}
+
+func TestStripImageMetadataJPEG(t *testing.T) {
+	data := testOrientedJPEG(t, 6)
+	img, mimeType, err := decodeImage(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped, err := stripImageMetadata(data, img, mimeType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stripped, []byte("Exif")) || bytes.Contains(stripped, []byte("GPS")) {
+		t.Fatal("JPEG metadata survived re-encoding")
+	}
+	// Ориентация применена к пикселям, повторно её применять не нужно
+	config, err := jpeg.DecodeConfig(bytes.NewReader(stripped))
+	if err != nil || config.Width != 2 || config.Height != 4 || jpegOrientation(stripped) != 1 {
+		t.Fatalf("re-encoded JPEG: %+v, %v", config, err)
+	}
+}
+
+func TestStripImageMetadataGIF(t *testing.T) {
+	frame := func(c uint8) *image.Paletted {
+		palette := color.Palette{color.Black, color.NRGBA{R: c, A: 255}}
+		img := image.NewPaletted(image.Rect(0, 0, 2, 2), palette)
+		img.SetColorIndex(1, 1, 1)
+		return img
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, &gif.GIF{Image: []*image.Paletted{frame(100), frame(200)}, Delay: []int{10, 10}}); err != nil {
+		t.Fatal(err)
+	}
+	// Расширение-комментарий сразу после логического экрана и глобальной палитры
+	data := buf.Bytes()
+	comment := append([]byte{0x21, 0xFE, 21}, "GPS 55.7558N 37.6173E"...)
+	comment = append(comment, 0)
+	header := 13
+	if data[10]&0x80 != 0 {
+		header += 3 << (data[10]&0x07 + 1)
+	}
+	tagged := append(append(append([]byte{}, data[:header]...), comment...), data[header:]...)
+
+	img, mimeType, err := decodeImage(tagged)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stripped, err := stripImageMetadata(tagged, img, mimeType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stripped, []byte("GPS")) {
+		t.Fatal("GIF comment survived re-encoding")
+	}
+	animation, err := gif.DecodeAll(bytes.NewReader(stripped))
+	if err != nil || len(animation.Image) != 2 {
+		t.Fatalf("animation lost: %v", err)
+	}
+}
+
+// Вложение-картинка сохраняется новым объектом без метаданных
+func TestProcessImageAttachmentStripsPNGMetadata(t *testing.T) {
+	store, err := newLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := blobStorage
+	blobStorage = store
+	t.Cleanup(func() { blobStorage = previous })
+	db, _ := newFakeDB(t)
+
+	original, err := storeBlobBytes(db, testGeotaggedPNG(t), "photo.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	processed, err := processImageAttachment(db, original, "photo.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if processed.Key == original.Key || processed.MimeType != "image/png" {
+		t.Fatalf("processed blob %+v, original %+v", processed, original)
+	}
+	object, err := blobStorage.Open(processed.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer object.Close()
+	stored, err := io.ReadAll(object)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(stored, []byte("GPS")) || bytes.Contains(stored, []byte("eXIf")) {
+		t.Fatal("stored attachment keeps the location")
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	const etag = `"group-7-v2"`
+	cases := map[string]bool{
+		"":                             false,
+		`"group-7-v2"`:                 true,
+		`W/"group-7-v2"`:               true,
+		`"group-7-v1", "group-7-v2"`:   true,
+		`*`:                            true,
+		`"group-7-v1"`:                 false,
+		`group-7-v2`:                   false,
+		`"group-7-v1",W/"group-7-v20"`: false,
+	}
+	for header, want := range cases {
+		if got := etagMatches(header, etag); got != want {
+			t.Errorf("etagMatches(%q) = %v, want %v", header, got, want)
+		}
+	}
+}
+
+// Адрес с актуальной версией кешируется бессрочно, иначе — с проверкой; совпавший ETag даёт 304
+func TestWriteImageCacheHeaders(t *testing.T) {
+	modTime := time.Date(2026, 3, 1, 12, 0, 0, 0, time.FixedZone("MSK", 3*60*60))
+	cases := []struct {
+		target      string
+		ifNoneMatch string
+		cache       string
+		notModified bool
+	}{
+		{"/group/image?chat_id=7&v=2", "", "public, max-age=31536000, immutable", false},
+		{"/group/image?chat_id=7&v=1", "", "public, no-cache", false},
+		{"/group/image?chat_id=7", "", "public, no-cache", false},
+		{"/group/image?chat_id=7", `"group-7-v2"`, "public, no-cache", true},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", c.target, nil)
+		if c.ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", c.ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		notModified := writeImageCacheHeaders(rec, req, groupImageETag(7, 2), "2", modTime)
+		if notModified != c.notModified || rec.Header().Get("Cache-Control") != c.cache {
+			t.Errorf("%s: 304 %v, Cache-Control %q", c.target, notModified, rec.Header().Get("Cache-Control"))
+		}
+		if c.notModified && rec.Code != http.StatusNotModified {
+			t.Errorf("%s: status %d, want 304", c.target, rec.Code)
+		}
+		if rec.Header().Get("ETag") != `"group-7-v2"` || rec.Header().Get("Last-Modified") != "Sun, 01 Mar 2026 09:00:00 GMT" {
+			t.Errorf("%s: headers %v", c.target, rec.Header())
+		}
+	}
+}
+
+func TestImageVersionToken(t *testing.T) {
+	key := sql.NullString{String: "sha256/ab/abcdef0123456789abcdef", Valid: true}
+	legacy := sql.NullString{String: "0123456789abcdef0123456789abcdef", Valid: true}
+	if got := imageVersionToken(key, legacy); got != "abcdef0123456789" {
+		t.Fatalf("blob version %q", got)
+	}
+	if got := imageVersionToken(sql.NullString{}, legacy); got != "0123456789abcdef" {
+		t.Fatalf("legacy version %q", got)
+	}
+	if got := imageVersionToken(sql.NullString{}, sql.NullString{}); got != "" || userImageURL(1, got) != "" {
+		t.Fatalf("no image: version %q, url %q", got, userImageURL(1, got))
+	}
+	if got := userImageURL(5, "abc"); got != "/user/image?id=5&v=abc" {
+		t.Fatalf("userImageURL = %q", got)
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Входящие вебхуки: интеграции (CI и т.п.) публикуют сообщения в группу по секретному адресу.
+// У каждого вебхука своя учётная запись-бот (users.is_bot), от имени которой сохраняются сообщения
+const (
+	incomingWebhookPath        = "/webhooks/incoming/"
+	maxIncomingWebhookBody     = 16 << 20 // Тело запроса с вложением в base64
+	maxIncomingAttachment      = 10 << 20 // Размер вложения после декодирования
+	maxIncomingWebhooksPerChat = 10
+	maxIncomingWebhookName     = 64
+)
+
+// Входящий вебхук; токен возвращается только при создании
+type incomingWebhook struct {
+	ID         int        `json:"id"`
+	ChatID     int        `json:"chat_id"`
+	BotUserID  int        `json:"bot_user_id"`
+	Name       string     `json:"name"`
+	CreatedBy  *int       `json:"created_by,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	Token      string     `json:"token,omitempty"`
+	URL        string     `json:"url,omitempty"`
+}
+
+// Тело запроса к входящему вебхуку
+type incomingWebhookMessage struct {
+	Text       string          `json:"text"`
+	ParseMode  string          `json:"parse_mode"`
+	Entities   []messageEntity `json:"entities"`
+	Attachment *struct {
+		FileName string `json:"file_name"`
+		Kind     string `json:"kind"`
+		Data     string `json:"data"` // Содержимое файла в base64
+	} `json:"attachment"`
+}
+
+// В БД хранится только хеш секретного токена (входящие вебхуки, боты): утечка таблицы не даёт доступа
+func secretTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Учётная запись-бот для интеграции. Вход по паролю для ботов невозможен
+func createBotUser(db dbExecutor, name string) (int, error) {
+	handle, err := newUploadID()
+	if err != nil {
+		return 0, err
+	}
+	var userID int
+	err = db.QueryRow(`
+        INSERT INTO users (username, password, name, is_bot)
+        VALUES ($1, '!', $2, TRUE)
+        RETURNING id`, "bot_"+handle[:12], name,
+	).Scan(&userID)
+	return userID, err
+}
+
+// Вебхуки создаются только для групп, управлять ими могут администраторы группы
+func canManageIncomingWebhooks(db queryRower, chatID, userID int) (bool, error) {
+	var isGroup bool
+	err := db.QueryRow("SELECT is_group FROM chats WHERE id = $1", chatID).Scan(&isGroup)
+	if err == sql.ErrNoRows || (err == nil && !isGroup) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return canManageWebhooks(db, chatID, userID)
+}
+
+// Входящие вебхуки группы: список (GET ?user_id&chat_id), создание (POST {user_id, chat_id, name})
+// и удаление (DELETE ?user_id&id). Сообщения, уже опубликованные вебхуком, остаются в истории
+func incomingWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	switch r.Method {
+	case "GET":
+		userID, errUser := strconv.Atoi(r.URL.Query().Get("user_id"))
+		chatID, errChat := strconv.Atoi(r.URL.Query().Get("chat_id"))
+		if errUser != nil || errChat != nil {
+			http.Error(w, "User ID and chat ID are required", http.StatusBadRequest)
+			return
+		}
+		if allowed, err := canManageIncomingWebhooks(db, chatID, userID); err != nil || !allowed {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		rows, err := db.Query(`
+            SELECT id, chat_id, bot_user_id, name, created_by, created_at, last_used_at
+            FROM incoming_webhooks WHERE chat_id = $1 ORDER BY id`, chatID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		hooks := []incomingWebhook{}
+		for rows.Next() {
+			var (
+				hook       incomingWebhook
+				createdBy  sql.NullInt64
+				lastUsedAt sql.NullTime
+			)
+			if err := rows.Scan(&hook.ID, &hook.ChatID, &hook.BotUserID, &hook.Name, &createdBy, &hook.CreatedAt, &lastUsedAt); err != nil {
+				log.Printf("Ошибка чтения входящего вебхука: %v", err)
+				continue
+			}
+			if createdBy.Valid {
+				id := int(createdBy.Int64)
+				hook.CreatedBy = &id
+			}
+			if lastUsedAt.Valid {
+				hook.LastUsedAt = &lastUsedAt.Time
+			}
+			hooks = append(hooks, hook)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hooks)
+
+	case "POST":
+		var data struct {
+			UserID int    `json:"user_id"`
+			ChatID int    `json:"chat_id"`
+			Name   string `json:"name"` // Имя отправителя сообщений
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		data.Name = strings.TrimSpace(sanitizeMessageText(data.Name))
+		if data.Name == "" || utf8.RuneCountInString(data.Name) > maxIncomingWebhookName {
+			http.Error(w, "Invalid name", http.StatusBadRequest)
+			return
+		}
+		if allowed, err := canManageIncomingWebhooks(db, data.ChatID, data.UserID); err != nil || !allowed {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM incoming_webhooks WHERE chat_id = $1", data.ChatID).Scan(&count); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if count >= maxIncomingWebhooksPerChat {
+			http.Error(w, "Too many webhooks", http.StatusConflict)
+			return
+		}
+
+		token, err := newWebhookSecret()
+		if err != nil {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		botUserID, err := createBotUser(tx, data.Name)
+		if err != nil {
+			log.Printf("Ошибка создания учётной записи вебхука: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		hook := incomingWebhook{ChatID: data.ChatID, BotUserID: botUserID, Name: data.Name, CreatedBy: &data.UserID}
+		err = tx.QueryRow(`
+            INSERT INTO incoming_webhooks (chat_id, bot_user_id, name, token_hash, created_by)
+            VALUES ($1, $2, $3, $4, $5)
+            RETURNING id, created_at`, data.ChatID, botUserID, data.Name, secretTokenHash(token), data.UserID,
+		).Scan(&hook.ID, &hook.CreatedAt)
+		if err != nil {
+			log.Printf("Ошибка создания входящего вебхука: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		// Адрес с токеном показывается один раз
+		hook.Token = token
+		hook.URL = incomingWebhookPath + token
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(hook)
+
+	case "DELETE":
+		userID, errUser := strconv.Atoi(r.URL.Query().Get("user_id"))
+		webhookID, errHook := strconv.Atoi(r.URL.Query().Get("id"))
+		if errUser != nil || errHook != nil {
+			http.Error(w, "User ID and webhook ID are required", http.StatusBadRequest)
+			return
+		}
+		var chatID int
+		err := db.QueryRow("SELECT chat_id FROM incoming_webhooks WHERE id = $1", webhookID).Scan(&chatID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if allowed, err := canManageIncomingWebhooks(db, chatID, userID); err != nil || !allowed {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		// Учётная запись-бот остаётся, чтобы в истории сохранилось имя отправителя
+		if _, err := db.Exec("DELETE FROM incoming_webhooks WHERE id = $1", webhookID); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Публикация сообщения: POST /webhooks/incoming/<token> с JSON {text, parse_mode, entities, attachment}.
+// Сообщение проходит тот же путь, что и сообщения из WebSocket
+func incomingWebhookPostHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	token := strings.TrimPrefix(r.URL.Path, incomingWebhookPath)
+	if token == "" || strings.Contains(token, "/") {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+
+	var data incomingWebhookMessage
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxIncomingWebhookBody)).Decode(&data); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(data.Text) == "" && data.Attachment == nil {
+		http.Error(w, "Text or attachment is required", http.StatusBadRequest)
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var webhookID, chatID, botUserID int
+	err = db.QueryRow(`
+        UPDATE incoming_webhooks SET last_used_at = CURRENT_TIMESTAMP
+        WHERE token_hash = $1
+        RETURNING id, chat_id, bot_user_id`, secretTokenHash(token),
+	).Scan(&webhookID, &chatID, &botUserID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	msg := chatMessage{ChatID: chatID, UserID: botUserID, Text: data.Text, ParseMode: data.ParseMode, Entities: data.Entities}
+	if data.Attachment != nil {
+		attachmentID, status, err := storeIncomingAttachment(db, botUserID, data.Attachment.FileName, data.Attachment.Kind, data.Attachment.Data)
+		if err != nil {
+			log.Printf("Вложение входящего вебхука %d отклонено: %v", webhookID, err)
+			http.Error(w, err.Error(), status)
+			return
+		}
+		msg.AttachmentIDs = []string{attachmentID}
+	}
+
+	messageID, err := sendChatMessage(msg, nil)
+	if err != nil {
+		if isMessageValidationError(err) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		http.Error(w, "Failed to send message", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{"message_id": messageID, "chat_id": chatID})
+}
+
+// Сохранение вложения из base64 как ожидающего отправки; возвращает ID вложения или ошибку с HTTP-статусом
+func storeIncomingAttachment(db *sql.DB, botUserID int, fileName, kindValue, encoded string) (string, int, error) {
+	kind, ok := parseAttachmentKind(kindValue)
+	if !ok || strings.TrimSpace(fileName) == "" {
+		return "", http.StatusBadRequest, errors.New("invalid attachment")
+	}
+	content, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(content) == 0 {
+		return "", http.StatusBadRequest, errors.New("attachment data must be base64")
+	}
+	if len(content) > maxIncomingAttachment {
+		return "", http.StatusRequestEntityTooLarge, errBlobTooLarge
+	}
+	fileName = clientFileName(fileName)
+
+	blob, err := storeBlobBytes(db, content, fileName)
+	if err != nil {
+		return "", http.StatusInternalServerError, errors.New("unable to store attachment")
+	}
+	if kind == attachmentKindVoice {
+		blob, err = processVoiceAttachment(db, blob)
+	} else {
+		blob, err = processImageAttachment(db, blob, fileName)
+	}
+	if errors.Is(err, errInvalidVoice) {
+		return "", http.StatusUnsupportedMediaType, err
+	}
+	if err != nil {
+		return "", http.StatusInternalServerError, errors.New("unable to process attachment")
+	}
+	attachmentID, _, err := createPendingAttachment(db, botUserID, kind, fileName, blob)
+	if err != nil {
+		return "", http.StatusInternalServerError, errors.New("unable to store attachment")
+	}
+	return attachmentID, 0, nil
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/base64"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSecretTokenHash(t *testing.T) {
+	hash := secretTokenHash("secret")
+	if len(hash) != 64 || hash != secretTokenHash("secret") || hash == secretTokenHash("Secret") {
+		t.Fatalf("secretTokenHash = %q", hash)
+	}
+	if strings.Contains(hash, "secret") {
+		t.Fatal("token stored in plain text")
+	}
+}
+
+// Бот получает случайный логин и пароль, с которым войти невозможно
+func TestCreateBotUser(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.on("INSERT INTO users", func([]driver.Value) fakeResult {
+		return fakeRow(int64(42))
+	})
+	userID, err := createBotUser(db, "CI")
+	if err != nil || userID != 42 {
+		t.Fatalf("createBotUser = %d, %v", userID, err)
+	}
+	q := fake.queries("INSERT INTO users")[0]
+	username, _ := q.args[0].(string)
+	if !strings.HasPrefix(username, "bot_") || len(username) != len("bot_")+12 || q.args[1] != "CI" {
+		t.Fatalf("bot user args: %v", q.args)
+	}
+	if !strings.Contains(q.query, "'!'") || !strings.Contains(q.query, "is_bot") {
+		t.Fatalf("bot user query: %s", q.query)
+	}
+}
+
+// Вебхуки есть только у групп; в группе ими управляют администраторы
+func TestCanManageIncomingWebhooks(t *testing.T) {
+	cases := []struct {
+		name    string
+		isGroup driver.Value // nil — чата нет
+		admin   bool
+		want    bool
+	}{
+		{"missing chat", nil, true, false},
+		{"direct chat", false, true, false},
+		{"group member", true, false, false},
+		{"group admin", true, true, true},
+	}
+	for _, c := range cases {
+		db, fake := newFakeDB(t)
+		fake.on("SELECT is_group FROM chats WHERE id = $1", func([]driver.Value) fakeResult {
+			if c.isGroup == nil {
+				return fakeResult{}
+			}
+			return fakeRow(c.isGroup)
+		})
+		fake.on("SELECT c.is_group FROM chats c", func([]driver.Value) fakeResult {
+			return fakeRow(true)
+		})
+		fake.on("p.is_admin OR gc.created_by", func([]driver.Value) fakeResult {
+			return fakeRow(c.admin)
+		})
+		if got, err := canManageIncomingWebhooks(db, 10, 1); err != nil || got != c.want {
+			t.Errorf("%s: %v, %v, want %v", c.name, got, err, c.want)
+		}
+	}
+}
+
+func TestIncomingWebhookPostHandlerValidation(t *testing.T) {
+	cases := []struct {
+		method string
+		path   string
+		body   string
+		want   int
+	}{
+		{"GET", incomingWebhookPath + "token", "", http.StatusMethodNotAllowed},
+		{"POST", incomingWebhookPath, `{"text":"hi"}`, http.StatusNotFound},
+		{"POST", incomingWebhookPath + "token/extra", `{"text":"hi"}`, http.StatusNotFound},
+		{"POST", incomingWebhookPath + "token", `{`, http.StatusBadRequest},
+		{"POST", incomingWebhookPath + "token", `{"text":"  "}`, http.StatusBadRequest},
+		{"POST", incomingWebhookPath + "token", `{"text":"` + strings.Repeat("a", maxIncomingWebhookBody) + `"}`, http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		incomingWebhookPostHandler(rec, httptest.NewRequest(c.method, c.path, strings.NewReader(c.body)))
+		if rec.Code != c.want {
+			t.Errorf("%s %s (%d bytes): status %d, want %d", c.method, c.path, len(c.body), rec.Code, c.want)
+		}
+	}
+}
+
+// Неверное вложение отклоняется до записи в хранилище
+func TestStoreIncomingAttachmentRejects(t *testing.T) {
+	db, fake := newFakeDB(t)
+	valid := base64.StdEncoding.EncodeToString([]byte("data"))
+	cases := []struct {
+		name, fileName, kind, data string
+		want                       int
+	}{
+		{"unknown kind", "a.txt", "video", valid, http.StatusBadRequest},
+		{"empty name", " ", "", valid, http.StatusBadRequest},
+		{"not base64", "a.txt", "", "!!!", http.StatusBadRequest},
+		{"empty data", "a.txt", "", "", http.StatusBadRequest},
+		{"too large", "a.txt", "", base64.StdEncoding.EncodeToString(make([]byte, maxIncomingAttachment+1)), http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		if _, status, err := storeIncomingAttachment(db, 42, c.fileName, c.kind, c.data); err == nil || status != c.want {
+			t.Errorf("%s: status %d, %v, want %d", c.name, status, err, c.want)
+		}
+	}
+	if n := len(fake.queries("")); n != 0 {
+		t.Fatalf("rejected attachment reached the database: %d queries", n)
+	}
+}
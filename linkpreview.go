@@ -0,0 +1,464 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Превью ссылок: при отправке сообщения из текста берётся первая ссылка, страница загружается
+// в фоне, метаданные Open Graph/HTML кешируются по адресу и прикрепляются к сообщению
+const (
+	linkPreviewTimeout      = 5 * time.Second
+	linkPreviewMaxBody      = 1 << 20 // Читается не больше 1 МБ страницы
+	linkPreviewMaxRedirects = 3
+	linkPreviewTTL          = 24 * time.Hour // Срок жизни успешно полученного превью
+	linkPreviewFailureTTL   = time.Hour      // Повторная попытка для страниц без превью
+	linkPreviewWorkers      = 4              // Одновременных загрузок страниц
+	maxPreviewTitle         = 300
+	maxPreviewDescription   = 1000
+	maxPreviewSiteName      = 100
+)
+
+var (
+	errBlockedAddress = errors.New("address is not allowed")
+	errNoPreview      = errors.New("page has no preview metadata")
+)
+
+// Превью ссылки в том виде, в котором оно отдаётся клиенту
+type linkPreview struct {
+	URL         string `json:"url"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+	ImageURL    string `json:"image_url,omitempty"`
+	SiteName    string `json:"site_name,omitempty"`
+}
+
+// Источник превью. Основная реализация ходит по HTTP; для проверки можно подставить свою
+type previewFetcher interface {
+	Fetch(ctx context.Context, rawURL string) (linkPreview, error)
+}
+
+// Текущий источник превью (nil — превью отключены)
+var linkPreviewFetcher previewFetcher
+
+var (
+	linkPreviewSlots   = make(chan struct{}, linkPreviewWorkers)
+	linkPreviewLocksMu sync.Mutex
+	linkPreviewLocks   = make(map[string]*linkPreviewLock) // Один адрес загружается только одной горутиной
+)
+
+// Блокировка загрузки одного адреса. Запись удаляется из linkPreviewLocks, когда её отпускает
+// последний ожидающий, иначе следующая горутина создала бы вторую блокировку для того же адреса
+type linkPreviewLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// Настройка по переменным окружения: LINK_PREVIEWS=off отключает превью,
+// LINK_PREVIEW_ALLOWED_ADDRS — адреса ip:port, разрешённые несмотря на защиту от SSRF
+// (например, локальный тестовый HTTP-сервер)
+func initLinkPreviews() {
+	if os.Getenv("LINK_PREVIEWS") == "off" {
+		return
+	}
+	linkPreviewFetcher = newHTTPPreviewFetcher(parseAllowedAddrs(os.Getenv("LINK_PREVIEW_ALLOWED_ADDRS")))
+}
+
+// Загрузка превью по HTTP с защитой от обращений к внутренним адресам
+type httpPreviewFetcher struct {
+	client *http.Client
+}
+
+func newHTTPPreviewFetcher(allowedAddrs map[string]bool) *httpPreviewFetcher {
+	return &httpPreviewFetcher{client: &http.Client{
+		Transport: newRestrictedTransport(allowedAddrs, linkPreviewTimeout),
+		Timeout:   linkPreviewTimeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= linkPreviewMaxRedirects {
+				return errors.New("too many redirects")
+			}
+			if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+				return fmt.Errorf("%w: %s", errBlockedAddress, req.URL.Scheme)
+			}
+			return nil
+		},
+	}}
+}
+
+// Транспорт для запросов по адресам, заданным пользователями (превью ссылок, вебхуки).
+// Адрес проверяется в момент подключения, уже после разрешения имени:
+// так не помогают ни перенаправления, ни подмена DNS-ответа
+func newRestrictedTransport(allowedAddrs map[string]bool, timeout time.Duration) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if allowedAddrs[address] {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isBlockedIP(ip) {
+				return fmt.Errorf("%w: %s", errBlockedAddress, address)
+			}
+			return nil
+		},
+	}
+	return &http.Transport{
+		Proxy:                 nil, // Прокси из окружения обошёл бы проверку адресов
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   timeout,
+		ResponseHeaderTimeout: timeout,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	}
+}
+
+// Список адресов ip:port из переменной окружения
+func parseAllowedAddrs(value string) map[string]bool {
+	allowed := make(map[string]bool)
+	for _, addr := range strings.Split(value, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			allowed[addr] = true
+		}
+	}
+	return allowed
+}
+
+// Диапазоны, не входящие в проверки net.IP: CGNAT, служебные, тестовые и NAT64
+var blockedNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range []string{"0.0.0.0/8", "100.64.0.0/10", "192.0.0.0/24", "198.18.0.0/15", "240.0.0.0/4", "64:ff9b::/96"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		networks = append(networks, network)
+	}
+	return networks
+}()
+
+// Частные, локальные, групповые и служебные адреса запрещены
+func isBlockedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+	for _, network := range blockedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *httpPreviewFetcher) Fetch(ctx context.Context, rawURL string) (linkPreview, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return linkPreview{}, err
+	}
+	req.Header.Set("User-Agent", "MessengerLinkPreview/1.0")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return linkPreview{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return linkPreview{}, fmt.Errorf("HTTP %s", resp.Status)
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return linkPreview{}, errNoPreview
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, linkPreviewMaxBody))
+	if err != nil {
+		return linkPreview{}, err
+	}
+	// Относительные адреса изображений считаются от конечного адреса после перенаправлений
+	preview := parseHTMLPreview(body, resp.Request.URL)
+	if preview.Title == "" && preview.Description == "" {
+		return linkPreview{}, errNoPreview
+	}
+	preview.URL = rawURL
+	return preview, nil
+}
+
+var (
+	htmlMetaPattern  = regexp.MustCompile(`(?is)<meta\s[^>]*>`)
+	htmlAttrPattern  = regexp.MustCompile(`(?is)([a-z_:.-]+)\s*=\s*(?:"([^"]*)"|'([^']*)'|([^\s"'>]+))`)
+	htmlTitlePattern = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	whitespaceRun    = regexp.MustCompile(`\s+`)
+)
+
+// Разбор метаданных страницы: Open Graph, Twitter Cards, затем обычные title и description
+func parseHTMLPreview(body []byte, base *url.URL) linkPreview {
+	page := strings.ToValidUTF8(string(body), "")
+	if end := strings.Index(strings.ToLower(page), "</head>"); end >= 0 {
+		page = page[:end]
+	}
+
+	meta := make(map[string]string)
+	for _, tag := range htmlMetaPattern.FindAllString(page, -1) {
+		attrs := make(map[string]string)
+		for _, m := range htmlAttrPattern.FindAllStringSubmatch(tag, -1) {
+			attrs[strings.ToLower(m[1])] = m[2] + m[3] + m[4]
+		}
+		key := strings.ToLower(attrs["property"])
+		if key == "" {
+			key = strings.ToLower(attrs["name"])
+		}
+		if _, seen := meta[key]; key != "" && !seen {
+			meta[key] = cleanPreviewText(attrs["content"], maxPreviewDescription)
+		}
+	}
+	first := func(keys ...string) string {
+		for _, key := range keys {
+			if value := meta[key]; value != "" {
+				return value
+			}
+		}
+		return ""
+	}
+
+	preview := linkPreview{
+		Title:       first("og:title", "twitter:title"),
+		Description: first("og:description", "twitter:description", "description"),
+		SiteName:    first("og:site_name"),
+	}
+	if preview.Title == "" {
+		if m := htmlTitlePattern.FindStringSubmatch(page); m != nil {
+			preview.Title = cleanPreviewText(m[1], maxPreviewTitle)
+		}
+	}
+	preview.Title = truncateRunes(preview.Title, maxPreviewTitle)
+	preview.SiteName = truncateRunes(preview.SiteName, maxPreviewSiteName)
+	if image := first("og:image:secure_url", "og:image:url", "og:image", "twitter:image"); image != "" {
+		if ref, err := url.Parse(image); err == nil {
+			resolved := base.ResolveReference(ref)
+			if (resolved.Scheme == "http" || resolved.Scheme == "https") && len(resolved.String()) <= maxEntityURLLength {
+				preview.ImageURL = resolved.String()
+			}
+		}
+	}
+	return preview
+}
+
+// Декодирование HTML-сущностей, схлопывание пробелов и ограничение длины
+func cleanPreviewText(s string, limit int) string {
+	s = strings.TrimSpace(whitespaceRun.ReplaceAllString(html.UnescapeString(s), " "))
+	return truncateRunes(sanitizeMessageText(s), limit)
+}
+
+func truncateRunes(s string, limit int) string {
+	if runes := []rune(s); len(runes) > limit {
+		return string(runes[:limit])
+	}
+	return s
+}
+
+var messageURLPattern = regexp.MustCompile(`(?i)https?://[^\s<>"']+`)
+
+// Адрес для превью: первая ссылка из форматирования или из текста сообщения
+func extractPreviewURL(text string, entities []messageEntity) string {
+	candidates := make([]string, 0, 2)
+	for _, e := range entities {
+		if e.Type == "link" {
+			candidates = append(candidates, e.URL)
+			break
+		}
+	}
+	if found := messageURLPattern.FindString(text); found != "" {
+		candidates = append(candidates, strings.TrimRight(found, ".,;:!?)]}"))
+	}
+	for _, candidate := range candidates {
+		u, err := url.Parse(candidate)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			continue
+		}
+		// Фрагмент не влияет на содержимое страницы и не участвует в ключе кеша
+		u.Fragment = ""
+		if normalized := u.String(); len(normalized) <= maxEntityURLLength {
+			return normalized
+		}
+	}
+	return ""
+}
+
+// Фоновое построение превью для отправленного сообщения
+func scheduleLinkPreview(messageID, chatID int, rawURL string) {
+	if linkPreviewFetcher == nil || rawURL == "" {
+		return
+	}
+	// Место занимается до запуска горутины: при всплеске сообщений со ссылками
+	// лишние превью пропускаются, а не копятся в ожидающих горутинах
+	select {
+	case linkPreviewSlots <- struct{}{}:
+	default:
+		log.Printf("Превью для сообщения %d пропущено: все загрузчики заняты", messageID)
+		return
+	}
+	go func() {
+		defer func() { <-linkPreviewSlots }()
+		attachLinkPreview(messageID, chatID, rawURL)
+	}()
+}
+
+func attachLinkPreview(messageID, chatID int, rawURL string) {
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("Превью: ошибка подключения к БД: %v", err)
+		return
+	}
+	defer db.Close()
+
+	preview, err := getLinkPreview(db, rawURL)
+	if err != nil {
+		log.Printf("Превью для %s не получено: %v", rawURL, err)
+		return
+	}
+
+	// Сообщение могли удалить, пока загружалась страница
+	result, err := db.Exec("UPDATE messages SET preview_url = $2 WHERE id = $1 AND NOT is_deleted", messageID, rawURL)
+	if err != nil {
+		log.Printf("Ошибка сохранения превью сообщения %d: %v", messageID, err)
+		return
+	}
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return
+	}
+
+	participantIDs, err := getChatParticipantIDs(db, chatID)
+	if err != nil {
+		log.Printf("Ошибка получения участников чата %d: %v", chatID, err)
+		return
+	}
+	broadcastToUsers(participantIDs, map[string]interface{}{
+		"type":       "message_preview",
+		"chat_id":    chatID,
+		"message_id": messageID,
+		"preview":    preview,
+	})
+}
+
+// Захват блокировки адреса; возвращает функцию освобождения
+func lockLinkPreview(rawURL string) func() {
+	linkPreviewLocksMu.Lock()
+	lock := linkPreviewLocks[rawURL]
+	if lock == nil {
+		lock = &linkPreviewLock{}
+		linkPreviewLocks[rawURL] = lock
+	}
+	lock.waiters++
+	linkPreviewLocksMu.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		linkPreviewLocksMu.Lock()
+		lock.waiters--
+		if lock.waiters == 0 {
+			delete(linkPreviewLocks, rawURL)
+		}
+		linkPreviewLocksMu.Unlock()
+	}
+}
+
+// Превью из кеша или загруженное заново. Неудачные попытки тоже кешируются, чтобы не
+// обращаться к странице при каждом сообщении с той же ссылкой
+func getLinkPreview(db *sql.DB, rawURL string) (linkPreview, error) {
+	defer lockLinkPreview(rawURL)()
+
+	preview := linkPreview{URL: rawURL}
+	var (
+		ok         bool
+		ageSeconds float64
+	)
+	// Возраст записи считается на стороне БД, чтобы не зависеть от часов и часового пояса сервера
+	err := db.QueryRow(`
+        SELECT ok, EXTRACT(EPOCH FROM CURRENT_TIMESTAMP - fetched_at)::float8,
+               COALESCE(title, ''), COALESCE(description, ''), COALESCE(image_url, ''), COALESCE(site_name, '')
+        FROM link_previews
+        WHERE url = $1`, rawURL,
+	).Scan(&ok, &ageSeconds, &preview.Title, &preview.Description, &preview.ImageURL, &preview.SiteName)
+	if err != nil && err != sql.ErrNoRows {
+		return linkPreview{}, err
+	}
+	if err == nil && linkPreviewCacheFresh(ok, time.Duration(ageSeconds*float64(time.Second))) {
+		if !ok {
+			return linkPreview{}, errNoPreview
+		}
+		return preview, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), linkPreviewTimeout)
+	defer cancel()
+	preview, fetchErr := linkPreviewFetcher.Fetch(ctx, rawURL)
+	_, err = db.Exec(`
+        INSERT INTO link_previews (url, ok, title, description, image_url, site_name, fetched_at)
+        VALUES ($1, $2, NULLIF($3, ''), NULLIF($4, ''), NULLIF($5, ''), NULLIF($6, ''), CURRENT_TIMESTAMP)
+        ON CONFLICT (url) DO UPDATE SET ok = $2, title = NULLIF($3, ''), description = NULLIF($4, ''),
+            image_url = NULLIF($5, ''), site_name = NULLIF($6, ''), fetched_at = CURRENT_TIMESTAMP`,
+		rawURL, fetchErr == nil, preview.Title, preview.Description, preview.ImageURL, preview.SiteName)
+	if err != nil {
+		log.Printf("Ошибка сохранения превью %s: %v", rawURL, err)
+	}
+	return preview, fetchErr
+}
+
+// Запись кеша действительна сутки, неудачная попытка — час
+func linkPreviewCacheFresh(ok bool, age time.Duration) bool {
+	if ok {
+		return age < linkPreviewTTL
+	}
+	return age < linkPreviewFailureTTL
+}
+
+// Загрузка превью ссылок для набора сообщений
+func loadLinkPreviews(db *sql.DB, messageIDs []int) (map[int]linkPreview, error) {
+	result := make(map[int]linkPreview)
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+
+	rows, err := db.Query(`
+        SELECT m.id, lp.url, COALESCE(lp.title, ''), COALESCE(lp.description, ''),
+               COALESCE(lp.image_url, ''), COALESCE(lp.site_name, '')
+        FROM messages m
+        JOIN link_previews lp ON lp.url = m.preview_url AND lp.ok
+        WHERE m.id = ANY($1) AND NOT m.is_deleted`, pq.Array(intsToInt64(messageIDs)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			messageID int
+			preview   linkPreview
+		)
+		if err := rows.Scan(&messageID, &preview.URL, &preview.Title, &preview.Description, &preview.ImageURL, &preview.SiteName); err != nil {
+			log.Printf("Ошибка чтения превью: %v", err)
+			continue
+		}
+		result[messageID] = preview
+	}
+	return result, rows.Err()
+}
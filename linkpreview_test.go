@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Локальный сервер доступен только при явном разрешении его адреса, как LINK_PREVIEW_ALLOWED_ADDRS
+func allowServer(server *httptest.Server) map[string]bool {
+	return parseAllowedAddrs(server.Listener.Addr().String())
+}
+
+func TestParseHTMLPreviewOpenGraph(t *testing.T) {
+	base, _ := url.Parse("https://example.com/articles/1")
+	page := `<html><head>
+		<title>Fallback title</title>
+		<meta property="og:title" content="Open &amp; Graph">
+		<meta name='description' content='  Plain
+			description '>
+		<meta property="og:site_name" content=Example>
+		<meta property="og:image" content="/img/cover.png">
+		</head><body><meta property="og:description" content="after head"></body></html>`
+
+	preview := parseHTMLPreview([]byte(page), base)
+	want := linkPreview{
+		Title:       "Open & Graph",
+		Description: "Plain description",
+		SiteName:    "Example",
+		ImageURL:    "https://example.com/img/cover.png",
+	}
+	if preview != want {
+		t.Fatalf("got %+v, want %+v", preview, want)
+	}
+}
+
+func TestParseHTMLPreviewTitleFallback(t *testing.T) {
+	base, _ := url.Parse("http://example.com/")
+	preview := parseHTMLPreview([]byte("<HTML><HEAD><Title lang=en>\n  Just a   title\n</TITLE>"+
+		`<meta property="og:image" content="javascript:alert(1)"></HEAD>`), base)
+	if preview.Title != "Just a title" || preview.Description != "" || preview.ImageURL != "" {
+		t.Fatalf("unexpected preview %+v", preview)
+	}
+}
+
+func TestHTTPPreviewFetcher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/page":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.Write([]byte(`<head><meta property="og:title" content="Hello"><meta property="og:image" content="pic.jpg"></head>`))
+		case "/moved":
+			http.Redirect(w, r, "/page", http.StatusFound)
+		case "/image":
+			w.Header().Set("Content-Type", "image/png")
+			w.Write([]byte("\x89PNG"))
+		}
+	}))
+	defer server.Close()
+	fetcher := newHTTPPreviewFetcher(allowServer(server))
+
+	preview, err := fetcher.Fetch(context.Background(), server.URL+"/moved")
+	if err != nil {
+		t.Fatalf("Fetch: %v", err)
+	}
+	if preview.URL != server.URL+"/moved" || preview.Title != "Hello" || preview.ImageURL != server.URL+"/pic.jpg" {
+		t.Fatalf("unexpected preview %+v", preview)
+	}
+	if _, err := fetcher.Fetch(context.Background(), server.URL+"/image"); !errors.Is(err, errNoPreview) {
+		t.Fatalf("non-HTML page: %v, want errNoPreview", err)
+	}
+}
+
+func TestHTTPPreviewFetcherBlocksLoopback(t *testing.T) {
+	hit := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { hit = true }))
+	defer server.Close()
+
+	_, err := newHTTPPreviewFetcher(nil).Fetch(context.Background(), server.URL+"/")
+	if !errors.Is(err, errBlockedAddress) {
+		t.Fatalf("Fetch of loopback: %v, want errBlockedAddress", err)
+	}
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	_, err = newHTTPPreviewFetcher(nil).Fetch(context.Background(), "http://localhost:"+port+"/")
+	if !errors.Is(err, errBlockedAddress) {
+		t.Fatalf("Fetch of localhost: %v, want errBlockedAddress", err)
+	}
+	if hit {
+		t.Fatal("blocked server received a request")
+	}
+}
+
+// Перенаправление с разрешённого адреса на внутренний блокируется при подключении
+func TestHTTPPreviewFetcherBlocksRedirectToPrivate(t *testing.T) {
+	internalHit := false
+	internal := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { internalHit = true }))
+	defer internal.Close()
+	public := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := internal.URL + "/metadata"
+		if r.URL.Path == "/private" {
+			target = "http://10.0.0.1/"
+		}
+		http.Redirect(w, r, target, http.StatusFound)
+	}))
+	defer public.Close()
+	fetcher := newHTTPPreviewFetcher(allowServer(public))
+
+	for _, path := range []string{"/loopback", "/private"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		_, err := fetcher.Fetch(ctx, public.URL+path)
+		cancel()
+		if !errors.Is(err, errBlockedAddress) {
+			t.Errorf("redirect %s: %v, want errBlockedAddress", path, err)
+		}
+	}
+	if internalHit {
+		t.Fatal("internal server received a request")
+	}
+}
+
+func TestIsBlockedIP(t *testing.T) {
+	blocked := []string{"127.0.0.1", "10.1.2.3", "172.16.0.1", "192.168.1.1", "169.254.169.254", "100.64.0.1",
+		"0.0.0.0", "224.0.0.1", "::1", "fc00::1", "fe80::1", "::ffff:127.0.0.1", "64:ff9b::a00:1"}
+	for _, addr := range blocked {
+		if !isBlockedIP(net.ParseIP(addr)) {
+			t.Errorf("%s is not blocked", addr)
+		}
+	}
+	for _, addr := range []string{"93.184.216.34", "2606:4700::1111"} {
+		if isBlockedIP(net.ParseIP(addr)) {
+			t.Errorf("%s is blocked", addr)
+		}
+	}
+}
+
+func TestLinkPreviewCacheFresh(t *testing.T) {
+	cases := []struct {
+		ok    bool
+		age   time.Duration
+		fresh bool
+	}{
+		{true, 23 * time.Hour, true},
+		{true, 25 * time.Hour, false},
+		{false, 59 * time.Minute, true},
+		{false, 61 * time.Minute, false},
+		{false, 23 * time.Hour, false},
+	}
+	for _, c := range cases {
+		if got := linkPreviewCacheFresh(c.ok, c.age); got != c.fresh {
+			t.Errorf("linkPreviewCacheFresh(%v, %v) = %v, want %v", c.ok, c.age, got, c.fresh)
+		}
+	}
+}
+
+// Загрузка одного адреса не выполняется параллельно, и блокировка удаляется
+// только после того, как её отпустит последний ожидающий
+func TestLockLinkPreview(t *testing.T) {
+	const rawURL = "https://example.com/page"
+	var (
+		wg      sync.WaitGroup
+		active  atomic.Int32
+		overlap atomic.Bool
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release := lockLinkPreview(rawURL)
+			if active.Add(1) > 1 {
+				overlap.Store(true)
+			}
+			time.Sleep(time.Millisecond)
+			active.Add(-1)
+			release()
+		}()
+	}
+	wg.Wait()
+	if overlap.Load() {
+		t.Fatal("the same URL was fetched concurrently")
+	}
+	linkPreviewLocksMu.Lock()
+	defer linkPreviewLocksMu.Unlock()
+	if len(linkPreviewLocks) != 0 {
+		t.Fatalf("%d locks left after release", len(linkPreviewLocks))
+	}
+}
+
+type stubPreviewFetcher struct{}
+
+func (stubPreviewFetcher) Fetch(context.Context, string) (linkPreview, error) {
+	return linkPreview{}, errors.New("not used")
+}
+
+// Когда все загрузчики заняты, превью пропускается без запуска ожидающей горутины
+func TestScheduleLinkPreviewDropsWhenBusy(t *testing.T) {
+	previous := linkPreviewFetcher
+	linkPreviewFetcher = stubPreviewFetcher{}
+	for i := 0; i < cap(linkPreviewSlots); i++ {
+		linkPreviewSlots <- struct{}{}
+	}
+	t.Cleanup(func() {
+		for i := 0; i < cap(linkPreviewSlots); i++ {
+			<-linkPreviewSlots
+		}
+		linkPreviewFetcher = previous
+	})
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 100; i++ {
+		scheduleLinkPreview(i, 1, "https://example.com/")
+	}
+	if after := runtime.NumGoroutine(); after > before+5 {
+		t.Fatalf("goroutines grew from %d to %d while all workers were busy", before, after)
+	}
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
+)
+
+const (
+	maxVenueName         = 100             // Максимальная длина названия места
+	maxVenueAddress      = 200             // Максимальная длина адреса места
+	maxLocationAccuracy  = 1500            // Погрешность в метрах
+	minLivePeriod        = 60              // Минимальная длительность трансляции, секунд
+	maxLivePeriod        = 24 * 60 * 60    // Максимальная длительность трансляции, секунд
+	liveLocationExpiry   = 5 * time.Second // Период проверки завершившихся трансляций
+	defaultLocationTitle = "Местоположение"
+)
+
+// Местоположение в сообщении: статичная точка или трансляция на ограниченное время
+type messageLocation struct {
+	MessageID    int        `json:"message_id"`
+	ChatID       int        `json:"chat_id"`
+	Latitude     float64    `json:"latitude"`
+	Longitude    float64    `json:"longitude"`
+	Accuracy     *float64   `json:"accuracy,omitempty"` // Погрешность в метрах
+	Heading      *int       `json:"heading,omitempty"`  // Направление движения, градусы (для трансляции)
+	VenueName    string     `json:"venue_name,omitempty"`
+	VenueAddress string     `json:"venue_address,omitempty"`
+	Live         bool       `json:"live"`
+	LiveUntil    *time.Time `json:"live_until,omitempty"`
+	Active       bool       `json:"active"` // Трансляция ещё идёт
+	UpdatedAt    time.Time  `json:"updated_at"`
+}
+
+// Команда WebSocket для местоположений
+type locationCommand struct {
+	MessageID    int      `json:"message_id"`
+	ChatID       int      `json:"chat_id"`
+	UserID       int      `json:"user_id"`
+	Latitude     *float64 `json:"latitude"`
+	Longitude    *float64 `json:"longitude"`
+	Accuracy     *float64 `json:"accuracy"`
+	Heading      *int     `json:"heading"`
+	VenueName    string   `json:"venue_name"`
+	VenueAddress string   `json:"venue_address"`
+	LivePeriod   int      `json:"live_period"` // Длительность трансляции в секундах; 0 — статичная точка
+}
+
+// Разбор команд местоположения из WebSocket
+func handleLocationCommand(conn *websocket.Conn, commandType string, message []byte) {
+	var cmd locationCommand
+	if err := json.Unmarshal(message, &cmd); err != nil {
+		log.Printf("Ошибка парсинга команды %s: %v", commandType, err)
+		return
+	}
+
+	switch commandType {
+	case "send_location":
+		handleSendLocationCommand(conn, cmd)
+	case "update_live_location":
+		handleUpdateLiveLocationCommand(cmd)
+	case "stop_live_location":
+		handleStopLiveLocationCommand(cmd)
+	}
+}
+
+// Проверка координат, погрешности и направления
+func validCoordinates(cmd locationCommand) bool {
+	if cmd.Latitude == nil || cmd.Longitude == nil {
+		return false
+	}
+	lat, lon := *cmd.Latitude, *cmd.Longitude
+	if math.IsNaN(lat) || math.IsNaN(lon) || lat < -90 || lat > 90 || lon < -180 || lon > 180 {
+		return false
+	}
+	if cmd.Accuracy != nil && (math.IsNaN(*cmd.Accuracy) || *cmd.Accuracy < 0 || *cmd.Accuracy > maxLocationAccuracy) {
+		return false
+	}
+	if cmd.Heading != nil && (*cmd.Heading < 1 || *cmd.Heading > 360) {
+		return false
+	}
+	return true
+}
+
+// Проверка и нормализация нового местоположения
+func validateLocationCommand(cmd *locationCommand) bool {
+	if !validCoordinates(*cmd) {
+		return false
+	}
+	cmd.VenueName = strings.TrimSpace(sanitizeMessageText(cmd.VenueName))
+	cmd.VenueAddress = strings.TrimSpace(sanitizeMessageText(cmd.VenueAddress))
+	if len([]rune(cmd.VenueName)) > maxVenueName || len([]rune(cmd.VenueAddress)) > maxVenueAddress {
+		return false
+	}
+	// Место с названием — всегда статичная точка
+	if cmd.LivePeriod != 0 && (cmd.VenueName != "" || cmd.LivePeriod < minLivePeriod || cmd.LivePeriod > maxLivePeriod) {
+		return false
+	}
+	if cmd.LivePeriod == 0 && cmd.Heading != nil {
+		return false
+	}
+	return true
+}
+
+// Отправка сообщения с местоположением
+func handleSendLocationCommand(conn *websocket.Conn, cmd locationCommand) {
+	if !validateLocationCommand(&cmd) {
+		log.Printf("Некорректное местоположение от пользователя %d", cmd.UserID)
+		conn.WriteJSON(map[string]interface{}{
+			"type":    "message_rejected",
+			"chat_id": cmd.ChatID,
+			"error":   "invalid location",
+		})
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("DB error: %v", err)
+		return
+	}
+	defer db.Close()
+
+	if ok, err := isChatParticipant(db, cmd.ChatID, cmd.UserID); err != nil || !ok {
+		log.Printf("Unauthorized location attempt: user %d, chat %d", cmd.UserID, cmd.ChatID)
+		return
+	}
+	if err := checkMemberMuted(db, cmd.ChatID, cmd.UserID); err != nil {
+		log.Printf("Местоположение пользователя %d в чат %d отклонено: %v", cmd.UserID, cmd.ChatID, err)
+		conn.WriteJSON(map[string]interface{}{
+			"type":    "message_rejected",
+			"chat_id": cmd.ChatID,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Transaction error: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	// Текст сообщения — название места, чтобы сообщение было понятно в списке чатов
+	text := cmd.VenueName
+	if text == "" {
+		text = defaultLocationTitle
+	}
+	msg := chatMessage{ChatID: cmd.ChatID, UserID: cmd.UserID, Text: text, MessageType: "location"}
+	stored, err := storeChatMessage(tx, msg)
+	if err != nil {
+		log.Printf("Ошибка сохранения сообщения с местоположением: %v", err)
+		return
+	}
+	_, err = tx.Exec(`
+        INSERT INTO message_locations (message_id, chat_id, latitude, longitude, accuracy, heading, venue_name, venue_address, live_until)
+        VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''),
+                CASE WHEN $9 > 0 THEN CURRENT_TIMESTAMP + $9 * INTERVAL '1 second' END)`,
+		stored.ID, cmd.ChatID, *cmd.Latitude, *cmd.Longitude, cmd.Accuracy, cmd.Heading, cmd.VenueName, cmd.VenueAddress, cmd.LivePeriod,
+	)
+	if err != nil {
+		log.Printf("Ошибка сохранения местоположения: %v", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		return
+	}
+
+	locations, err := loadMessageLocations(db, []int{stored.ID})
+	if err != nil || locations[stored.ID] == nil {
+		log.Printf("Ошибка загрузки местоположения %d: %v", stored.ID, err)
+		return
+	}
+	stored.Extra = map[string]interface{}{"location": locations[stored.ID]}
+	broadcastChatMessage(db, stored, msg, conn)
+}
+
+// Новые координаты трансляции; принимаются только от автора, пока трансляция идёт
+func handleUpdateLiveLocationCommand(cmd locationCommand) {
+	if !validCoordinates(cmd) {
+		log.Printf("Некорректные координаты трансляции от пользователя %d", cmd.UserID)
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("DB error: %v", err)
+		return
+	}
+	defer db.Close()
+
+	var chatID int
+	err = db.QueryRow(`
+        UPDATE message_locations l
+        SET latitude = $3, longitude = $4, accuracy = $5, heading = $6, updated_at = CURRENT_TIMESTAMP
+        FROM messages m
+        WHERE l.message_id = $1 AND m.id = l.message_id AND m.user_id = $2 AND NOT m.is_deleted
+          AND l.live_until > CURRENT_TIMESTAMP AND l.stopped_at IS NULL
+        RETURNING l.chat_id`,
+		cmd.MessageID, cmd.UserID, *cmd.Latitude, *cmd.Longitude, cmd.Accuracy, cmd.Heading,
+	).Scan(&chatID)
+	if err == sql.ErrNoRows {
+		log.Printf("Трансляция %d недоступна для пользователя %d", cmd.MessageID, cmd.UserID)
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка обновления трансляции %d: %v", cmd.MessageID, err)
+		return
+	}
+	broadcastLocationUpdate(db, cmd.MessageID, chatID)
+}
+
+// Досрочная остановка трансляции автором
+func handleStopLiveLocationCommand(cmd locationCommand) {
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("DB error: %v", err)
+		return
+	}
+	defer db.Close()
+
+	var chatID int
+	err = db.QueryRow(`
+        UPDATE message_locations l
+        SET stopped_at = CURRENT_TIMESTAMP, heading = NULL, updated_at = CURRENT_TIMESTAMP
+        FROM messages m
+        WHERE l.message_id = $1 AND m.id = l.message_id AND m.user_id = $2
+          AND l.live_until IS NOT NULL AND l.stopped_at IS NULL
+        RETURNING l.chat_id`,
+		cmd.MessageID, cmd.UserID,
+	).Scan(&chatID)
+	if err != nil {
+		log.Printf("Трансляция %d не остановлена: %v", cmd.MessageID, err)
+		return
+	}
+	broadcastLocationUpdate(db, cmd.MessageID, chatID)
+}
+
+// Рассылка текущего состояния местоположения участникам чата
+func broadcastLocationUpdate(db *sql.DB, messageID, chatID int) {
+	locations, err := loadMessageLocations(db, []int{messageID})
+	if err != nil || locations[messageID] == nil {
+		log.Printf("Ошибка загрузки местоположения %d: %v", messageID, err)
+		return
+	}
+	participantIDs, err := getChatParticipantIDs(db, chatID)
+	if err != nil {
+		log.Printf("Ошибка получения участников чата %d: %v", chatID, err)
+		return
+	}
+	broadcastToUsers(participantIDs, map[string]interface{}{
+		"type":       "location_updated",
+		"chat_id":    chatID,
+		"message_id": messageID,
+		"location":   locations[messageID],
+	})
+}
+
+// Загрузка местоположений для набора сообщений
+func loadMessageLocations(db *sql.DB, messageIDs []int) (map[int]*messageLocation, error) {
+	result := make(map[int]*messageLocation)
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+
+	rows, err := db.Query(`
+        SELECT l.message_id, l.chat_id, l.latitude, l.longitude, l.accuracy, l.heading,
+               COALESCE(l.venue_name, ''), COALESCE(l.venue_address, ''), l.live_until,
+               l.live_until > CURRENT_TIMESTAMP AND l.stopped_at IS NULL, l.updated_at
+        FROM message_locations l
+        JOIN messages m ON m.id = l.message_id
+        WHERE l.message_id = ANY($1) AND NOT m.is_deleted`, pq.Array(intsToInt64(messageIDs)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			location  messageLocation
+			accuracy  sql.NullFloat64
+			heading   sql.NullInt64
+			liveUntil sql.NullTime
+			active    sql.NullBool
+		)
+		if err := rows.Scan(&location.MessageID, &location.ChatID, &location.Latitude, &location.Longitude, &accuracy, &heading,
+			&location.VenueName, &location.VenueAddress, &liveUntil, &active, &location.UpdatedAt); err != nil {
+			log.Printf("Ошибка чтения местоположения: %v", err)
+			continue
+		}
+		if accuracy.Valid {
+			location.Accuracy = &accuracy.Float64
+		}
+		if heading.Valid {
+			h := int(heading.Int64)
+			location.Heading = &h
+		}
+		if liveUntil.Valid {
+			location.Live = true
+			location.LiveUntil = &liveUntil.Time
+			location.Active = active.Bool
+		}
+		result[location.MessageID] = &location
+	}
+	return result, rows.Err()
+}
+
+// Фоновое завершение трансляций, у которых истекло время
+func startLiveLocationExpirer() {
+	go func() {
+		ticker := time.NewTicker(liveLocationExpiry)
+		defer ticker.Stop()
+		for range ticker.C {
+			expireLiveLocations()
+		}
+	}()
+}
+
+func expireLiveLocations() {
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("Трансляции: ошибка подключения к БД: %v", err)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+        UPDATE message_locations SET stopped_at = live_until, heading = NULL
+        WHERE live_until IS NOT NULL AND stopped_at IS NULL AND live_until <= CURRENT_TIMESTAMP
+        RETURNING message_id, chat_id`)
+	if err != nil {
+		log.Printf("Трансляции: ошибка завершения: %v", err)
+		return
+	}
+	type expiredLocation struct{ messageID, chatID int }
+	var expired []expiredLocation
+	for rows.Next() {
+		var l expiredLocation
+		if err := rows.Scan(&l.messageID, &l.chatID); err == nil {
+			expired = append(expired, l)
+		}
+	}
+	rows.Close()
+
+	for _, l := range expired {
+		broadcastLocationUpdate(db, l.messageID, l.chatID)
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"database/sql/driver"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateLocationCommand(t *testing.T) {
+	lat, lon := 55.7558, 37.6173
+	ptr := func(v float64) *float64 { return &v }
+	heading := func(v int) *int { return &v }
+	point := func(change func(*locationCommand)) locationCommand {
+		cmd := locationCommand{Latitude: &lat, Longitude: &lon}
+		change(&cmd)
+		return cmd
+	}
+
+	valid := map[string]locationCommand{
+		"point":         point(func(c *locationCommand) {}),
+		"venue":         point(func(c *locationCommand) { c.VenueName, c.VenueAddress = " Кремль ", "Москва" }),
+		"live":          point(func(c *locationCommand) { c.LivePeriod, c.Heading, c.Accuracy = 900, heading(360), ptr(15) }),
+		"poles":         point(func(c *locationCommand) { c.Latitude, c.Longitude = ptr(-90), ptr(180) }),
+		"zero accuracy": point(func(c *locationCommand) { c.Accuracy = ptr(0) }),
+	}
+	for name, cmd := range valid {
+		if !validateLocationCommand(&cmd) {
+			t.Errorf("%s rejected", name)
+		}
+	}
+	if cmd := valid["venue"]; validateLocationCommand(&cmd) && cmd.VenueName != "Кремль" {
+		t.Errorf("venue name not trimmed: %q", cmd.VenueName)
+	}
+
+	invalid := map[string]locationCommand{
+		"no latitude":     {Longitude: &lon},
+		"latitude range":  point(func(c *locationCommand) { c.Latitude = ptr(90.01) }),
+		"longitude range": point(func(c *locationCommand) { c.Longitude = ptr(-180.5) }),
+		"NaN":             point(func(c *locationCommand) { c.Latitude = ptr(math.NaN()) }),
+		"accuracy":        point(func(c *locationCommand) { c.Accuracy = ptr(maxLocationAccuracy + 1) }),
+		"heading":         point(func(c *locationCommand) { c.LivePeriod, c.Heading = 900, heading(0) }),
+		"static heading":  point(func(c *locationCommand) { c.Heading = heading(90) }),
+		"short live":      point(func(c *locationCommand) { c.LivePeriod = minLivePeriod - 1 }),
+		"long live":       point(func(c *locationCommand) { c.LivePeriod = maxLivePeriod + 1 }),
+		"live venue":      point(func(c *locationCommand) { c.LivePeriod, c.VenueName = 900, "Кафе" }),
+		"long venue":      point(func(c *locationCommand) { c.VenueName = strings.Repeat("я", maxVenueName+1) }),
+	}
+	for name, cmd := range invalid {
+		if validateLocationCommand(&cmd) {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
+
+// Трансляция отмечается активной, пока не истекла и не остановлена
+func TestLoadMessageLocations(t *testing.T) {
+	db, fake := newFakeDB(t)
+	now := time.Now()
+	fake.on("FROM message_locations l", func([]driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{
+			{int64(1), int64(10), 55.75, 37.61, nil, nil, "Кремль", "", nil, nil, now},
+			{int64(2), int64(10), 59.93, 30.33, 12.5, int64(90), "", "", now.Add(time.Hour), true, now},
+		}}
+	})
+
+	locations, err := loadMessageLocations(db, []int{1, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := fake.queries("FROM message_locations l"); !strings.Contains(q[0].query, "NOT m.is_deleted") {
+		t.Fatal("locations of deleted messages are not excluded")
+	}
+	static := locations[1]
+	if static.Live || static.Active || static.Accuracy != nil || static.VenueName != "Кремль" {
+		t.Fatalf("static point: %+v", static)
+	}
+	live := locations[2]
+	if !live.Live || !live.Active || *live.Accuracy != 12.5 || *live.Heading != 90 || live.LiveUntil == nil {
+		t.Fatalf("live location: %+v", live)
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"        // Для форматированного ввода/вывода
 	"log"        // Для логирования ошибок
 	"net/http"   // Для создания HTTP-сервера
+	"os"         // Для чтения аргументов командной строки
 )
 
 // Добавляем middleware для CORS
@@ -13,9 +14,12 @@ func enableCORS(next http.HandlerFunc) http.HandlerFunc {
 		// Разрешаем запросы с любых доменов (*)
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		// Разрешенные HTTP-методы
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PATCH, HEAD, DELETE, OPTIONS")
 		// Разрешенные заголовки
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Range, If-None-Match, If-Modified-Since, Tus-Resumable, Upload-Length, Upload-Offset, Upload-Metadata, Upload-Checksum")
+		// Заголовки ответа, доступные клиенту (скачивание файлов по частям, возобновляемая загрузка)
+		w.Header().Set("Access-Control-Expose-Headers", "Content-Disposition, Content-Range, Accept-Ranges, ETag, X-Image-Version, "+
+			"Location, Tus-Resumable, Tus-Version, Tus-Extension, Tus-Max-Size, Tus-Checksum-Algorithm, Upload-Offset, Upload-Length, Upload-Expires")
 		// Для предварительных запросов OPTIONS сразу отвечаем OK
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -27,6 +31,22 @@ func enableCORS(next http.HandlerFunc) http.HandlerFunc {
 }
 
 func main() {
+	// Хранилище аватаров и вложений
+	if err := initBlobStorage(); err != nil {
+		log.Fatal("Ошибка инициализации хранилища файлов: ", err)
+	}
+	initLinkPreviews()
+	initWebhooks()
+	initPushNotifications()
+
+	// Служебная команда вместо запуска сервера
+	if len(os.Args) > 1 {
+		if err := runMaintenanceCommand(os.Args[1]); err != nil {
+			log.Fatal("Ошибка выполнения команды: ", err)
+		}
+		return
+	}
+
 	// Загрузка TLS-сертификата и приватного ключа
 	cert, err := tls.LoadX509KeyPair("C:\\Program Files\\OpenSSL-Win64\\bin\\server.crt", "C:\\Program Files\\OpenSSL-Win64\\bin\\server.key")
 	if err != nil {
@@ -55,7 +75,11 @@ func main() {
 	http.HandleFunc("/user/image", enableCORS(userImageHandler))
 	http.HandleFunc("/add-reaction", enableCORS(addReactionHandler))
 	http.HandleFunc("/get-reactions", enableCORS(getReactionsHandler))
+	http.HandleFunc("/remove-reaction", enableCORS(removeReactionHandler))
 	http.HandleFunc("/uploadFile", enableCORS(uploadFileHandler))
+	http.HandleFunc("/download-file", enableCORS(downloadFileHandler))
+	http.HandleFunc("/uploads", withTusHeaders(enableCORS(uploadsHandler)))
+	http.HandleFunc("/uploads/", withTusHeaders(enableCORS(uploadHandler)))
 	http.HandleFunc("/user-status", enableCORS(getUserStatusHandler))
 	http.HandleFunc("/user/profile", enableCORS(userProfileHandler))
 	http.HandleFunc("/group-chats", enableCORS(createGroupChatHandler))
@@ -64,6 +88,48 @@ func main() {
 	http.HandleFunc("/reset_unread", resetUnreadHandler)
 	http.HandleFunc("/group_participants_count", getGroupParticipantsCountHandler)
 	http.HandleFunc("/group/image", enableCORS(groupImageHandler))
+	http.HandleFunc("/group/update", enableCORS(updateGroupHandler))
+	http.HandleFunc("/chat/delete", enableCORS(deleteChatHandler))
+	http.HandleFunc("/chat/clear-history", enableCORS(clearHistoryHandler))
+	http.HandleFunc("/saved-messages", enableCORS(savedMessagesHandler))
+	http.HandleFunc("/saved-messages/tags", enableCORS(savedTagsHandler))
+	http.HandleFunc("/scheduled-messages", enableCORS(scheduledMessagesHandler))
+	http.HandleFunc("/chat/ttl", enableCORS(chatTTLHandler))
+	http.HandleFunc("/chat/reactions", enableCORS(chatReactionsHandler))
+	http.HandleFunc("/sticker-packs", enableCORS(stickerPacksHandler))
+	http.HandleFunc("/sticker-packs/pack", enableCORS(stickerPackHandler))
+	http.HandleFunc("/sticker-packs/stickers", enableCORS(packStickersHandler))
+	http.HandleFunc("/sticker-packs/install", enableCORS(installStickerPackHandler))
+	http.HandleFunc("/sticker", enableCORS(stickerFileHandler))
+	http.HandleFunc("/webhooks", enableCORS(webhooksHandler))
+	http.HandleFunc("/webhooks/deliveries", enableCORS(webhookDeliveriesHandler))
+	http.HandleFunc("/webhooks/incoming", enableCORS(incomingWebhooksHandler))
+	http.HandleFunc(incomingWebhookPath, enableCORS(incomingWebhookPostHandler))
+	http.HandleFunc("/bots", enableCORS(botsHandler))
+	http.HandleFunc("/bots/token", enableCORS(botTokenHandler))
+	http.HandleFunc("/bots/commands", enableCORS(botCommandsHandler))
+	http.HandleFunc(botAPIPath, enableCORS(botAPIHandler))
+	http.HandleFunc("/chat/commands", enableCORS(chatCommandsHandler))
+	http.HandleFunc("/push/devices", enableCORS(pushDevicesHandler))
+	http.HandleFunc("/push/config", enableCORS(pushConfigHandler))
+	http.HandleFunc("/push/mock", enableCORS(pushMockHandler))
+	// Фоновая отправка отложенных сообщений
+	startMessageScheduler()
+	// Фоновое удаление исчезающих сообщений
+	startMessageReaper()
+	// Автоматическое закрытие опросов
+	startPollCloser()
+	// Завершение трансляций местоположения по истечении времени
+	startLiveLocationExpirer()
+	// Удаление брошенных возобновляемых загрузок
+	startUploadCleaner()
+	// Доставка исходящих вебхуков
+	startWebhookDispatcher()
+	// Доставка обновлений ботам с вебхуком
+	startBotUpdatePusher()
+	// Отправка push-уведомлений пользователям без соединения
+	startPushDispatcher()
+
 	// Запуск сервера
 	fmt.Println("Server starting on :8080")
 	// ListenAndServeTLS запускает HTTPS-сервер
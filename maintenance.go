@@ -0,0 +1,233 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+)
+
+// Служебные команды запускаются вместо сервера: go run . <команда>
+var maintenanceCommands = map[string]func(db *sql.DB) error{
+	"repair-direct-chats": repairDirectChats,
+	"migrate-blobs":       migrateBlobs,
+	"gc-blobs":            collectUnusedBlobs,
+}
+
+// Выполнение служебной команды по имени
+func runMaintenanceCommand(name string) error {
+	command, ok := maintenanceCommands[name]
+	if !ok {
+		return fmt.Errorf("неизвестная команда: %s", name)
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return command(db)
+}
+
+// repairDirectChats объединяет дубликаты личных чатов одной пары пользователей
+// и проставляет ключ пары, после чего создаёт уникальный индекс
+func repairDirectChats(db *sql.DB) error {
+	if _, err := db.Exec("ALTER TABLE chats ADD COLUMN IF NOT EXISTS direct_key VARCHAR(64)"); err != nil {
+		return err
+	}
+
+	// Личные чаты ровно с двумя участниками, сгруппированные по паре
+	rows, err := db.Query(`
+        SELECT MIN(p.user_id), MAX(p.user_id), c.id
+        FROM chats c
+        JOIN participants p ON p.chat_id = c.id
+        WHERE NOT c.is_group
+        GROUP BY c.id
+        HAVING COUNT(*) = 2
+        ORDER BY 1, 2, c.id`)
+	if err != nil {
+		return err
+	}
+	pairs := make(map[string][]int)
+	var keys []string
+	for rows.Next() {
+		var userA, userB, chatID int
+		if err := rows.Scan(&userA, &userB, &chatID); err != nil {
+			rows.Close()
+			return err
+		}
+		key := directChatKey(userA, userB)
+		if _, ok := pairs[key]; !ok {
+			keys = append(keys, key)
+		}
+		pairs[key] = append(pairs[key], chatID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	merged := 0
+	for _, key := range keys {
+		chatIDs := pairs[key]
+		if err := mergeDirectChats(db, key, chatIDs[0], chatIDs[1:]); err != nil {
+			return fmt.Errorf("пара %s: %w", key, err)
+		}
+		merged += len(chatIDs) - 1
+	}
+
+	if _, err := db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_chats_direct_key ON chats(direct_key)"); err != nil {
+		return err
+	}
+	log.Printf("Проверено пар: %d, объединено дубликатов чатов: %d", len(keys), merged)
+	return nil
+}
+
+// Перенос сообщений дубликатов в самый старый чат пары и удаление дубликатов
+func mergeDirectChats(db *sql.DB, key string, keepID int, duplicateIDs []int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, dupID := range duplicateIDs {
+		// Повторные системные сообщения "Чат создан" не переносим
+		if _, err := tx.Exec("DELETE FROM messages WHERE chat_id = $1 AND is_system AND content = 'Чат создан'", dupID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE messages SET chat_id = $1 WHERE chat_id = $2", keepID, dupID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE messages SET original_chat_id = $1 WHERE original_chat_id = $2", keepID, dupID); err != nil {
+			return err
+		}
+		// Счётчики непрочитанных суммируются
+		if _, err := tx.Exec(`
+            UPDATE participants p
+            SET unread_count = p.unread_count + d.unread_count
+            FROM participants d
+            WHERE p.chat_id = $1 AND d.chat_id = $2 AND p.user_id = d.user_id`, keepID, dupID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM chats WHERE id = $1", dupID); err != nil {
+			return err
+		}
+		log.Printf("Чат %d объединён с чатом %d", dupID, keepID)
+	}
+
+	if _, err := tx.Exec(`
+        UPDATE chats
+        SET direct_key = $2,
+            last_message_at = (SELECT MAX(created_at) FROM messages WHERE chat_id = $1)
+        WHERE id = $1`, keepID, key); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Таблицы с двоичными данными в BYTEA и колонками для ключа хранилища
+var blobColumns = []struct {
+	table, idColumn, dataColumn, keyColumn, nameColumn string
+}{
+	{"users", "id", "image", "image_key", "'avatar.jpg'"},
+	{"group_chats", "id", "image", "image_key", "'group.jpg'"},
+	{"message_files", "id", "file_data", "blob_key", "file_name"},
+}
+
+// migrateBlobs переносит аватары и вложения из BYTEA-колонок в хранилище файлов.
+// Команду можно прерывать и запускать повторно: обработанные строки пропускаются
+func migrateBlobs(db *sql.DB) error {
+	for _, stmt := range []string{
+		`CREATE TABLE IF NOT EXISTS blobs (
+            key VARCHAR(100) PRIMARY KEY,
+            size BIGINT NOT NULL,
+            mime_type VARCHAR(255),
+            created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+            last_stored_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+        )`,
+		"ALTER TABLE blobs ADD COLUMN IF NOT EXISTS width INT",
+		"ALTER TABLE blobs ADD COLUMN IF NOT EXISTS height INT",
+		"ALTER TABLE blobs ADD COLUMN IF NOT EXISTS blurhash VARCHAR(64)",
+		"ALTER TABLE blobs ADD COLUMN IF NOT EXISTS duration_ms INT",
+		"ALTER TABLE blobs ADD COLUMN IF NOT EXISTS waveform BYTEA",
+		`CREATE TABLE IF NOT EXISTS blob_variants (
+            blob_key VARCHAR(100) NOT NULL REFERENCES blobs(key) ON DELETE CASCADE,
+            variant VARCHAR(20) NOT NULL,
+            variant_key VARCHAR(100) NOT NULL REFERENCES blobs(key),
+            width INT NOT NULL,
+            height INT NOT NULL,
+            PRIMARY KEY (blob_key, variant)
+        )`,
+		"ALTER TABLE users ADD COLUMN IF NOT EXISTS image_key VARCHAR(100) REFERENCES blobs(key)",
+		"ALTER TABLE group_chats ADD COLUMN IF NOT EXISTS image_key VARCHAR(100) REFERENCES blobs(key)",
+		"ALTER TABLE message_files ADD COLUMN IF NOT EXISTS blob_key VARCHAR(100) REFERENCES blobs(key)",
+		"ALTER TABLE message_files ALTER COLUMN file_data DROP NOT NULL",
+	} {
+		if _, err := db.Exec(stmt); err != nil {
+			return err
+		}
+	}
+
+	for _, c := range blobColumns {
+		moved := 0
+		for {
+			// Строки читаются пачками, чтобы не загружать все данные в память
+			rows, err := db.Query(fmt.Sprintf(
+				"SELECT %s, %s, %s FROM %s WHERE %s IS NOT NULL AND %s IS NULL ORDER BY %s LIMIT 50",
+				c.idColumn, c.dataColumn, c.nameColumn, c.table, c.dataColumn, c.keyColumn, c.idColumn))
+			if err != nil {
+				return err
+			}
+			type pending struct {
+				id   int
+				data []byte
+				name string
+			}
+			var batch []pending
+			for rows.Next() {
+				var p pending
+				if err := rows.Scan(&p.id, &p.data, &p.name); err != nil {
+					rows.Close()
+					return err
+				}
+				batch = append(batch, p)
+			}
+			rows.Close()
+			if err := rows.Err(); err != nil {
+				return err
+			}
+			if len(batch) == 0 {
+				break
+			}
+
+			for _, p := range batch {
+				if len(p.data) == 0 {
+					// Пустые значения просто очищаются
+					if _, err := db.Exec(fmt.Sprintf("UPDATE %s SET %s = NULL WHERE %s = $1", c.table, c.dataColumn, c.idColumn), p.id); err != nil {
+						return err
+					}
+					continue
+				}
+				blob, err := storeBlobBytes(db, p.data, p.name)
+				if err != nil {
+					return fmt.Errorf("%s %d: %w", c.table, p.id, err)
+				}
+				query := fmt.Sprintf("UPDATE %s SET %s = $2, %s = NULL WHERE %s = $1", c.table, c.keyColumn, c.dataColumn, c.idColumn)
+				if c.table == "message_files" {
+					query = "UPDATE message_files SET blob_key = $2, file_data = NULL, file_size = $3, mime_type = COALESCE(mime_type, $4) WHERE id = $1"
+					_, err = db.Exec(query, p.id, blob.Key, blob.Size, blob.MimeType)
+				} else {
+					_, err = db.Exec(query, p.id, blob.Key)
+				}
+				if err != nil {
+					return err
+				}
+				moved++
+			}
+		}
+		log.Printf("%s: перенесено в хранилище %d объектов", c.table, moved)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDirectChatKey(t *testing.T) {
+	if directChatKey(7, 3) != "3:7" || directChatKey(3, 7) != "3:7" {
+		t.Fatalf("key is not symmetric: %q %q", directChatKey(7, 3), directChatKey(3, 7))
+	}
+	if directChatKey(5, 5) != "5:5" {
+		t.Fatalf("self chat key %q", directChatKey(5, 5))
+	}
+	// Разделитель не даёт совпасть разным парам
+	if directChatKey(1, 23) == directChatKey(12, 3) {
+		t.Fatal("different pairs share a key")
+	}
+}
+
+// Дубликаты одной пары сливаются в самый старый чат, остальные пары только получают ключ
+func TestRepairDirectChats(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.on("GROUP BY c.id", func([]driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{
+			{int64(1), int64(2), int64(10)},
+			{int64(1), int64(2), int64(14)},
+			{int64(1), int64(2), int64(17)},
+			{int64(3), int64(4), int64(20)},
+		}}
+	})
+
+	if err := repairDirectChats(db); err != nil {
+		t.Fatal(err)
+	}
+
+	var moved [][]driver.Value
+	for _, q := range fake.queries("UPDATE messages SET chat_id = $1 WHERE chat_id = $2") {
+		moved = append(moved, q.args)
+	}
+	if want := [][]driver.Value{{int64(10), int64(14)}, {int64(10), int64(17)}}; !reflect.DeepEqual(moved, want) {
+		t.Fatalf("moved messages %v, want %v", moved, want)
+	}
+	var deleted []driver.Value
+	for _, q := range fake.queries("DELETE FROM chats WHERE id = $1") {
+		deleted = append(deleted, q.args[0])
+	}
+	if want := []driver.Value{int64(14), int64(17)}; !reflect.DeepEqual(deleted, want) {
+		t.Fatalf("deleted chats %v, want %v", deleted, want)
+	}
+	var keyed [][]driver.Value
+	for _, q := range fake.queries("SET direct_key = $2") {
+		keyed = append(keyed, q.args)
+	}
+	if want := [][]driver.Value{{int64(10), "1:2"}, {int64(20), "3:4"}}; !reflect.DeepEqual(keyed, want) {
+		t.Fatalf("keys %v, want %v", keyed, want)
+	}
+	if len(fake.queries("CREATE UNIQUE INDEX IF NOT EXISTS idx_chats_direct_key")) != 1 {
+		t.Fatal("unique index not created")
+	}
+}
+
+// Ошибка слияния откатывает транзакцию пары, и индекс не создаётся
+func TestRepairDirectChatsRollsBackOnError(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.on("GROUP BY c.id", func([]driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{
+			{int64(1), int64(2), int64(10)},
+			{int64(1), int64(2), int64(14)},
+		}}
+	})
+	fake.on("SET original_chat_id", func([]driver.Value) fakeResult {
+		return fakeResult{err: errors.New("deadlock detected")}
+	})
+
+	if err := repairDirectChats(db); err == nil {
+		t.Fatal("merge error ignored")
+	}
+	if len(fake.queries("COMMIT")) != 0 || len(fake.queries("ROLLBACK")) != 1 {
+		t.Fatal("failed merge was not rolled back")
+	}
+	if len(fake.queries("CREATE UNIQUE INDEX")) != 0 {
+		t.Fatal("unique index created over unmerged duplicates")
+	}
+}
+
+// Существующий чат пары возвращается и снова показывается тому, кто его скрывал
+func TestGetExistingDirectChat(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.on("WHERE direct_key = $1", func(args []driver.Value) fakeResult {
+		if args[0] != "3:7" {
+			return fakeResult{}
+		}
+		return fakeRow(int64(42))
+	})
+
+	chatID, err := getExistingDirectChat(db, 7, 3)
+	if err != nil || chatID != 42 {
+		t.Fatalf("getExistingDirectChat = %d, %v", chatID, err)
+	}
+	unhidden := fake.queries("SET hidden_at = NULL")
+	if len(unhidden) != 1 || !reflect.DeepEqual(unhidden[0].args, []driver.Value{int64(42), int64(7)}) {
+		t.Fatalf("chat not unhidden for the requester: %+v", unhidden)
+	}
+	if _, err := getExistingDirectChat(db, 7, 4); err == nil {
+		t.Fatal("missing chat reported as existing")
+	}
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	"github.com/lib/pq"
+)
+
+// Упоминание в тексте сообщения. Смещение и длина считаются в UTF-16 единицах,
+// как длина строк у клиента
+type messageMention struct {
+	Type     string `json:"type"` // user или all
+	UserID   int    `json:"user_id,omitempty"`
+	Username string `json:"username"`
+	Offset   int    `json:"offset"`
+	Length   int    `json:"length"`
+}
+
+// Упоминание, найденное в тексте до проверки участников
+type mentionToken struct {
+	username string
+	offset   int
+	length   int
+}
+
+// Допустимые символы имени пользователя в упоминании
+func isMentionRune(r rune) bool {
+	return r == '_' || r == '.' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+// Поиск всех @username в тексте
+func parseMentionTokens(text string) []mentionToken {
+	var (
+		tokens []mentionToken
+		prev   rune
+		offset int
+	)
+	runes := []rune(text)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		// '@' начинает упоминание только в начале текста или после разделителя
+		if r == '@' && (i == 0 || !isMentionRune(prev) && prev != '@') {
+			j := i + 1
+			for j < len(runes) && isMentionRune(runes[j]) {
+				j++
+			}
+			// Точка в конце относится к предложению, а не к имени
+			for j > i+1 && runes[j-1] == '.' {
+				j--
+			}
+			if j > i+1 {
+				mention := runes[i:j]
+				tokens = append(tokens, mentionToken{
+					username: string(mention[1:]),
+					offset:   offset,
+					length:   len(utf16.Encode(mention)),
+				})
+				offset += len(utf16.Encode(mention))
+				prev = runes[j-1]
+				i = j - 1
+				continue
+			}
+		}
+		offset += len(utf16.Encode([]rune{r}))
+		prev = r
+	}
+	return tokens
+}
+
+// Разбор упоминаний в сообщении, сохранение и увеличение счётчиков непрочитанных упоминаний.
+// Учитываются только участники чата; @all доступно администраторам групп.
+// previous — упоминания до редактирования: уже упомянутым счётчик повторно не увеличивается
+func storeMessageMentions(db dbExecutor, messageID, chatID, senderID int, text string, previous []messageMention) ([]messageMention, error) {
+	tokens := parseMentionTokens(text)
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	// Участники чата по имени пользователя (без учёта регистра)
+	rows, err := db.Query(`
+        SELECT u.id, u.username
+        FROM participants p
+        JOIN users u ON u.id = p.user_id
+        WHERE p.chat_id = $1`, chatID)
+	if err != nil {
+		return nil, err
+	}
+	members := make(map[string]int)
+	names := make(map[int]string)
+	for rows.Next() {
+		var (
+			id       int
+			username string
+		)
+		if err := rows.Scan(&id, &username); err != nil {
+			continue
+		}
+		members[strings.ToLower(username)] = id
+		names[id] = username
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var (
+		mentions    []messageMention
+		mentioned   = make(map[int]bool)
+		mentionsAll bool
+	)
+	for _, token := range tokens {
+		lower := strings.ToLower(token.username)
+		if lower == "all" {
+			if _, isUser := members[lower]; !isUser {
+				var isGroup bool
+				if err := db.QueryRow("SELECT is_group FROM chats WHERE id = $1", chatID).Scan(&isGroup); err != nil {
+					return nil, err
+				}
+				allowed := false
+				if isGroup {
+					if allowed, err = canManageGroup(db, chatID, senderID); err != nil {
+						return nil, err
+					}
+				}
+				if allowed {
+					mentions = append(mentions, messageMention{Type: "all", Username: token.username, Offset: token.offset, Length: token.length})
+					mentionsAll = true
+				}
+				continue
+			}
+		}
+		userID, ok := members[lower]
+		if !ok {
+			continue
+		}
+		mentions = append(mentions, messageMention{Type: "user", UserID: userID, Username: names[userID], Offset: token.offset, Length: token.length})
+		mentioned[userID] = true
+	}
+	if len(mentions) == 0 {
+		return nil, nil
+	}
+
+	for _, mention := range mentions {
+		var userID sql.NullInt64
+		if mention.Type == "user" {
+			userID = sql.NullInt64{Int64: int64(mention.UserID), Valid: true}
+		}
+		_, err := db.Exec(`
+            INSERT INTO message_mentions (message_id, user_id, mention_type, start_offset, length)
+            VALUES ($1, $2, $3, $4, $5)`,
+			messageID, userID, mention.Type, mention.Offset, mention.Length)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Счётчик увеличивается один раз на сообщение, даже если пользователя упомянули несколько раз
+	notified := []int64{int64(senderID)}
+	for _, mention := range previous {
+		if mention.Type == "all" {
+			return mentions, nil
+		}
+		notified = append(notified, int64(mention.UserID))
+	}
+	if mentionsAll {
+		_, err = db.Exec("UPDATE participants SET unread_mentions = unread_mentions + 1 WHERE chat_id = $1 AND user_id != ALL($2)", chatID, pq.Array(notified))
+	} else {
+		for _, id := range notified {
+			delete(mentioned, int(id))
+		}
+		for userID := range mentioned {
+			_, err = db.Exec("UPDATE participants SET unread_mentions = unread_mentions + 1 WHERE chat_id = $1 AND user_id = $2", chatID, userID)
+			if err != nil {
+				break
+			}
+		}
+	}
+	return mentions, err
+}
+
+// Удаление упоминаний сообщения перед повторным разбором отредактированного текста
+func deleteMessageMentions(db dbExecutor, messageID int) ([]messageMention, error) {
+	rows, err := db.Query("DELETE FROM message_mentions WHERE message_id = $1 RETURNING mention_type, user_id", messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var mentions []messageMention
+	for rows.Next() {
+		var (
+			mention messageMention
+			userID  sql.NullInt64
+		)
+		if err := rows.Scan(&mention.Type, &userID); err != nil {
+			return nil, err
+		}
+		mention.UserID = int(userID.Int64)
+		mentions = append(mentions, mention)
+	}
+	return mentions, rows.Err()
+}
+
+// Получатели события mention: упомянутые пользователи или все участники при @all (кроме автора)
+func mentionRecipients(mentions []messageMention, participantIDs []int, senderID int) []int {
+	targets := make(map[int]bool)
+	for _, mention := range mentions {
+		if mention.Type == "all" {
+			for _, id := range participantIDs {
+				targets[id] = true
+			}
+		} else {
+			targets[mention.UserID] = true
+		}
+	}
+	delete(targets, senderID)
+
+	var recipients []int
+	for id := range targets {
+		recipients = append(recipients, id)
+	}
+	return recipients
+}
+
+// Отдельное событие упоминания доставляется всегда, независимо от настроек уведомлений чата
+func broadcastMentions(mentions []messageMention, participantIDs []int, chatID, messageID, senderID int, senderName, text string) {
+	if len(mentions) == 0 {
+		return
+	}
+	recipients := mentionRecipients(mentions, participantIDs, senderID)
+	if len(recipients) == 0 {
+		return
+	}
+	broadcastToUsers(recipients, map[string]interface{}{
+		"type":        "mention",
+		"chat_id":     chatID,
+		"message_id":  messageID,
+		"user_id":     senderID,
+		"sender_name": senderName,
+		"text":        text,
+		"mentions":    mentions,
+	})
+}
+
+// Загрузка упоминаний для набора сообщений
+func loadMessageMentions(db *sql.DB, messageIDs []int) (map[int][]messageMention, error) {
+	result := make(map[int][]messageMention)
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+
+	rows, err := db.Query(`
+        SELECT mm.message_id, mm.mention_type, mm.user_id, u.username, mm.start_offset, mm.length
+        FROM message_mentions mm
+        JOIN messages m ON m.id = mm.message_id
+        LEFT JOIN users u ON u.id = mm.user_id
+        WHERE mm.message_id = ANY($1) AND NOT m.is_deleted
+        ORDER BY mm.message_id, mm.start_offset`, pq.Array(intsToInt64(messageIDs)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			messageID int
+			mention   messageMention
+			userID    sql.NullInt64
+			username  sql.NullString
+		)
+		if err := rows.Scan(&messageID, &mention.Type, &userID, &username, &mention.Offset, &mention.Length); err != nil {
+			log.Printf("Ошибка чтения упоминания: %v", err)
+			continue
+		}
+		mention.UserID = int(userID.Int64)
+		mention.Username = username.String
+		if mention.Type == "all" {
+			mention.Username = "all"
+		}
+		result[messageID] = append(result[messageID], mention)
+	}
+	return result, rows.Err()
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// Смещения и длины в UTF-16 единицах: эмодзи вне BMP занимает две единицы
+func TestParseMentionTokens(t *testing.T) {
+	cases := []struct {
+		text string
+		want []mentionToken
+	}{
+		{"@alice привет", []mentionToken{{"alice", 0, 6}}},
+		{"😀 @bob и @Вася.", []mentionToken{{"bob", 3, 4}, {"Вася", 10, 5}}},
+		{"@john.doe, @a_b", []mentionToken{{"john.doe", 0, 9}, {"a_b", 11, 4}}},
+		{"😀@bob 𝒳@eve", []mentionToken{{"bob", 2, 4}}},
+		{"mail@example.com", nil},
+		{"@@bob", nil},
+		{"@ @. @", nil},
+		{"(@all)", []mentionToken{{"all", 1, 4}}},
+	}
+	for _, c := range cases {
+		if got := parseMentionTokens(c.text); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("parseMentionTokens(%q) = %+v, want %+v", c.text, got, c.want)
+		}
+	}
+}
+
+func TestMentionRecipients(t *testing.T) {
+	participants := []int{1, 2, 3, 4}
+	got := mentionRecipients([]messageMention{{Type: "user", UserID: 2}, {Type: "user", UserID: 1}, {Type: "user", UserID: 2}}, participants, 1)
+	if !reflect.DeepEqual(got, []int{2}) {
+		t.Fatalf("user mentions: %v, want [2]", got)
+	}
+	got = mentionRecipients([]messageMention{{Type: "all"}}, participants, 1)
+	sort.Ints(got)
+	if !reflect.DeepEqual(got, []int{2, 3, 4}) {
+		t.Fatalf("@all: %v, want everyone but the sender", got)
+	}
+}
+
+// Упоминание внутри кода не выделяется
+func TestMergeMentionEntities(t *testing.T) {
+	entities := []messageEntity{{Type: "code", Offset: 6, Length: 6}}
+	mentions := []messageMention{
+		{Type: "user", UserID: 2, Offset: 0, Length: 4},
+		{Type: "user", UserID: 3, Offset: 7, Length: 4},
+	}
+	got := mergeMentionEntities(entities, mentions)
+	want := []messageEntity{
+		{Type: "mention", Offset: 0, Length: 4, UserID: 2},
+		{Type: "code", Offset: 6, Length: 6},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("mergeMentionEntities = %+v, want %+v", got, want)
+	}
+}
+
+// Упоминаются только участники; @all — только администратором группы;
+// счётчик растёт один раз на пользователя и не растёт у автора
+func TestStoreMessageMentions(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.on("JOIN users u ON u.id = p.user_id", func([]driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{{int64(1), "alice"}, {int64(2), "Bob"}}}
+	})
+	fake.on("SELECT is_group FROM chats", func([]driver.Value) fakeResult {
+		return fakeRow(true)
+	})
+	fake.on("p.is_admin OR gc.created_by", func([]driver.Value) fakeResult {
+		return fakeRow(false)
+	})
+
+	mentions, err := storeMessageMentions(db, 100, 10, 1, "@bob @BOB @alice @carol @all", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []messageMention{
+		{Type: "user", UserID: 2, Username: "Bob", Offset: 0, Length: 4},
+		{Type: "user", UserID: 2, Username: "Bob", Offset: 5, Length: 4},
+		{Type: "user", UserID: 1, Username: "alice", Offset: 10, Length: 6},
+	}
+	if !reflect.DeepEqual(mentions, want) {
+		t.Fatalf("mentions %+v, want %+v", mentions, want)
+	}
+	if n := len(fake.queries("INSERT INTO message_mentions")); n != 3 {
+		t.Fatalf("stored %d mentions, want 3", n)
+	}
+	counters := fake.queries("unread_mentions = unread_mentions + 1")
+	if len(counters) != 1 || counters[0].args[1] != int64(2) {
+		t.Fatalf("mention counters: %+v", counters)
+	}
+}
@@ -0,0 +1,295 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+var (
+	// Изменять и удалять сообщение для всех может только его автор
+	errNotMessageAuthor = errors.New("not the message author")
+	// Администратор группы временно запретил участнику писать (/mute)
+	errMemberMuted = errors.New("you are muted in this chat")
+)
+
+// Общий интерфейс для *sql.DB и *sql.Tx с выполнением любых запросов
+type dbExecutor interface {
+	queryRower
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Сообщение чата в том виде, в котором его присылает клиент
+type chatMessage struct {
+	ChatID           int             `json:"chat_id"`
+	UserID           int             `json:"user_id"`
+	Text             string          `json:"text"`
+	ParentMessageID  *int            `json:"parent_message_id"`
+	IsForwarded      bool            `json:"is_forwarded"`
+	OriginalSenderID *int            `json:"original_sender_id"`
+	OriginalChatID   *int            `json:"original_chat_id"`
+	ParseMode        string          `json:"parse_mode"` // "markdown" или пусто
+	Entities         []messageEntity `json:"entities"`
+	AttachmentIDs    []string        `json:"attachment_ids"` // Загруженные заранее файлы (ID загрузок)
+	MessageType      string          `json:"-"`              // Тип сообщения задаёт только сервер (text, poll, album, ...)
+	ReplyMarkup      *inlineKeyboard `json:"-"`              // Кнопки под сообщением (только для сообщений ботов)
+}
+
+// Результат сохранения сообщения в БД
+type storedMessage struct {
+	ID        int
+	CreatedAt time.Time
+	ExpiresAt sql.NullTime // Время автоудаления, если в чате включены исчезающие сообщения
+	Mentions  []messageMention
+	Entities  []messageEntity        // Форматирование вместе с найденными упоминаниями
+	Extra     map[string]interface{} // Дополнительные поля для рассылки (опрос, вложения и т.п.)
+}
+
+// Преобразование необязательного ID в значение для SQL-запроса
+func nullableID(id *int) sql.NullInt64 {
+	if id == nil {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: int64(*id), Valid: true}
+}
+
+// Проверка запрета писать в чат (/mute). Выполняется в точках входа, через которые пишет сам
+// пользователь или бот, а не в storeChatMessage: серверные отправки от имени пользователя
+// (отложенные сообщения) обрабатывают запрет явно
+func checkMemberMuted(db queryRower, chatID, userID int) error {
+	var muted bool
+	err := db.QueryRow(`
+        SELECT EXISTS (
+            SELECT 1 FROM participants
+            WHERE chat_id = $1 AND user_id = $2 AND muted_until > CURRENT_TIMESTAMP
+        )`, chatID, userID).Scan(&muted)
+	if err != nil {
+		return err
+	}
+	if muted {
+		return errMemberMuted
+	}
+	return nil
+}
+
+// Сохранение сообщения в БД и увеличение счётчиков непрочитанных у остальных участников
+func storeChatMessage(db dbExecutor, msg chatMessage) (storedMessage, error) {
+	var stored storedMessage
+	// Время автоудаления вычисляется из настройки чата в момент вставки
+	err := db.QueryRow(`
+        INSERT INTO messages (chat_id, user_id, content, parent_message_id, is_forwarded, original_sender_id, original_chat_id, expires_at, entities, message_type, reply_markup)
+        SELECT $1, $2, $3, $4, $5, $6, $7, `+messageExpirySQL+`, $8::jsonb, COALESCE(NULLIF($9, ''), 'text'), $10::jsonb
+        FROM chats c WHERE c.id = $1
+        RETURNING id, created_at, expires_at`,
+		msg.ChatID, msg.UserID, msg.Text, nullableID(msg.ParentMessageID), msg.IsForwarded, nullableID(msg.OriginalSenderID), nullableID(msg.OriginalChatID),
+		entitiesJSON(msg.Entities), msg.MessageType, replyMarkupJSON(msg.ReplyMarkup),
+	).Scan(&stored.ID, &stored.CreatedAt, &stored.ExpiresAt)
+	if err != nil {
+		return storedMessage{}, err
+	}
+
+	_, err = db.Exec(
+		"UPDATE participants SET unread_count = unread_count + 1 WHERE chat_id = $1 AND user_id != $2",
+		msg.ChatID, msg.UserID,
+	)
+	if err != nil {
+		return storedMessage{}, err
+	}
+
+	stored.Mentions, err = storeMessageMentions(db, stored.ID, msg.ChatID, msg.UserID, msg.Text, nil)
+	if err != nil {
+		return storedMessage{}, err
+	}
+	stored.Entities, err = attachMentionEntities(db, stored.ID, msg.Entities, stored.Mentions)
+	if err != nil {
+		return storedMessage{}, err
+	}
+	return stored, nil
+}
+
+// Дополнение сохранённого форматирования сущностями упоминаний
+func attachMentionEntities(db dbExecutor, messageID int, entities []messageEntity, mentions []messageMention) ([]messageEntity, error) {
+	if len(mentions) == 0 {
+		return entities, nil
+	}
+	merged := mergeMentionEntities(entities, mentions)
+	_, err := db.Exec("UPDATE messages SET entities = $2::jsonb WHERE id = $1", messageID, entitiesJSON(merged))
+	return merged, err
+}
+
+// Рассылка сохранённого сообщения всем участникам чата.
+// sender — соединение отправителя (nil, если сообщение отправлено сервером от имени пользователя)
+func broadcastChatMessage(db *sql.DB, stored storedMessage, msg chatMessage, sender *websocket.Conn) {
+	// Получаем имя отправителя; у ботов и интеграций показывается отображаемое имя
+	var (
+		senderName  string
+		senderIsBot bool
+	)
+	err := db.QueryRow(`
+        SELECT CASE WHEN is_bot THEN COALESCE(name, username) ELSE username END, is_bot
+        FROM users WHERE id = $1`, msg.UserID).Scan(&senderName, &senderIsBot)
+	if err != nil {
+		log.Printf("Ошибка получения имени отправителя: %v", err)
+		senderName = "Unknown"
+	}
+	// Формируем объект сообщения для рассылки
+	msgDataMap := map[string]interface{}{
+		"id":                 stored.ID,
+		"chat_id":            msg.ChatID,
+		"user_id":            msg.UserID,
+		"text":               msg.Text,
+		"created_at":         stored.CreatedAt.Format(time.RFC3339),
+		"isMe":               false,
+		"sender_name":        senderName,
+		"parent_message_id":  msg.ParentMessageID,
+		"is_forwarded":       msg.IsForwarded,
+		"original_sender_id": msg.OriginalSenderID,
+		"original_chat_id":   msg.OriginalChatID,
+	}
+	if len(stored.Mentions) > 0 {
+		msgDataMap["mentions"] = stored.Mentions
+	}
+	if len(stored.Entities) > 0 {
+		msgDataMap["entities"] = stored.Entities
+	}
+	if msg.MessageType != "" {
+		msgDataMap["message_type"] = msg.MessageType
+	}
+	if senderIsBot {
+		msgDataMap["sender_is_bot"] = true
+	}
+	if msg.ReplyMarkup != nil {
+		msgDataMap["reply_markup"] = msg.ReplyMarkup
+	}
+	for key, value := range stored.Extra {
+		msgDataMap[key] = value
+	}
+	if stored.ExpiresAt.Valid {
+		msgDataMap["expires_at"] = stored.ExpiresAt.Time.Format(time.RFC3339)
+	}
+	// Если есть родительское сообщение, получаем его текст
+	if msg.ParentMessageID != nil {
+		var parentContent string
+		err := db.QueryRow("SELECT content FROM messages WHERE id = $1", *msg.ParentMessageID).Scan(&parentContent)
+		if err == nil {
+			msgDataMap["parent_content"] = parentContent
+		} else {
+			log.Printf("Ошибка получения parent_content: %v", err)
+		}
+	}
+
+	emitWebhookEvent(db, msg.ChatID, webhookEventMessageCreated, webhookMessageData(msgDataMap))
+
+	// Получаем участников чата из базы данных
+	participantIDs, err := getChatParticipantIDs(db, msg.ChatID)
+	if err != nil {
+		log.Printf("Ошибка получения участников чата: %v", err)
+		return
+	}
+
+	// Боты-участники чата получают сообщение как обновление
+	queueBotUpdates(db, participantIDs, msg.UserID, botUpdateMessage, webhookMessageData(msgDataMap))
+	// Участники без открытых соединений получают push-уведомление
+	queuePushNotifications(db, participantIDs, msg.UserID, msg.ChatID, stored.ID, senderName, pushPreviewText(msg.Text, msg.MessageType))
+
+	// Упомянутые пользователи дополнительно получают событие mention
+	defer broadcastMentions(stored.Mentions, participantIDs, msg.ChatID, stored.ID, msg.UserID, senderName, msg.Text)
+
+	// Рассылка всем участникам чата
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	log.Printf("Рассылка сообщения клиентам в чате %d (участники: %v)", msg.ChatID, participantIDs)
+	for client, info := range clients {
+		// Проверяем, является ли клиент участником чата
+		for _, pid := range participantIDs {
+			if info.userID == pid {
+				isMe := client == sender || (sender == nil && info.userID == msg.UserID)
+				msgDataMap["isMe"] = isMe
+				messageWithIsMe, _ := json.Marshal(msgDataMap)
+				err := client.WriteMessage(websocket.TextMessage, messageWithIsMe)
+				if err != nil {
+					log.Printf("Ошибка отправки сообщения клиенту (user_id=%d): %v", info.userID, err)
+					client.Close()
+					delete(clients, client)
+				}
+				break // Прерываем внутренний цикл, так как сообщение уже отправлено этому клиенту
+			}
+		}
+	}
+}
+
+// Ошибки проверки текста, о которых сообщается отправителю
+func isMessageValidationError(err error) bool {
+	return errors.Is(err, errMessageTooLong) || errors.Is(err, errTooManyEntities) ||
+		errors.Is(err, errInvalidEntity) || errors.Is(err, errInvalidCharacters) ||
+		errors.Is(err, errInvalidAttachments) || errors.Is(err, errMemberMuted)
+}
+
+// Сохранение и рассылка сообщения — общий путь для всех источников сообщений
+func sendChatMessage(msg chatMessage, sender *websocket.Conn) (int, error) {
+	// Очистка текста и разбор форматирования до сохранения
+	text, entities, err := prepareMessageText(msg.Text, msg.ParseMode, msg.Entities)
+	if err != nil {
+		log.Printf("Сообщение пользователя %d отклонено: %v", msg.UserID, err)
+		return 0, err
+	}
+	msg.Text, msg.Entities, msg.ParseMode = text, entities, ""
+
+	// Подключаемся к базе данных
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("Ошибка подключения к БД при отправке сообщения: %v", err)
+		return 0, err
+	}
+	defer db.Close()
+
+	// Сообщение и его вложения сохраняются одной транзакцией
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Ошибка начала транзакции: %v", err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := checkMemberMuted(tx, msg.ChatID, msg.UserID); err != nil {
+		log.Printf("Сообщение пользователя %d в чат %d отклонено: %v", msg.UserID, msg.ChatID, err)
+		return 0, err
+	}
+	pending, err := lockPendingAttachments(tx, msg.UserID, msg.AttachmentIDs)
+	if err != nil {
+		log.Printf("Вложения сообщения пользователя %d отклонены: %v", msg.UserID, err)
+		return 0, err
+	}
+	if msg.MessageType == "" {
+		msg.MessageType = attachmentsMessageType(pending)
+	}
+
+	// Сохраняем сообщение в базу данных
+	stored, err := storeChatMessage(tx, msg)
+	if err != nil {
+		log.Printf("Ошибка сохранения сообщения в БД: %v", err)
+		return 0, err
+	}
+	attachments, err := attachPendingFiles(tx, stored.ID, pending)
+	if err != nil {
+		log.Printf("Ошибка сохранения вложений: %v", err)
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Ошибка фиксации транзакции: %v", err)
+		return 0, err
+	}
+	if len(attachments) > 0 {
+		stored.Extra = map[string]interface{}{"attachments": attachments}
+	}
+
+	broadcastChatMessage(db, stored, msg, sender)
+	// Превью ссылки приходит отдельным событием message_preview
+	scheduleLinkPreview(stored.ID, msg.ChatID, extractPreviewURL(msg.Text, msg.Entities))
+	return stored.ID, nil
+}
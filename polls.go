@@ -0,0 +1,533 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
+)
+
+const (
+	maxPollQuestion  = 300             // Максимальная длина вопроса
+	maxPollOption    = 100             // Максимальная длина варианта ответа
+	minPollOptions   = 2               // Минимум вариантов
+	maxPollOptions   = 10              // Максимум вариантов
+	pollCloseCheck   = 5 * time.Second // Период проверки опросов с истёкшим временем
+	maxPollOpenHours = 30 * 24         // Максимальная длительность опроса, часов
+)
+
+// Вариант ответа с результатами
+type pollOptionResult struct {
+	ID     int    `json:"id"`
+	Text   string `json:"text"`
+	Votes  int    `json:"votes"`
+	Voters []int  `json:"voters,omitempty"` // Только для открытых (не анонимных) опросов
+}
+
+// Опрос с текущими результатами
+type pollResults struct {
+	ID              int                `json:"id"`
+	MessageID       int                `json:"message_id"`
+	ChatID          int                `json:"chat_id"`
+	Question        string             `json:"question"`
+	Options         []pollOptionResult `json:"options"`
+	MultipleChoice  bool               `json:"multiple_choice"`
+	Anonymous       bool               `json:"anonymous"`
+	Quiz            bool               `json:"quiz"`
+	CorrectOptionID *int               `json:"correct_option_id,omitempty"` // Раскрывается проголосовавшим и после закрытия
+	CloseAt         *time.Time         `json:"close_at,omitempty"`
+	Closed          bool               `json:"closed"`
+	TotalVoters     int                `json:"total_voters"`
+	ChosenOptionIDs []int              `json:"chosen_option_ids,omitempty"` // Выбор текущего пользователя
+	CreatedBy       int                `json:"created_by"`
+}
+
+// Команда WebSocket для опросов
+type pollCommand struct {
+	PollID         int      `json:"poll_id"`
+	ChatID         int      `json:"chat_id"`
+	UserID         int      `json:"user_id"`
+	Question       string   `json:"question"`
+	Options        []string `json:"options"`
+	MultipleChoice bool     `json:"multiple_choice"`
+	Anonymous      *bool    `json:"anonymous"` // По умолчанию опрос анонимный
+	Quiz           bool     `json:"quiz"`
+	CorrectOption  int      `json:"correct_option"` // Индекс правильного варианта в Options (для викторины)
+	CloseAt        string   `json:"close_at"`
+	OptionIDs      []int    `json:"option_ids"`
+}
+
+// Разбор команд опросов из WebSocket
+func handlePollCommand(conn *websocket.Conn, commandType string, message []byte) {
+	var cmd pollCommand
+	if err := json.Unmarshal(message, &cmd); err != nil {
+		log.Printf("Ошибка парсинга команды %s: %v", commandType, err)
+		return
+	}
+
+	switch commandType {
+	case "create_poll":
+		handleCreatePollCommand(conn, cmd)
+	case "poll_vote":
+		handlePollVoteCommand(conn, cmd)
+	case "poll_retract":
+		handlePollVoteCommand(conn, pollCommand{PollID: cmd.PollID, UserID: cmd.UserID})
+	case "poll_close":
+		handlePollCloseCommand(conn, cmd)
+	}
+}
+
+// Проверка и нормализация параметров нового опроса
+func validatePollCommand(cmd *pollCommand) (sql.NullTime, bool) {
+	cmd.Question = strings.TrimSpace(sanitizeMessageText(cmd.Question))
+	if cmd.Question == "" || len([]rune(cmd.Question)) > maxPollQuestion {
+		return sql.NullTime{}, false
+	}
+	if len(cmd.Options) < minPollOptions || len(cmd.Options) > maxPollOptions {
+		return sql.NullTime{}, false
+	}
+	for i, option := range cmd.Options {
+		option = strings.TrimSpace(sanitizeMessageText(option))
+		if option == "" || len([]rune(option)) > maxPollOption {
+			return sql.NullTime{}, false
+		}
+		cmd.Options[i] = option
+	}
+	if cmd.Anonymous == nil {
+		anonymous := true
+		cmd.Anonymous = &anonymous
+	}
+	// Викторина — всегда один правильный вариант
+	if cmd.Quiz && (cmd.MultipleChoice || cmd.CorrectOption < 0 || cmd.CorrectOption >= len(cmd.Options)) {
+		return sql.NullTime{}, false
+	}
+
+	var closeAt sql.NullTime
+	if cmd.CloseAt != "" {
+		t, err := time.Parse(time.RFC3339, cmd.CloseAt)
+		if err != nil || !t.After(time.Now()) || t.Sub(time.Now()) > maxPollOpenHours*time.Hour {
+			return sql.NullTime{}, false
+		}
+		closeAt = sql.NullTime{Time: t, Valid: true}
+	}
+	return closeAt, true
+}
+
+// Создание сообщения-опроса
+func handleCreatePollCommand(conn *websocket.Conn, cmd pollCommand) {
+	closeAt, ok := validatePollCommand(&cmd)
+	if !ok {
+		log.Printf("Некорректный опрос от пользователя %d", cmd.UserID)
+		conn.WriteJSON(map[string]interface{}{
+			"type":    "message_rejected",
+			"chat_id": cmd.ChatID,
+			"error":   "invalid poll",
+		})
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("DB error: %v", err)
+		return
+	}
+	defer db.Close()
+
+	if ok, err := isChatParticipant(db, cmd.ChatID, cmd.UserID); err != nil || !ok {
+		log.Printf("Unauthorized poll attempt: user %d, chat %d", cmd.UserID, cmd.ChatID)
+		return
+	}
+	if err := checkMemberMuted(db, cmd.ChatID, cmd.UserID); err != nil {
+		log.Printf("Опрос пользователя %d в чат %d отклонён: %v", cmd.UserID, cmd.ChatID, err)
+		conn.WriteJSON(map[string]interface{}{
+			"type":    "message_rejected",
+			"chat_id": cmd.ChatID,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Transaction error: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	// Текст сообщения — вопрос, чтобы опрос отображался в списке чатов
+	msg := chatMessage{ChatID: cmd.ChatID, UserID: cmd.UserID, Text: cmd.Question, MessageType: "poll"}
+	stored, err := storeChatMessage(tx, msg)
+	if err != nil {
+		log.Printf("Ошибка сохранения сообщения-опроса: %v", err)
+		return
+	}
+
+	var pollID int
+	err = tx.QueryRow(`
+        INSERT INTO polls (message_id, chat_id, question, multiple_choice, is_anonymous, is_quiz, close_at, created_by)
+        VALUES ($1, $2, $3, $4, $5, $6, $7::timestamptz, $8) RETURNING id`,
+		stored.ID, cmd.ChatID, cmd.Question, cmd.MultipleChoice, *cmd.Anonymous, cmd.Quiz, closeAt, cmd.UserID,
+	).Scan(&pollID)
+	if err != nil {
+		log.Printf("Ошибка сохранения опроса: %v", err)
+		return
+	}
+	for i, option := range cmd.Options {
+		var optionID int
+		err := tx.QueryRow(
+			"INSERT INTO poll_options (poll_id, position, text) VALUES ($1, $2, $3) RETURNING id",
+			pollID, i, option,
+		).Scan(&optionID)
+		if err != nil {
+			log.Printf("Ошибка сохранения варианта опроса: %v", err)
+			return
+		}
+		if cmd.Quiz && i == cmd.CorrectOption {
+			if _, err := tx.Exec("UPDATE polls SET correct_option_id = $2 WHERE id = $1", pollID, optionID); err != nil {
+				log.Printf("Ошибка сохранения правильного ответа: %v", err)
+				return
+			}
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		return
+	}
+
+	polls, err := loadPollResults(db, []int{stored.ID}, 0)
+	if err != nil || polls[stored.ID] == nil {
+		log.Printf("Ошибка загрузки опроса %d: %v", pollID, err)
+		return
+	}
+	stored.Extra = map[string]interface{}{"poll": polls[stored.ID]}
+	broadcastChatMessage(db, stored, msg, conn)
+}
+
+// Голосование: заменяет прежний выбор пользователя; пустой список отзывает голос
+func handlePollVoteCommand(conn *websocket.Conn, cmd pollCommand) {
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("DB error: %v", err)
+		return
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Transaction error: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var (
+		messageID      int
+		chatID         int
+		multipleChoice bool
+		isQuiz         bool
+		closed         bool
+	)
+	// Блокируем опрос, чтобы голосование не пересеклось с закрытием
+	err = tx.QueryRow(`
+        SELECT p.message_id, p.chat_id, p.multiple_choice, p.is_quiz,
+               p.is_closed OR (p.close_at IS NOT NULL AND p.close_at <= CURRENT_TIMESTAMP)
+        FROM polls p
+        JOIN participants pt ON pt.chat_id = p.chat_id AND pt.user_id = $2
+        JOIN messages m ON m.id = p.message_id
+        WHERE p.id = $1 AND NOT m.is_deleted
+        FOR UPDATE OF p`, cmd.PollID, cmd.UserID,
+	).Scan(&messageID, &chatID, &multipleChoice, &isQuiz, &closed)
+	if err != nil {
+		log.Printf("Unauthorized vote: user %d, poll %d: %v", cmd.UserID, cmd.PollID, err)
+		return
+	}
+	if closed {
+		log.Printf("Голос в закрытом опросе %d отклонён", cmd.PollID)
+		return
+	}
+
+	optionIDs := uniqueInts(cmd.OptionIDs)
+	if len(optionIDs) > 1 && !multipleChoice {
+		log.Printf("Несколько вариантов в опросе %d с одиночным выбором", cmd.PollID)
+		return
+	}
+
+	// В викторине ответ окончательный
+	if isQuiz {
+		if len(optionIDs) == 0 {
+			log.Printf("Отзыв ответа в викторине %d невозможен", cmd.PollID)
+			return
+		}
+		var voted bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM poll_votes WHERE poll_id = $1 AND user_id = $2)", cmd.PollID, cmd.UserID).Scan(&voted); err != nil || voted {
+			log.Printf("Повторный ответ в викторине %d от пользователя %d отклонён", cmd.PollID, cmd.UserID)
+			return
+		}
+	}
+
+	if len(optionIDs) > 0 {
+		var valid int
+		err := tx.QueryRow("SELECT COUNT(*) FROM poll_options WHERE poll_id = $1 AND id = ANY($2)", cmd.PollID, pq.Array(intsToInt64(optionIDs))).Scan(&valid)
+		if err != nil || valid != len(optionIDs) {
+			log.Printf("Неизвестные варианты в опросе %d: %v", cmd.PollID, optionIDs)
+			return
+		}
+	}
+
+	if _, err := tx.Exec("DELETE FROM poll_votes WHERE poll_id = $1 AND user_id = $2", cmd.PollID, cmd.UserID); err != nil {
+		log.Printf("Ошибка удаления голоса: %v", err)
+		return
+	}
+	for _, optionID := range optionIDs {
+		if _, err := tx.Exec("INSERT INTO poll_votes (poll_id, option_id, user_id) VALUES ($1, $2, $3)", cmd.PollID, optionID, cmd.UserID); err != nil {
+			log.Printf("Ошибка сохранения голоса: %v", err)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		return
+	}
+
+	broadcastPollUpdate(db, messageID, chatID)
+
+	// Проголосовавший получает свой выбор и, в викторине, правильный ответ
+	own, err := loadPollResults(db, []int{messageID}, cmd.UserID)
+	if err == nil && own[messageID] != nil {
+		broadcastToUsers([]int{cmd.UserID}, map[string]interface{}{
+			"type":    "poll_vote_accepted",
+			"chat_id": chatID,
+			"poll":    own[messageID],
+		})
+	}
+}
+
+// Досрочное закрытие опроса автором или администратором группы
+func handlePollCloseCommand(conn *websocket.Conn, cmd pollCommand) {
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("DB error: %v", err)
+		return
+	}
+	defer db.Close()
+
+	var (
+		messageID int
+		chatID    int
+		createdBy sql.NullInt64
+	)
+	err = db.QueryRow("SELECT message_id, chat_id, created_by FROM polls WHERE id = $1 AND NOT is_closed", cmd.PollID).Scan(&messageID, &chatID, &createdBy)
+	if err != nil {
+		log.Printf("Опрос %d не найден или уже закрыт: %v", cmd.PollID, err)
+		return
+	}
+	if !createdBy.Valid || int(createdBy.Int64) != cmd.UserID {
+		allowed, err := canManageGroup(db, chatID, cmd.UserID)
+		if err != nil || !allowed {
+			log.Printf("Unauthorized poll close: user %d, poll %d", cmd.UserID, cmd.PollID)
+			return
+		}
+	}
+
+	if _, err := db.Exec("UPDATE polls SET is_closed = TRUE, closed_at = CURRENT_TIMESTAMP WHERE id = $1", cmd.PollID); err != nil {
+		log.Printf("Ошибка закрытия опроса %d: %v", cmd.PollID, err)
+		return
+	}
+	broadcastPollUpdate(db, messageID, chatID)
+}
+
+// Рассылка актуальных результатов опроса участникам чата
+func broadcastPollUpdate(db *sql.DB, messageID, chatID int) {
+	polls, err := loadPollResults(db, []int{messageID}, 0)
+	if err != nil || polls[messageID] == nil {
+		log.Printf("Ошибка загрузки результатов опроса сообщения %d: %v", messageID, err)
+		return
+	}
+	participantIDs, err := getChatParticipantIDs(db, chatID)
+	if err != nil {
+		log.Printf("Ошибка получения участников чата %d: %v", chatID, err)
+		return
+	}
+	broadcastToUsers(participantIDs, map[string]interface{}{
+		"type":       "poll_updated",
+		"chat_id":    chatID,
+		"message_id": messageID,
+		"poll":       polls[messageID],
+	})
+}
+
+// Загрузка опросов с результатами по ID сообщений.
+// viewerID — пользователь, для которого отмечается его выбор (0 — общий вид без личных данных)
+func loadPollResults(db *sql.DB, messageIDs []int, viewerID int) (map[int]*pollResults, error) {
+	result := make(map[int]*pollResults)
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+
+	rows, err := db.Query(`
+        SELECT p.id, p.message_id, p.chat_id, p.question, p.multiple_choice, p.is_anonymous, p.is_quiz, p.correct_option_id,
+               p.close_at, p.is_closed OR (p.close_at IS NOT NULL AND p.close_at <= CURRENT_TIMESTAMP), COALESCE(p.created_by, 0)
+        FROM polls p
+        JOIN messages m ON m.id = p.message_id
+        WHERE p.message_id = ANY($1) AND NOT m.is_deleted`, pq.Array(intsToInt64(messageIDs)))
+	if err != nil {
+		return nil, err
+	}
+	byPoll := make(map[int]*pollResults)
+	correct := make(map[int]int)
+	var pollIDs []int
+	for rows.Next() {
+		var (
+			poll      pollResults
+			correctID sql.NullInt64
+			closeAt   sql.NullTime
+		)
+		if err := rows.Scan(&poll.ID, &poll.MessageID, &poll.ChatID, &poll.Question, &poll.MultipleChoice, &poll.Anonymous,
+			&poll.Quiz, &correctID, &closeAt, &poll.Closed, &poll.CreatedBy); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if closeAt.Valid {
+			poll.CloseAt = &closeAt.Time
+		}
+		if correctID.Valid {
+			correct[poll.ID] = int(correctID.Int64)
+		}
+		p := poll
+		byPoll[poll.ID] = &p
+		result[poll.MessageID] = &p
+		pollIDs = append(pollIDs, poll.ID)
+	}
+	rows.Close()
+	if len(pollIDs) == 0 {
+		return result, rows.Err()
+	}
+
+	optionIndex := make(map[int]*pollOptionResult)
+	rows, err = db.Query("SELECT id, poll_id, text FROM poll_options WHERE poll_id = ANY($1) ORDER BY poll_id, position", pq.Array(intsToInt64(pollIDs)))
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var (
+			option pollOptionResult
+			pollID int
+		)
+		if err := rows.Scan(&option.ID, &pollID, &option.Text); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		byPoll[pollID].Options = append(byPoll[pollID].Options, option)
+	}
+	rows.Close()
+	for _, poll := range byPoll {
+		for i := range poll.Options {
+			optionIndex[poll.Options[i].ID] = &poll.Options[i]
+		}
+	}
+
+	rows, err = db.Query("SELECT poll_id, option_id, user_id FROM poll_votes WHERE poll_id = ANY($1) ORDER BY created_at", pq.Array(intsToInt64(pollIDs)))
+	if err != nil {
+		return nil, err
+	}
+	voters := make(map[int]map[int]bool)
+	for rows.Next() {
+		var pollID, optionID, userID int
+		if err := rows.Scan(&pollID, &optionID, &userID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		poll := byPoll[pollID]
+		if option := optionIndex[optionID]; option != nil {
+			option.Votes++
+			if !poll.Anonymous {
+				option.Voters = append(option.Voters, userID)
+			}
+		}
+		if voters[pollID] == nil {
+			voters[pollID] = make(map[int]bool)
+		}
+		voters[pollID][userID] = true
+		if viewerID != 0 && userID == viewerID {
+			poll.ChosenOptionIDs = append(poll.ChosenOptionIDs, optionID)
+		}
+	}
+	rows.Close()
+
+	for pollID, poll := range byPoll {
+		poll.TotalVoters = len(voters[pollID])
+		// Правильный ответ виден только ответившему или после закрытия викторины
+		if id, ok := correct[pollID]; ok && (poll.Closed || len(poll.ChosenOptionIDs) > 0) {
+			correctID := id
+			poll.CorrectOptionID = &correctID
+		}
+	}
+	return result, rows.Err()
+}
+
+// Фоновое закрытие опросов, у которых истекло время
+func startPollCloser() {
+	go func() {
+		ticker := time.NewTicker(pollCloseCheck)
+		defer ticker.Stop()
+		for range ticker.C {
+			closeDuePolls()
+		}
+	}()
+}
+
+func closeDuePolls() {
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("Опросы: ошибка подключения к БД: %v", err)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+        UPDATE polls SET is_closed = TRUE, closed_at = CURRENT_TIMESTAMP
+        WHERE NOT is_closed AND close_at IS NOT NULL AND close_at <= CURRENT_TIMESTAMP
+        RETURNING message_id, chat_id`)
+	if err != nil {
+		log.Printf("Опросы: ошибка закрытия: %v", err)
+		return
+	}
+	type closedPoll struct{ messageID, chatID int }
+	var closed []closedPoll
+	for rows.Next() {
+		var p closedPoll
+		if err := rows.Scan(&p.messageID, &p.chatID); err == nil {
+			closed = append(closed, p)
+		}
+	}
+	rows.Close()
+
+	for _, p := range closed {
+		broadcastPollUpdate(db, p.messageID, p.chatID)
+	}
+}
+
+// Удаление повторов из списка ID
+func uniqueInts(values []int) []int {
+	seen := make(map[int]bool)
+	var result []int
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			result = append(result, v)
+		}
+	}
+	return result
+}
+
+// Преобразование для pq.Array
+func intsToInt64(values []int) []int64 {
+	result := make([]int64, len(values))
+	for i, v := range values {
+		result[i] = int64(v)
+	}
+	return result
+}
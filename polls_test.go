@@ -0,0 +1,112 @@
+package main
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Опрос без явного флага — анонимный, как и в схеме (is_anonymous DEFAULT TRUE)
+func TestValidatePollCommandAnonymousByDefault(t *testing.T) {
+	cases := map[string]bool{
+		`{"question":"Q","options":["a","b"]}`:                   true,
+		`{"question":"Q","options":["a","b"],"anonymous":true}`:  true,
+		`{"question":"Q","options":["a","b"],"anonymous":false}`: false,
+	}
+	for raw, want := range cases {
+		var cmd pollCommand
+		if err := json.Unmarshal([]byte(raw), &cmd); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := validatePollCommand(&cmd); !ok || *cmd.Anonymous != want {
+			t.Errorf("%s: valid %v, anonymous %v; want %v", raw, ok, cmd.Anonymous, want)
+		}
+	}
+
+	// /poll не передаёт флаг
+	cmd := pollCommand{Question: "Вопрос ", Options: []string{" Да", "Нет "}}
+	if _, ok := validatePollCommand(&cmd); !ok || !*cmd.Anonymous {
+		t.Fatalf("/poll: valid %v, anonymous %v; want anonymous", ok, cmd.Anonymous)
+	}
+	if cmd.Question != "Вопрос" || !reflect.DeepEqual(cmd.Options, []string{"Да", "Нет"}) {
+		t.Fatalf("options not normalized: %q %q", cmd.Question, cmd.Options)
+	}
+}
+
+func TestValidatePollCommandRejects(t *testing.T) {
+	cases := map[string]pollCommand{
+		"empty question":       {Question: " ", Options: []string{"a", "b"}},
+		"one option":           {Question: "Q", Options: []string{"a"}},
+		"too many options":     {Question: "Q", Options: strings.Split(strings.Repeat("a,", maxPollOptions), ",")},
+		"blank option":         {Question: "Q", Options: []string{"a", " "}},
+		"multiple choice quiz": {Question: "Q", Options: []string{"a", "b"}, Quiz: true, MultipleChoice: true},
+		"quiz answer range":    {Question: "Q", Options: []string{"a", "b"}, Quiz: true, CorrectOption: 2},
+		"close in the past":    {Question: "Q", Options: []string{"a", "b"}, CloseAt: "2000-01-01T00:00:00Z"},
+		"close not RFC 3339":   {Question: "Q", Options: []string{"a", "b"}, CloseAt: "tomorrow"},
+	}
+	for name, cmd := range cases {
+		if _, ok := validatePollCommand(&cmd); ok {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+// Голоса анонимного опроса считаются без списка проголосовавших;
+// правильный ответ викторины раскрывается только ответившему
+func TestLoadPollResults(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.on("FROM polls p", func([]driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{
+			{int64(1), int64(100), int64(10), "Анонимный", false, true, true, int64(12), nil, false, int64(7)},
+			{int64(2), int64(200), int64(10), "Открытый", false, false, false, nil, nil, false, int64(7)},
+		}}
+	})
+	fake.on("FROM poll_options", func([]driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{
+			{int64(11), int64(1), "a"}, {int64(12), int64(1), "b"},
+			{int64(21), int64(2), "a"}, {int64(22), int64(2), "b"},
+		}}
+	})
+	fake.on("FROM poll_votes", func([]driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{
+			{int64(1), int64(11), int64(5)}, {int64(1), int64(12), int64(6)},
+			{int64(2), int64(22), int64(5)}, {int64(2), int64(22), int64(6)},
+		}}
+	})
+
+	polls, err := loadPollResults(db, []int{100, 200}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q := fake.queries("FROM polls p"); len(q) != 1 || !strings.Contains(q[0].query, "NOT m.is_deleted") {
+		t.Fatal("polls of deleted messages are not excluded")
+	}
+
+	anonymous := polls[100]
+	if anonymous.TotalVoters != 2 || anonymous.Options[0].Votes != 1 || anonymous.Options[1].Votes != 1 {
+		t.Fatalf("anonymous poll counts: %+v", anonymous)
+	}
+	for _, option := range anonymous.Options {
+		if len(option.Voters) != 0 {
+			t.Fatalf("anonymous poll exposes voters: %+v", option)
+		}
+	}
+	if anonymous.CorrectOptionID == nil || *anonymous.CorrectOptionID != 12 || !reflect.DeepEqual(anonymous.ChosenOptionIDs, []int{11}) {
+		t.Fatalf("quiz for a voter: correct %v, chosen %v", anonymous.CorrectOptionID, anonymous.ChosenOptionIDs)
+	}
+
+	public := polls[200]
+	if public.Options[1].Votes != 2 || !reflect.DeepEqual(public.Options[1].Voters, []int{5, 6}) {
+		t.Fatalf("public poll voters: %+v", public.Options)
+	}
+
+	notVoted, err := loadPollResults(db, []int{100}, 9)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notVoted[100].CorrectOptionID != nil {
+		t.Fatal("quiz answer revealed before voting")
+	}
+}
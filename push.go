@@ -0,0 +1,662 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/lib/pq"
+)
+
+// Push-уведомления: участники чата без открытого WebSocket-соединения получают уведомление
+// на зарегистрированные устройства. Уведомления копятся в очереди по паре (устройство, чат):
+// пока уведомление не отправлено, новые сообщения чата сворачиваются в него, а на устройстве
+// оно заменяет предыдущее по ключу чата. Неудачные отправки повторяются, недействительные
+// токены удаляются
+const (
+	pushPlatformFCM     = "fcm"
+	pushPlatformAPNs    = "apns"
+	pushPlatformWebPush = "webpush"
+	pushPlatformMock    = "mock"
+
+	pushTimeout        = 10 * time.Second
+	pushPollInterval   = 2 * time.Second
+	pushCollapseDelay  = 2 * time.Second // Сообщения, пришедшие за это время, уходят одним уведомлением
+	pushBatchSize      = 50
+	pushMaxAttempts    = 5
+	pushBaseRetryDelay = 5 * time.Second
+	pushMaxRetryDelay  = 5 * time.Minute
+	pushLease          = time.Minute
+	pushPreviewLength  = 100
+	maxPushDevices     = 20 // Устройств на пользователя
+	maxPushTokenLength = 2048
+	maxPushSessionID   = 64
+)
+
+var errInvalidPushToken = errors.New("push token is no longer valid")
+
+// Отправка уведомления через сервис платформы. Недействительный токен — errInvalidPushToken,
+// остальные ошибки считаются временными
+type pushProvider interface {
+	Send(ctx context.Context, device pushDevice, n pushNotification) error
+}
+
+// Провайдеры по платформам; пусто — push-уведомления отключены
+var pushProviders = make(map[string]pushProvider)
+
+// Сигнал диспетчеру о новых уведомлениях
+var pushWake = make(chan struct{}, 1)
+
+// Зарегистрированное устройство
+type pushDevice struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	SessionID  string     `json:"session_id"`
+	Platform   string     `json:"platform"`
+	Token      string     `json:"-"`
+	P256dh     string     `json:"-"`
+	Auth       string     `json:"-"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastPushAt *time.Time `json:"last_push_at,omitempty"`
+}
+
+// Уведомление о новых сообщениях в чате
+type pushNotification struct {
+	ChatID       int    `json:"chat_id"`
+	MessageID    int    `json:"message_id"`
+	Title        string `json:"title"`
+	Body         string `json:"body"`
+	MessageCount int    `json:"message_count"`
+	CollapseKey  string `json:"collapse_key"` // Уведомление заменяет предыдущее с тем же ключом
+}
+
+// Данные уведомления для приложения (строки — требование FCM)
+func (n pushNotification) data() map[string]string {
+	return map[string]string{
+		"chat_id":       strconv.Itoa(n.ChatID),
+		"message_id":    strconv.Itoa(n.MessageID),
+		"message_count": strconv.Itoa(n.MessageCount),
+	}
+}
+
+// Настройка по переменным окружения: PUSH=off отключает уведомления; провайдеры включаются
+// своими параметрами (FCM_CREDENTIALS_FILE, APNS_*, VAPID_*), PUSH_MOCK=on — локальный провайдер для проверки
+func initPushNotifications() {
+	if os.Getenv("PUSH") == "off" {
+		return
+	}
+	if file := os.Getenv("FCM_CREDENTIALS_FILE"); file != "" {
+		if provider, err := newFCMProvider(file); err != nil {
+			log.Printf("Push: FCM отключён: %v", err)
+		} else {
+			pushProviders[pushPlatformFCM] = provider
+		}
+	}
+	if file := os.Getenv("APNS_KEY_FILE"); file != "" {
+		provider, err := newAPNsProvider(file, os.Getenv("APNS_KEY_ID"), os.Getenv("APNS_TEAM_ID"),
+			os.Getenv("APNS_TOPIC"), os.Getenv("APNS_SANDBOX") == "on")
+		if err != nil {
+			log.Printf("Push: APNs отключён: %v", err)
+		} else {
+			pushProviders[pushPlatformAPNs] = provider
+		}
+	}
+	if key := os.Getenv("VAPID_PRIVATE_KEY"); key != "" {
+		provider, err := newWebPushProvider(key, os.Getenv("VAPID_SUBJECT"), parseAllowedAddrs(os.Getenv("PUSH_ALLOWED_ADDRS")))
+		if err != nil {
+			log.Printf("Push: Web Push отключён: %v", err)
+		} else {
+			pushProviders[pushPlatformWebPush] = provider
+		}
+	}
+	if os.Getenv("PUSH_MOCK") == "on" {
+		pushProviders[pushPlatformMock] = &mockPushProvider{}
+	}
+}
+
+// Пользователи из списка, у которых нет открытых соединений
+func offlineUserIDs(userIDs []int) []int {
+	clientsMu.Lock()
+	online := make(map[int]bool, len(clients))
+	for _, info := range clients {
+		online[info.userID] = true
+	}
+	clientsMu.Unlock()
+
+	var offline []int
+	for _, id := range userIDs {
+		if !online[id] {
+			offline = append(offline, id)
+		}
+	}
+	return offline
+}
+
+func isUserOnline(userID int) bool {
+	return len(offlineUserIDs([]int{userID})) == 0
+}
+
+// Краткий текст сообщения для уведомления
+func pushPreviewText(text, messageType string) string {
+	text = strings.Join(strings.Fields(text), " ")
+	if utf8.RuneCountInString(text) > pushPreviewLength {
+		text = string([]rune(text)[:pushPreviewLength]) + "…"
+	}
+	if text != "" && messageType != "voice" && messageType != "location" {
+		return text
+	}
+	switch messageType {
+	case "voice":
+		return "Голосовое сообщение"
+	case "album":
+		return "Альбом"
+	case "location":
+		return "Местоположение"
+	case "sticker":
+		return "Стикер"
+	default:
+		return "Новое сообщение"
+	}
+}
+
+// Постановка уведомлений для участников без соединений (кроме отправителя).
+// Неотправленное уведомление того же чата обновляется, а не дублируется
+func queuePushNotifications(db *sql.DB, participantIDs []int, senderID, chatID, messageID int, senderName, preview string) {
+	if len(pushProviders) == 0 {
+		return
+	}
+	recipients := pushRecipients(participantIDs, senderID)
+	if len(recipients) == 0 {
+		return
+	}
+	result, err := db.Exec(`
+        INSERT INTO push_notifications (device_id, chat_id, message_id, sender_name, preview, next_attempt_at)
+        SELECT d.id, $2, $3, $4, $5, CURRENT_TIMESTAMP + $6 * INTERVAL '1 millisecond'
+        FROM push_devices d
+        WHERE d.user_id = ANY($1)
+        ON CONFLICT (device_id, chat_id) DO UPDATE
+        SET message_id = EXCLUDED.message_id,
+            sender_name = EXCLUDED.sender_name,
+            preview = EXCLUDED.preview,
+            message_count = push_notifications.message_count + 1,
+            attempts = 0,
+            next_attempt_at = LEAST(push_notifications.next_attempt_at, EXCLUDED.next_attempt_at)`,
+		pq.Array(intsToInt64(recipients)), chatID, messageID, senderName, preview, pushCollapseDelay.Milliseconds())
+	if err != nil {
+		log.Printf("Push: ошибка постановки уведомлений для чата %d: %v", chatID, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		select {
+		case pushWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Отзыв неотправленных уведомлений о сообщении, удалённом у всех, чтобы его текст не попал
+// на устройства. Уведомление только об этом сообщении удаляется; свёрнутое уведомление
+// переводится на последнее оставшееся сообщение чата от другого участника
+func withdrawPushNotifications(db *sql.DB, messageID int) {
+	if _, err := db.Exec("DELETE FROM push_notifications WHERE message_id = $1 AND message_count <= 1", messageID); err != nil {
+		log.Printf("Push: ошибка отзыва уведомлений о сообщении %d: %v", messageID, err)
+		return
+	}
+	rows, err := db.Query(`
+        SELECT n.device_id, n.chat_id, d.user_id
+        FROM push_notifications n
+        JOIN push_devices d ON d.id = n.device_id
+        WHERE n.message_id = $1`, messageID)
+	if err != nil {
+		log.Printf("Push: ошибка выборки уведомлений о сообщении %d: %v", messageID, err)
+		return
+	}
+	type collapsed struct{ deviceID, chatID, userID int }
+	var pending []collapsed
+	for rows.Next() {
+		var c collapsed
+		if err := rows.Scan(&c.deviceID, &c.chatID, &c.userID); err != nil {
+			log.Printf("Push: ошибка чтения уведомления: %v", err)
+			continue
+		}
+		pending = append(pending, c)
+	}
+	rows.Close()
+
+	for _, c := range pending {
+		var (
+			latestID                      int
+			senderName, text, messageType string
+		)
+		err := db.QueryRow(`
+            SELECT m.id, COALESCE(CASE WHEN u.is_bot THEN COALESCE(u.name, u.username) ELSE u.username END, 'Unknown'),
+                   m.content, m.message_type
+            FROM messages m
+            LEFT JOIN users u ON u.id = m.user_id
+            WHERE m.chat_id = $1 AND m.id != $2 AND NOT m.is_deleted AND NOT m.is_system
+              AND m.user_id IS DISTINCT FROM $3
+            ORDER BY m.created_at DESC, m.id DESC
+            LIMIT 1`, c.chatID, messageID, c.userID).Scan(&latestID, &senderName, &text, &messageType)
+		if err == sql.ErrNoRows {
+			_, err = db.Exec("DELETE FROM push_notifications WHERE device_id = $1 AND chat_id = $2 AND message_id = $3",
+				c.deviceID, c.chatID, messageID)
+		} else if err == nil {
+			_, err = db.Exec(`
+                UPDATE push_notifications
+                SET message_id = $4, sender_name = $5, preview = $6, message_count = message_count - 1
+                WHERE device_id = $1 AND chat_id = $2 AND message_id = $3`,
+				c.deviceID, c.chatID, messageID, latestID, senderName, pushPreviewText(text, messageType))
+		}
+		if err != nil {
+			log.Printf("Push: ошибка отзыва уведомления устройства %d: %v", c.deviceID, err)
+		}
+	}
+}
+
+// Получатели уведомления: участники без открытых соединений, кроме отправителя
+func pushRecipients(participantIDs []int, senderID int) []int {
+	var recipients []int
+	for _, id := range offlineUserIDs(participantIDs) {
+		if id != senderID {
+			recipients = append(recipients, id)
+		}
+	}
+	return recipients
+}
+
+// Задержка перед повторной отправкой: экспоненциальный рост со случайной добавкой
+func pushRetryDelay(attempts int) time.Duration {
+	delay := time.Duration(float64(pushBaseRetryDelay) * math.Pow(2, float64(attempts-1)))
+	if delay > pushMaxRetryDelay || delay <= 0 {
+		delay = pushMaxRetryDelay
+	}
+	return delay + time.Duration(mathrand.Int63n(int64(delay)/5+1))
+}
+
+// Фоновая отправка push-уведомлений
+func startPushDispatcher() {
+	if len(pushProviders) == 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(pushPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-pushWake:
+				// Новое уведомление ждёт, пока в него свернутся следующие сообщения чата
+				time.Sleep(pushCollapseDelay)
+			}
+			dispatchPushNotifications()
+		}
+	}()
+}
+
+func dispatchPushNotifications() {
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("Push: ошибка подключения к БД: %v", err)
+		return
+	}
+	defer db.Close()
+
+	// Уведомления берутся в работу с арендой, как доставки вебхуков
+	rows, err := db.Query(`
+        UPDATE push_notifications n
+        SET attempts = n.attempts + 1,
+            next_attempt_at = CURRENT_TIMESTAMP + $2 * INTERVAL '1 second'
+        FROM push_devices d
+        WHERE d.id = n.device_id AND (n.device_id, n.chat_id) IN (
+            SELECT device_id, chat_id FROM push_notifications
+            WHERE next_attempt_at <= CURRENT_TIMESTAMP
+            ORDER BY next_attempt_at
+            LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING n.chat_id, n.message_id, n.sender_name, n.preview, n.message_count, n.attempts,
+                  (SELECT gc.name FROM group_chats gc WHERE gc.chat_id = n.chat_id),
+                  d.id, d.user_id, d.platform, d.token, COALESCE(d.p256dh, ''), COALESCE(d.auth, '')`,
+		pushBatchSize, int(pushLease.Seconds()))
+	if err != nil {
+		log.Printf("Push: ошибка выборки уведомлений: %v", err)
+		return
+	}
+	type job struct {
+		device       pushDevice
+		notification pushNotification
+		attempts     int
+	}
+	var jobs []job
+	for rows.Next() {
+		var (
+			j                   job
+			senderName, preview string
+			groupName           sql.NullString
+		)
+		err := rows.Scan(&j.notification.ChatID, &j.notification.MessageID, &senderName, &preview,
+			&j.notification.MessageCount, &j.attempts, &groupName,
+			&j.device.ID, &j.device.UserID, &j.device.Platform, &j.device.Token, &j.device.P256dh, &j.device.Auth)
+		if err != nil {
+			log.Printf("Push: ошибка чтения уведомления: %v", err)
+			continue
+		}
+		j.notification = newPushNotification(j.notification.ChatID, j.notification.MessageID, j.notification.MessageCount,
+			groupName, senderName, preview)
+		jobs = append(jobs, j)
+	}
+	rows.Close()
+
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		wg.Add(1)
+		go func(j job) {
+			defer wg.Done()
+			// Пользователь подключился, пока уведомление ждало отправки, — сообщения он уже получил
+			if isUserOnline(j.device.UserID) {
+				completePushNotification(db, j.device.ID, j.notification)
+				return
+			}
+			provider := pushProviders[j.device.Platform]
+			if provider == nil {
+				log.Printf("Push: нет провайдера для платформы %s (устройство %d)", j.device.Platform, j.device.ID)
+				completePushNotification(db, j.device.ID, j.notification)
+				return
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), pushTimeout)
+			err := provider.Send(ctx, j.device, j.notification)
+			cancel()
+			recordPushAttempt(db, j.device, j.notification, j.attempts, err)
+		}(j)
+	}
+	wg.Wait()
+}
+
+// Уведомление по записи очереди; свёрнутые сообщения чата показываются одним уведомлением
+// с общим ключом, заменяющим предыдущее на устройстве
+func newPushNotification(chatID, messageID, count int, groupName sql.NullString, senderName, preview string) pushNotification {
+	title, body := pushNotificationText(groupName, senderName, preview, count)
+	return pushNotification{
+		ChatID:       chatID,
+		MessageID:    messageID,
+		Title:        title,
+		Body:         body,
+		MessageCount: count,
+		CollapseKey:  fmt.Sprintf("chat-%d", chatID),
+	}
+}
+
+// Заголовок и текст уведомления: в группе — название группы и автор, в личном чате — автор
+func pushNotificationText(groupName sql.NullString, senderName, preview string, count int) (string, string) {
+	title := senderName
+	if groupName.Valid {
+		title = groupName.String
+	}
+	if count > 1 {
+		return title, fmt.Sprintf("Новых сообщений: %d", count)
+	}
+	if groupName.Valid {
+		return title, senderName + ": " + preview
+	}
+	return title, preview
+}
+
+// Удаление отправленного уведомления. Если за время отправки пришло новое сообщение,
+// уведомление уже обновлено и остаётся в очереди
+func completePushNotification(db *sql.DB, deviceID int, n pushNotification) {
+	_, err := db.Exec(
+		"DELETE FROM push_notifications WHERE device_id = $1 AND chat_id = $2 AND message_id = $3",
+		deviceID, n.ChatID, n.MessageID)
+	if err != nil {
+		log.Printf("Push: ошибка удаления уведомления устройства %d: %v", deviceID, err)
+	}
+}
+
+// Исход попытки отправки с номером attempts: sent, invalid_token (устройство удаляется),
+// expired (попытки исчерпаны) или retry с задержкой до следующей попытки
+func pushAttemptOutcome(attempts int, sendErr error) (string, time.Duration) {
+	switch {
+	case sendErr == nil:
+		return "sent", 0
+	case errors.Is(sendErr, errInvalidPushToken):
+		return "invalid_token", 0
+	case attempts >= pushMaxAttempts:
+		return "expired", 0
+	default:
+		return "retry", pushRetryDelay(attempts)
+	}
+}
+
+// Результат отправки: успех, удаление недействительного токена или повтор с задержкой
+func recordPushAttempt(db *sql.DB, device pushDevice, n pushNotification, attempts int, sendErr error) {
+	var err error
+	outcome, retryDelay := pushAttemptOutcome(attempts, sendErr)
+	switch outcome {
+	case "sent":
+		completePushNotification(db, device.ID, n)
+		_, err = db.Exec("UPDATE push_devices SET last_push_at = CURRENT_TIMESTAMP WHERE id = $1", device.ID)
+	case "invalid_token":
+		log.Printf("Push: токен устройства %d (%s) недействителен, устройство удалено", device.ID, device.Platform)
+		_, err = db.Exec("DELETE FROM push_devices WHERE id = $1", device.ID)
+	case "expired":
+		log.Printf("Push: уведомление для устройства %d не отправлено после %d попыток: %v", device.ID, attempts, sendErr)
+		completePushNotification(db, device.ID, n)
+	default:
+		_, err = db.Exec(`
+            UPDATE push_notifications
+            SET next_attempt_at = CURRENT_TIMESTAMP + $3 * INTERVAL '1 millisecond'
+            WHERE device_id = $1 AND chat_id = $2`, device.ID, n.ChatID, retryDelay.Milliseconds())
+	}
+	if err != nil {
+		log.Printf("Push: ошибка обновления состояния устройства %d: %v", device.ID, err)
+	}
+}
+
+// Проверка токена устройства для платформы
+func validPushDevice(platform, token, p256dh, auth string) bool {
+	if token == "" || len(token) > maxPushTokenLength || !utf8.ValidString(token) || strings.ContainsAny(token, " \t\r\n") {
+		return false
+	}
+	switch platform {
+	case pushPlatformAPNs:
+		for _, c := range token {
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return false
+			}
+		}
+		return true
+	case pushPlatformWebPush:
+		return strings.HasPrefix(token, "https://") && validWebhookURL(token) && validWebPushKeys(p256dh, auth)
+	default:
+		return true
+	}
+}
+
+// Устройства пользователя (GET ?user_id), регистрация устройства сессии
+// (POST {user_id, session_id, platform, token, keys{p256dh, auth}}) и отмена регистрации
+// при выходе (DELETE ?user_id&session_id)
+func pushDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	switch r.Method {
+	case "GET":
+		userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+		if err != nil {
+			http.Error(w, "User ID is required", http.StatusBadRequest)
+			return
+		}
+		rows, err := db.Query(`
+            SELECT id, user_id, session_id, platform, created_at, last_push_at
+            FROM push_devices WHERE user_id = $1 ORDER BY created_at`, userID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		devices := []pushDevice{}
+		for rows.Next() {
+			var (
+				d          pushDevice
+				lastPushAt sql.NullTime
+			)
+			if err := rows.Scan(&d.ID, &d.UserID, &d.SessionID, &d.Platform, &d.CreatedAt, &lastPushAt); err != nil {
+				continue
+			}
+			if lastPushAt.Valid {
+				d.LastPushAt = &lastPushAt.Time
+			}
+			devices = append(devices, d)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(devices)
+
+	case "POST":
+		var data struct {
+			UserID    int    `json:"user_id"`
+			SessionID string `json:"session_id"`
+			Platform  string `json:"platform"`
+			Token     string `json:"token"`
+			Keys      struct {
+				P256dh string `json:"p256dh"`
+				Auth   string `json:"auth"`
+			} `json:"keys"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		data.SessionID = strings.TrimSpace(data.SessionID)
+		if data.SessionID == "" || len(data.SessionID) > maxPushSessionID {
+			http.Error(w, "Session ID is required", http.StatusBadRequest)
+			return
+		}
+		if pushProviders[data.Platform] == nil {
+			http.Error(w, "Push platform is not available", http.StatusBadRequest)
+			return
+		}
+		if !validPushDevice(data.Platform, data.Token, data.Keys.P256dh, data.Keys.Auth) {
+			http.Error(w, "Invalid device token", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		// Прежняя регистрация сессии и тот же токен у другого пользователя (смена учётной записи) заменяются
+		_, err = tx.Exec(`
+            DELETE FROM push_devices
+            WHERE (user_id = $1 AND session_id = $2) OR (platform = $3 AND token = $4)`,
+			data.UserID, data.SessionID, data.Platform, data.Token)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM push_devices WHERE user_id = $1", data.UserID).Scan(&count); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if count >= maxPushDevices {
+			http.Error(w, "Too many devices", http.StatusConflict)
+			return
+		}
+
+		device := pushDevice{UserID: data.UserID, SessionID: data.SessionID, Platform: data.Platform}
+		err = tx.QueryRow(`
+            INSERT INTO push_devices (user_id, session_id, platform, token, p256dh, auth)
+            SELECT u.id, $2, $3, $4, NULLIF($5, ''), NULLIF($6, '')
+            FROM users u WHERE u.id = $1 AND NOT u.is_bot
+            RETURNING id, created_at`,
+			data.UserID, data.SessionID, data.Platform, data.Token, data.Keys.P256dh, data.Keys.Auth,
+		).Scan(&device.ID, &device.CreatedAt)
+		if err == sql.ErrNoRows {
+			http.Error(w, "User not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			log.Printf("Push: ошибка регистрации устройства: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(device)
+
+	case "DELETE":
+		userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+		sessionID := r.URL.Query().Get("session_id")
+		if err != nil || sessionID == "" {
+			http.Error(w, "User ID and session ID are required", http.StatusBadRequest)
+			return
+		}
+		if _, err := db.Exec("DELETE FROM push_devices WHERE user_id = $1 AND session_id = $2", userID, sessionID); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Доступные платформы и открытый ключ VAPID для подписки Web Push
+func pushConfigHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	platforms := []string{}
+	for _, platform := range []string{pushPlatformFCM, pushPlatformAPNs, pushPlatformWebPush, pushPlatformMock} {
+		if pushProviders[platform] != nil {
+			platforms = append(platforms, platform)
+		}
+	}
+	config := map[string]interface{}{"platforms": platforms}
+	if provider, ok := pushProviders[pushPlatformWebPush].(*webPushProvider); ok {
+		config["vapid_public_key"] = provider.applicationServerKey()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(config)
+}
+
+// Уведомления, «отправленные» локальным провайдером (GET ?user_id); только при PUSH_MOCK=on
+func pushMockHandler(w http.ResponseWriter, r *http.Request) {
+	provider, ok := pushProviders[pushPlatformMock].(*mockPushProvider)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Error(w, "User ID is required", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(provider.sentTo(userID))
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Провайдеры push-уведомлений: Firebase Cloud Messaging (HTTP v1), Apple Push Notification
+// service (HTTP/2, авторизация токеном) и Web Push (RFC 8030) с шифрованием RFC 8291 и VAPID.
+// Учётные данные сервисов подписываются JWT без сторонних библиотек
+const (
+	fcmScope          = "https://www.googleapis.com/auth/firebase.messaging"
+	fcmSendURL        = "https://fcm.googleapis.com/v1/projects/%s/messages:send"
+	apnsProductionURL = "https://api.push.apple.com"
+	apnsSandboxURL    = "https://api.sandbox.push.apple.com"
+	apnsTokenLifetime = 50 * time.Minute // Apple принимает токен не дольше часа
+	webPushTTL        = 24 * time.Hour   // Сколько сервис хранит уведомление для выключенного устройства
+	webPushRecordSize = 4096
+	vapidTokenExpiry  = 12 * time.Hour
+	maxMockPushes     = 200
+	maxProviderError  = 512 // Сколько байт ответа сервиса попадает в текст ошибки
+)
+
+var base64URL = base64.RawURLEncoding
+
+// JWT с подписью sign; заголовок и утверждения сериализуются как есть
+func signJWT(header, claims map[string]interface{}, sign func(digest []byte) ([]byte, error)) (string, error) {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64URL.EncodeToString(headerJSON) + "." + base64URL.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := sign(digest[:])
+	if err != nil {
+		return "", err
+	}
+	return unsigned + "." + base64URL.EncodeToString(signature), nil
+}
+
+// Подпись ES256: r и s по 32 байта подряд (RFC 7518), а не ASN.1
+func es256Signer(key *ecdsa.PrivateKey) func([]byte) ([]byte, error) {
+	return func(digest []byte) ([]byte, error) {
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest)
+		if err != nil {
+			return nil, err
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature, nil
+	}
+}
+
+// Закрытый ключ PKCS#8 из PEM (сервисный аккаунт Google, ключ .p8 Apple)
+func parsePKCS8PrivateKey(data []byte) (interface{}, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	return x509.ParsePKCS8PrivateKey(block.Bytes)
+}
+
+// Ошибка с началом ответа сервиса для журнала
+func pushResponseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, maxProviderError))
+	return fmt.Errorf("push service responded %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+}
+
+// Firebase Cloud Messaging: ключ сервисного аккаунта обменивается на access token OAuth 2.0
+type fcmProvider struct {
+	client      *http.Client
+	projectID   string
+	clientEmail string
+	tokenURI    string
+	key         *rsa.PrivateKey
+
+	mu          sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+func newFCMProvider(credentialsFile string) (*fcmProvider, error) {
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	var credentials struct {
+		ProjectID   string `json:"project_id"`
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+		TokenURI    string `json:"token_uri"`
+	}
+	if err := json.Unmarshal(data, &credentials); err != nil {
+		return nil, err
+	}
+	if credentials.ProjectID == "" || credentials.ClientEmail == "" || credentials.TokenURI == "" {
+		return nil, errors.New("incomplete service account credentials")
+	}
+	parsed, err := parsePKCS8PrivateKey([]byte(credentials.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("service account key is not RSA")
+	}
+	return &fcmProvider{
+		client:      &http.Client{Timeout: pushTimeout},
+		projectID:   credentials.ProjectID,
+		clientEmail: credentials.ClientEmail,
+		tokenURI:    credentials.TokenURI,
+		key:         key,
+	}, nil
+}
+
+// Access token кешируется до истечения срока
+func (p *fcmProvider) token(ctx context.Context) (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.accessToken != "" && time.Now().Before(p.expiresAt) {
+		return p.accessToken, nil
+	}
+
+	now := time.Now()
+	assertion, err := signJWT(
+		map[string]interface{}{"alg": "RS256", "typ": "JWT"},
+		map[string]interface{}{
+			"iss":   p.clientEmail,
+			"scope": fcmScope,
+			"aud":   p.tokenURI,
+			"iat":   now.Unix(),
+			"exp":   now.Add(time.Hour).Unix(),
+		},
+		func(digest []byte) ([]byte, error) {
+			return rsa.SignPKCS1v15(rand.Reader, p.key, crypto.SHA256, digest)
+		})
+	if err != nil {
+		return "", err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", p.tokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", pushResponseError(resp)
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", err
+	}
+	// Токен обновляется с запасом до истечения
+	p.accessToken = result.AccessToken
+	p.expiresAt = now.Add(time.Duration(result.ExpiresIn)*time.Second - time.Minute)
+	return p.accessToken, nil
+}
+
+func (p *fcmProvider) Send(ctx context.Context, device pushDevice, n pushNotification) error {
+	accessToken, err := p.token(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"message": map[string]interface{}{
+			"token":        device.Token,
+			"notification": map[string]string{"title": n.Title, "body": n.Body},
+			"data":         n.data(),
+			"android": map[string]interface{}{
+				"collapse_key": n.CollapseKey,
+				"priority":     "high",
+				"notification": map[string]string{"tag": n.CollapseKey},
+			},
+			"apns": map[string]interface{}{
+				"headers": map[string]string{"apns-collapse-id": n.CollapseKey},
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", fmt.Sprintf(fcmSendURL, p.projectID), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return nil
+	case resp.StatusCode == http.StatusNotFound:
+		// UNREGISTERED: приложение удалено или токен устарел
+		return errInvalidPushToken
+	case resp.StatusCode == http.StatusUnauthorized:
+		p.mu.Lock()
+		p.accessToken = ""
+		p.mu.Unlock()
+	}
+	return pushResponseError(resp)
+}
+
+// Apple Push Notification service: запросы по HTTP/2 с токеном ES256 ключа .p8
+type apnsProvider struct {
+	client *http.Client
+	host   string
+	keyID  string
+	teamID string
+	topic  string // Bundle ID приложения
+	key    *ecdsa.PrivateKey
+
+	mu       sync.Mutex
+	jwt      string
+	issuedAt time.Time
+}
+
+func newAPNsProvider(keyFile, keyID, teamID, topic string, sandbox bool) (*apnsProvider, error) {
+	if keyID == "" || teamID == "" || topic == "" {
+		return nil, errors.New("APNS_KEY_ID, APNS_TEAM_ID and APNS_TOPIC are required")
+	}
+	data, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := parsePKCS8PrivateKey(data)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("APNs key is not ECDSA")
+	}
+	host := apnsProductionURL
+	if sandbox {
+		host = apnsSandboxURL
+	}
+	// Стандартный транспорт согласует HTTP/2 через ALPN, который требуется APNs
+	return &apnsProvider{
+		client: &http.Client{Timeout: pushTimeout},
+		host:   host,
+		keyID:  keyID,
+		teamID: teamID,
+		topic:  topic,
+		key:    key,
+	}, nil
+}
+
+func (p *apnsProvider) token() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.jwt != "" && time.Since(p.issuedAt) < apnsTokenLifetime {
+		return p.jwt, nil
+	}
+	now := time.Now()
+	jwt, err := signJWT(
+		map[string]interface{}{"alg": "ES256", "kid": p.keyID},
+		map[string]interface{}{"iss": p.teamID, "iat": now.Unix()},
+		es256Signer(p.key))
+	if err != nil {
+		return "", err
+	}
+	p.jwt, p.issuedAt = jwt, now
+	return jwt, nil
+}
+
+func (p *apnsProvider) Send(ctx context.Context, device pushDevice, n pushNotification) error {
+	jwt, err := p.token()
+	if err != nil {
+		return err
+	}
+	payload := map[string]interface{}{
+		"aps": map[string]interface{}{
+			"alert":     map[string]string{"title": n.Title, "body": n.Body},
+			"sound":     "default",
+			"thread-id": n.CollapseKey,
+		},
+	}
+	for key, value := range n.data() {
+		payload[key] = value
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", p.host+"/3/device/"+device.Token, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "bearer "+jwt)
+	req.Header.Set("apns-topic", p.topic)
+	req.Header.Set("apns-push-type", "alert")
+	req.Header.Set("apns-priority", "10")
+	req.Header.Set("apns-collapse-id", n.CollapseKey)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		return nil
+	}
+	// 410 — токен больше не активен; 400 с причиной о токене — токен не от этого приложения
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxProviderError))
+	var result struct {
+		Reason string `json:"reason"`
+	}
+	json.Unmarshal(data, &result)
+	switch {
+	case resp.StatusCode == http.StatusGone,
+		result.Reason == "BadDeviceToken", result.Reason == "DeviceTokenNotForTopic", result.Reason == "Unregistered":
+		return errInvalidPushToken
+	case resp.StatusCode == http.StatusForbidden && result.Reason == "ExpiredProviderToken":
+		p.mu.Lock()
+		p.jwt = ""
+		p.mu.Unlock()
+	}
+	return fmt.Errorf("apns responded %d: %s", resp.StatusCode, result.Reason)
+}
+
+// Web Push: содержимое шифруется ключами подписки браузера (aes128gcm, RFC 8291),
+// сервер подтверждает себя ключом VAPID (RFC 8292)
+type webPushProvider struct {
+	client    *http.Client
+	subject   string // mailto: или https: для связи с администратором
+	key       *ecdsa.PrivateKey
+	publicKey []byte // Несжатая точка P-256
+}
+
+// Ключ VAPID — 32 байта закрытого ключа P-256 в base64url, как у распространённых утилит web-push
+func newWebPushProvider(privateKey, subject string, allowedAddrs map[string]bool) (*webPushProvider, error) {
+	if !strings.HasPrefix(subject, "mailto:") && !strings.HasPrefix(subject, "https://") {
+		return nil, errors.New("VAPID_SUBJECT must be a mailto: or https: URL")
+	}
+	raw, err := base64URL.DecodeString(strings.TrimRight(privateKey, "="))
+	if err != nil {
+		return nil, err
+	}
+	ecdhKey, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, err
+	}
+	publicKey := ecdhKey.PublicKey().Bytes()
+	key := &ecdsa.PrivateKey{
+		PublicKey: ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(publicKey[1:33]),
+			Y:     new(big.Int).SetBytes(publicKey[33:]),
+		},
+		D: new(big.Int).SetBytes(raw),
+	}
+	// Адрес подписки задаёт клиент, поэтому запросы идут через транспорт с защитой от SSRF
+	return &webPushProvider{
+		client: &http.Client{
+			Transport: newRestrictedTransport(allowedAddrs, pushTimeout),
+			Timeout:   pushTimeout,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		subject:   subject,
+		key:       key,
+		publicKey: publicKey,
+	}, nil
+}
+
+// Открытый ключ для PushManager.subscribe (applicationServerKey)
+func (p *webPushProvider) applicationServerKey() string {
+	return base64URL.EncodeToString(p.publicKey)
+}
+
+// Ключи подписки браузера: p256dh — точка P-256, auth — 16 байт
+func validWebPushKeys(p256dh, auth string) bool {
+	public, err := base64URL.DecodeString(strings.TrimRight(p256dh, "="))
+	if err != nil {
+		return false
+	}
+	if _, err := ecdh.P256().NewPublicKey(public); err != nil {
+		return false
+	}
+	secret, err := base64URL.DecodeString(strings.TrimRight(auth, "="))
+	return err == nil && len(secret) == 16
+}
+
+// Шифрование одной записи aes128gcm по RFC 8291
+func encryptWebPush(plaintext []byte, p256dh, auth string) ([]byte, error) {
+	uaPublicBytes, err := base64URL.DecodeString(strings.TrimRight(p256dh, "="))
+	if err != nil {
+		return nil, err
+	}
+	authSecret, err := base64URL.DecodeString(strings.TrimRight(auth, "="))
+	if err != nil {
+		return nil, err
+	}
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return encryptWebPushRecord(plaintext, uaPublicBytes, authSecret, asPrivate, salt)
+}
+
+// Шифрование с заданными ключом сервера и солью (для каждого сообщения — новые)
+func encryptWebPushRecord(plaintext, uaPublicBytes, authSecret []byte, asPrivate *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := asPrivate.PublicKey().Bytes()
+	sharedSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+
+	// IKM из общего секрета и секрета подписки
+	prkKey, err := hkdf.Extract(sha256.New, sharedSecret, authSecret)
+	if err != nil {
+		return nil, err
+	}
+	keyInfo := "WebPush: info\x00" + string(uaPublicBytes) + string(asPublic)
+	ikm, err := hkdf.Expand(sha256.New, prkKey, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	prk, err := hkdf.Extract(sha256.New, ikm, salt)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// Единственная запись завершается разделителем 0x02
+	record := append(append([]byte(nil), plaintext...), 0x02)
+	if len(record)+gcm.Overhead() > webPushRecordSize {
+		return nil, errors.New("push payload is too large")
+	}
+
+	// Заголовок: salt, размер записи, ключ отправителя
+	header := make([]byte, 0, 16+4+1+len(asPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+	return gcm.Seal(header, nonce, record, nil), nil
+}
+
+func (p *webPushProvider) Send(ctx context.Context, device pushDevice, n pushNotification) error {
+	endpoint, err := url.Parse(device.Token)
+	if err != nil {
+		return errInvalidPushToken
+	}
+	plaintext, err := json.Marshal(map[string]interface{}{
+		"title": n.Title,
+		"body":  n.Body,
+		"tag":   n.CollapseKey,
+		"data":  n.data(),
+	})
+	if err != nil {
+		return err
+	}
+	body, err := encryptWebPush(plaintext, device.P256dh, device.Auth)
+	if err != nil {
+		return err
+	}
+	jwt, err := signJWT(
+		map[string]interface{}{"typ": "JWT", "alg": "ES256"},
+		map[string]interface{}{
+			"aud": endpoint.Scheme + "://" + endpoint.Host,
+			"exp": time.Now().Add(vapidTokenExpiry).Unix(),
+			"sub": p.subject,
+		},
+		es256Signer(p.key))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", device.Token, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", fmt.Sprintf("%d", int(webPushTTL.Seconds())))
+	req.Header.Set("Urgency", "high")
+	// Непрочитанное уведомление того же чата заменяется сервисом
+	req.Header.Set("Topic", n.CollapseKey)
+	req.Header.Set("Authorization", fmt.Sprintf("vapid t=%s, k=%s", jwt, p.applicationServerKey()))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		return nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		// Подписка отозвана или истекла
+		return errInvalidPushToken
+	}
+	return pushResponseError(resp)
+}
+
+// Локальный провайдер для проверки без внешних сервисов: уведомления сохраняются в памяти.
+// Токен с префиксом invalid считается недействительным, с префиксом fail — временно недоступным
+type mockPushProvider struct {
+	mu   sync.Mutex
+	sent []mockPush
+}
+
+type mockPush struct {
+	DeviceID     int              `json:"device_id"`
+	UserID       int              `json:"user_id"`
+	Token        string           `json:"token"`
+	Notification pushNotification `json:"notification"`
+	SentAt       time.Time        `json:"sent_at"`
+}
+
+func (p *mockPushProvider) Send(ctx context.Context, device pushDevice, n pushNotification) error {
+	switch {
+	case strings.HasPrefix(device.Token, "invalid"):
+		return errInvalidPushToken
+	case strings.HasPrefix(device.Token, "fail"):
+		return errors.New("mock push service is unavailable")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sent = append(p.sent, mockPush{DeviceID: device.ID, UserID: device.UserID, Token: device.Token, Notification: n, SentAt: time.Now()})
+	if len(p.sent) > maxMockPushes {
+		p.sent = p.sent[len(p.sent)-maxMockPushes:]
+	}
+	log.Printf("Push (mock): устройство %d пользователя %d: %s — %s", device.ID, device.UserID, n.Title, n.Body)
+	return nil
+}
+
+func (p *mockPushProvider) sentTo(userID int) []mockPush {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	result := []mockPush{}
+	for _, push := range p.sent {
+		if push.UserID == userID {
+			result = append(result, push)
+		}
+	}
+	return result
+}
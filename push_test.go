@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/sha256"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/gorilla/websocket"
+)
+
+// Пример из RFC 8291, раздел 5
+const (
+	rfc8291Plaintext = "When I grow up, I want to be a watermelon"
+	rfc8291ASPrivate = "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"
+	rfc8291UAPrivate = "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"
+	rfc8291UAPublic  = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	rfc8291Auth      = "BTBZMqHH6r4Tts7J_aSIgg"
+	rfc8291Salt      = "DGv6ra1nlYgDCS1FRnbzlw"
+	rfc8291Message   = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+)
+
+func mustDecodeB64(t *testing.T, s string) []byte {
+	t.Helper()
+	data, err := base64URL.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestEncryptWebPushRFC8291(t *testing.T) {
+	asPrivate, err := ecdh.P256().NewPrivateKey(mustDecodeB64(t, rfc8291ASPrivate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := encryptWebPushRecord([]byte(rfc8291Plaintext), mustDecodeB64(t, rfc8291UAPublic),
+		mustDecodeB64(t, rfc8291Auth), asPrivate, mustDecodeB64(t, rfc8291Salt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if encoded := base64URL.EncodeToString(got); encoded != rfc8291Message {
+		t.Fatalf("message =\n%s\nwant\n%s", encoded, rfc8291Message)
+	}
+}
+
+// Расшифровка на стороне браузера (RFC 8291, RFC 8188)
+func decryptWebPush(t *testing.T, message []byte, uaPrivate *ecdh.PrivateKey, authSecret []byte) []byte {
+	t.Helper()
+	if len(message) < 21 || len(message) < 21+int(message[20]) {
+		t.Fatal("short message")
+	}
+	salt, keyLen := message[:16], int(message[20])
+	if rs := binary.BigEndian.Uint32(message[16:]); rs != webPushRecordSize {
+		t.Fatalf("record size %d", rs)
+	}
+	asPublic, err := ecdh.P256().NewPublicKey(message[21 : 21+keyLen])
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared, err := uaPrivate.ECDH(asPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prkKey, _ := hkdf.Extract(sha256.New, shared, authSecret)
+	ikm, _ := hkdf.Expand(sha256.New, prkKey, "WebPush: info\x00"+string(uaPrivate.PublicKey().Bytes())+string(asPublic.Bytes()), 32)
+	prk, _ := hkdf.Extract(sha256.New, ikm, salt)
+	cek, _ := hkdf.Expand(sha256.New, prk, "Content-Encoding: aes128gcm\x00", 16)
+	nonce, _ := hkdf.Expand(sha256.New, prk, "Content-Encoding: nonce\x00", 12)
+	block, _ := aes.NewCipher(cek)
+	gcm, _ := cipher.NewGCM(block)
+	record, err := gcm.Open(nil, nonce, message[21+keyLen:], nil)
+	if err != nil {
+		t.Fatalf("decrypt: %v", err)
+	}
+	if len(record) == 0 || record[len(record)-1] != 0x02 {
+		t.Fatalf("bad padding delimiter in %x", record)
+	}
+	return record[:len(record)-1]
+}
+
+func TestEncryptWebPushRoundTrip(t *testing.T) {
+	uaPrivate, err := ecdh.P256().NewPrivateKey(mustDecodeB64(t, rfc8291UAPrivate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if base64URL.EncodeToString(uaPrivate.PublicKey().Bytes()) != rfc8291UAPublic {
+		t.Fatal("RFC 8291 key pair mismatch")
+	}
+	if !validWebPushKeys(rfc8291UAPublic, rfc8291Auth+"==") {
+		t.Fatal("RFC 8291 subscription keys rejected")
+	}
+
+	first, err := encryptWebPush([]byte(rfc8291Plaintext), rfc8291UAPublic, rfc8291Auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _ := encryptWebPush([]byte(rfc8291Plaintext), rfc8291UAPublic, rfc8291Auth)
+	if string(first[:16]) == string(second[:16]) || string(first[21:86]) == string(second[21:86]) {
+		t.Fatal("salt and server key must be fresh for every message")
+	}
+	if got := decryptWebPush(t, first, uaPrivate, mustDecodeB64(t, rfc8291Auth)); string(got) != rfc8291Plaintext {
+		t.Fatalf("decrypted %q", got)
+	}
+
+	if _, err := encryptWebPush(make([]byte, webPushRecordSize), rfc8291UAPublic, rfc8291Auth); err == nil {
+		t.Fatal("oversized payload accepted")
+	}
+}
+
+// Подключённый пользователь получает сообщения по WebSocket, уведомление ему не ставится
+func TestPushRecipientsOfflineOnly(t *testing.T) {
+	conn := new(websocket.Conn)
+	clientsMu.Lock()
+	clients[conn] = clientInfo{userID: 2, chatID: 10}
+	clientsMu.Unlock()
+	defer func() {
+		clientsMu.Lock()
+		delete(clients, conn)
+		clientsMu.Unlock()
+	}()
+
+	got := pushRecipients([]int{1, 2, 3, 4}, 1)
+	if len(got) != 2 || got[0] != 3 || got[1] != 4 {
+		t.Fatalf("pushRecipients = %v, want [3 4]", got)
+	}
+	if !isUserOnline(2) || isUserOnline(3) {
+		t.Fatal("isUserOnline does not match registered clients")
+	}
+}
+
+func TestNewPushNotificationCollapse(t *testing.T) {
+	group := sql.NullString{String: "Team", Valid: true}
+	single := newPushNotification(10, 100, 1, group, "alice", "hi")
+	if single.Title != "Team" || single.Body != "alice: hi" || single.CollapseKey != "chat-10" {
+		t.Fatalf("single message: %+v", single)
+	}
+	// Сообщения, пришедшие до отправки, сворачиваются в одно уведомление с тем же ключом
+	collapsed := newPushNotification(10, 103, 4, group, "bob", "last")
+	if collapsed.Title != "Team" || collapsed.Body != "Новых сообщений: 4" || collapsed.CollapseKey != single.CollapseKey ||
+		collapsed.MessageID != 103 || collapsed.data()["message_count"] != "4" {
+		t.Fatalf("collapsed: %+v", collapsed)
+	}
+	direct := newPushNotification(11, 5, 1, sql.NullString{}, "carol", "hello")
+	if direct.Title != "carol" || direct.Body != "hello" || direct.CollapseKey == single.CollapseKey {
+		t.Fatalf("direct chat: %+v", direct)
+	}
+}
+
+// Цикл отправки, как в dispatchPushNotifications: мок-провайдер и исход каждой попытки
+func TestMockPushProviderOutcomes(t *testing.T) {
+	provider := &mockPushProvider{}
+	n := newPushNotification(10, 100, 1, sql.NullString{}, "alice", "hi")
+
+	send := func(device pushDevice) (string, int) {
+		for attempts := 1; ; attempts++ {
+			outcome, delay := pushAttemptOutcome(attempts, provider.Send(context.Background(), device, n))
+			if outcome != "retry" {
+				return outcome, attempts
+			}
+			if delay < pushBaseRetryDelay<<(attempts-1) || delay > pushMaxRetryDelay+pushMaxRetryDelay/5 {
+				t.Fatalf("retry %d: delay %v", attempts, delay)
+			}
+		}
+	}
+
+	if outcome, attempts := send(pushDevice{ID: 1, UserID: 7, Platform: pushPlatformMock, Token: "device-token"}); outcome != "sent" || attempts != 1 {
+		t.Fatalf("valid token: %s after %d attempts", outcome, attempts)
+	}
+	if sent := provider.sentTo(7); len(sent) != 1 || sent[0].DeviceID != 1 || sent[0].Notification != n {
+		t.Fatalf("sentTo(7) = %+v", sent)
+	}
+	if outcome, attempts := send(pushDevice{ID: 2, UserID: 8, Token: "invalid-token"}); outcome != "invalid_token" || attempts != 1 {
+		t.Fatalf("invalid token: %s after %d attempts", outcome, attempts)
+	}
+	if outcome, attempts := send(pushDevice{ID: 3, UserID: 8, Token: "fail-token"}); outcome != "expired" || attempts != pushMaxAttempts {
+		t.Fatalf("failing token: %s after %d attempts", outcome, attempts)
+	}
+	if sent := provider.sentTo(8); len(sent) != 0 {
+		t.Fatalf("failed devices recorded as sent: %+v", sent)
+	}
+	if outcome, _ := pushAttemptOutcome(1, errors.Join(errors.New("HTTP 410"), errInvalidPushToken)); outcome != "invalid_token" {
+		t.Fatalf("wrapped invalid token: %s", outcome)
+	}
+}
+
+func TestPushRetryDelayCapped(t *testing.T) {
+	for attempts := 1; attempts <= 30; attempts++ {
+		if delay := pushRetryDelay(attempts); delay < pushBaseRetryDelay || delay > pushMaxRetryDelay+pushMaxRetryDelay/5 {
+			t.Fatalf("pushRetryDelay(%d) = %v", attempts, delay)
+		}
+	}
+}
+
+// Уведомление об удалённом у всех сообщении отзывается: одиночное удаляется,
+// свёрнутое переводится на последнее оставшееся сообщение чата
+func TestWithdrawPushNotifications(t *testing.T) {
+	const deletedID = 42
+	db, fake := newFakeDB(t)
+	fake.on("FROM push_notifications n", func([]driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{
+			{int64(1), int64(10), int64(100)},
+			{int64(2), int64(20), int64(200)},
+		}}
+	})
+	fake.on("FROM messages m", func(args []driver.Value) fakeResult {
+		if args[0].(int64) == 20 {
+			return fakeResult{}
+		}
+		return fakeRow(int64(41), "alice", "предыдущее сообщение", "text")
+	})
+
+	withdrawPushNotifications(db, deletedID)
+
+	single := fake.queries("message_count <= 1")
+	if len(single) != 1 || single[0].args[0] != int64(deletedID) {
+		t.Fatalf("single notifications not deleted: %+v", single)
+	}
+	repointed := fake.queries("UPDATE push_notifications")
+	if len(repointed) != 1 {
+		t.Fatalf("collapsed notifications updated %d times, want 1", len(repointed))
+	}
+	want := []driver.Value{int64(1), int64(10), int64(deletedID), int64(41), "alice", "предыдущее сообщение"}
+	if !reflect.DeepEqual(repointed[0].args, want) {
+		t.Fatalf("collapsed notification re-pointed with %v, want %v", repointed[0].args, want)
+	}
+	// В чате не осталось других сообщений — уведомление удаляется
+	removed := fake.queries("DELETE FROM push_notifications WHERE device_id = $1")
+	if len(removed) != 1 || removed[0].args[0] != int64(2) {
+		t.Fatalf("notification without remaining messages: %+v", removed)
+	}
+	if latest := fake.queries("FROM messages m"); latest[0].args[2] != int64(100) {
+		t.Fatalf("recipient's own messages not excluded: %v", latest[0].args)
+	}
+}
@@ -0,0 +1,462 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
+)
+
+const (
+	defaultMaxReactions = 3  // Реакций одного пользователя на сообщение по умолчанию
+	maxReactionsLimit   = 10 // Верхняя граница настройки чата
+	maxAllowedReactions = 50 // Максимальный размер списка разрешённых реакций
+	maxReactionLength   = 50 // Длина реакции в символах (как в схеме)
+)
+
+var (
+	errReactionNotAllowed = errors.New("reaction is not allowed in this chat")
+	errInvalidReaction    = errors.New("invalid reaction")
+	errReactionForbidden  = errors.New("not a chat participant")
+)
+
+// Сводка по одной реакции на сообщение
+type reactionSummary struct {
+	Reaction    string   `json:"reaction"`
+	Count       int      `json:"count"`
+	ReactedByMe bool     `json:"reacted_by_me,omitempty"`
+	CustomEmoji *sticker `json:"custom_emoji,omitempty"` // Для реакций вида emoji:<id>
+}
+
+// Нормализация текста реакции
+func normalizeReaction(reaction string) (string, bool) {
+	reaction = strings.TrimSpace(reaction)
+	if reaction == "" || !utf8.ValidString(reaction) || utf8.RuneCountInString(reaction) > maxReactionLength {
+		return "", false
+	}
+	return reaction, true
+}
+
+// Добавление реакции с учётом настроек чата.
+// При превышении лимита самые старые реакции пользователя снимаются; возвращаются признак
+// добавления (false, если такая реакция уже стояла) и снятые реакции
+func addMessageReaction(db *sql.DB, messageID, userID int, reaction string) (int, bool, []string, error) {
+	reaction, ok := normalizeReaction(reaction)
+	if !ok {
+		return 0, false, nil, errInvalidReaction
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, false, nil, err
+	}
+	defer tx.Rollback()
+
+	var (
+		chatID     int
+		allowed    []string
+		maxPerUser int
+	)
+	err = tx.QueryRow(`
+        SELECT c.id, c.allowed_reactions, c.max_reactions_per_user
+        FROM messages m
+        JOIN chats c ON c.id = m.chat_id
+        JOIN participants p ON p.chat_id = c.id AND p.user_id = $2
+        WHERE m.id = $1 AND NOT m.is_deleted
+        FOR UPDATE OF p`, messageID, userID,
+	).Scan(&chatID, pq.Array(&allowed), &maxPerUser)
+	if err == sql.ErrNoRows {
+		return 0, false, nil, errReactionForbidden
+	}
+	if err != nil {
+		return 0, false, nil, err
+	}
+	if allowed != nil && !containsString(allowed, reaction) {
+		return 0, false, nil, errReactionNotAllowed
+	}
+	if err := validateCustomEmojiReaction(tx, reaction); err != nil {
+		return 0, false, nil, err
+	}
+
+	result, err := tx.Exec(`
+        INSERT INTO message_reactions (message_id, user_id, reaction) VALUES ($1, $2, $3)
+        ON CONFLICT (message_id, user_id, reaction) DO NOTHING`,
+		messageID, userID, reaction)
+	if err != nil {
+		return 0, false, nil, err
+	}
+	// Повторная реакция ничего не меняет: лимит не пересчитывается, событие не рассылается
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		return chatID, false, nil, nil
+	}
+
+	rows, err := tx.Query(`
+        DELETE FROM message_reactions WHERE id IN (
+            SELECT id FROM message_reactions
+            WHERE message_id = $1 AND user_id = $2
+            ORDER BY created_at DESC, id DESC
+            OFFSET $3
+        )
+        RETURNING reaction`, messageID, userID, maxPerUser)
+	if err != nil {
+		return 0, false, nil, err
+	}
+	var removed []string
+	for rows.Next() {
+		var r string
+		if err := rows.Scan(&r); err == nil {
+			removed = append(removed, r)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, false, nil, err
+	}
+
+	return chatID, true, removed, tx.Commit()
+}
+
+// Снятие реакции пользователя с сообщения
+func removeMessageReaction(db *sql.DB, messageID, userID int, reaction string) (int, bool, error) {
+	reaction, ok := normalizeReaction(reaction)
+	if !ok {
+		return 0, false, errInvalidReaction
+	}
+
+	var chatID int
+	err := db.QueryRow(`
+        SELECT m.chat_id FROM messages m
+        JOIN participants p ON p.chat_id = m.chat_id AND p.user_id = $2
+        WHERE m.id = $1 AND NOT m.is_deleted`, messageID, userID).Scan(&chatID)
+	if err == sql.ErrNoRows {
+		return 0, false, errReactionForbidden
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	result, err := db.Exec("DELETE FROM message_reactions WHERE message_id = $1 AND user_id = $2 AND reaction = $3", messageID, userID, reaction)
+	if err != nil {
+		return 0, false, err
+	}
+	affected, _ := result.RowsAffected()
+	return chatID, affected > 0, nil
+}
+
+// Рассылка изменения реакций участникам чата
+func broadcastReaction(db *sql.DB, chatID, messageID, userID int, action, reaction string) {
+	summaries, err := loadReactionSummaries(db, []int{messageID}, 0)
+	if err != nil {
+		log.Printf("Ошибка загрузки реакций сообщения %d: %v", messageID, err)
+	}
+	participantIDs, err := getChatParticipantIDs(db, chatID)
+	if err != nil {
+		log.Printf("Ошибка получения участников чата %d: %v", chatID, err)
+		return
+	}
+	list := summaries[messageID]
+	if list == nil {
+		list = []reactionSummary{}
+	}
+	if action == "added" {
+		emitWebhookEvent(db, chatID, webhookEventReactionAdded, map[string]interface{}{
+			"chat_id":    chatID,
+			"message_id": messageID,
+			"user_id":    userID,
+			"reaction":   reaction,
+		})
+	}
+	broadcastToUsers(participantIDs, map[string]interface{}{
+		"type":       "reaction",
+		"action":     action, // added или removed
+		"chat_id":    chatID,
+		"message_id": messageID,
+		"user_id":    userID,
+		"reaction":   reaction,
+		"reactions":  list,
+	})
+}
+
+// Сводка реакций для набора сообщений в порядке первой реакции каждого вида.
+// viewerID — пользователь, для которого отмечается reacted_by_me (0 — без отметки)
+func loadReactionSummaries(db *sql.DB, messageIDs []int, viewerID int) (map[int][]reactionSummary, error) {
+	result := make(map[int][]reactionSummary)
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+
+	rows, err := db.Query(`
+        SELECT r.message_id, r.reaction, COUNT(*), BOOL_OR(r.user_id = $2)
+        FROM message_reactions r
+        JOIN messages m ON m.id = r.message_id
+        WHERE r.message_id = ANY($1) AND NOT m.is_deleted
+        GROUP BY r.message_id, r.reaction
+        ORDER BY r.message_id, MIN(r.created_at)`, pq.Array(intsToInt64(messageIDs)), viewerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			messageID int
+			summary   reactionSummary
+		)
+		if err := rows.Scan(&messageID, &summary.Reaction, &summary.Count, &summary.ReactedByMe); err != nil {
+			log.Printf("Ошибка чтения реакции: %v", err)
+			continue
+		}
+		result[messageID] = append(result[messageID], summary)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	attachCustomEmoji(db, result)
+	return result, nil
+}
+
+// Добавление или снятие реакции через WebSocket
+func handleReactionCommand(conn *websocket.Conn, commandType string, messageID, userID int, reaction string) {
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("DB error: %v", err)
+		return
+	}
+	defer db.Close()
+
+	if commandType == "remove_reaction" {
+		chatID, removed, err := removeMessageReaction(db, messageID, userID, reaction)
+		if err != nil {
+			log.Printf("Ошибка снятия реакции: %v", err)
+			return
+		}
+		if removed {
+			broadcastReaction(db, chatID, messageID, userID, "removed", strings.TrimSpace(reaction))
+		}
+		return
+	}
+
+	chatID, added, removed, err := addMessageReaction(db, messageID, userID, reaction)
+	if err != nil {
+		log.Printf("Реакция пользователя %d на сообщение %d отклонена: %v", userID, messageID, err)
+		conn.WriteJSON(map[string]interface{}{
+			"type":       "reaction_rejected",
+			"message_id": messageID,
+			"reaction":   reaction,
+			"error":      err.Error(),
+		})
+		return
+	}
+	for _, r := range removed {
+		broadcastReaction(db, chatID, messageID, userID, "removed", r)
+	}
+	if added {
+		broadcastReaction(db, chatID, messageID, userID, "added", strings.TrimSpace(reaction))
+	}
+}
+
+// Ответ клиенту по ошибке изменения реакции
+func writeReactionError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errInvalidReaction):
+		http.Error(w, "Invalid reaction", http.StatusBadRequest)
+	case errors.Is(err, errReactionNotAllowed):
+		http.Error(w, "Reaction is not allowed in this chat", http.StatusForbidden)
+	case errors.Is(err, errReactionForbidden):
+		http.Error(w, "Message not found", http.StatusNotFound)
+	default:
+		log.Printf("Ошибка изменения реакции: %v", err)
+		http.Error(w, "Failed to update reaction", http.StatusInternalServerError)
+	}
+}
+
+// removeReactionHandler снимает одну реакцию пользователя с сообщения
+func removeReactionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var data struct {
+		MessageID int    `json:"message_id"`
+		UserID    int    `json:"user_id"`
+		Reaction  string `json:"reaction"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	chatID, removed, err := removeMessageReaction(db, data.MessageID, data.UserID, data.Reaction)
+	if err != nil {
+		writeReactionError(w, err)
+		return
+	}
+	if removed {
+		broadcastReaction(db, chatID, data.MessageID, data.UserID, "removed", strings.TrimSpace(data.Reaction))
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("Reaction removed successfully"))
+}
+
+// chatReactionsHandler возвращает или меняет настройки реакций чата:
+// список разрешённых реакций (пустой — любые) и лимит реакций одного пользователя
+func chatReactionsHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	switch r.Method {
+	case "GET":
+		chatID, err1 := strconv.Atoi(r.URL.Query().Get("chat_id"))
+		userID, err2 := strconv.Atoi(r.URL.Query().Get("user_id"))
+		if err1 != nil || err2 != nil {
+			http.Error(w, "Invalid chat_id or user_id", http.StatusBadRequest)
+			return
+		}
+		var (
+			allowed []string
+			maxPer  int
+		)
+		err := db.QueryRow(`
+            SELECT c.allowed_reactions, c.max_reactions_per_user FROM chats c
+            JOIN participants p ON p.chat_id = c.id AND p.user_id = $2
+            WHERE c.id = $1`, chatID, userID).Scan(pq.Array(&allowed), &maxPer)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if allowed == nil {
+			allowed = []string{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"chat_id":           chatID,
+			"allowed_reactions": allowed,
+			"max_per_user":      maxPer,
+		})
+
+	case "POST":
+		var data struct {
+			ChatID           int      `json:"chat_id"`
+			UserID           int      `json:"user_id"`
+			AllowedReactions []string `json:"allowed_reactions"` // Пустой список — разрешены любые
+			MaxPerUser       int      `json:"max_per_user"`      // 0 — значение по умолчанию
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if data.MaxPerUser == 0 {
+			data.MaxPerUser = defaultMaxReactions
+		}
+		if data.MaxPerUser < 1 || data.MaxPerUser > maxReactionsLimit || len(data.AllowedReactions) > maxAllowedReactions {
+			http.Error(w, "Invalid reaction settings", http.StatusBadRequest)
+			return
+		}
+		var allowed []string
+		for _, reaction := range data.AllowedReactions {
+			reaction, ok := normalizeReaction(reaction)
+			if !ok || validateCustomEmojiReaction(db, reaction) != nil {
+				http.Error(w, "Invalid reaction", http.StatusBadRequest)
+				return
+			}
+			if !containsString(allowed, reaction) {
+				allowed = append(allowed, reaction)
+			}
+		}
+
+		var isGroup bool
+		err := db.QueryRow(`
+            SELECT c.is_group FROM chats c
+            JOIN participants p ON p.chat_id = c.id AND p.user_id = $2
+            WHERE c.id = $1`, data.ChatID, data.UserID).Scan(&isGroup)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Chat not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if isGroup {
+			ok, err := canManageGroup(db, data.ChatID, data.UserID)
+			if err != nil {
+				http.Error(w, "Database error", http.StatusInternalServerError)
+				return
+			}
+			if !ok {
+				http.Error(w, "Only group admins can change reactions", http.StatusForbidden)
+				return
+			}
+		}
+
+		// NULL в allowed_reactions означает отсутствие ограничений
+		var allowedValue interface{}
+		if len(allowed) > 0 {
+			allowedValue = pq.Array(allowed)
+		}
+		_, err = db.Exec("UPDATE chats SET allowed_reactions = $2, max_reactions_per_user = $3 WHERE id = $1", data.ChatID, allowedValue, data.MaxPerUser)
+		if err != nil {
+			log.Printf("Ошибка изменения реакций чата %d: %v", data.ChatID, err)
+			http.Error(w, "Failed to update chat", http.StatusInternalServerError)
+			return
+		}
+		if allowed == nil {
+			allowed = []string{}
+		}
+
+		participantIDs, err := getChatParticipantIDs(db, data.ChatID)
+		if err != nil {
+			log.Printf("Ошибка получения участников чата %d: %v", data.ChatID, err)
+		}
+		broadcastToUsers(participantIDs, map[string]interface{}{
+			"type":              "chat_reactions_updated",
+			"chat_id":           data.ChatID,
+			"allowed_reactions": allowed,
+			"max_per_user":      data.MaxPerUser,
+			"updated_by":        data.UserID,
+		})
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"chat_id":           data.ChatID,
+			"allowed_reactions": allowed,
+			"max_per_user":      data.MaxPerUser,
+		})
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeReaction(t *testing.T) {
+	if got, ok := normalizeReaction(" 👍 "); !ok || got != "👍" {
+		t.Fatalf("normalizeReaction = %q, %v", got, ok)
+	}
+	for _, reaction := range []string{"", "  ", "\xff", strings.Repeat("a", maxReactionLength+1)} {
+		if _, ok := normalizeReaction(reaction); ok {
+			t.Errorf("normalizeReaction(%q) accepted", reaction)
+		}
+	}
+}
+
+// Поддельная БД реакций: настройки чата сообщения и набор уже стоящих реакций пользователя
+func newReactionFakeDB(t *testing.T, allowed driver.Value, existing []string, maxPerUser int) (*sql.DB, *fakeDB) {
+	db, fake := newFakeDB(t)
+	fake.on("c.allowed_reactions", func([]driver.Value) fakeResult {
+		return fakeRow(int64(10), allowed, int64(maxPerUser))
+	})
+	fake.on("INSERT INTO message_reactions", func(args []driver.Value) fakeResult {
+		for _, reaction := range existing {
+			if reaction == args[2] {
+				return fakeResult{}
+			}
+		}
+		existing = append(existing, args[2].(string))
+		return fakeResult{affected: 1}
+	})
+	// Снимаются самые старые реакции сверх лимита
+	fake.on("OFFSET $3", func(args []driver.Value) fakeResult {
+		var result fakeResult
+		for len(existing) > int(args[2].(int64)) {
+			result.rows = append(result.rows, []driver.Value{existing[0]})
+			existing = existing[1:]
+		}
+		return result
+	})
+	return db, fake
+}
+
+func TestAddMessageReaction(t *testing.T) {
+	db, fake := newReactionFakeDB(t, nil, []string{"👍", "❤"}, 2)
+
+	chatID, added, removed, err := addMessageReaction(db, 100, 1, "🔥")
+	if err != nil || chatID != 10 || !added || !reflect.DeepEqual(removed, []string{"👍"}) {
+		t.Fatalf("over the limit: chat %d, added %v, removed %v, %v", chatID, added, removed, err)
+	}
+	if len(fake.queries("COMMIT")) != 1 {
+		t.Fatal("reaction not committed")
+	}
+
+	// Повторная реакция не пересчитывает лимит
+	_, added, removed, err = addMessageReaction(db, 100, 1, "🔥")
+	if err != nil || added || removed != nil {
+		t.Fatalf("repeated reaction: added %v, removed %v, %v", added, removed, err)
+	}
+	if n := len(fake.queries("OFFSET $3")); n != 1 {
+		t.Fatalf("limit applied %d times, want 1", n)
+	}
+}
+
+func TestAddMessageReactionRejected(t *testing.T) {
+	db, fake := newReactionFakeDB(t, []byte("{👍,❤}"), nil, defaultMaxReactions)
+	if _, _, _, err := addMessageReaction(db, 100, 1, "🔥"); !errors.Is(err, errReactionNotAllowed) {
+		t.Fatalf("reaction outside the chat list: %v", err)
+	}
+	if _, _, _, err := addMessageReaction(db, 100, 1, " "); !errors.Is(err, errInvalidReaction) {
+		t.Fatalf("empty reaction: %v", err)
+	}
+	if len(fake.queries("INSERT INTO message_reactions")) != 0 {
+		t.Fatal("rejected reaction stored")
+	}
+
+	// Удалённое сообщение и чужой чат неотличимы: строки нет
+	empty, _ := newFakeDB(t)
+	if _, _, _, err := addMessageReaction(empty, 100, 1, "👍"); !errors.Is(err, errReactionForbidden) {
+		t.Fatalf("deleted message: %v", err)
+	}
+	if _, _, err := removeMessageReaction(empty, 100, 1, "👍"); !errors.Is(err, errReactionForbidden) {
+		t.Fatalf("remove from a deleted message: %v", err)
+	}
+}
+
+func TestLoadReactionSummaries(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.on("FROM message_reactions r", func([]driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{
+			{int64(100), "👍", int64(3), true},
+			{int64(100), "❤", int64(1), false},
+			{int64(200), "🔥", int64(2), false},
+		}}
+	})
+
+	summaries, err := loadReactionSummaries(db, []int{100, 200}, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int][]reactionSummary{
+		100: {{Reaction: "👍", Count: 3, ReactedByMe: true}, {Reaction: "❤", Count: 1}},
+		200: {{Reaction: "🔥", Count: 2}},
+	}
+	if !reflect.DeepEqual(summaries, want) {
+		t.Fatalf("summaries %+v, want %+v", summaries, want)
+	}
+	if q := fake.queries("FROM message_reactions r"); !strings.Contains(q[0].query, "NOT m.is_deleted") {
+		t.Fatal("reactions of deleted messages are not excluded")
+	}
+}
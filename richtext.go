@@ -0,0 +1,543 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+const (
+	maxMessageLength   = 4096                 // Максимальная длина текста сообщения в UTF-16 единицах
+	maxMessageBytes    = 4 * maxMessageLength // Предел исходного текста (с разметкой) в байтах
+	maxMessageEntities = 100                  // Максимальное количество сущностей форматирования
+	maxEntityURLLength = 2048                 // Максимальная длина ссылки
+	maxPreLanguage     = 32                   // Максимальная длина названия языка блока кода
+)
+
+// Сущность форматирования текста. Смещение и длина в UTF-16 единицах,
+// клиент применяет их к обычному тексту и никогда не отображает HTML из сообщения
+type messageEntity struct {
+	Type     string `json:"type"`               // bold, italic, code, pre, link, mention, spoiler
+	Offset   int    `json:"offset"`             // Начало сущности
+	Length   int    `json:"length"`             // Длина сущности
+	URL      string `json:"url,omitempty"`      // Адрес ссылки (для link)
+	Language string `json:"language,omitempty"` // Язык блока кода (для pre)
+	UserID   int    `json:"user_id,omitempty"`  // Упомянутый пользователь (для mention)
+}
+
+var (
+	errMessageTooLong    = errors.New("message text is too long")
+	errTooManyEntities   = errors.New("too many entities")
+	errInvalidEntity     = errors.New("invalid entity")
+	errInvalidCharacters = errors.New("message text contains invalid characters")
+)
+
+// Типы сущностей, которые клиент может передать явно; упоминания определяет только сервер
+var clientEntityTypes = map[string]bool{
+	"bold":    true,
+	"italic":  true,
+	"code":    true,
+	"pre":     true,
+	"link":    true,
+	"spoiler": true,
+}
+
+// Длина строки в UTF-16 единицах
+func utf16Len(runes []rune) int {
+	n := 0
+	for _, r := range runes {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// Удаление управляющих символов (кроме перевода строки и табуляции) и приведение переводов строк к \n
+func sanitizeMessageText(text string) string {
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if r == '\r' {
+			return '\n'
+		}
+		if unicode.IsControl(r) || r == unicode.ReplacementChar || (r >= 0x202A && r <= 0x202E) || (r >= 0x2066 && r <= 0x2069) {
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// Проверка адреса ссылки: только http(s) и mailto
+func validEntityURL(raw string) bool {
+	if raw == "" || len(raw) > maxEntityURLLength {
+		return false
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return u.Host != ""
+	case "mailto":
+		return u.Opaque != ""
+	}
+	return false
+}
+
+// Проверка названия языка блока кода
+func validPreLanguage(language string) bool {
+	if len(language) > maxPreLanguage {
+		return false
+	}
+	for _, r := range language {
+		if !(r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)) || r == '+' || r == '#' || r == '-' || r == '_') {
+			return false
+		}
+	}
+	return true
+}
+
+// Проверка сущностей: границы, допустимые типы, ссылки и вложенность без частичных пересечений
+func validateEntities(textLen int, entities []messageEntity) ([]messageEntity, error) {
+	if len(entities) > maxMessageEntities {
+		return nil, errTooManyEntities
+	}
+	result := make([]messageEntity, 0, len(entities))
+	for _, e := range entities {
+		if !clientEntityTypes[e.Type] {
+			return nil, errInvalidEntity
+		}
+		if e.Offset < 0 || e.Length <= 0 || e.Offset+e.Length > textLen {
+			return nil, errInvalidEntity
+		}
+		if e.Type == "link" && !validEntityURL(e.URL) {
+			return nil, errInvalidEntity
+		}
+		if e.Type == "pre" && !validPreLanguage(e.Language) {
+			return nil, errInvalidEntity
+		}
+		// Лишние поля других типов не сохраняем
+		clean := messageEntity{Type: e.Type, Offset: e.Offset, Length: e.Length}
+		switch e.Type {
+		case "link":
+			clean.URL = e.URL
+		case "pre":
+			clean.Language = e.Language
+		}
+		result = append(result, clean)
+	}
+
+	sortEntities(result)
+	// Сущности либо вложены друг в друга, либо не пересекаются; внутри code/pre форматирования нет
+	var stack []messageEntity
+	for _, e := range result {
+		for len(stack) > 0 && stack[len(stack)-1].Offset+stack[len(stack)-1].Length <= e.Offset {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) > 0 {
+			parent := stack[len(stack)-1]
+			if e.Offset+e.Length > parent.Offset+parent.Length || parent.Type == "code" || parent.Type == "pre" {
+				return nil, errInvalidEntity
+			}
+		}
+		stack = append(stack, e)
+	}
+	return result, nil
+}
+
+// Сортировка сущностей: по началу, внешние раньше вложенных
+func sortEntities(entities []messageEntity) {
+	sort.SliceStable(entities, func(i, j int) bool {
+		if entities[i].Offset != entities[j].Offset {
+			return entities[i].Offset < entities[j].Offset
+		}
+		return entities[i].Length > entities[j].Length
+	})
+}
+
+// Символы, которые можно экранировать обратной косой чертой
+func isMarkdownSpecial(r rune) bool {
+	return strings.ContainsRune("\\*_`|[]()~", r)
+}
+
+// Проверка, что в позиции i начинается строка marker
+func hasRunePrefix(src []rune, i int, marker string) bool {
+	m := []rune(marker)
+	if i+len(m) > len(src) {
+		return false
+	}
+	for k, r := range m {
+		if src[i+k] != r {
+			return false
+		}
+	}
+	return true
+}
+
+// Маркеры строчного форматирования подмножества Markdown
+var markdownSpans = []struct {
+	marker     string
+	entityType string
+}{
+	{"**", "bold"},
+	{"__", "italic"},
+	{"||", "spoiler"},
+	{"*", "italic"},
+}
+
+// Атомарные участки разметки: внутри них маркеры форматирования не ищутся
+const (
+	markdownAtomEscape = iota + 1 // \x
+	markdownAtomPre               // ```язык\nблок```
+	markdownAtomCode              // `код`
+)
+
+// Разбор подмножества Markdown за линейное время. До разбора один проход находит экранирования
+// и фрагменты кода, а проходы с конца строят таблицы ближайших маркеров вне этих участков:
+// закрывающий маркер находится за O(1), и каждый символ разбирается ровно один раз
+type markdownParser struct {
+	src         []rune
+	atomEnd     []int  // Конец атомарного участка, начинающегося в позиции (0 — участка нет)
+	atomKind    []int8 // Вид атомарного участка
+	runEnd      []int  // Конец серии одинаковых символов, в которую входит позиция
+	nextPair    map[rune][]int
+	nextStar    []int
+	nextStarRun []int
+	nextLinkMid []int
+	nextParen   []int
+	validURLs   map[int]bool // Проверенные адреса ссылок по позиции "](" перед ними
+
+	out      []rune
+	outLen   int // Длина out в UTF-16 единицах
+	entities []messageEntity
+}
+
+// Блок кода: язык в первой строке, если она похожа на название языка
+func splitPreLanguage(inner []rune) (string, []rune) {
+	if nl := indexRune(inner, '\n'); nl >= 0 && nl <= maxPreLanguage && validPreLanguage(string(inner[:nl])) {
+		return string(inner[:nl]), inner[nl+1:]
+	}
+	return "", inner
+}
+
+func newMarkdownParser(src []rune) *markdownParser {
+	n := len(src)
+	p := &markdownParser{
+		src:       src,
+		atomEnd:   make([]int, n),
+		atomKind:  make([]int8, n),
+		runEnd:    make([]int, n),
+		nextPair:  map[rune][]int{'*': make([]int, n+1), '_': make([]int, n+1), '|': make([]int, n+1)},
+		validURLs: make(map[int]bool),
+	}
+
+	// Ближайшие "`" и "```": внутри кода экранирование не действует
+	nextTick, nextTriple := make([]int, n+1), make([]int, n+1)
+	nextTick[n], nextTriple[n] = n, n
+	for i := n - 1; i >= 0; i-- {
+		nextTick[i], nextTriple[i] = nextTick[i+1], nextTriple[i+1]
+		if src[i] == '`' {
+			nextTick[i] = i
+			if hasRunePrefix(src, i, "```") {
+				nextTriple[i] = i
+			}
+		}
+	}
+
+	// Атомарные участки в том порядке, в котором их встречает разбор
+	inside := make([]bool, n)
+	for i := 0; i < n; {
+		end, kind := 0, int8(0)
+		switch {
+		case src[i] == '\\' && i+1 < n && isMarkdownSpecial(src[i+1]):
+			end, kind = i+2, markdownAtomEscape
+		case hasRunePrefix(src, i, "```") && nextTriple[i+3] < n && nextTriple[i+3] > i+3:
+			if _, inner := splitPreLanguage(src[i+3 : nextTriple[i+3]]); len(inner) > 0 {
+				end, kind = nextTriple[i+3]+3, markdownAtomPre
+			}
+		}
+		if end == 0 && src[i] == '`' && nextTick[i+1] < n && nextTick[i+1] > i+1 {
+			end, kind = nextTick[i+1]+1, markdownAtomCode
+		}
+		if end == 0 {
+			i++
+			continue
+		}
+		p.atomEnd[i], p.atomKind[i] = end, kind
+		for k := i; k < end; k++ {
+			inside[k] = true
+		}
+		i = end
+	}
+
+	// Таблицы ближайших маркеров вне атомарных участков
+	p.nextStar, p.nextStarRun = make([]int, n+1), make([]int, n+1)
+	p.nextLinkMid, p.nextParen = make([]int, n+1), make([]int, n+1)
+	p.nextStar[n], p.nextStarRun[n], p.nextLinkMid[n], p.nextParen[n] = n, n, n, n
+	for _, next := range p.nextPair {
+		next[n] = n
+	}
+	for i := n - 1; i >= 0; i-- {
+		p.runEnd[i] = i + 1
+		if i+1 < n && src[i+1] == src[i] {
+			p.runEnd[i] = p.runEnd[i+1]
+		}
+		for c, next := range p.nextPair {
+			next[i] = next[i+1]
+			if !inside[i] && src[i] == c && i+1 < n && src[i+1] == c {
+				next[i] = i
+			}
+		}
+		p.nextStar[i], p.nextStarRun[i] = p.nextStar[i+1], p.nextStarRun[i+1]
+		p.nextLinkMid[i], p.nextParen[i] = p.nextLinkMid[i+1], p.nextParen[i+1]
+		if inside[i] {
+			continue
+		}
+		switch src[i] {
+		case '*':
+			p.nextStar[i] = i
+			if (i == 0 || src[i-1] != '*' || inside[i-1]) && p.runEnd[i]-i != 2 {
+				p.nextStarRun[i] = i
+			}
+		case ']':
+			if i+1 < n && src[i+1] == '(' {
+				p.nextLinkMid[i] = i
+			}
+		case ')':
+			p.nextParen[i] = i
+		}
+	}
+	return p
+}
+
+// Закрывающий маркер span.marker в [from, hi); -1, если его нет.
+// Для маркеров из одинаковых символов берётся конец серии: в "*курсив***" жирный закрывают последние "**"
+func (p *markdownParser) closeSpan(marker string, from, hi int) int {
+	if marker != "*" {
+		j := p.nextPair[rune(marker[0])][from]
+		if j+2 > hi {
+			return -1
+		}
+		return min(p.runEnd[j], hi) - 2
+	}
+
+	j := p.nextStar[from]
+	if j >= hi {
+		return -1
+	}
+	if run := min(p.runEnd[j], hi); run-j != 2 {
+		return run - 1
+	}
+	// Серия из двух "*" закрывает жирный, а не курсив; дальше проверяются только начала других серий
+	after := min(p.runEnd[j], hi)
+	j = p.nextStarRun[after]
+	if j >= hi {
+		// Серия из двух "*" на границе участка обрезается до одной
+		if last := hi - 1; last >= after && p.nextStar[last] == last && p.nextStar[last-1] != last-1 {
+			return last
+		}
+		return -1
+	}
+	if run := min(p.runEnd[j], hi); run-j != 2 {
+		return run - 1
+	}
+	return -1
+}
+
+// Ссылка [текст](url), начинающаяся в i: конец текста и конец адреса; ok = false, если её нет
+func (p *markdownParser) closeLink(i, hi int) (closeText, closeURL int, ok bool) {
+	closeText = p.nextLinkMid[i+1]
+	if closeText+2 > hi || closeText <= i+1 {
+		return 0, 0, false
+	}
+	closeURL = p.nextParen[closeText+2]
+	if closeURL >= hi || closeURL <= closeText+2 {
+		return 0, 0, false
+	}
+	// Адрес проверяется один раз, даже если к нему ведёт много открывающих "["
+	valid, checked := p.validURLs[closeText]
+	if !checked {
+		valid = closeURL-closeText-2 <= maxEntityURLLength && validEntityURL(string(p.src[closeText+2:closeURL]))
+		p.validURLs[closeText] = valid
+	}
+	return closeText, closeURL, valid
+}
+
+func (p *markdownParser) emit(text []rune) {
+	p.out = append(p.out, text...)
+	p.outLen += utf16Len(text)
+}
+
+// Сущность вокруг разобранного участка [lo, hi); false, если текста внутри нет
+func (p *markdownParser) span(entity messageEntity, lo, hi int) bool {
+	index, outLen, offset := len(p.entities), len(p.out), p.outLen
+	entity.Offset = offset
+	p.entities = append(p.entities, entity)
+	p.parse(lo, hi)
+	if p.outLen == offset {
+		p.entities, p.out = p.entities[:index], p.out[:outLen]
+		return false
+	}
+	p.entities[index].Length = p.outLen - offset
+	return true
+}
+
+// Разбор участка [lo, hi) исходного текста
+func (p *markdownParser) parse(lo, hi int) {
+	src := p.src
+	for i := lo; i < hi; {
+		if end := p.atomEnd[i]; end > 0 && end <= hi {
+			switch p.atomKind[i] {
+			case markdownAtomEscape:
+				p.emit(src[i+1 : i+2])
+			case markdownAtomPre:
+				language, inner := splitPreLanguage(src[i+3 : end-3])
+				p.entities = append(p.entities, messageEntity{Type: "pre", Offset: p.outLen, Length: utf16Len(inner), Language: language})
+				p.emit(inner)
+			case markdownAtomCode:
+				inner := src[i+1 : end-1]
+				p.entities = append(p.entities, messageEntity{Type: "code", Offset: p.outLen, Length: utf16Len(inner)})
+				p.emit(inner)
+			}
+			i = end
+			continue
+		}
+
+		if src[i] == '[' {
+			if closeText, closeURL, ok := p.closeLink(i, hi); ok {
+				link := messageEntity{Type: "link", URL: string(src[closeText+2 : closeURL])}
+				if p.span(link, i+1, closeText) {
+					i = closeURL + 1
+					continue
+				}
+			}
+		}
+
+		matched := false
+		for _, s := range markdownSpans {
+			if !hasRunePrefix(src[:hi], i, s.marker) {
+				continue
+			}
+			start := i + len(s.marker)
+			end := p.closeSpan(s.marker, start, hi)
+			if end <= start || !p.span(messageEntity{Type: s.entityType}, start, end) {
+				continue
+			}
+			i = end + len(s.marker)
+			matched = true
+			break
+		}
+		if matched {
+			continue
+		}
+
+		p.emit(src[i : i+1])
+		i++
+	}
+}
+
+// Разбор подмножества Markdown в обычный текст и сущности:
+// **жирный**, *курсив* или __курсив__, `код`, ```язык\nблок```, [текст](url), ||спойлер||
+func parseMarkdown(src []rune) ([]rune, []messageEntity) {
+	p := newMarkdownParser(src)
+	p.parse(0, len(src))
+	return p.out, p.entities
+}
+
+// Позиция символа в срезе рун
+func indexRune(src []rune, r rune) int {
+	for i, c := range src {
+		if c == r {
+			return i
+		}
+	}
+	return -1
+}
+
+// Подготовка текста сообщения: очистка, разбор Markdown или проверка переданных сущностей, ограничения длины.
+// parseMode "markdown" — сущности строятся сервером из разметки; иначе принимаются явные сущности клиента
+func prepareMessageText(text, parseMode string, entities []messageEntity) (string, []messageEntity, error) {
+	// Заведомо длинный текст отклоняется до разбора разметки
+	if len(text) > maxMessageBytes {
+		return "", nil, errMessageTooLong
+	}
+	clean := sanitizeMessageText(text)
+
+	switch parseMode {
+	case "markdown":
+		plain, parsed := parseMarkdown([]rune(clean))
+		clean = string(plain)
+		entities = parsed
+	case "":
+		// Очистка сдвинула бы смещения переданных сущностей
+		if clean != text && len(entities) > 0 {
+			return "", nil, errInvalidCharacters
+		}
+	default:
+		return "", nil, errInvalidEntity
+	}
+
+	textLen := utf16Len([]rune(clean))
+	if textLen > maxMessageLength {
+		return "", nil, errMessageTooLong
+	}
+
+	validated, err := validateEntities(textLen, entities)
+	if err != nil {
+		return "", nil, err
+	}
+	return clean, validated, nil
+}
+
+// Сериализация сущностей для колонки JSONB (NULL, если форматирования нет)
+func entitiesJSON(entities []messageEntity) interface{} {
+	if len(entities) == 0 {
+		return nil
+	}
+	data, _ := json.Marshal(entities)
+	return string(data)
+}
+
+// Разбор сущностей из колонки JSONB
+func parseEntitiesJSON(raw []byte) []messageEntity {
+	if len(raw) == 0 {
+		return nil
+	}
+	var entities []messageEntity
+	if err := json.Unmarshal(raw, &entities); err != nil {
+		return nil
+	}
+	return entities
+}
+
+// Добавление сущностей упоминаний, найденных сервером, к форматированию сообщения
+func mergeMentionEntities(entities []messageEntity, mentions []messageMention) []messageEntity {
+	if len(mentions) == 0 {
+		return entities
+	}
+	merged := append([]messageEntity{}, entities...)
+	for _, m := range mentions {
+		// Упоминание внутри кода не выделяется
+		insideCode := false
+		for _, e := range entities {
+			if (e.Type == "code" || e.Type == "pre") && m.Offset >= e.Offset && m.Offset < e.Offset+e.Length {
+				insideCode = true
+				break
+			}
+		}
+		if !insideCode {
+			merged = append(merged, messageEntity{Type: "mention", Offset: m.Offset, Length: m.Length, UserID: m.UserID})
+		}
+	}
+	sortEntities(merged)
+	return merged
+}
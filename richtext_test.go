@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseMarkdown(t *testing.T) {
+	cases := []struct {
+		src      string
+		text     string
+		entities []messageEntity
+	}{
+		{"**жирный** и *курсив*", "жирный и курсив", []messageEntity{
+			{Type: "bold", Offset: 0, Length: 6},
+			{Type: "italic", Offset: 9, Length: 6},
+		}},
+		{"__курсив__ ||спойлер||", "курсив спойлер", []messageEntity{
+			{Type: "italic", Offset: 0, Length: 6},
+			{Type: "spoiler", Offset: 7, Length: 7},
+		}},
+		{"**a *b* c**", "a b c", []messageEntity{
+			{Type: "bold", Offset: 0, Length: 5},
+			{Type: "italic", Offset: 2, Length: 1},
+		}},
+		{"***x***", "x", []messageEntity{
+			{Type: "bold", Offset: 0, Length: 1},
+			{Type: "italic", Offset: 0, Length: 1},
+		}},
+		{"||[**сайт**](https://example.com/a)||", "сайт", []messageEntity{
+			{Type: "spoiler", Offset: 0, Length: 4},
+			{Type: "link", Offset: 0, Length: 4, URL: "https://example.com/a"},
+			{Type: "bold", Offset: 0, Length: 4},
+		}},
+		{"`a **b**`", "a **b**", []messageEntity{{Type: "code", Offset: 0, Length: 7}}},
+		{"```go\nfmt()\n```", "fmt()\n", []messageEntity{{Type: "pre", Offset: 0, Length: 6, Language: "go"}}},
+		{"```не язык\nx```", "не язык\nx", []messageEntity{{Type: "pre", Offset: 0, Length: 9}}},
+		{"😀**b**", "😀b", []messageEntity{{Type: "bold", Offset: 2, Length: 1}}},
+		{`\*не курсив\*`, "*не курсив*", nil},
+		{"[x](javascript:alert(1))", "[x](javascript:alert(1))", nil},
+		{"**", "**", nil},
+		{"*a", "*a", nil},
+		{"[a](", "[a](", nil},
+	}
+	for _, c := range cases {
+		text, entities := parseMarkdown([]rune(c.src))
+		if string(text) != c.text || !reflect.DeepEqual(entities, c.entities) {
+			t.Errorf("parseMarkdown(%q) = %q %+v; want %q %+v", c.src, string(text), entities, c.text, c.entities)
+		}
+	}
+}
+
+func TestPrepareMessageTextLimits(t *testing.T) {
+	if _, _, err := prepareMessageText(strings.Repeat("a", maxMessageBytes+1), "markdown", nil); !errors.Is(err, errMessageTooLong) {
+		t.Fatalf("oversized source: %v, want errMessageTooLong", err)
+	}
+	if _, _, err := prepareMessageText(strings.Repeat("*a* ", maxMessageEntities+1), "markdown", nil); !errors.Is(err, errTooManyEntities) {
+		t.Fatalf("too many entities: %v, want errTooManyEntities", err)
+	}
+	// Разметка не входит в предел длины текста
+	text, entities, err := prepareMessageText("**"+strings.Repeat("a", maxMessageLength)+"**", "markdown", nil)
+	if err != nil || len(text) != maxMessageLength || len(entities) != 1 {
+		t.Fatalf("markup around a full-length text: %d chars, %d entities, %v", len(text), len(entities), err)
+	}
+}
+
+// Худшие для разбора входы предельного размера: каждый символ открывает, но не закрывает сущность
+var markdownWorstCases = map[string]string{
+	"brackets":     strings.Repeat("[", maxMessageBytes),
+	"stars":        strings.Repeat("*", maxMessageBytes-1),
+	"open links":   strings.Repeat("[a](", maxMessageBytes/4),
+	"nested":       strings.Repeat("**[||_", maxMessageBytes/6),
+	"backticks":    strings.Repeat("`", maxMessageBytes-1),
+	"link mids":    strings.Repeat("[](", maxMessageBytes/3),
+	"star runs":    strings.Repeat("*a**", maxMessageBytes/4),
+	"long urls":    strings.Repeat("[x](http://"+strings.Repeat("a", 64), maxMessageBytes/76),
+	"escapes":      strings.Repeat(`\`, maxMessageBytes),
+	"closed spans": strings.Repeat("**a**", maxMessageBytes/5),
+}
+
+// Разбор линейный: вход предельного размера разбирается за миллисекунды при любой разметке
+func TestParseMarkdownWorstCase(t *testing.T) {
+	for name, src := range markdownWorstCases {
+		start := time.Now()
+		parseMarkdown([]rune(src))
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("%s: parsed %d runes in %v", name, len(src), elapsed)
+		}
+	}
+}
+
+func BenchmarkParseMarkdown(b *testing.B) {
+	for name, src := range markdownWorstCases {
+		runes := []rune(src)
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				parseMarkdown(runes)
+			}
+		})
+	}
+}
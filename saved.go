@@ -0,0 +1,434 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	maxSavedTags      = 20 // Максимум тегов на одно сохранённое сообщение
+	maxSavedTagLength = 50 // Максимальная длина тега
+)
+
+// Получение чата "Избранное" пользователя; чат создаётся при первом обращении
+func getOrCreateSavedChat(db *sql.DB, userID int) (int, bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, false, err
+	}
+	defer tx.Rollback()
+
+	// Ключ пары из одного и того же пользователя гарантирует единственность избранного
+	var chatID int
+	err = tx.QueryRow(
+		"INSERT INTO chats (direct_key, is_saved) VALUES ($1, true) ON CONFLICT (direct_key) DO NOTHING RETURNING id",
+		directChatKey(userID, userID),
+	).Scan(&chatID)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		err = db.QueryRow("SELECT id FROM chats WHERE direct_key = $1", directChatKey(userID, userID)).Scan(&chatID)
+		if err != nil {
+			return 0, false, err
+		}
+		_, err = db.Exec("UPDATE participants SET hidden_at = NULL WHERE chat_id = $1 AND user_id = $2", chatID, userID)
+		return chatID, false, err
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	if _, err := tx.Exec("INSERT INTO participants (chat_id, user_id, is_admin) VALUES ($1, $2, true)", chatID, userID); err != nil {
+		return 0, false, err
+	}
+	if _, _, err := insertSystemMessage(tx, chatID, "Избранное создано"); err != nil {
+		return 0, false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, false, err
+	}
+
+	broadcastNewChat(chatID, []int{userID})
+	return chatID, true, nil
+}
+
+// Нормализация тегов: нижний регистр, без '#', без повторов
+func normalizeSavedTags(tags []string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(tag), "#")))
+		tag = strings.ReplaceAll(tag, ",", "")
+		if tag == "" || seen[tag] || len([]rune(tag)) > maxSavedTagLength {
+			continue
+		}
+		seen[tag] = true
+		result = append(result, tag)
+		if len(result) == maxSavedTags {
+			break
+		}
+	}
+	return result
+}
+
+// Замена набора тегов сохранённого сообщения
+func replaceSavedTags(tx *sql.Tx, savedID int, tags []string) error {
+	if _, err := tx.Exec("DELETE FROM saved_message_tags WHERE saved_message_id = $1", savedID); err != nil {
+		return err
+	}
+	for _, tag := range tags {
+		if _, err := tx.Exec("INSERT INTO saved_message_tags (saved_message_id, tag) VALUES ($1, $2)", savedID, tag); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Сохранение сообщения в "Избранное": копия или ссылка на исходное сообщение
+func handleSaveMessageCommand(conn *websocket.Conn, messageID, userID int, mode string, tags []string) {
+	if mode == "" {
+		mode = "copy"
+	}
+	if mode != "copy" && mode != "reference" {
+		log.Printf("Неизвестный режим сохранения: %s", mode)
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("DB error: %v", err)
+		return
+	}
+	defer db.Close()
+
+	var (
+		sourceChatID     int
+		sourceUserID     sql.NullInt64
+		content          string
+		isDeleted        bool
+		originalSenderID sql.NullInt64
+		originalChatID   sql.NullInt64
+	)
+	err = db.QueryRow(`
+        SELECT m.chat_id, m.user_id, m.content, m.is_deleted, m.original_sender_id, m.original_chat_id
+        FROM messages m
+        JOIN participants p ON p.chat_id = m.chat_id AND p.user_id = $2
+        WHERE m.id = $1 AND NOT m.is_system`, messageID, userID,
+	).Scan(&sourceChatID, &sourceUserID, &content, &isDeleted, &originalSenderID, &originalChatID)
+	if err != nil || isDeleted {
+		log.Printf("Unauthorized save attempt: user %d, message %d", userID, messageID)
+		return
+	}
+
+	// Источник сохраняется так же, как при пересылке: первоначальный автор и чат
+	if !originalSenderID.Valid {
+		originalSenderID = sourceUserID
+	}
+	if !originalChatID.Valid {
+		originalChatID = sql.NullInt64{Int64: int64(sourceChatID), Valid: true}
+	}
+
+	savedChatID, _, err := getOrCreateSavedChat(db, userID)
+	if err != nil {
+		log.Printf("Ошибка получения избранного пользователя %d: %v", userID, err)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Transaction error: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	var (
+		newMessageID int
+		createdAt    time.Time
+	)
+	err = tx.QueryRow(`
+        INSERT INTO messages (chat_id, user_id, content, is_forwarded, original_sender_id, original_chat_id)
+        VALUES ($1, $2, $3, true, $4, $5) RETURNING id, created_at`,
+		savedChatID, userID, content, originalSenderID, originalChatID,
+	).Scan(&newMessageID, &createdAt)
+	if err != nil {
+		log.Printf("Ошибка сохранения сообщения в избранное: %v", err)
+		return
+	}
+
+	// В режиме копии вложения дублируются, в режиме ссылки остаются у исходного сообщения
+	if mode == "copy" {
+		_, err = tx.Exec(`
+            INSERT INTO message_files (message_id, kind, file_name, file_data, blob_key, file_size, mime_type)
+            SELECT $1, kind, file_name, file_data, blob_key, file_size, mime_type FROM message_files WHERE message_id = $2`,
+			newMessageID, messageID)
+		if err != nil {
+			log.Printf("Ошибка копирования вложений: %v", err)
+			return
+		}
+	}
+
+	var savedID int
+	err = tx.QueryRow(`
+        INSERT INTO saved_messages (user_id, message_id, source_message_id, is_reference)
+        VALUES ($1, $2, $3, $4) RETURNING id`,
+		userID, newMessageID, messageID, mode == "reference",
+	).Scan(&savedID)
+	if err != nil {
+		log.Printf("Ошибка записи закладки: %v", err)
+		return
+	}
+
+	tags = normalizeSavedTags(tags)
+	if err := replaceSavedTags(tx, savedID, tags); err != nil {
+		log.Printf("Ошибка сохранения тегов: %v", err)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		return
+	}
+
+	var originalSenderName string
+	if originalSenderID.Valid {
+		db.QueryRow("SELECT username FROM users WHERE id = $1", originalSenderID.Int64).Scan(&originalSenderName)
+	}
+
+	// Новое сообщение в "Избранном" видно на всех устройствах пользователя
+	broadcastToUsers([]int{userID}, map[string]interface{}{
+		"id":                   newMessageID,
+		"chat_id":              savedChatID,
+		"user_id":              userID,
+		"text":                 content,
+		"created_at":           createdAt.Format(time.RFC3339),
+		"isMe":                 true,
+		"is_forwarded":         true,
+		"original_sender_id":   originalSenderID.Int64,
+		"original_sender_name": originalSenderName,
+		"original_chat_id":     originalChatID.Int64,
+		"saved_message_id":     savedID,
+		"source_message_id":    messageID,
+		"is_reference":         mode == "reference",
+		"tags":                 tags,
+	})
+
+	conn.WriteJSON(map[string]interface{}{
+		"type":              "message_saved",
+		"saved_message_id":  savedID,
+		"message_id":        newMessageID,
+		"source_message_id": messageID,
+		"chat_id":           savedChatID,
+	})
+}
+
+// savedMessagesHandler возвращает сохранённые сообщения пользователя с фильтром по тегу
+func savedMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user_id", http.StatusBadRequest)
+		return
+	}
+	tag := ""
+	if tags := normalizeSavedTags([]string{r.URL.Query().Get("tag")}); len(tags) > 0 {
+		tag = tags[0]
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// Для ссылок показываем актуальный текст исходного сообщения, если оно не удалено
+	rows, err := db.Query(`
+        SELECT
+            s.id,
+            s.message_id,
+            s.source_message_id,
+            s.is_reference,
+            s.created_at,
+            CASE
+                WHEN s.is_reference AND src.id IS NOT NULL AND NOT src.is_deleted THEN src.content
+                ELSE m.content
+            END AS content,
+            m.original_sender_id,
+            m.original_chat_id,
+            ou.username,
+            COALESCE(string_agg(t.tag, ',' ORDER BY t.tag), '') AS tags
+        FROM saved_messages s
+        JOIN messages m ON m.id = s.message_id
+        LEFT JOIN messages src ON src.id = s.source_message_id
+        LEFT JOIN users ou ON ou.id = m.original_sender_id
+        LEFT JOIN saved_message_tags t ON t.saved_message_id = s.id
+        WHERE s.user_id = $1
+            AND ($2 = '' OR EXISTS (
+                SELECT 1 FROM saved_message_tags ft
+                WHERE ft.saved_message_id = s.id AND ft.tag = $2
+            ))
+        GROUP BY s.id, m.id, src.id, ou.username
+        ORDER BY s.created_at DESC`, userID, tag)
+	if err != nil {
+		log.Printf("Ошибка получения избранного: %v", err)
+		http.Error(w, "Query error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	saved := []map[string]interface{}{}
+	for rows.Next() {
+		var (
+			id                 int
+			messageID          int
+			sourceMessageID    sql.NullInt64
+			isReference        bool
+			createdAt          time.Time
+			content            string
+			originalSenderID   sql.NullInt64
+			originalChatID     sql.NullInt64
+			originalSenderName sql.NullString
+			tagList            string
+		)
+		if err := rows.Scan(&id, &messageID, &sourceMessageID, &isReference, &createdAt, &content,
+			&originalSenderID, &originalChatID, &originalSenderName, &tagList); err != nil {
+			log.Printf("Ошибка чтения закладки: %v", err)
+			continue
+		}
+		tags := []string{}
+		if tagList != "" {
+			tags = strings.Split(tagList, ",")
+		}
+		saved = append(saved, map[string]interface{}{
+			"id":                   id,
+			"message_id":           messageID,
+			"source_message_id":    sourceMessageID.Int64,
+			"is_reference":         isReference,
+			"source_available":     sourceMessageID.Valid,
+			"saved_at":             createdAt,
+			"text":                 content,
+			"original_sender_id":   originalSenderID.Int64,
+			"original_chat_id":     originalChatID.Int64,
+			"original_sender_name": originalSenderName.String,
+			"tags":                 tags,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(saved)
+}
+
+// savedTagsHandler: GET — список тегов пользователя, POST — замена тегов сохранённого сообщения
+func savedTagsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		listSavedTagsHandler(w, r)
+	case "POST":
+		setSavedTagsHandler(w, r)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listSavedTagsHandler(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user_id", http.StatusBadRequest)
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+        SELECT t.tag, COUNT(*)
+        FROM saved_message_tags t
+        JOIN saved_messages s ON s.id = t.saved_message_id
+        WHERE s.user_id = $1
+        GROUP BY t.tag
+        ORDER BY COUNT(*) DESC, t.tag`, userID)
+	if err != nil {
+		http.Error(w, "Query error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	tags := []map[string]interface{}{}
+	for rows.Next() {
+		var (
+			tag   string
+			count int
+		)
+		if err := rows.Scan(&tag, &count); err != nil {
+			continue
+		}
+		tags = append(tags, map[string]interface{}{"tag": tag, "count": count})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tags)
+}
+
+func setSavedTagsHandler(w http.ResponseWriter, r *http.Request) {
+	var data struct {
+		UserID         int      `json:"user_id"`
+		SavedMessageID int      `json:"saved_message_id"`
+		Tags           []string `json:"tags"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Transaction error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var ownerID int
+	err = tx.QueryRow("SELECT user_id FROM saved_messages WHERE id = $1 FOR UPDATE", data.SavedMessageID).Scan(&ownerID)
+	if err != nil || ownerID != data.UserID {
+		http.Error(w, "Saved message not found", http.StatusNotFound)
+		return
+	}
+
+	tags := normalizeSavedTags(data.Tags)
+	if err := replaceSavedTags(tx, data.SavedMessageID, tags); err != nil {
+		log.Printf("Ошибка сохранения тегов: %v", err)
+		http.Error(w, "Failed to update tags", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Transaction commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"saved_message_id": data.SavedMessageID,
+		"tags":             tags,
+	})
+}
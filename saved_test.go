@@ -0,0 +1,72 @@
+package main
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeSavedTags(t *testing.T) {
+	got := normalizeSavedTags([]string{" #Work ", "work", "", "#", "a,b", strings.Repeat("я", maxSavedTagLength+1), "Идеи"})
+	if want := []string{"work", "ab", "идеи"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("normalizeSavedTags = %q, want %q", got, want)
+	}
+
+	many := make([]string, maxSavedTags+5)
+	for i := range many {
+		many[i] = strings.Repeat("t", i+1)
+	}
+	if got := normalizeSavedTags(many); len(got) != maxSavedTags {
+		t.Fatalf("%d tags kept, want %d", len(got), maxSavedTags)
+	}
+}
+
+// Первое обращение создаёт чат с владельцем-участником и системным сообщением
+func TestGetOrCreateSavedChatCreates(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.on("INSERT INTO chats", func(args []driver.Value) fakeResult {
+		if args[0] != "5:5" {
+			t.Errorf("saved chat key %v", args[0])
+		}
+		return fakeRow(int64(30))
+	})
+	fake.on("INSERT INTO messages", func([]driver.Value) fakeResult {
+		return fakeRow(int64(300), time.Now())
+	})
+	owner := connectTestClient(t, 5, 0)
+
+	chatID, created, err := getOrCreateSavedChat(db, 5)
+	if err != nil || chatID != 30 || !created {
+		t.Fatalf("getOrCreateSavedChat = %d, %v, %v", chatID, created, err)
+	}
+	if q := fake.queries("INSERT INTO participants"); len(q) != 1 || q[0].args[1] != int64(5) {
+		t.Fatalf("owner not added: %+v", q)
+	}
+	if len(fake.queries("COMMIT")) != 1 {
+		t.Fatal("saved chat not committed")
+	}
+	if event := readTestEvent(t, owner); event["type"] != "new_chat" {
+		t.Fatalf("owner event: %v", event)
+	}
+}
+
+// Повторное обращение возвращает существующий чат и снова показывает его
+func TestGetOrCreateSavedChatExisting(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.on("WHERE direct_key = $1", func([]driver.Value) fakeResult {
+		return fakeRow(int64(30))
+	})
+
+	chatID, created, err := getOrCreateSavedChat(db, 5)
+	if err != nil || chatID != 30 || created {
+		t.Fatalf("getOrCreateSavedChat = %d, %v, %v", chatID, created, err)
+	}
+	if len(fake.queries("INSERT INTO participants")) != 0 {
+		t.Fatal("existing saved chat got another participant")
+	}
+	if q := fake.queries("SET hidden_at = NULL"); len(q) != 1 {
+		t.Fatal("existing saved chat not unhidden")
+	}
+}
@@ -0,0 +1,513 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	schedulerInterval       = 2 * time.Second      // Период проверки отложенных сообщений
+	maxScheduleAhead        = 365 * 24 * time.Hour // Максимальный срок откладывания
+	schedulerBatchLimit     = 100                  // Максимум отправок за один проход
+	schedulerMaxAttempts    = 6                    // Попыток отправки при временных ошибках
+	schedulerBaseRetryDelay = 10 * time.Second     // Задержка перед первым повтором
+	schedulerMaxRetryDelay  = 10 * time.Minute     // Максимальная задержка между повторами
+)
+
+// Автор отложенного сообщения больше не участник чата
+var errScheduledAuthorLeft = errors.New("author is no longer a chat participant")
+
+// Отложенное сообщение для ответов клиенту
+type scheduledMessage struct {
+	ID              int             `json:"id"`
+	ChatID          int             `json:"chat_id"`
+	UserID          int             `json:"user_id"`
+	Text            string          `json:"text"`
+	Entities        []messageEntity `json:"entities,omitempty"`
+	ParentMessageID *int            `json:"parent_message_id"`
+	SendAt          time.Time       `json:"send_at"`
+	Status          string          `json:"status"`
+	CreatedAt       time.Time       `json:"created_at"`
+}
+
+// Команда WebSocket для работы с отложенными сообщениями
+type scheduleCommand struct {
+	ScheduledID     int             `json:"scheduled_id"`
+	ChatID          int             `json:"chat_id"`
+	UserID          int             `json:"user_id"`
+	Text            string          `json:"text"`
+	NewText         string          `json:"new_text"`
+	SendAt          string          `json:"send_at"`
+	ParentMessageID *int            `json:"parent_message_id"`
+	ParseMode       string          `json:"parse_mode"`
+	Entities        []messageEntity `json:"entities"`
+}
+
+// Проверка времени отправки: только в будущем и не дальше допустимого срока.
+// В запросах значение приводится к timestamptz, чтобы смещение часового пояса клиента не терялось
+func parseSendAt(value string) (time.Time, bool) {
+	sendAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	now := time.Now()
+	if !sendAt.After(now) || sendAt.Sub(now) > maxScheduleAhead {
+		return time.Time{}, false
+	}
+	return sendAt, true
+}
+
+// Создание отложенного сообщения
+func handleScheduleMessageCommand(conn *websocket.Conn, cmd scheduleCommand) {
+	sendAt, ok := parseSendAt(cmd.SendAt)
+	if !ok || cmd.Text == "" {
+		log.Printf("Некорректное отложенное сообщение от пользователя %d: send_at=%q", cmd.UserID, cmd.SendAt)
+		return
+	}
+	// Текст проверяется при планировании, чтобы ошибка не обнаружилась только в момент отправки
+	text, entities, err := prepareMessageText(cmd.Text, cmd.ParseMode, cmd.Entities)
+	if err != nil {
+		log.Printf("Отложенное сообщение пользователя %d отклонено: %v", cmd.UserID, err)
+		conn.WriteJSON(map[string]interface{}{
+			"type":    "message_rejected",
+			"chat_id": cmd.ChatID,
+			"error":   err.Error(),
+		})
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("DB error: %v", err)
+		return
+	}
+	defer db.Close()
+
+	if ok, err := isChatParticipant(db, cmd.ChatID, cmd.UserID); err != nil || !ok {
+		log.Printf("Unauthorized schedule attempt: user %d, chat %d", cmd.UserID, cmd.ChatID)
+		return
+	}
+
+	scheduled := scheduledMessage{
+		ChatID:          cmd.ChatID,
+		UserID:          cmd.UserID,
+		Text:            text,
+		Entities:        entities,
+		ParentMessageID: cmd.ParentMessageID,
+		Status:          "pending",
+	}
+	err = db.QueryRow(`
+        INSERT INTO scheduled_messages (chat_id, user_id, content, entities, parent_message_id, send_at)
+        VALUES ($1, $2, $3, $4::jsonb, $5, $6::timestamptz) RETURNING id, send_at, created_at`,
+		cmd.ChatID, cmd.UserID, text, entitiesJSON(entities), nullableID(cmd.ParentMessageID), sendAt,
+	).Scan(&scheduled.ID, &scheduled.SendAt, &scheduled.CreatedAt)
+	if err != nil {
+		log.Printf("Ошибка сохранения отложенного сообщения: %v", err)
+		return
+	}
+
+	broadcastToUsers([]int{cmd.UserID}, map[string]interface{}{
+		"type":      "scheduled_message_created",
+		"scheduled": scheduled,
+	})
+}
+
+// Изменение текста или времени отправки отложенного сообщения
+func handleEditScheduledCommand(conn *websocket.Conn, cmd scheduleCommand) {
+	var sendAt sql.NullTime
+	if cmd.SendAt != "" {
+		t, ok := parseSendAt(cmd.SendAt)
+		if !ok {
+			log.Printf("Некорректное время отправки: %q", cmd.SendAt)
+			return
+		}
+		sendAt = sql.NullTime{Time: t, Valid: true}
+	}
+
+	var (
+		newText  string
+		entities []messageEntity
+	)
+	if cmd.NewText != "" {
+		var err error
+		newText, entities, err = prepareMessageText(cmd.NewText, cmd.ParseMode, cmd.Entities)
+		if err != nil {
+			log.Printf("Изменение отложенного сообщения %d отклонено: %v", cmd.ScheduledID, err)
+			return
+		}
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("DB error: %v", err)
+		return
+	}
+	defer db.Close()
+
+	// Редактировать можно только своё и ещё не отправленное сообщение
+	scheduled := scheduledMessage{ID: cmd.ScheduledID}
+	var (
+		parentID    sql.NullInt64
+		rawEntities []byte
+	)
+	err = db.QueryRow(`
+        UPDATE scheduled_messages
+        SET content = CASE WHEN $3 = '' THEN content ELSE $3 END,
+            entities = CASE WHEN $3 = '' THEN entities ELSE $5::jsonb END,
+            send_at = COALESCE($4::timestamptz, send_at),
+            updated_at = CURRENT_TIMESTAMP
+        WHERE id = $1 AND user_id = $2 AND status = 'pending'
+        RETURNING chat_id, user_id, content, entities, parent_message_id, send_at, status, created_at`,
+		cmd.ScheduledID, cmd.UserID, newText, sendAt, entitiesJSON(entities),
+	).Scan(&scheduled.ChatID, &scheduled.UserID, &scheduled.Text, &rawEntities, &parentID, &scheduled.SendAt, &scheduled.Status, &scheduled.CreatedAt)
+	if err != nil {
+		log.Printf("Unauthorized or failed scheduled edit: user %d, scheduled %d: %v", cmd.UserID, cmd.ScheduledID, err)
+		return
+	}
+	scheduled.Entities = parseEntitiesJSON(rawEntities)
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		scheduled.ParentMessageID = &id
+	}
+
+	broadcastToUsers([]int{cmd.UserID}, map[string]interface{}{
+		"type":      "scheduled_message_updated",
+		"scheduled": scheduled,
+	})
+}
+
+// Отмена отложенного сообщения
+func handleCancelScheduledCommand(conn *websocket.Conn, cmd scheduleCommand) {
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("DB error: %v", err)
+		return
+	}
+	defer db.Close()
+
+	var chatID int
+	err = db.QueryRow(`
+        UPDATE scheduled_messages
+        SET status = 'cancelled', updated_at = CURRENT_TIMESTAMP
+        WHERE id = $1 AND user_id = $2 AND status = 'pending'
+        RETURNING chat_id`,
+		cmd.ScheduledID, cmd.UserID,
+	).Scan(&chatID)
+	if err != nil {
+		log.Printf("Unauthorized or failed scheduled cancel: user %d, scheduled %d: %v", cmd.UserID, cmd.ScheduledID, err)
+		return
+	}
+
+	broadcastToUsers([]int{cmd.UserID}, map[string]interface{}{
+		"type":         "scheduled_message_cancelled",
+		"scheduled_id": cmd.ScheduledID,
+		"chat_id":      chatID,
+	})
+}
+
+// Список ожидающих отправки сообщений пользователя в чате
+func getPendingScheduled(db *sql.DB, chatID, userID int) ([]scheduledMessage, error) {
+	rows, err := db.Query(`
+        SELECT id, chat_id, user_id, content, entities, parent_message_id, send_at, status, created_at
+        FROM scheduled_messages
+        WHERE chat_id = $1 AND user_id = $2 AND status = 'pending'
+        ORDER BY send_at`, chatID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []scheduledMessage{}
+	for rows.Next() {
+		var (
+			item        scheduledMessage
+			parentID    sql.NullInt64
+			rawEntities []byte
+		)
+		if err := rows.Scan(&item.ID, &item.ChatID, &item.UserID, &item.Text, &rawEntities, &parentID, &item.SendAt, &item.Status, &item.CreatedAt); err != nil {
+			log.Printf("Ошибка чтения отложенного сообщения: %v", err)
+			continue
+		}
+		if parentID.Valid {
+			id := int(parentID.Int64)
+			item.ParentMessageID = &id
+		}
+		item.Entities = parseEntitiesJSON(rawEntities)
+		list = append(list, item)
+	}
+	return list, rows.Err()
+}
+
+// Отправка списка отложенных сообщений через WebSocket
+func handleListScheduledCommand(conn *websocket.Conn, cmd scheduleCommand) {
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("DB error: %v", err)
+		return
+	}
+	defer db.Close()
+
+	list, err := getPendingScheduled(db, cmd.ChatID, cmd.UserID)
+	if err != nil {
+		log.Printf("Ошибка получения отложенных сообщений: %v", err)
+		return
+	}
+
+	conn.WriteJSON(map[string]interface{}{
+		"type":      "scheduled_messages",
+		"chat_id":   cmd.ChatID,
+		"scheduled": list,
+	})
+}
+
+// scheduledMessagesHandler возвращает отложенные сообщения пользователя в чате
+func scheduledMessagesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	chatID, err := strconv.Atoi(r.URL.Query().Get("chat_id"))
+	if err != nil {
+		http.Error(w, "Invalid chat_id", http.StatusBadRequest)
+		return
+	}
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user_id", http.StatusBadRequest)
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	list, err := getPendingScheduled(db, chatID, userID)
+	if err != nil {
+		log.Printf("Ошибка получения отложенных сообщений: %v", err)
+		http.Error(w, "Query error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// Фоновый планировщик отложенных сообщений.
+// Состояние хранится в БД, поэтому после перезапуска сервера просроченные сообщения отправляются при первом проходе
+func startMessageScheduler() {
+	go func() {
+		ticker := time.NewTicker(schedulerInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			dispatchDueScheduledMessages()
+		}
+	}()
+}
+
+// Отправка всех сообщений, время которых наступило
+func dispatchDueScheduledMessages() {
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("Планировщик: ошибка подключения к БД: %v", err)
+		return
+	}
+	defer db.Close()
+
+	dispatchScheduledBatch(db)
+}
+
+// Один проход планировщика. Неудачная отправка отдельного сообщения записывается в его строку
+// и не останавливает остальные; проход прерывается только при ошибке самой БД
+func dispatchScheduledBatch(db *sql.DB) {
+	for i := 0; i < schedulerBatchLimit; i++ {
+		found, err := dispatchNextScheduledMessage(db)
+		if err != nil {
+			log.Printf("Планировщик: ошибка отправки: %v", err)
+			return
+		}
+		if !found {
+			return
+		}
+	}
+}
+
+// Задержка перед повтором после временной ошибки: экспоненциальный рост с ограничением
+func scheduledRetryDelay(attempts int) time.Duration {
+	if attempts > 10 {
+		return schedulerMaxRetryDelay
+	}
+	delay := schedulerBaseRetryDelay << (attempts - 1)
+	if delay > schedulerMaxRetryDelay {
+		delay = schedulerMaxRetryDelay
+	}
+	return delay
+}
+
+// Состояние отложенного сообщения после попытки с номером attempts: sent, failed или pending
+// с задержкой до повтора. Ошибки текста, запрет писать и выход автора из чата повтором не исправить
+func scheduledAttemptOutcome(attempts int, sendErr error) (string, time.Duration) {
+	switch {
+	case sendErr == nil:
+		return "sent", 0
+	case isMessageValidationError(sendErr) || errors.Is(sendErr, errScheduledAuthorLeft):
+		return "failed", 0
+	case attempts >= schedulerMaxAttempts:
+		return "failed", 0
+	default:
+		return "pending", scheduledRetryDelay(attempts)
+	}
+}
+
+// Причина отказа для автора: текст внутренних ошибок БД клиенту не передаётся
+func scheduledFailureReason(sendErr error) string {
+	if isMessageValidationError(sendErr) || errors.Is(sendErr, errScheduledAuthorLeft) {
+		return sendErr.Error()
+	}
+	return "message could not be sent"
+}
+
+// Проверки и сохранение отложенного сообщения в транзакции планировщика
+func storeScheduledMessage(tx *sql.Tx, msg chatMessage) (storedMessage, error) {
+	// Автор мог покинуть чат, пока сообщение ждало отправки
+	ok, err := isChatParticipant(tx, msg.ChatID, msg.UserID)
+	if err != nil {
+		return storedMessage{}, err
+	}
+	if !ok {
+		return storedMessage{}, errScheduledAuthorLeft
+	}
+	// Запрет писать, выданный после планирования, действует и на отложенные сообщения
+	if err := checkMemberMuted(tx, msg.ChatID, msg.UserID); err != nil {
+		return storedMessage{}, err
+	}
+	return storeChatMessage(tx, msg)
+}
+
+// Отправка одного сообщения. Вставка сообщения и смена статуса выполняются в одной транзакции,
+// поэтому сообщение не отправится дважды даже при падении сервера или нескольких экземплярах.
+// Ошибка отправки откатывается до точки сохранения, а результат попытки записывается в ту же строку
+func dispatchNextScheduledMessage(db *sql.DB) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var (
+		scheduledID int
+		attempts    int
+		msg         chatMessage
+		parentID    sql.NullInt64
+		rawEntities []byte
+	)
+	err = tx.QueryRow(`
+        SELECT id, chat_id, user_id, content, entities, parent_message_id, attempts
+        FROM scheduled_messages
+        WHERE status = 'pending' AND send_at <= CURRENT_TIMESTAMP
+          AND (next_attempt_at IS NULL OR next_attempt_at <= CURRENT_TIMESTAMP)
+        ORDER BY send_at
+        LIMIT 1
+        FOR UPDATE SKIP LOCKED`,
+	).Scan(&scheduledID, &msg.ChatID, &msg.UserID, &msg.Text, &rawEntities, &parentID, &attempts)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if parentID.Valid {
+		id := int(parentID.Int64)
+		msg.ParentMessageID = &id
+	}
+	msg.Entities = parseEntitiesJSON(rawEntities)
+	attempts++
+
+	if _, err := tx.Exec("SAVEPOINT scheduled_send"); err != nil {
+		return false, err
+	}
+	stored, sendErr := storeScheduledMessage(tx, msg)
+	if sendErr != nil {
+		if _, err := tx.Exec("ROLLBACK TO SAVEPOINT scheduled_send"); err != nil {
+			return false, err
+		}
+		outcome, retryDelay := scheduledAttemptOutcome(attempts, sendErr)
+		_, err = tx.Exec(`
+            UPDATE scheduled_messages
+            SET status = $2, attempts = $3, last_error = $4,
+                next_attempt_at = CASE WHEN $2 = 'pending' THEN CURRENT_TIMESTAMP + $5 * INTERVAL '1 millisecond' END,
+                updated_at = CURRENT_TIMESTAMP
+            WHERE id = $1`, scheduledID, outcome, attempts, sendErr.Error(), retryDelay.Milliseconds())
+		if err != nil {
+			return false, err
+		}
+		if err := tx.Commit(); err != nil {
+			return false, err
+		}
+
+		if outcome == "pending" {
+			log.Printf("Планировщик: сообщение %d не отправлено (попытка %d), повтор через %v: %v", scheduledID, attempts, retryDelay, sendErr)
+			return true, nil
+		}
+		log.Printf("Планировщик: сообщение %d пользователя %d в чат %d не отправлено: %v", scheduledID, msg.UserID, msg.ChatID, sendErr)
+		broadcastToUsers([]int{msg.UserID}, map[string]interface{}{
+			"type":         "scheduled_message_failed",
+			"scheduled_id": scheduledID,
+			"chat_id":      msg.ChatID,
+			"error":        scheduledFailureReason(sendErr),
+		})
+		return true, nil
+	}
+
+	messageID := stored.ID
+	_, err = tx.Exec(`
+        UPDATE scheduled_messages
+        SET status = 'sent', sent_message_id = $2, attempts = $3, next_attempt_at = NULL, updated_at = CURRENT_TIMESTAMP
+        WHERE id = $1`, scheduledID, messageID, attempts)
+	if err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	log.Printf("Планировщик: отложенное сообщение %d отправлено как %d", scheduledID, messageID)
+	broadcastChatMessage(db, stored, msg, nil)
+	broadcastToUsers([]int{msg.UserID}, map[string]interface{}{
+		"type":         "scheduled_message_sent",
+		"scheduled_id": scheduledID,
+		"chat_id":      msg.ChatID,
+		"message_id":   messageID,
+	})
+	return true, nil
+}
+
+// Разбор команд отложенных сообщений из WebSocket
+func handleScheduledCommand(conn *websocket.Conn, commandType string, message []byte) {
+	var cmd scheduleCommand
+	if err := json.Unmarshal(message, &cmd); err != nil {
+		log.Printf("Ошибка парсинга команды %s: %v", commandType, err)
+		return
+	}
+
+	switch commandType {
+	case "schedule_message":
+		handleScheduleMessageCommand(conn, cmd)
+	case "edit_scheduled":
+		handleEditScheduledCommand(conn, cmd)
+	case "cancel_scheduled":
+		handleCancelScheduledCommand(conn, cmd)
+	case "list_scheduled":
+		handleListScheduledCommand(conn, cmd)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Подключённый по WebSocket пользователь: серверная сторона регистрируется в clients,
+// события читаются с клиентской
+func connectTestClient(t *testing.T, userID, chatID int) *websocket.Conn {
+	t.Helper()
+	registered := make(chan *websocket.Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		clientsMu.Lock()
+		clients[conn] = clientInfo{userID: userID, chatID: chatID}
+		clientsMu.Unlock()
+		registered <- conn
+	}))
+	t.Cleanup(server.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(server.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn := <-registered
+	t.Cleanup(func() {
+		clientsMu.Lock()
+		delete(clients, serverConn)
+		clientsMu.Unlock()
+		serverConn.Close()
+		conn.Close()
+	})
+	return conn
+}
+
+// Следующее событие, полученное клиентом
+func readTestEvent(t *testing.T, conn *websocket.Conn) map[string]interface{} {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var event map[string]interface{}
+	if err := conn.ReadJSON(&event); err != nil {
+		t.Fatalf("no event received: %v", err)
+	}
+	return event
+}
+
+func TestScheduledAttemptOutcome(t *testing.T) {
+	transient := errors.New("connection reset by peer")
+	cases := []struct {
+		attempts int
+		err      error
+		outcome  string
+	}{
+		{1, nil, "sent"},
+		{1, errMessageTooLong, "failed"},
+		{1, errMemberMuted, "failed"},
+		{1, errScheduledAuthorLeft, "failed"},
+		{1, transient, "pending"},
+		{schedulerMaxAttempts - 1, transient, "pending"},
+		{schedulerMaxAttempts, transient, "failed"},
+	}
+	for _, c := range cases {
+		outcome, delay := scheduledAttemptOutcome(c.attempts, c.err)
+		if outcome != c.outcome {
+			t.Errorf("attempt %d, %v: outcome %s, want %s", c.attempts, c.err, outcome, c.outcome)
+		}
+		if (outcome == "pending") != (delay > 0) {
+			t.Errorf("attempt %d, %v: delay %v for %s", c.attempts, c.err, delay, outcome)
+		}
+	}
+	if reason := scheduledFailureReason(transient); strings.Contains(reason, "connection") {
+		t.Fatalf("internal error exposed to the author: %q", reason)
+	}
+}
+
+func TestScheduledRetryDelay(t *testing.T) {
+	previous := time.Duration(0)
+	for attempts := 1; attempts <= 40; attempts++ {
+		delay := scheduledRetryDelay(attempts)
+		if delay < previous || delay < schedulerBaseRetryDelay || delay > schedulerMaxRetryDelay {
+			t.Fatalf("scheduledRetryDelay(%d) = %v after %v", attempts, delay, previous)
+		}
+		previous = delay
+	}
+}
+
+// Строка scheduled_messages в поддельной БД
+type testScheduledRow struct {
+	id, chatID, userID, attempts int
+	status                       string
+	retryLater                   bool
+}
+
+// Поддельная БД планировщика: выборка ближайшего сообщения, смена статуса и вставка в messages.
+// mutedUsers задают автора, которому запрещено писать, failingChats — временную ошибку вставки
+func newScheduledFakeDB(t *testing.T, rows []*testScheduledRow, mutedUsers, failingChats map[int]bool) (*sql.DB, *fakeDB) {
+	db, fake := newFakeDB(t)
+	find := func(id int64) *testScheduledRow {
+		for _, row := range rows {
+			if int64(row.id) == id {
+				return row
+			}
+		}
+		t.Fatalf("unknown scheduled message %d", id)
+		return nil
+	}
+
+	fake.on("FROM scheduled_messages", func([]driver.Value) fakeResult {
+		for _, row := range rows {
+			if row.status == "pending" && !row.retryLater {
+				return fakeRow(int64(row.id), int64(row.chatID), int64(row.userID), "text", nil, nil, int64(row.attempts))
+			}
+		}
+		return fakeResult{}
+	})
+	fake.on("SET status = $2", func(args []driver.Value) fakeResult {
+		row := find(args[0].(int64))
+		row.status, row.attempts = args[1].(string), int(args[2].(int64))
+		row.retryLater = row.status == "pending"
+		return fakeResult{affected: 1}
+	})
+	fake.on("SET status = 'sent'", func(args []driver.Value) fakeResult {
+		row := find(args[0].(int64))
+		row.status, row.attempts = "sent", int(args[2].(int64))
+		return fakeResult{affected: 1}
+	})
+	fake.on("muted_until > CURRENT_TIMESTAMP", func(args []driver.Value) fakeResult {
+		return fakeRow(mutedUsers[int(args[1].(int64))])
+	})
+	fake.on("FROM participants WHERE chat_id = $1 AND user_id = $2", func([]driver.Value) fakeResult {
+		return fakeRow(true)
+	})
+	fake.on("INSERT INTO messages", func(args []driver.Value) fakeResult {
+		if failingChats[int(args[0].(int64))] {
+			return fakeResult{err: errors.New("deadlock detected")}
+		}
+		return fakeRow(int64(500+args[0].(int64)), time.Now(), nil)
+	})
+	return db, fake
+}
+
+// Сообщение, которое нельзя отправить, помечается failed, автор получает уведомление,
+// а следующее сообщение уходит в том же проходе
+func TestDispatchScheduledBatchSkipsFailedMessage(t *testing.T) {
+	rows := []*testScheduledRow{
+		{id: 1, chatID: 10, userID: 1, status: "pending"},
+		{id: 2, chatID: 20, userID: 2, status: "pending"},
+	}
+	db, fake := newScheduledFakeDB(t, rows, map[int]bool{1: true}, nil)
+	author := connectTestClient(t, 1, 0)
+	other := connectTestClient(t, 2, 0)
+
+	dispatchScheduledBatch(db)
+
+	if rows[0].status != "failed" || rows[0].attempts != 1 {
+		t.Fatalf("muted author's message: %+v, want failed", *rows[0])
+	}
+	if rows[1].status != "sent" {
+		t.Fatalf("next message: %+v, want sent", *rows[1])
+	}
+	if n := len(fake.queries("ROLLBACK TO SAVEPOINT")); n != 1 {
+		t.Fatalf("rolled back to savepoint %d times, want 1", n)
+	}
+	if n := len(fake.queries("INSERT INTO messages")); n != 1 {
+		t.Fatalf("inserted %d messages, want 1", n)
+	}
+	if event := readTestEvent(t, author); event["type"] != "scheduled_message_failed" ||
+		event["scheduled_id"] != float64(1) || event["error"] != errMemberMuted.Error() {
+		t.Fatalf("author event: %v", event)
+	}
+	if event := readTestEvent(t, other); event["type"] != "scheduled_message_sent" || event["message_id"] != float64(520) {
+		t.Fatalf("sent event: %v", event)
+	}
+}
+
+// Временная ошибка откладывает повтор только этого сообщения; после исчерпания попыток — failed
+func TestDispatchScheduledBatchRetriesTransientError(t *testing.T) {
+	rows := []*testScheduledRow{
+		{id: 1, chatID: 30, userID: 1, status: "pending"},
+		{id: 2, chatID: 20, userID: 2, status: "pending"},
+		{id: 3, chatID: 30, userID: 3, status: "pending", attempts: schedulerMaxAttempts - 1},
+	}
+	db, fake := newScheduledFakeDB(t, rows, nil, map[int]bool{30: true})
+
+	dispatchScheduledBatch(db)
+
+	if rows[0].status != "pending" || !rows[0].retryLater || rows[0].attempts != 1 {
+		t.Fatalf("transient failure: %+v, want pending with retry", *rows[0])
+	}
+	if rows[1].status != "sent" {
+		t.Fatalf("next message: %+v, want sent", *rows[1])
+	}
+	if rows[2].status != "failed" || rows[2].attempts != schedulerMaxAttempts {
+		t.Fatalf("last attempt: %+v, want failed", *rows[2])
+	}
+	for _, q := range fake.queries("SET status = $2") {
+		if q.args[1] == "pending" && q.args[4].(int64) != scheduledRetryDelay(1).Milliseconds() {
+			t.Fatalf("retry delay %v ms, want %v", q.args[4], scheduledRetryDelay(1))
+		}
+	}
+}
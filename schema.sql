@@ -1,13 +1,65 @@
 -- Подключение к базе данных 'mydatabase' под пользователем 'postgres' должно быть выполнено перед запуском
 
 -- Удаление существующих таблиц в обратном порядке зависимостей, чтобы избежать ошибок
+DROP TABLE IF EXISTS push_notifications;
+DROP TABLE IF EXISTS push_devices;
+DROP TABLE IF EXISTS callback_queries;
+DROP TABLE IF EXISTS bot_updates;
+DROP TABLE IF EXISTS bot_commands;
+DROP TABLE IF EXISTS bots;
+DROP TABLE IF EXISTS incoming_webhooks;
+DROP TABLE IF EXISTS webhook_attempts;
+DROP TABLE IF EXISTS webhook_deliveries;
+DROP TABLE IF EXISTS webhooks;
+DROP TABLE IF EXISTS poll_votes;
+DROP TABLE IF EXISTS poll_options;
+DROP TABLE IF EXISTS polls;
+DROP TABLE IF EXISTS message_mentions;
+DROP TABLE IF EXISTS scheduled_messages;
+DROP TABLE IF EXISTS saved_message_tags;
+DROP TABLE IF EXISTS saved_messages;
+DROP TABLE IF EXISTS deleted_messages;
+DROP TABLE IF EXISTS message_contacts;
+DROP TABLE IF EXISTS message_locations;
+DROP TABLE IF EXISTS voice_listens;
+DROP TABLE IF EXISTS uploads;
 DROP TABLE IF EXISTS message_files;
 DROP TABLE IF EXISTS message_reactions;
 DROP TABLE IF EXISTS messages;
+DROP TABLE IF EXISTS user_sticker_packs;
+DROP TABLE IF EXISTS stickers;
+DROP TABLE IF EXISTS sticker_packs;
+DROP TABLE IF EXISTS link_previews;
 DROP TABLE IF EXISTS participants;
 DROP TABLE IF EXISTS group_chats;
 DROP TABLE IF EXISTS chats;
 DROP TABLE IF EXISTS users;
+DROP TABLE IF EXISTS blob_variants;
+DROP TABLE IF EXISTS blobs;
+
+-- Таблица объектов хранилища файлов (ключ — SHA-256 содержимого, одинаковые файлы хранятся один раз)
+CREATE TABLE blobs (
+    key VARCHAR(100) PRIMARY KEY,         -- Ключ объекта в хранилище
+    size BIGINT NOT NULL,                -- Размер в байтах
+    mime_type VARCHAR(255),              -- MIME-тип, определённый при загрузке
+    width INT,                           -- Ширина изображения
+    height INT,                          -- Высота изображения
+    blurhash VARCHAR(64),                -- Размытое превью изображения (BlurHash)
+    duration_ms INT,                     -- Длительность голосового сообщения
+    waveform BYTEA,                      -- Волна громкости голосового сообщения (64 значения 0..31)
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- Время первой загрузки
+    last_stored_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP -- Время последней загрузки (для очистки неиспользуемых)
+);
+
+-- Таблица уменьшенных копий изображений (размеры аватаров, миниатюры вложений)
+CREATE TABLE blob_variants (
+    blob_key VARCHAR(100) NOT NULL REFERENCES blobs(key) ON DELETE CASCADE, -- Исходный объект
+    variant VARCHAR(20) NOT NULL,        -- Вариант: small, medium, large, thumb
+    variant_key VARCHAR(100) NOT NULL REFERENCES blobs(key), -- Объект с уменьшенной копией
+    width INT NOT NULL,                  -- Ширина копии
+    height INT NOT NULL,                 -- Высота копии
+    PRIMARY KEY (blob_key, variant)
+);
 
 -- Таблица пользователей
 CREATE TABLE users (
@@ -16,7 +68,9 @@ CREATE TABLE users (
     password VARCHAR(255) NOT NULL,       -- Пароль (хэшированный)
     name VARCHAR(255),                    -- Имя пользователя (опционально)
     bio TEXT,                            -- Описание профиля (опционально)
-    image BYTEA,                         -- Аватар пользователя в бинарном формате (опционально)
+    image BYTEA,                         -- Аватар в бинарном формате (устаревшее, переносится командой migrate-blobs)
+    image_key VARCHAR(100) REFERENCES blobs(key), -- Ключ аватара в хранилище файлов
+    is_bot BOOLEAN NOT NULL DEFAULT FALSE, -- Учётная запись бота или интеграции (вход по паролю невозможен)
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP -- Дата создания аккаунта
 );
 
@@ -25,7 +79,12 @@ CREATE TABLE chats (
     id SERIAL PRIMARY KEY,                -- Уникальный идентификатор чата
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- Дата создания чата
     last_message_at TIMESTAMP,           -- Время последнего сообщения (обновляется триггером)
-    is_group BOOLEAN NOT NULL DEFAULT FALSE -- Флаг, указывающий, является ли чат групповым
+    is_group BOOLEAN NOT NULL DEFAULT FALSE, -- Флаг, указывающий, является ли чат групповым
+    direct_key VARCHAR(64),              -- Ключ пары участников личного чата ("меньший_id:больший_id"), NULL для групп
+    is_saved BOOLEAN NOT NULL DEFAULT FALSE, -- Флаг чата "Избранное" (чат пользователя с самим собой)
+    message_ttl INT,                     -- Время жизни новых сообщений в секундах (NULL — автоудаление выключено)
+    allowed_reactions TEXT[],            -- Разрешённые реакции (NULL — любые)
+    max_reactions_per_user INT NOT NULL DEFAULT 3 -- Сколько разных реакций один пользователь может поставить на сообщение
 );
 
 -- Таблица участников чатов (связь многие-ко-многим между users и chats)
@@ -33,10 +92,56 @@ CREATE TABLE participants (
     chat_id INT REFERENCES chats(id) ON DELETE CASCADE, -- ID чата, удаление чата каскадно удаляет записи
     user_id INT REFERENCES users(id) ON DELETE CASCADE, -- ID пользователя, удаление пользователя удаляет записи
     unread_count INT NOT NULL DEFAULT 0, -- Количество непрочитанных сообщений для пользователя в чате
+    unread_mentions INT NOT NULL DEFAULT 0, -- Количество непрочитанных упоминаний пользователя в чате
     is_admin BOOLEAN NOT NULL DEFAULT FALSE, -- Флаг, указывающий, является ли участник администратором
+    hidden_at TIMESTAMP,                 -- Время удаления чата "у себя" (чат скрыт до следующего сообщения)
+    history_cleared_at TIMESTAMP,        -- Граница очистки истории: более ранние сообщения не показываются
+    muted_until TIMESTAMP,               -- До какого времени администратор запретил участнику писать (/mute)
     PRIMARY KEY (chat_id, user_id)       -- Составной первичный ключ
 );
 
+-- Кеш превью ссылок (Open Graph / HTML-метаданные страниц)
+CREATE TABLE link_previews (
+    url VARCHAR(2048) PRIMARY KEY,       -- Адрес страницы
+    ok BOOLEAN NOT NULL,                 -- Превью получено (FALSE — неудачная попытка, повтор позже)
+    title VARCHAR(300),                  -- Заголовок
+    description TEXT,                    -- Описание
+    image_url VARCHAR(2048),             -- Изображение страницы
+    site_name VARCHAR(100),              -- Название сайта
+    fetched_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP -- Время загрузки
+);
+
+-- Наборы стикеров и пользовательских эмодзи
+CREATE TABLE sticker_packs (
+    id SERIAL PRIMARY KEY,                -- Уникальный идентификатор набора
+    short_name VARCHAR(64) NOT NULL,     -- Короткое имя для ссылок (уникально без учёта регистра)
+    title VARCHAR(64) NOT NULL,          -- Название
+    kind VARCHAR(10) NOT NULL DEFAULT 'sticker' CHECK (kind IN ('sticker', 'emoji')), -- Стикеры или эмодзи для реакций
+    owner_id INT REFERENCES users(id) ON DELETE SET NULL, -- Автор набора
+    is_official BOOLEAN NOT NULL DEFAULT FALSE, -- Набор создан администратором сервера
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP -- Время создания
+);
+
+-- Стикеры и эмодзи наборов (файлы WebP/PNG в хранилище)
+CREATE TABLE stickers (
+    id SERIAL PRIMARY KEY,                -- Уникальный идентификатор стикера
+    pack_id INT NOT NULL REFERENCES sticker_packs(id) ON DELETE CASCADE, -- Набор
+    blob_key VARCHAR(100) NOT NULL REFERENCES blobs(key), -- Файл изображения
+    emoji VARCHAR(64),                   -- Эмодзи, которому соответствует стикер (поиск, текст сообщения)
+    position INT NOT NULL DEFAULT 0,     -- Порядок в наборе
+    width INT NOT NULL,                  -- Ширина
+    height INT NOT NULL,                 -- Высота
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP -- Время добавления
+);
+
+-- Наборы, установленные пользователями
+CREATE TABLE user_sticker_packs (
+    user_id INT REFERENCES users(id) ON DELETE CASCADE, -- Пользователь
+    pack_id INT REFERENCES sticker_packs(id) ON DELETE CASCADE, -- Набор
+    installed_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- Время установки
+    PRIMARY KEY (user_id, pack_id)
+);
+
 -- Таблица сообщений
 CREATE TABLE messages (
     id SERIAL PRIMARY KEY,                -- Уникальный идентификатор сообщения
@@ -48,7 +153,57 @@ CREATE TABLE messages (
     parent_message_id INT REFERENCES messages(id) ON DELETE SET NULL, -- ID родительского сообщения (для ответов)
     is_forwarded BOOLEAN NOT NULL DEFAULT FALSE, -- Флаг пересланного сообщения
     original_sender_id INT REFERENCES users(id) ON DELETE SET NULL, -- ID исходного отправителя (для пересылки)
-    original_chat_id INT REFERENCES chats(id) ON DELETE SET NULL -- ID исходного чата (для пересылки)
+    original_chat_id INT REFERENCES chats(id) ON DELETE SET NULL, -- ID исходного чата (для пересылки)
+    is_deleted BOOLEAN NOT NULL DEFAULT FALSE, -- Флаг сообщения, удалённого для всех
+    is_edited BOOLEAN NOT NULL DEFAULT FALSE, -- Флаг отредактированного сообщения
+    edited_at TIMESTAMP,                 -- Время последнего редактирования
+    expires_at TIMESTAMP,                -- Время автоудаления (для исчезающих сообщений)
+    entities JSONB,                      -- Сущности форматирования (жирный, курсив, код, ссылки, упоминания, спойлеры)
+    message_type VARCHAR(20) NOT NULL DEFAULT 'text', -- Тип сообщения: text, poll, album, voice, location, contact, sticker
+    preview_url VARCHAR(2048) REFERENCES link_previews(url) ON DELETE SET NULL, -- Ссылка, превью которой показывается под сообщением
+    sticker_id INT REFERENCES stickers(id) ON DELETE SET NULL, -- Стикер сообщения типа sticker
+    reply_markup JSONB                   -- Кнопки под сообщением бота
+);
+
+-- Таблица опросов (сообщение типа poll)
+CREATE TABLE polls (
+    id SERIAL PRIMARY KEY,                -- Уникальный идентификатор опроса
+    message_id INT NOT NULL UNIQUE REFERENCES messages(id) ON DELETE CASCADE, -- Сообщение, в котором опубликован опрос
+    chat_id INT NOT NULL REFERENCES chats(id) ON DELETE CASCADE, -- ID чата
+    question TEXT NOT NULL,              -- Вопрос
+    multiple_choice BOOLEAN NOT NULL DEFAULT FALSE, -- Разрешён выбор нескольких вариантов
+    is_anonymous BOOLEAN NOT NULL DEFAULT TRUE, -- Анонимный опрос (голосовавшие не раскрываются)
+    is_quiz BOOLEAN NOT NULL DEFAULT FALSE, -- Режим викторины с правильным ответом
+    correct_option_id INT,               -- Правильный вариант (для викторины)
+    close_at TIMESTAMPTZ,                -- Время автоматического закрытия
+    is_closed BOOLEAN NOT NULL DEFAULT FALSE, -- Флаг закрытого опроса
+    closed_at TIMESTAMP,                 -- Время закрытия
+    created_by INT REFERENCES users(id) ON DELETE SET NULL -- Автор опроса
+);
+
+-- Таблица вариантов ответа
+CREATE TABLE poll_options (
+    id SERIAL PRIMARY KEY,                -- Уникальный идентификатор варианта
+    poll_id INT NOT NULL REFERENCES polls(id) ON DELETE CASCADE, -- ID опроса
+    position INT NOT NULL,               -- Порядковый номер варианта
+    text TEXT NOT NULL                   -- Текст варианта
+);
+
+-- Таблица голосов
+CREATE TABLE poll_votes (
+    poll_id INT NOT NULL REFERENCES polls(id) ON DELETE CASCADE, -- ID опроса
+    option_id INT NOT NULL REFERENCES poll_options(id) ON DELETE CASCADE, -- Выбранный вариант
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, -- Проголосовавший пользователь
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- Время голоса
+    PRIMARY KEY (poll_id, option_id, user_id)
+);
+
+-- Таблица сообщений, удалённых отдельными пользователями "у себя"
+CREATE TABLE deleted_messages (
+    message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE, -- ID удалённого сообщения
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, -- ID пользователя, удалившего сообщение
+    deleted BOOLEAN NOT NULL DEFAULT TRUE, -- Флаг удаления
+    PRIMARY KEY (message_id, user_id)
 );
 
 -- Таблица реакций на сообщения
@@ -58,18 +213,73 @@ CREATE TABLE message_reactions (
     user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, -- ID пользователя, поставившего реакцию
     reaction VARCHAR(50) NOT NULL,       -- Текст реакции (например, "👍" или "😂")
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- Время добавления реакции
-    UNIQUE (message_id, user_id)         -- Ограничение: один пользователь — одна реакция на сообщение
+    UNIQUE (message_id, user_id, reaction) -- Ограничение: одна и та же реакция пользователя не повторяется
 );
 
 -- Таблица файлов, прикреплённых к сообщениям
 CREATE TABLE message_files (
     id SERIAL PRIMARY KEY,                -- Уникальный идентификатор файла
     message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE, -- ID сообщения, к которому файл прикреплён
+    kind VARCHAR(10) NOT NULL DEFAULT 'file', -- Вид вложения: file или voice
     file_name VARCHAR(255) NOT NULL,     -- Имя файла
-    file_data BYTEA NOT NULL,            -- Бинарные данные файла
+    file_data BYTEA,                     -- Бинарные данные файла (устаревшее, переносится командой migrate-blobs)
+    blob_key VARCHAR(100) REFERENCES blobs(key), -- Ключ файла в хранилище
+    file_size BIGINT NOT NULL DEFAULT 0, -- Размер файла в байтах
+    mime_type VARCHAR(255),              -- MIME-тип файла
     uploaded_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP -- Время загрузки файла
 );
 
+-- Таблица местоположений (сообщения типа location): статичная точка или трансляция
+CREATE TABLE message_locations (
+    message_id INT PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE, -- Сообщение с местоположением
+    chat_id INT NOT NULL REFERENCES chats(id) ON DELETE CASCADE, -- ID чата
+    latitude DOUBLE PRECISION NOT NULL,  -- Широта
+    longitude DOUBLE PRECISION NOT NULL, -- Долгота
+    accuracy REAL,                       -- Погрешность в метрах
+    heading SMALLINT,                    -- Направление движения (1..360) для трансляции
+    venue_name VARCHAR(100),             -- Название места
+    venue_address VARCHAR(200),          -- Адрес места
+    live_until TIMESTAMP,                -- Окончание трансляции (NULL — статичная точка)
+    stopped_at TIMESTAMP,                -- Время остановки трансляции
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP -- Время последнего обновления координат
+);
+
+-- Таблица карточек контактов (сообщения типа contact)
+CREATE TABLE message_contacts (
+    message_id INT PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE, -- Сообщение с контактом
+    contact_user_id INT REFERENCES users(id) ON DELETE SET NULL, -- Пользователь мессенджера (если указан)
+    name VARCHAR(255) NOT NULL,          -- Имя контакта на момент отправки
+    phone VARCHAR(50),                   -- Телефон из vCard
+    vcard TEXT                           -- Исходная vCard
+);
+
+-- Таблица прослушиваний голосовых сообщений получателями
+CREATE TABLE voice_listens (
+    message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE, -- Голосовое сообщение
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, -- Прослушавший пользователь
+    listened_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- Время прослушивания
+    PRIMARY KEY (message_id, user_id)
+);
+
+-- Таблица возобновляемых загрузок файлов (протокол tus)
+CREATE TABLE uploads (
+    id VARCHAR(64) PRIMARY KEY,          -- Случайный идентификатор загрузки
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, -- Загружающий пользователь
+    kind VARCHAR(10) NOT NULL DEFAULT 'file', -- Вид вложения: file или voice
+    file_name VARCHAR(255) NOT NULL,     -- Имя файла
+    length BIGINT NOT NULL,              -- Объявленный размер файла
+    upload_offset BIGINT NOT NULL DEFAULT 0, -- Сколько байт уже получено
+    sha256 VARCHAR(64),                  -- Ожидаемая контрольная сумма файла (необязательно)
+    message_id INT REFERENCES messages(id) ON DELETE CASCADE, -- Сообщение, к которому прикрепляется файл
+    status VARCHAR(20) NOT NULL DEFAULT 'uploading', -- uploading, completed (вложение ждёт отправки) или attached
+    blob_key VARCHAR(100) REFERENCES blobs(key), -- Ключ файла в хранилище после завершения
+    mime_type VARCHAR(255),              -- MIME-тип завершённого файла
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- Время создания загрузки
+    updated_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- Время получения последней части
+    expires_at TIMESTAMP NOT NULL,       -- Незавершённая или неотправленная загрузка удаляется после этого времени
+    completed_at TIMESTAMP               -- Время завершения
+);
+
 -- Таблица групповых чатов (дополнительная информация для чатов с is_group = TRUE)
 CREATE TABLE group_chats (
     id SERIAL PRIMARY KEY,                -- Уникальный идентификатор записи группового чата
@@ -78,7 +288,176 @@ CREATE TABLE group_chats (
     description TEXT,                    -- Описание группы (опционально)
     created_by INT REFERENCES users(id) ON DELETE SET NULL, -- ID создателя группы
     created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- Дата создания группы
-    image BYTEA                          -- Изображение группы (опционально)
+    image BYTEA,                         -- Изображение группы (устаревшее, переносится командой migrate-blobs)
+    image_key VARCHAR(100) REFERENCES blobs(key), -- Ключ изображения группы в хранилище файлов
+    image_version INT NOT NULL DEFAULT 1, -- Версия изображения (увеличивается при каждом изменении, используется для кеширования)
+    updated_at TIMESTAMP                 -- Время последнего изменения информации о группе
+);
+
+-- Упоминания пользователей в сообщениях
+CREATE TABLE message_mentions (
+    id SERIAL PRIMARY KEY,                -- Уникальный идентификатор упоминания
+    message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE, -- ID сообщения
+    user_id INT REFERENCES users(id) ON DELETE CASCADE, -- Упомянутый пользователь (NULL для @all)
+    mention_type VARCHAR(10) NOT NULL,   -- user или all
+    start_offset INT NOT NULL,           -- Смещение упоминания в тексте (в UTF-16 единицах)
+    length INT NOT NULL                  -- Длина упоминания (в UTF-16 единицах)
+);
+
+-- Сообщения, сохранённые пользователями в "Избранное"
+CREATE TABLE saved_messages (
+    id SERIAL PRIMARY KEY,                -- Уникальный идентификатор закладки
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, -- Владелец закладки
+    message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE, -- Сообщение в чате "Избранное"
+    source_message_id INT REFERENCES messages(id) ON DELETE SET NULL, -- Исходное сообщение (NULL, если удалено)
+    is_reference BOOLEAN NOT NULL DEFAULT FALSE, -- Ссылка на исходное сообщение вместо копии
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP -- Время сохранения
+);
+
+-- Теги сохранённых сообщений для фильтрации
+CREATE TABLE saved_message_tags (
+    saved_message_id INT NOT NULL REFERENCES saved_messages(id) ON DELETE CASCADE, -- ID закладки
+    tag VARCHAR(50) NOT NULL,            -- Тег (в нижнем регистре)
+    PRIMARY KEY (saved_message_id, tag)
+);
+
+-- Отложенные сообщения (отправляются фоновым планировщиком)
+CREATE TABLE scheduled_messages (
+    id SERIAL PRIMARY KEY,                -- Уникальный идентификатор отложенного сообщения
+    chat_id INT NOT NULL REFERENCES chats(id) ON DELETE CASCADE, -- ID чата
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, -- ID автора
+    content TEXT NOT NULL,               -- Текст сообщения
+    entities JSONB,                      -- Сущности форматирования
+    parent_message_id INT REFERENCES messages(id) ON DELETE SET NULL, -- ID сообщения, на которое отвечаем
+    send_at TIMESTAMP NOT NULL,          -- Время отправки
+    status VARCHAR(20) NOT NULL DEFAULT 'pending', -- pending, sent, cancelled, failed
+    sent_message_id INT REFERENCES messages(id) ON DELETE SET NULL, -- ID отправленного сообщения
+    attempts INT NOT NULL DEFAULT 0,     -- Число неудачных попыток отправки
+    next_attempt_at TIMESTAMP,           -- Время повтора после временной ошибки (NULL — в send_at)
+    last_error TEXT,                     -- Причина последней неудачной попытки
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- Время создания
+    updated_at TIMESTAMP                 -- Время последнего изменения
+);
+
+-- Исходящие вебхуки: подписки чата (chat_id) или всего сервера (chat_id IS NULL)
+CREATE TABLE webhooks (
+    id SERIAL PRIMARY KEY,                -- Уникальный идентификатор подписки
+    chat_id INT REFERENCES chats(id) ON DELETE CASCADE, -- Чат, события которого отправляются (NULL — все чаты)
+    owner_id INT REFERENCES users(id) ON DELETE SET NULL, -- Создатель подписки
+    url VARCHAR(2048) NOT NULL,          -- Адрес подписчика
+    secret VARCHAR(64) NOT NULL,         -- Ключ подписи HMAC-SHA256
+    events TEXT[] NOT NULL,              -- События: message.created, message.edited, message.deleted, reaction.added, member.joined
+    is_active BOOLEAN NOT NULL DEFAULT TRUE, -- Подписка включена
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP -- Время создания
+);
+
+-- Очередь доставки событий вебхукам
+CREATE TABLE webhook_deliveries (
+    id SERIAL PRIMARY KEY,                -- Уникальный идентификатор доставки (передаётся в X-Webhook-Delivery)
+    webhook_id INT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE, -- Подписка
+    event VARCHAR(50) NOT NULL,          -- Тип события
+    chat_id INT NOT NULL,                -- Чат события (без внешнего ключа: событие удаления чата тоже доставляется)
+    payload JSONB NOT NULL,              -- Данные события
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'delivered', 'dead')), -- Состояние; dead — попытки исчерпаны
+    attempts INT NOT NULL DEFAULT 0,     -- Число выполненных попыток
+    next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, -- Время следующей попытки
+    delivered_at TIMESTAMP,              -- Время успешной доставки
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP -- Время события
+);
+
+-- Журнал попыток доставки вебхуков
+CREATE TABLE webhook_attempts (
+    id SERIAL PRIMARY KEY,                -- Уникальный идентификатор попытки
+    delivery_id INT NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE, -- Доставка
+    attempted_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- Время попытки
+    status_code INT,                     -- HTTP-статус ответа (NULL — ответа не было)
+    error TEXT,                          -- Ошибка соединения или неуспешный статус
+    response TEXT,                       -- Начало ответа подписчика
+    duration_ms BIGINT NOT NULL          -- Длительность запроса
+);
+
+-- Входящие вебхуки: интеграции публикуют сообщения в группу от имени своей учётной записи-бота
+CREATE TABLE incoming_webhooks (
+    id SERIAL PRIMARY KEY,                -- Уникальный идентификатор вебхука
+    chat_id INT NOT NULL REFERENCES chats(id) ON DELETE CASCADE, -- Группа, в которую публикуются сообщения
+    bot_user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, -- Отправитель сообщений
+    name VARCHAR(64) NOT NULL,           -- Имя интеграции
+    token_hash VARCHAR(64) NOT NULL UNIQUE, -- SHA-256 секретного токена из адреса вебхука
+    created_by INT REFERENCES users(id) ON DELETE SET NULL, -- Кто создал вебхук
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- Время создания
+    last_used_at TIMESTAMP               -- Время последней публикации
+);
+
+-- Боты Bot API: учётная запись users.is_bot, принадлежащая пользователю
+CREATE TABLE bots (
+    user_id INT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE, -- Учётная запись бота
+    owner_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, -- Владелец бота
+    description TEXT,                    -- Описание бота
+    token_hash VARCHAR(64) NOT NULL UNIQUE, -- SHA-256 токена доступа
+    webhook_url TEXT,                    -- Адрес доставки обновлений (NULL — getUpdates)
+    webhook_secret VARCHAR(64),          -- Секрет подписи доставок
+    push_failures INT NOT NULL DEFAULT 0, -- Неудачных доставок подряд
+    next_push_at TIMESTAMP,              -- Время следующей попытки доставки
+    last_push_error TEXT,                -- Последняя ошибка доставки
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP -- Время создания
+);
+
+-- Команды бота для подсказок клиенту
+CREATE TABLE bot_commands (
+    bot_user_id INT NOT NULL REFERENCES bots(user_id) ON DELETE CASCADE, -- Бот
+    command VARCHAR(32) NOT NULL,        -- Команда без косой черты
+    description VARCHAR(256) NOT NULL,   -- Описание команды
+    position INT NOT NULL,               -- Порядок в списке
+    PRIMARY KEY (bot_user_id, command)
+);
+
+-- Очередь обновлений бота до подтверждения получения
+CREATE TABLE bot_updates (
+    id BIGSERIAL PRIMARY KEY,            -- update_id
+    bot_user_id INT NOT NULL REFERENCES bots(user_id) ON DELETE CASCADE, -- Бот-получатель
+    payload JSONB NOT NULL,              -- Обновление ({"message": ...}, {"callback_query": ...})
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP -- Время постановки в очередь
+);
+
+-- Нажатия кнопок под сообщениями ботов
+CREATE TABLE callback_queries (
+    id VARCHAR(32) PRIMARY KEY,          -- Идентификатор нажатия
+    bot_user_id INT NOT NULL REFERENCES bots(user_id) ON DELETE CASCADE, -- Бот
+    message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE, -- Сообщение с кнопкой
+    chat_id INT NOT NULL REFERENCES chats(id) ON DELETE CASCADE, -- Чат сообщения
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, -- Нажавший пользователь
+    data VARCHAR(64) NOT NULL,           -- callback_data кнопки
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- Время нажатия
+    answered_at TIMESTAMP                -- Время ответа бота
+);
+
+-- Устройства для push-уведомлений: одна регистрация на сессию клиента
+CREATE TABLE push_devices (
+    id SERIAL PRIMARY KEY,                -- Уникальный идентификатор устройства
+    user_id INT NOT NULL REFERENCES users(id) ON DELETE CASCADE, -- Владелец
+    session_id VARCHAR(64) NOT NULL,     -- Идентификатор сессии (установки) клиента
+    platform VARCHAR(16) NOT NULL,       -- fcm, apns, webpush или mock
+    token TEXT NOT NULL,                 -- Токен устройства (для Web Push — адрес подписки)
+    p256dh VARCHAR(128),                 -- Ключ подписки Web Push
+    auth VARCHAR(32),                    -- Секрет подписки Web Push
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- Время регистрации
+    last_push_at TIMESTAMP,              -- Время последнего отправленного уведомления
+    UNIQUE (user_id, session_id),
+    UNIQUE (platform, token)
+);
+
+-- Очередь push-уведомлений: не больше одного неотправленного уведомления на устройство и чат
+CREATE TABLE push_notifications (
+    device_id INT NOT NULL REFERENCES push_devices(id) ON DELETE CASCADE, -- Устройство
+    chat_id INT NOT NULL REFERENCES chats(id) ON DELETE CASCADE, -- Чат
+    message_id INT NOT NULL REFERENCES messages(id) ON DELETE CASCADE, -- Последнее сообщение
+    sender_name VARCHAR(255) NOT NULL,   -- Автор последнего сообщения
+    preview TEXT NOT NULL,               -- Начало текста последнего сообщения
+    message_count INT NOT NULL DEFAULT 1, -- Сколько сообщений свёрнуто в уведомление
+    attempts INT NOT NULL DEFAULT 0,     -- Попыток отправки
+    next_attempt_at TIMESTAMP NOT NULL,  -- Время следующей попытки
+    created_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP, -- Время постановки в очередь
+    PRIMARY KEY (device_id, chat_id)
 );
 
 -- Функция для обновления времени последнего сообщения в чате
@@ -98,4 +477,29 @@ EXECUTE FUNCTION update_chat_last_message();
 
 -- Индексы для оптимизации запросов
 CREATE INDEX idx_messages_parent ON messages(parent_message_id); -- Для быстрого поиска ответов на сообщения
-CREATE INDEX idx_messages_original ON messages(original_chat_id, original_sender_id); -- Для поиска пересланных сообщений
\ No newline at end of file
+CREATE INDEX idx_messages_original ON messages(original_chat_id, original_sender_id); -- Для поиска пересланных сообщений
+CREATE INDEX idx_saved_messages_user ON saved_messages(user_id, created_at); -- Для списка избранного пользователя
+CREATE INDEX idx_scheduled_messages_due ON scheduled_messages(send_at) WHERE status = 'pending'; -- Для выборки планировщиком
+CREATE INDEX idx_messages_expires ON messages(expires_at) WHERE expires_at IS NOT NULL; -- Для удаления истёкших сообщений
+CREATE INDEX idx_message_mentions_message ON message_mentions(message_id); -- Для загрузки упоминаний сообщений
+CREATE INDEX idx_polls_close_at ON polls(close_at) WHERE NOT is_closed; -- Для автоматического закрытия опросов
+CREATE INDEX idx_poll_options_poll ON poll_options(poll_id, position); -- Для загрузки вариантов опроса
+CREATE INDEX idx_message_reactions_message ON message_reactions(message_id, created_at); -- Для сводки реакций сообщений
+CREATE INDEX idx_message_files_message ON message_files(message_id); -- Для списка вложений сообщений
+CREATE INDEX idx_uploads_user ON uploads(user_id, created_at); -- Для квот загрузок пользователя
+CREATE INDEX idx_uploads_expires ON uploads(expires_at) WHERE status != 'attached'; -- Для удаления брошенных загрузок
+CREATE INDEX idx_message_locations_live ON message_locations(live_until) WHERE live_until IS NOT NULL AND stopped_at IS NULL; -- Для завершения трансляций местоположения
+CREATE UNIQUE INDEX idx_sticker_packs_short_name ON sticker_packs(LOWER(short_name)); -- Уникальность короткого имени набора
+CREATE INDEX idx_stickers_pack ON stickers(pack_id, position); -- Стикеры набора по порядку
+CREATE INDEX idx_stickers_emoji ON stickers(emoji); -- Поиск наборов по эмодзи
+CREATE INDEX idx_user_sticker_packs_pack ON user_sticker_packs(pack_id); -- Установки набора
+CREATE INDEX idx_webhooks_chat ON webhooks(chat_id); -- Подписки чата
+CREATE INDEX idx_webhook_deliveries_due ON webhook_deliveries(next_attempt_at) WHERE status = 'pending'; -- Для выборки обработчиком доставок
+CREATE INDEX idx_webhook_deliveries_webhook ON webhook_deliveries(webhook_id, id); -- Журнал доставок подписки
+CREATE INDEX idx_webhook_attempts_delivery ON webhook_attempts(delivery_id); -- Попытки доставки
+CREATE INDEX idx_incoming_webhooks_chat ON incoming_webhooks(chat_id); -- Входящие вебхуки группы
+CREATE INDEX idx_bots_owner ON bots(owner_id); -- Боты владельца
+CREATE INDEX idx_bot_updates_bot ON bot_updates(bot_user_id, id); -- Очередь обновлений бота
+CREATE INDEX idx_push_devices_user ON push_devices(user_id); -- Устройства пользователя
+CREATE INDEX idx_push_notifications_due ON push_notifications(next_attempt_at); -- Уведомления к отправке
+CREATE UNIQUE INDEX idx_chats_direct_key ON chats(direct_key); -- Не более одного личного чата на пару пользователей
\ No newline at end of file
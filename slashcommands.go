@@ -0,0 +1,575 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+// Команды вида "/command args" перехватываются до сохранения сообщения: встроенные выполняются
+// сервером, остальные передаются ботам чата, зарегистрировавшим команду (setCommands).
+// Незнакомая команда отправляется как обычное сообщение
+const (
+	defaultMuteDuration = time.Hour
+	maxMuteDuration     = 366 * 24 * time.Hour
+	maxTopicLength      = 1024
+	maxEphemeralText    = 4096
+)
+
+// "/command", "/command@botname", "/command аргументы"
+var slashCommandPattern = regexp.MustCompile(`^/([A-Za-z0-9_]{1,32})(?:@([A-Za-z0-9_]{3,32}))?(?:\s+([\s\S]*))?$`)
+
+// Разобранная команда из текста сообщения
+type slashCommand struct {
+	Name        string // Без косой черты, в нижнем регистре
+	BotUsername string // Адресат из /command@botname
+	Args        string
+}
+
+// Вызов команды пользователем в чате
+type commandInvocation struct {
+	Conn    *websocket.Conn
+	ChatID  int
+	UserID  int
+	Command slashCommand
+}
+
+// Встроенная команда сервера
+type builtinCommand struct {
+	Name        string
+	Description string
+	GroupOnly   bool // Только в группах
+	AdminOnly   bool // Только администраторам и создателю группы
+	Run         func(db *sql.DB, inv commandInvocation)
+}
+
+// Команда в списке подсказок чата
+type chatCommandInfo struct {
+	Command     string `json:"command"`
+	Description string `json:"description"`
+	BotID       int    `json:"bot_id,omitempty"`
+	BotUsername string `json:"bot_username,omitempty"`
+}
+
+var builtinCommands = []builtinCommand{
+	{Name: "mute", Description: "Запретить участнику писать: /mute @username [30m|2h|1d]", GroupOnly: true, AdminOnly: true, Run: runMuteCommand},
+	{Name: "unmute", Description: "Снова разрешить участнику писать: /unmute @username", GroupOnly: true, AdminOnly: true, Run: runUnmuteCommand},
+	{Name: "kick", Description: "Исключить участника из группы: /kick @username", GroupOnly: true, AdminOnly: true, Run: runKickCommand},
+	{Name: "topic", Description: "Показать или изменить описание группы: /topic [текст]", GroupOnly: true, Run: runTopicCommand},
+	{Name: "poll", Description: "Создать опрос: /poll Вопрос | Вариант 1 | Вариант 2", Run: runPollCommand},
+}
+
+func findBuiltinCommand(name string) *builtinCommand {
+	for i := range builtinCommands {
+		if builtinCommands[i].Name == name {
+			return &builtinCommands[i]
+		}
+	}
+	return nil
+}
+
+// Разбор команды из текста сообщения
+func parseSlashCommand(text string) (slashCommand, bool) {
+	match := slashCommandPattern.FindStringSubmatch(strings.TrimSpace(text))
+	if match == nil {
+		return slashCommand{}, false
+	}
+	return slashCommand{
+		Name:        strings.ToLower(match[1]),
+		BotUsername: match[2],
+		Args:        strings.TrimSpace(match[3]),
+	}, true
+}
+
+// Сообщение, которое видит только один пользователь; не сохраняется в истории
+func sendEphemeralMessage(userID, chatID, botID int, text string) {
+	payload := map[string]interface{}{
+		"type":       "ephemeral_message",
+		"chat_id":    chatID,
+		"text":       text,
+		"created_at": time.Now().Format(time.RFC3339),
+	}
+	if botID != 0 {
+		payload["bot_id"] = botID
+	}
+	broadcastToUsers([]int{userID}, payload)
+}
+
+func (inv commandInvocation) reply(text string) {
+	sendEphemeralMessage(inv.UserID, inv.ChatID, 0, text)
+}
+
+// Перехват команды из сообщения WebSocket. false — сообщение не является командой
+// (или команду никто не обрабатывает) и отправляется как обычное
+func handleSlashCommand(conn *websocket.Conn, msg chatMessage) bool {
+	if len(msg.AttachmentIDs) > 0 {
+		return false
+	}
+	cmd, ok := parseSlashCommand(msg.Text)
+	if !ok {
+		return false
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("DB error: %v", err)
+		return false
+	}
+	defer db.Close()
+
+	var isParticipant, isGroup bool
+	err = db.QueryRow(`
+        SELECT EXISTS (SELECT 1 FROM participants WHERE chat_id = $1 AND user_id = $2),
+               EXISTS (SELECT 1 FROM group_chats WHERE chat_id = $1)`, msg.ChatID, msg.UserID,
+	).Scan(&isParticipant, &isGroup)
+	if err != nil {
+		log.Printf("Ошибка проверки чата %d для команды: %v", msg.ChatID, err)
+		return true
+	}
+	if !isParticipant {
+		log.Printf("Unauthorized command attempt: user %d, chat %d", msg.UserID, msg.ChatID)
+		return true
+	}
+	inv := commandInvocation{Conn: conn, ChatID: msg.ChatID, UserID: msg.UserID, Command: cmd}
+
+	if builtin := findBuiltinCommand(cmd.Name); builtin != nil && cmd.BotUsername == "" {
+		if builtin.GroupOnly && !isGroup {
+			inv.reply(fmt.Sprintf("Команда /%s доступна только в группах", cmd.Name))
+			return true
+		}
+		if builtin.AdminOnly {
+			allowed, err := canManageGroup(db, msg.ChatID, msg.UserID)
+			if err != nil {
+				log.Printf("Ошибка проверки прав на группу %d: %v", msg.ChatID, err)
+				return true
+			}
+			if !allowed {
+				inv.reply(fmt.Sprintf("Команда /%s доступна только администраторам группы", cmd.Name))
+				return true
+			}
+		}
+		builtin.Run(db, inv)
+		return true
+	}
+	return routeBotCommand(db, inv)
+}
+
+// Передача команды ботам чата, зарегистрировавшим её (или одному боту из /command@botname)
+func routeBotCommand(db *sql.DB, inv commandInvocation) bool {
+	rows, err := db.Query(`
+        SELECT b.user_id
+        FROM bot_commands bc
+        JOIN bots b ON b.user_id = bc.bot_user_id
+        JOIN participants p ON p.chat_id = $1 AND p.user_id = b.user_id
+        JOIN users u ON u.id = b.user_id
+        WHERE bc.command = $2 AND ($3 = '' OR LOWER(u.username) = LOWER($3))`,
+		inv.ChatID, inv.Command.Name, inv.Command.BotUsername)
+	if err != nil {
+		log.Printf("Ошибка поиска ботов для команды /%s: %v", inv.Command.Name, err)
+		return false
+	}
+	var botIDs []int
+	for rows.Next() {
+		var id int
+		if rows.Scan(&id) == nil {
+			botIDs = append(botIDs, id)
+		}
+	}
+	rows.Close()
+	if len(botIDs) == 0 {
+		return false
+	}
+
+	var (
+		username string
+		name     sql.NullString
+	)
+	if err := db.QueryRow("SELECT username, name FROM users WHERE id = $1", inv.UserID).Scan(&username, &name); err != nil {
+		log.Printf("Ошибка загрузки пользователя %d: %v", inv.UserID, err)
+		return true
+	}
+	queueBotUpdates(db, botIDs, inv.UserID, botUpdateCommand, map[string]interface{}{
+		"chat_id": inv.ChatID,
+		"from":    map[string]interface{}{"id": inv.UserID, "username": username, "name": name.String},
+		"command": inv.Command.Name,
+		"args":    inv.Command.Args,
+	})
+	inv.Conn.WriteJSON(map[string]interface{}{
+		"type":    "command_sent",
+		"chat_id": inv.ChatID,
+		"command": inv.Command.Name,
+	})
+	return true
+}
+
+// Участник чата по аргументу "@username"
+func resolveCommandTarget(db *sql.DB, chatID int, arg string) (int, string, bool) {
+	username := strings.TrimPrefix(arg, "@")
+	if username == "" {
+		return 0, "", false
+	}
+	var userID int
+	err := db.QueryRow(`
+        SELECT u.id, u.username FROM users u
+        JOIN participants p ON p.user_id = u.id AND p.chat_id = $1
+        WHERE LOWER(u.username) = LOWER($2)`, chatID, username,
+	).Scan(&userID, &username)
+	if err != nil {
+		return 0, "", false
+	}
+	return userID, username, true
+}
+
+// Длительность вида 30m, 2h, 1d (число без суффикса — минуты)
+func parseMuteDuration(value string) (time.Duration, bool) {
+	if value == "" {
+		return defaultMuteDuration, true
+	}
+	unit := time.Minute
+	switch value[len(value)-1] {
+	case 'm':
+		value = value[:len(value)-1]
+	case 'h':
+		unit, value = time.Hour, value[:len(value)-1]
+	case 'd':
+		unit, value = 24*time.Hour, value[:len(value)-1]
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 || time.Duration(n) > maxMuteDuration/unit {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+func formatMuteDuration(d time.Duration) string {
+	switch {
+	case d%(24*time.Hour) == 0:
+		return fmt.Sprintf("%d дн.", d/(24*time.Hour))
+	case d%time.Hour == 0:
+		return fmt.Sprintf("%d ч", d/time.Hour)
+	default:
+		return fmt.Sprintf("%d мин", d/time.Minute)
+	}
+}
+
+func commandActorName(db *sql.DB, userID int) string {
+	var name string
+	if err := db.QueryRow("SELECT username FROM users WHERE id = $1", userID).Scan(&name); err != nil {
+		return "Unknown"
+	}
+	return name
+}
+
+// Системное сообщение о действии команды и событие для участников группы
+func announceGroupChange(db *sql.DB, chatID int, notice string, event map[string]interface{}) {
+	messageID, createdAt, err := insertSystemMessage(db, chatID, notice)
+	if err != nil {
+		log.Printf("Ошибка создания системного сообщения в чате %d: %v", chatID, err)
+		return
+	}
+	participantIDs, err := getChatParticipantIDs(db, chatID)
+	if err != nil {
+		log.Printf("Ошибка получения участников чата %d: %v", chatID, err)
+		return
+	}
+	broadcastToUsers(participantIDs, systemMessagePayload(chatID, messageID, notice, createdAt))
+	if event != nil {
+		broadcastToUsers(participantIDs, event)
+	}
+}
+
+// /mute @username [длительность]
+func runMuteCommand(db *sql.DB, inv commandInvocation) {
+	args := strings.Fields(inv.Command.Args)
+	if len(args) == 0 || len(args) > 2 {
+		inv.reply("Использование: /mute @username [30m|2h|1d]")
+		return
+	}
+	targetID, targetName, ok := resolveCommandTarget(db, inv.ChatID, args[0])
+	if !ok {
+		inv.reply("Участник не найден")
+		return
+	}
+	durationArg := ""
+	if len(args) == 2 {
+		durationArg = args[1]
+	}
+	duration, ok := parseMuteDuration(durationArg)
+	if !ok {
+		inv.reply("Некорректная длительность: укажите, например, 30m, 2h или 1d")
+		return
+	}
+	// Администраторов ограничить нельзя
+	if isAdmin, err := canManageGroup(db, inv.ChatID, targetID); err != nil || isAdmin {
+		inv.reply("Нельзя ограничить администратора группы")
+		return
+	}
+
+	var mutedUntil time.Time
+	err := db.QueryRow(`
+        UPDATE participants SET muted_until = CURRENT_TIMESTAMP + $3 * INTERVAL '1 second'
+        WHERE chat_id = $1 AND user_id = $2
+        RETURNING muted_until`, inv.ChatID, targetID, int64(duration/time.Second),
+	).Scan(&mutedUntil)
+	if err != nil {
+		log.Printf("Ошибка ограничения участника %d в чате %d: %v", targetID, inv.ChatID, err)
+		return
+	}
+	notice := fmt.Sprintf("%s запретил(а) %s писать в группу на %s", commandActorName(db, inv.UserID), targetName, formatMuteDuration(duration))
+	announceGroupChange(db, inv.ChatID, notice, map[string]interface{}{
+		"type":        "member_muted",
+		"chat_id":     inv.ChatID,
+		"user_id":     targetID,
+		"muted_until": mutedUntil.Format(time.RFC3339),
+		"muted_by":    inv.UserID,
+	})
+}
+
+// /unmute @username
+func runUnmuteCommand(db *sql.DB, inv commandInvocation) {
+	args := strings.Fields(inv.Command.Args)
+	if len(args) != 1 {
+		inv.reply("Использование: /unmute @username")
+		return
+	}
+	targetID, targetName, ok := resolveCommandTarget(db, inv.ChatID, args[0])
+	if !ok {
+		inv.reply("Участник не найден")
+		return
+	}
+	result, err := db.Exec(`
+        UPDATE participants SET muted_until = NULL
+        WHERE chat_id = $1 AND user_id = $2 AND muted_until > CURRENT_TIMESTAMP`, inv.ChatID, targetID)
+	if err != nil {
+		log.Printf("Ошибка снятия ограничения с участника %d в чате %d: %v", targetID, inv.ChatID, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		inv.reply(fmt.Sprintf("%s может писать в группу", targetName))
+		return
+	}
+	notice := fmt.Sprintf("%s снова разрешил(а) %s писать в группу", commandActorName(db, inv.UserID), targetName)
+	announceGroupChange(db, inv.ChatID, notice, map[string]interface{}{
+		"type":       "member_unmuted",
+		"chat_id":    inv.ChatID,
+		"user_id":    targetID,
+		"unmuted_by": inv.UserID,
+	})
+}
+
+// /kick @username
+func runKickCommand(db *sql.DB, inv commandInvocation) {
+	args := strings.Fields(inv.Command.Args)
+	if len(args) != 1 {
+		inv.reply("Использование: /kick @username")
+		return
+	}
+	targetID, targetName, ok := resolveCommandTarget(db, inv.ChatID, args[0])
+	if !ok {
+		inv.reply("Участник не найден")
+		return
+	}
+	if targetID == inv.UserID {
+		inv.reply("Нельзя исключить самого себя")
+		return
+	}
+
+	// Создателя исключить нельзя, администратора — только создатель
+	var (
+		createdBy     sql.NullInt64
+		targetIsAdmin bool
+	)
+	err := db.QueryRow(`
+        SELECT gc.created_by, p.is_admin
+        FROM group_chats gc
+        JOIN participants p ON p.chat_id = gc.chat_id AND p.user_id = $2
+        WHERE gc.chat_id = $1`, inv.ChatID, targetID,
+	).Scan(&createdBy, &targetIsAdmin)
+	if err != nil {
+		log.Printf("Ошибка загрузки группы %d для /kick: %v", inv.ChatID, err)
+		return
+	}
+	actorIsCreator := createdBy.Valid && int(createdBy.Int64) == inv.UserID
+	if (createdBy.Valid && int(createdBy.Int64) == targetID) || (targetIsAdmin && !actorIsCreator) {
+		inv.reply("Недостаточно прав, чтобы исключить этого участника")
+		return
+	}
+
+	// Исключённый получает событие вместе с оставшимися участниками
+	participantIDs, err := getChatParticipantIDs(db, inv.ChatID)
+	if err != nil {
+		log.Printf("Ошибка получения участников чата %d: %v", inv.ChatID, err)
+		return
+	}
+	notice := fmt.Sprintf("%s исключил(а) %s из группы", commandActorName(db, inv.UserID), targetName)
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Transaction error: %v", err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("DELETE FROM participants WHERE chat_id = $1 AND user_id = $2", inv.ChatID, targetID); err != nil {
+		log.Printf("Ошибка исключения участника %d из чата %d: %v", targetID, inv.ChatID, err)
+		return
+	}
+	messageID, createdAt, err := insertSystemMessage(tx, inv.ChatID, notice)
+	if err != nil {
+		log.Printf("Ошибка создания системного сообщения в чате %d: %v", inv.ChatID, err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		return
+	}
+
+	broadcastToUsers(participantIDs, systemMessagePayload(inv.ChatID, messageID, notice, createdAt))
+	broadcastToUsers(participantIDs, map[string]interface{}{
+		"type":       "chat_member_removed",
+		"chat_id":    inv.ChatID,
+		"user_id":    targetID,
+		"removed_by": inv.UserID,
+	})
+}
+
+// /topic — текущее описание группы, /topic текст — новое описание (только администраторам)
+func runTopicCommand(db *sql.DB, inv commandInvocation) {
+	topic := strings.TrimSpace(sanitizeMessageText(inv.Command.Args))
+	if topic == "" {
+		var description sql.NullString
+		if err := db.QueryRow("SELECT description FROM group_chats WHERE chat_id = $1", inv.ChatID).Scan(&description); err != nil {
+			log.Printf("Ошибка загрузки описания группы %d: %v", inv.ChatID, err)
+			return
+		}
+		if description.String == "" {
+			inv.reply("У группы нет описания")
+		} else {
+			inv.reply(description.String)
+		}
+		return
+	}
+	if allowed, err := canManageGroup(db, inv.ChatID, inv.UserID); err != nil || !allowed {
+		inv.reply("Изменять описание группы могут только администраторы")
+		return
+	}
+	if utf8.RuneCountInString(topic) > maxTopicLength {
+		inv.reply("Описание слишком длинное")
+		return
+	}
+
+	var (
+		name         string
+		imageVersion int
+		hasImage     bool
+	)
+	err := db.QueryRow(`
+        UPDATE group_chats SET description = $2, updated_at = CURRENT_TIMESTAMP
+        WHERE chat_id = $1
+        RETURNING name, image_version, image IS NOT NULL OR image_key IS NOT NULL`, inv.ChatID, topic,
+	).Scan(&name, &imageVersion, &hasImage)
+	if err != nil {
+		log.Printf("Ошибка обновления описания группы %d: %v", inv.ChatID, err)
+		return
+	}
+	event := map[string]interface{}{"type": "group_updated"}
+	for key, value := range groupInfoPayload(inv.ChatID, name, topic, imageVersion, hasImage, inv.UserID) {
+		event[key] = value
+	}
+	announceGroupChange(db, inv.ChatID, fmt.Sprintf("%s изменил(а) описание группы", commandActorName(db, inv.UserID)), event)
+}
+
+// /poll Вопрос | Вариант 1 | Вариант 2 ...
+func runPollCommand(db *sql.DB, inv commandInvocation) {
+	parts := strings.Split(inv.Command.Args, "|")
+	if len(parts) < 1+minPollOptions {
+		inv.reply("Использование: /poll Вопрос | Вариант 1 | Вариант 2")
+		return
+	}
+	handleCreatePollCommand(inv.Conn, pollCommand{
+		ChatID:   inv.ChatID,
+		UserID:   inv.UserID,
+		Question: parts[0],
+		Options:  parts[1:],
+	})
+}
+
+// Команды, доступные пользователю в чате, для подсказок клиента (GET ?chat_id&user_id)
+func chatCommandsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	chatID, errChat := strconv.Atoi(r.URL.Query().Get("chat_id"))
+	userID, errUser := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if errChat != nil || errUser != nil {
+		http.Error(w, "Chat ID and user ID are required", http.StatusBadRequest)
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var isParticipant, isGroup bool
+	err = db.QueryRow(`
+        SELECT EXISTS (SELECT 1 FROM participants WHERE chat_id = $1 AND user_id = $2),
+               EXISTS (SELECT 1 FROM group_chats WHERE chat_id = $1)`, chatID, userID,
+	).Scan(&isParticipant, &isGroup)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if !isParticipant {
+		http.Error(w, "Not a chat participant", http.StatusForbidden)
+		return
+	}
+	isAdmin := false
+	if isGroup {
+		if isAdmin, err = canManageGroup(db, chatID, userID); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+
+	commands := []chatCommandInfo{}
+	for _, builtin := range builtinCommands {
+		if (builtin.GroupOnly && !isGroup) || (builtin.AdminOnly && !isAdmin) {
+			continue
+		}
+		commands = append(commands, chatCommandInfo{Command: builtin.Name, Description: builtin.Description})
+	}
+
+	rows, err := db.Query(`
+        SELECT bc.command, bc.description, b.user_id, u.username
+        FROM bot_commands bc
+        JOIN bots b ON b.user_id = bc.bot_user_id
+        JOIN participants p ON p.chat_id = $1 AND p.user_id = b.user_id
+        JOIN users u ON u.id = b.user_id
+        ORDER BY u.username, bc.position`, chatID)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c chatCommandInfo
+		if err := rows.Scan(&c.Command, &c.Description, &c.BotID, &c.BotUsername); err == nil {
+			commands = append(commands, c)
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(commands)
+}
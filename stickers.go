@@ -0,0 +1,903 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
+)
+
+const (
+	stickerKindSticker = "sticker" // Набор стикеров, отправляемых отдельным сообщением
+	stickerKindEmoji   = "emoji"   // Набор пользовательских эмодзи для реакций
+
+	maxStickerFileSize = 512 << 10 // Файл стикера
+	maxStickerSide     = 512       // Сторона стикера в пикселях
+	maxEmojiFileSize   = 64 << 10  // Файл пользовательского эмодзи
+	maxEmojiSide       = 100       // Сторона эмодзи в пикселях
+
+	maxStickersPerPack  = 120 // Стикеров в наборе
+	maxEmojiPerPack     = 200 // Эмодзи в наборе
+	maxPacksPerUser     = 50  // Наборов, созданных одним пользователем
+	maxPackTitleLength  = 64
+	maxStickerEmojiLen  = 16 // Эмодзи, с которым связан стикер (для поиска и текста сообщения)
+	stickerSearchLimit  = 50
+	customEmojiReaction = "emoji:" // Префикс реакции пользовательским эмодзи: emoji:<id>
+)
+
+var (
+	errInvalidStickerFile = errors.New("invalid sticker file")
+	errStickerNotFound    = errors.New("sticker not found")
+
+	// Короткое имя набора используется в ссылках на него
+	packShortNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_]{2,63}$`)
+)
+
+// Стикер или пользовательское эмодзи
+type sticker struct {
+	ID       int    `json:"id"`
+	PackID   int    `json:"pack_id"`
+	Emoji    string `json:"emoji,omitempty"`
+	Width    int    `json:"width"`
+	Height   int    `json:"height"`
+	MimeType string `json:"mime_type"`
+	URL      string `json:"url"`
+}
+
+// Набор стикеров или эмодзи
+type stickerPack struct {
+	ID           int       `json:"id"`
+	ShortName    string    `json:"short_name"`
+	Title        string    `json:"title"`
+	Kind         string    `json:"kind"`
+	IsOfficial   bool      `json:"is_official"`
+	OwnerID      *int      `json:"owner_id,omitempty"`
+	StickerCount int       `json:"sticker_count"`
+	Installed    bool      `json:"installed"`
+	Stickers     []sticker `json:"stickers,omitempty"`
+}
+
+// Команда WebSocket send_sticker
+type stickerCommand struct {
+	ChatID          int  `json:"chat_id"`
+	UserID          int  `json:"user_id"`
+	StickerID       int  `json:"sticker_id"`
+	ParentMessageID *int `json:"parent_message_id"`
+}
+
+// Администраторы сервера задаются списком ID в ADMIN_USER_IDS; их наборы считаются официальными
+func isServerAdmin(userID int) bool {
+	for _, id := range strings.Split(os.Getenv("ADMIN_USER_IDS"), ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(id)); err == nil && n == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// Адрес файла стикера: токен версии — часть хеша содержимого, поэтому файл кешируется бессрочно
+func stickerURL(id int, blobKey string) string {
+	return fmt.Sprintf("/sticker?id=%d&v=%s", id, imageVersionToken(sql.NullString{String: blobKey, Valid: true}, sql.NullString{}))
+}
+
+// Размеры изображения WebP (форматы VP8, VP8L и расширенный VP8X). Размер RIFF и всех чанков
+// должен точно соответствовать файлу, а поток изображения — присутствовать целиком:
+// обрезанный файл клиент не сможет показать
+func webpDimensions(data []byte) (int, int, bool) {
+	if len(data) < 20 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return 0, 0, false
+	}
+	if uint64(binary.LittleEndian.Uint32(data[4:8]))+8 != uint64(len(data)) {
+		return 0, 0, false
+	}
+
+	type chunk struct {
+		fourCC  string
+		payload []byte
+	}
+	var chunks []chunk
+	pos := 12
+	for pos < len(data) {
+		if pos+8 > len(data) {
+			return 0, 0, false
+		}
+		size := uint64(binary.LittleEndian.Uint32(data[pos+4:]))
+		if size > uint64(len(data)-pos-8) {
+			return 0, 0, false
+		}
+		end := pos + 8 + int(size)
+		chunks = append(chunks, chunk{string(data[pos : pos+4]), data[pos+8 : end]})
+		pos = end + end&1 // Чанки нечётной длины дополняются байтом
+	}
+	if pos != len(data) && pos != len(data)+1 || len(chunks) == 0 {
+		return 0, 0, false
+	}
+
+	first := chunks[0]
+	if first.fourCC != "VP8X" {
+		return webpBitstreamDimensions(first.fourCC, first.payload)
+	}
+	// Флаги, 3 зарезервированных байта, затем ширина-1 и высота-1 по 24 бита
+	if len(first.payload) < 10 {
+		return 0, 0, false
+	}
+	width := (int(first.payload[4]) | int(first.payload[5])<<8 | int(first.payload[6])<<16) + 1
+	height := (int(first.payload[7]) | int(first.payload[8])<<8 | int(first.payload[9])<<16) + 1
+	// Холст должен содержать изображение того же размера или кадры анимации
+	hasImage := false
+	for _, c := range chunks[1:] {
+		switch c.fourCC {
+		case "VP8 ", "VP8L":
+			w, h, ok := webpBitstreamDimensions(c.fourCC, c.payload)
+			if !ok || w != width || h != height {
+				return 0, 0, false
+			}
+			hasImage = true
+		case "ANMF":
+			// Смещение и размеры кадра, длительность и флаги, затем данные кадра
+			if len(c.payload) <= 16 {
+				return 0, 0, false
+			}
+			hasImage = true
+		}
+	}
+	return width, height, hasImage
+}
+
+// Размеры из заголовка потока VP8 или VP8L
+func webpBitstreamDimensions(fourCC string, payload []byte) (int, int, bool) {
+	switch fourCC {
+	case "VP8 ":
+		// Кадр-ключ: 3 байта тега кадра (бит 0 — не ключевой, с 5-го — размер первого раздела),
+		// стартовый код 9d 01 2a, затем 14-битные ширина и высота
+		if len(payload) < 10 || payload[3] != 0x9d || payload[4] != 0x01 || payload[5] != 0x2a {
+			return 0, 0, false
+		}
+		tag := uint32(payload[0]) | uint32(payload[1])<<8 | uint32(payload[2])<<16
+		if tag&1 != 0 || uint64(tag>>5) > uint64(len(payload)-10) {
+			return 0, 0, false
+		}
+		width := int(binary.LittleEndian.Uint16(payload[6:8]) & 0x3fff)
+		height := int(binary.LittleEndian.Uint16(payload[8:10]) & 0x3fff)
+		return width, height, width > 0 && height > 0
+	case "VP8L":
+		// Сигнатура 0x2f, затем ширина-1 и высота-1 по 14 бит, флаг альфы и версия 0
+		if len(payload) <= 5 || payload[0] != 0x2f {
+			return 0, 0, false
+		}
+		bits := binary.LittleEndian.Uint32(payload[1:5])
+		if bits>>29 != 0 {
+			return 0, 0, false
+		}
+		return int(bits&0x3fff) + 1, int((bits>>14)&0x3fff) + 1, true
+	}
+	return 0, 0, false
+}
+
+// Проверка файла стикера или эмодзи: только WebP или PNG, ограничение размера файла и сторон.
+// Возвращает MIME-тип и размеры изображения
+func validateStickerImage(data []byte, kind string) (string, int, int, error) {
+	maxSize, maxSide := maxStickerFileSize, maxStickerSide
+	if kind == stickerKindEmoji {
+		maxSize, maxSide = maxEmojiFileSize, maxEmojiSide
+	}
+	if len(data) > maxSize {
+		return "", 0, 0, errBlobTooLarge
+	}
+
+	var (
+		mimeType      string
+		width, height int
+	)
+	if w, h, ok := webpDimensions(data); ok {
+		mimeType, width, height = "image/webp", w, h
+	} else if config, err := png.DecodeConfig(bytes.NewReader(data)); err == nil {
+		mimeType, width, height = "image/png", config.Width, config.Height
+	} else {
+		return "", 0, 0, errInvalidStickerFile
+	}
+	if width <= 0 || height <= 0 || width > maxSide || height > maxSide {
+		return "", 0, 0, errInvalidStickerFile
+	}
+	// PNG небольшого размера декодируется целиком, чтобы не принять обрезанный файл
+	if mimeType == "image/png" {
+		if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+			return "", 0, 0, errInvalidStickerFile
+		}
+	}
+	return mimeType, width, height, nil
+}
+
+// Проверка эмодзи стикера: непустая короткая строка без пробелов
+func normalizeStickerEmoji(emoji string) (string, bool) {
+	emoji = strings.TrimSpace(emoji)
+	if emoji == "" || !utf8.ValidString(emoji) || utf8.RuneCountInString(emoji) > maxStickerEmojiLen || strings.ContainsAny(emoji, " \t\r\n") {
+		return "", false
+	}
+	return emoji, true
+}
+
+// ID пользовательского эмодзи из реакции вида emoji:<id>
+func customEmojiID(reaction string) (int, bool) {
+	if !strings.HasPrefix(reaction, customEmojiReaction) {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(reaction, customEmojiReaction))
+	return id, err == nil && id > 0
+}
+
+// Реакция пользовательским эмодзи допустима, только если эмодзи существует в наборе типа emoji
+func validateCustomEmojiReaction(db queryRower, reaction string) error {
+	if !strings.HasPrefix(reaction, customEmojiReaction) {
+		return nil
+	}
+	id, ok := customEmojiID(reaction)
+	if !ok {
+		return errInvalidReaction
+	}
+	var exists bool
+	err := db.QueryRow(`
+        SELECT EXISTS (
+            SELECT 1 FROM stickers s JOIN sticker_packs p ON p.id = s.pack_id
+            WHERE s.id = $1 AND p.kind = 'emoji'
+        )`, id).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return errInvalidReaction
+	}
+	return nil
+}
+
+const stickerColumns = `s.id, s.pack_id, COALESCE(s.emoji, ''), s.width, s.height, b.mime_type, s.blob_key`
+
+// Чтение строки стикера, выбранной со столбцами stickerColumns
+func scanSticker(scan func(...interface{}) error) (sticker, error) {
+	var (
+		s        sticker
+		mimeType sql.NullString
+		blobKey  string
+	)
+	if err := scan(&s.ID, &s.PackID, &s.Emoji, &s.Width, &s.Height, &mimeType, &blobKey); err != nil {
+		return sticker{}, err
+	}
+	s.MimeType = mimeType.String
+	s.URL = stickerURL(s.ID, blobKey)
+	return s, nil
+}
+
+// Загрузка стикеров по ID
+func loadStickers(db *sql.DB, ids []int) (map[int]sticker, error) {
+	result := make(map[int]sticker)
+	if len(ids) == 0 {
+		return result, nil
+	}
+	rows, err := db.Query(`
+        SELECT `+stickerColumns+`
+        FROM stickers s JOIN blobs b ON b.key = s.blob_key
+        WHERE s.id = ANY($1)`, pq.Array(intsToInt64(ids)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		s, err := scanSticker(rows.Scan)
+		if err != nil {
+			log.Printf("Ошибка чтения стикера: %v", err)
+			continue
+		}
+		result[s.ID] = s
+	}
+	return result, rows.Err()
+}
+
+// Стикеры сообщений типа sticker
+func loadMessageStickers(db *sql.DB, messageIDs []int) (map[int]sticker, error) {
+	result := make(map[int]sticker)
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+	rows, err := db.Query(`
+        SELECT m.id, `+stickerColumns+`
+        FROM messages m
+        JOIN stickers s ON s.id = m.sticker_id
+        JOIN blobs b ON b.key = s.blob_key
+        WHERE m.id = ANY($1) AND NOT m.is_deleted`, pq.Array(intsToInt64(messageIDs)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var messageID int
+		s, err := scanSticker(func(dest ...interface{}) error {
+			return rows.Scan(append([]interface{}{&messageID}, dest...)...)
+		})
+		if err != nil {
+			log.Printf("Ошибка чтения стикера сообщения: %v", err)
+			continue
+		}
+		result[messageID] = s
+	}
+	return result, rows.Err()
+}
+
+// Пользовательские эмодзи, использованные в сводках реакций
+func attachCustomEmoji(db *sql.DB, summaries map[int][]reactionSummary) {
+	var ids []int
+	for _, list := range summaries {
+		for _, summary := range list {
+			if id, ok := customEmojiID(summary.Reaction); ok {
+				ids = append(ids, id)
+			}
+		}
+	}
+	if len(ids) == 0 {
+		return
+	}
+	emoji, err := loadStickers(db, uniqueInts(ids))
+	if err != nil {
+		log.Printf("Ошибка загрузки пользовательских эмодзи: %v", err)
+		return
+	}
+	for _, list := range summaries {
+		for i := range list {
+			if id, ok := customEmojiID(list[i].Reaction); ok {
+				if e, found := emoji[id]; found {
+					list[i].CustomEmoji = &e
+				}
+			}
+		}
+	}
+}
+
+// Набор со списком стикеров
+func loadStickerPack(db *sql.DB, packID, userID int) (*stickerPack, error) {
+	var (
+		pack    stickerPack
+		ownerID sql.NullInt64
+	)
+	err := db.QueryRow(`
+        SELECT p.id, p.short_name, p.title, p.kind, p.is_official, p.owner_id,
+               (SELECT COUNT(*) FROM stickers s WHERE s.pack_id = p.id),
+               EXISTS (SELECT 1 FROM user_sticker_packs u WHERE u.pack_id = p.id AND u.user_id = $2)
+        FROM sticker_packs p WHERE p.id = $1`, packID, userID,
+	).Scan(&pack.ID, &pack.ShortName, &pack.Title, &pack.Kind, &pack.IsOfficial, &ownerID, &pack.StickerCount, &pack.Installed)
+	if err != nil {
+		return nil, err
+	}
+	if ownerID.Valid {
+		id := int(ownerID.Int64)
+		pack.OwnerID = &id
+	}
+
+	rows, err := db.Query(`
+        SELECT `+stickerColumns+`
+        FROM stickers s JOIN blobs b ON b.key = s.blob_key
+        WHERE s.pack_id = $1
+        ORDER BY s.position, s.id`, packID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	pack.Stickers = []sticker{}
+	for rows.Next() {
+		s, err := scanSticker(rows.Scan)
+		if err != nil {
+			log.Printf("Ошибка чтения стикера: %v", err)
+			continue
+		}
+		pack.Stickers = append(pack.Stickers, s)
+	}
+	return &pack, rows.Err()
+}
+
+// Изменять набор может его владелец или администратор сервера
+func canEditStickerPack(db queryRower, packID, userID int) (string, bool, error) {
+	var (
+		kind    string
+		ownerID sql.NullInt64
+	)
+	err := db.QueryRow("SELECT kind, owner_id FROM sticker_packs WHERE id = $1", packID).Scan(&kind, &ownerID)
+	if err != nil {
+		return "", false, err
+	}
+	return kind, isServerAdmin(userID) || (ownerID.Valid && int(ownerID.Int64) == userID), nil
+}
+
+// Список и поиск наборов (GET) и создание набора (POST)
+func stickerPacksHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	switch r.Method {
+	case "GET":
+		// user_id — для отметки установленных наборов; q ищет по названию, короткому имени и эмодзи стикеров
+		userID, _ := strconv.Atoi(r.URL.Query().Get("user_id"))
+		query := strings.TrimSpace(r.URL.Query().Get("q"))
+		kind := r.URL.Query().Get("kind")
+		if kind != "" && kind != stickerKindSticker && kind != stickerKindEmoji {
+			http.Error(w, "Invalid kind", http.StatusBadRequest)
+			return
+		}
+		installedOnly := r.URL.Query().Get("installed") == "1"
+		if installedOnly && userID == 0 {
+			http.Error(w, "User ID is required", http.StatusBadRequest)
+			return
+		}
+
+		rows, err := db.Query(`
+            SELECT p.id, p.short_name, p.title, p.kind, p.is_official, p.owner_id,
+                   (SELECT COUNT(*) FROM stickers s WHERE s.pack_id = p.id),
+                   u.user_id IS NOT NULL
+            FROM sticker_packs p
+            LEFT JOIN user_sticker_packs u ON u.pack_id = p.id AND u.user_id = $1
+            WHERE ($2 = '' OR p.kind = $2)
+              AND (NOT $3 OR u.user_id IS NOT NULL)
+              AND ($4 = '' OR p.title ILIKE '%' || $4 || '%' OR p.short_name ILIKE '%' || $4 || '%'
+                   OR EXISTS (SELECT 1 FROM stickers s WHERE s.pack_id = p.id AND s.emoji = $4))
+            ORDER BY u.installed_at NULLS LAST, p.is_official DESC, p.id
+            LIMIT $5`, userID, kind, installedOnly, query, stickerSearchLimit)
+		if err != nil {
+			log.Printf("Ошибка поиска наборов стикеров: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		packs := []stickerPack{}
+		for rows.Next() {
+			var (
+				pack    stickerPack
+				ownerID sql.NullInt64
+			)
+			if err := rows.Scan(&pack.ID, &pack.ShortName, &pack.Title, &pack.Kind, &pack.IsOfficial, &ownerID, &pack.StickerCount, &pack.Installed); err != nil {
+				log.Printf("Ошибка чтения набора стикеров: %v", err)
+				continue
+			}
+			if ownerID.Valid {
+				id := int(ownerID.Int64)
+				pack.OwnerID = &id
+			}
+			packs = append(packs, pack)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(packs)
+
+	case "POST":
+		var data struct {
+			UserID    int    `json:"user_id"`
+			ShortName string `json:"short_name"`
+			Title     string `json:"title"`
+			Kind      string `json:"kind"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		data.Title = strings.TrimSpace(sanitizeMessageText(data.Title))
+		if data.Kind == "" {
+			data.Kind = stickerKindSticker
+		}
+		if data.Kind != stickerKindSticker && data.Kind != stickerKindEmoji {
+			http.Error(w, "Invalid kind", http.StatusBadRequest)
+			return
+		}
+		if !packShortNamePattern.MatchString(data.ShortName) {
+			http.Error(w, "Invalid short name", http.StatusBadRequest)
+			return
+		}
+		if data.Title == "" || utf8.RuneCountInString(data.Title) > maxPackTitleLength {
+			http.Error(w, "Invalid title", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM sticker_packs WHERE owner_id = $1", data.UserID).Scan(&count); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if count >= maxPacksPerUser {
+			http.Error(w, "Too many sticker packs", http.StatusConflict)
+			return
+		}
+
+		var packID int
+		err = tx.QueryRow(`
+            INSERT INTO sticker_packs (short_name, title, kind, owner_id, is_official)
+            VALUES ($1, $2, $3, $4, $5)
+            ON CONFLICT DO NOTHING
+            RETURNING id`, data.ShortName, data.Title, data.Kind, data.UserID, isServerAdmin(data.UserID),
+		).Scan(&packID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Short name is already taken", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			// Нарушение внешнего ключа — пользователя нет
+			log.Printf("Ошибка создания набора стикеров: %v", err)
+			http.Error(w, "Unable to create sticker pack", http.StatusBadRequest)
+			return
+		}
+		// Автор сразу получает свой набор
+		if _, err := tx.Exec("INSERT INTO user_sticker_packs (user_id, pack_id) VALUES ($1, $2)", data.UserID, packID); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		pack, err := loadStickerPack(db, packID, data.UserID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(pack)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Набор со стикерами по ID или короткому имени
+func stickerPackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	userID, _ := strconv.Atoi(r.URL.Query().Get("user_id"))
+
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	packID, err := strconv.Atoi(r.URL.Query().Get("id"))
+	if err != nil {
+		shortName := r.URL.Query().Get("short_name")
+		if shortName == "" || db.QueryRow("SELECT id FROM sticker_packs WHERE LOWER(short_name) = LOWER($1)", shortName).Scan(&packID) != nil {
+			http.Error(w, "Sticker pack not found", http.StatusNotFound)
+			return
+		}
+	}
+
+	pack, err := loadStickerPack(db, packID, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Sticker pack not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка загрузки набора стикеров %d: %v", packID, err)
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pack)
+}
+
+// Добавление стикера в набор (POST multipart: user_id, pack_id, emoji, file) и удаление (DELETE ?user_id&sticker_id)
+func packStickersHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	switch r.Method {
+	case "POST":
+		r.ParseMultipartForm(1 << 20)
+		userID, errUser := strconv.Atoi(r.FormValue("user_id"))
+		packID, errPack := strconv.Atoi(r.FormValue("pack_id"))
+		if errUser != nil || errPack != nil {
+			http.Error(w, "User ID and pack ID are required", http.StatusBadRequest)
+			return
+		}
+		emoji, ok := normalizeStickerEmoji(r.FormValue("emoji"))
+		if !ok {
+			http.Error(w, "Invalid emoji", http.StatusBadRequest)
+			return
+		}
+		file, handler, err := r.FormFile("file")
+		if err != nil {
+			http.Error(w, "Unable to retrieve file", http.StatusBadRequest)
+			return
+		}
+		defer file.Close()
+
+		kind, allowed, err := canEditStickerPack(db, packID, userID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Sticker pack not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		data, err := io.ReadAll(io.LimitReader(file, maxStickerFileSize+1))
+		if err != nil {
+			http.Error(w, "Unable to read file", http.StatusBadRequest)
+			return
+		}
+		mimeType, width, height, err := validateStickerImage(data, kind)
+		if errors.Is(err, errBlobTooLarge) {
+			http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Only WebP and PNG images within the size limit are supported", http.StatusBadRequest)
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+
+		// Блокировка набора сериализует добавление и проверку лимита
+		var count int
+		err = tx.QueryRow(`
+            SELECT (SELECT COUNT(*) FROM stickers WHERE pack_id = p.id)
+            FROM sticker_packs p WHERE p.id = $1 FOR UPDATE`, packID).Scan(&count)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		limit := maxStickersPerPack
+		if kind == stickerKindEmoji {
+			limit = maxEmojiPerPack
+		}
+		if count >= limit {
+			http.Error(w, "Sticker pack is full", http.StatusConflict)
+			return
+		}
+
+		blob, err := storeBlobBytes(tx, data, handler.Filename)
+		if err != nil {
+			log.Printf("Ошибка сохранения стикера: %v", err)
+			http.Error(w, "Storage error", http.StatusInternalServerError)
+			return
+		}
+		_, err = tx.Exec("UPDATE blobs SET mime_type = $2, width = $3, height = $4 WHERE key = $1", blob.Key, mimeType, width, height)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		var stickerID int
+		err = tx.QueryRow(`
+            INSERT INTO stickers (pack_id, blob_key, emoji, position, width, height)
+            VALUES ($1, $2, $3, $4, $5, $6)
+            RETURNING id`, packID, blob.Key, emoji, count, width, height,
+		).Scan(&stickerID)
+		if err != nil {
+			log.Printf("Ошибка добавления стикера: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+
+		stickers, err := loadStickers(db, []int{stickerID})
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(stickers[stickerID])
+
+	case "DELETE":
+		userID, errUser := strconv.Atoi(r.URL.Query().Get("user_id"))
+		stickerID, errSticker := strconv.Atoi(r.URL.Query().Get("sticker_id"))
+		if errUser != nil || errSticker != nil {
+			http.Error(w, "User ID and sticker ID are required", http.StatusBadRequest)
+			return
+		}
+		var packID int
+		if err := db.QueryRow("SELECT pack_id FROM stickers WHERE id = $1", stickerID).Scan(&packID); err != nil {
+			http.Error(w, "Sticker not found", http.StatusNotFound)
+			return
+		}
+		if _, allowed, err := canEditStickerPack(db, packID, userID); err != nil || !allowed {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		// Отправленные сообщения остаются с текстом-эмодзи; файл удалит очистка хранилища
+		if _, err := db.Exec("DELETE FROM stickers WHERE id = $1", stickerID); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Установка (installed=true) и удаление набора из списка пользователя
+func installStickerPackHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var data struct {
+		UserID    int  `json:"user_id"`
+		PackID    int  `json:"pack_id"`
+		Installed bool `json:"installed"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	if data.Installed {
+		_, err = db.Exec(`
+            INSERT INTO user_sticker_packs (user_id, pack_id) VALUES ($1, $2)
+            ON CONFLICT DO NOTHING`, data.UserID, data.PackID)
+		if err != nil {
+			// Нарушение внешнего ключа — нет набора или пользователя
+			http.Error(w, "Sticker pack not found", http.StatusNotFound)
+			return
+		}
+	} else {
+		_, err = db.Exec("DELETE FROM user_sticker_packs WHERE user_id = $1 AND pack_id = $2", data.UserID, data.PackID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Файл стикера или эмодзи. Ключ объекта — хеш содержимого, поэтому он же служит ETag
+func stickerFileHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var (
+		blobKey  string
+		mimeType sql.NullString
+		storedAt sql.NullTime
+	)
+	err = db.QueryRow(`
+        SELECT s.blob_key, b.mime_type, b.created_at
+        FROM stickers s JOIN blobs b ON b.key = s.blob_key
+        WHERE s.id = $1`, r.URL.Query().Get("id")).Scan(&blobKey, &mimeType, &storedAt)
+	if err != nil {
+		http.Error(w, "Sticker not found", http.StatusNotFound)
+		return
+	}
+
+	etag := `"` + blobKey[strings.LastIndex(blobKey, "/")+1:] + `"`
+	if writeImageCacheHeaders(w, r, etag, imageVersionToken(sql.NullString{String: blobKey, Valid: true}, sql.NullString{}), storedAt.Time) {
+		return
+	}
+	w.Header().Set("Content-Type", mimeType.String)
+	serveBlob(w, r, blobKey, storedAt.Time)
+}
+
+// Отправка стикера сообщением. Текст сообщения — эмодзи стикера, чтобы он был понятен в списке чатов
+func handleSendStickerCommand(conn *websocket.Conn, message []byte) {
+	var cmd stickerCommand
+	if err := json.Unmarshal(message, &cmd); err != nil {
+		log.Printf("Ошибка парсинга команды send_sticker: %v", err)
+		return
+	}
+	reject := func(reason string) {
+		conn.WriteJSON(map[string]interface{}{
+			"type":    "message_rejected",
+			"chat_id": cmd.ChatID,
+			"error":   reason,
+		})
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("DB error: %v", err)
+		return
+	}
+	defer db.Close()
+
+	if ok, err := isChatParticipant(db, cmd.ChatID, cmd.UserID); err != nil || !ok {
+		log.Printf("Unauthorized sticker attempt: user %d, chat %d", cmd.UserID, cmd.ChatID)
+		return
+	}
+	if err := checkMemberMuted(db, cmd.ChatID, cmd.UserID); err != nil {
+		reject(err.Error())
+		return
+	}
+
+	var emoji string
+	err = db.QueryRow(`
+        SELECT COALESCE(s.emoji, '') FROM stickers s
+        JOIN sticker_packs p ON p.id = s.pack_id
+        WHERE s.id = $1 AND p.kind = 'sticker'`, cmd.StickerID).Scan(&emoji)
+	if err != nil {
+		log.Printf("Стикер %d не найден: %v", cmd.StickerID, err)
+		reject(errStickerNotFound.Error())
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Transaction error: %v", err)
+		return
+	}
+	defer tx.Rollback()
+
+	msg := chatMessage{ChatID: cmd.ChatID, UserID: cmd.UserID, Text: emoji, ParentMessageID: cmd.ParentMessageID, MessageType: "sticker"}
+	stored, err := storeChatMessage(tx, msg)
+	if err != nil {
+		log.Printf("Ошибка сохранения сообщения со стикером: %v", err)
+		return
+	}
+	if _, err := tx.Exec("UPDATE messages SET sticker_id = $2 WHERE id = $1", stored.ID, cmd.StickerID); err != nil {
+		log.Printf("Ошибка сохранения стикера сообщения: %v", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Transaction commit error: %v", err)
+		return
+	}
+
+	stickers, err := loadMessageStickers(db, []int{stored.ID})
+	if err != nil {
+		log.Printf("Ошибка загрузки стикера сообщения %d: %v", stored.ID, err)
+		return
+	}
+	if s, ok := stickers[stored.ID]; ok {
+		stored.Extra = map[string]interface{}{"sticker": s}
+	}
+	broadcastChatMessage(db, stored, msg, conn)
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/png"
+	"testing"
+)
+
+func riffChunk(fourCC string, payload []byte) []byte {
+	chunk := append([]byte(fourCC), binary.LittleEndian.AppendUint32(nil, uint32(len(payload)))...)
+	chunk = append(chunk, payload...)
+	if len(payload)%2 == 1 {
+		chunk = append(chunk, 0)
+	}
+	return chunk
+}
+
+func buildWebP(chunks ...[]byte) []byte {
+	body := append([]byte("WEBP"), bytes.Join(chunks, nil)...)
+	return append(append([]byte("RIFF"), binary.LittleEndian.AppendUint32(nil, uint32(len(body)))...), body...)
+}
+
+// Ключевой кадр VP8 с первым разделом partition байт (содержимое не декодируется)
+func vp8Payload(width, height, partition int) []byte {
+	tag := uint32(partition)<<5 | 1<<4 // Ключевой кадр, show_frame
+	payload := []byte{byte(tag), byte(tag >> 8), byte(tag >> 16), 0x9d, 0x01, 0x2a}
+	payload = binary.LittleEndian.AppendUint16(payload, uint16(width))
+	payload = binary.LittleEndian.AppendUint16(payload, uint16(height))
+	return append(payload, make([]byte, partition)...)
+}
+
+func vp8lPayload(width, height int) []byte {
+	bits := uint32(width-1) | uint32(height-1)<<14
+	return append(binary.LittleEndian.AppendUint32([]byte{0x2f}, bits), 0x00, 0x01, 0x02)
+}
+
+func vp8xPayload(width, height int) []byte {
+	w, h := width-1, height-1
+	return []byte{0, 0, 0, 0, byte(w), byte(w >> 8), byte(w >> 16), byte(h), byte(h >> 8), byte(h >> 16)}
+}
+
+func TestWebPDimensions(t *testing.T) {
+	valid := map[string][]byte{
+		"vp8":       buildWebP(riffChunk("VP8 ", vp8Payload(300, 200, 21))),
+		"vp8l":      buildWebP(riffChunk("VP8L", vp8lPayload(300, 200))),
+		"vp8x":      buildWebP(riffChunk("VP8X", vp8xPayload(300, 200)), riffChunk("ALPH", []byte{1, 2}), riffChunk("VP8 ", vp8Payload(300, 200, 4))),
+		"animation": buildWebP(riffChunk("VP8X", vp8xPayload(300, 200)), riffChunk("ANIM", make([]byte, 6)), riffChunk("ANMF", make([]byte, 40))),
+	}
+	for name, data := range valid {
+		if w, h, ok := webpDimensions(data); !ok || w != 300 || h != 200 {
+			t.Errorf("%s: got %dx%d, %v", name, w, h, ok)
+		}
+	}
+
+	vp8 := valid["vp8"]
+	invalid := map[string][]byte{
+		"truncated file":      vp8[:len(vp8)-10],
+		"trailing garbage":    append(append([]byte(nil), vp8...), 0, 0, 0, 0),
+		"partition too large": buildWebP(riffChunk("VP8 ", vp8Payload(300, 200, 21)[:20])),
+		"chunk past end":      append(buildWebP(riffChunk("VP8L", vp8lPayload(300, 200)))[:20], 0xff, 0xff, 0, 0, 0x2f, 0, 0, 0, 0, 0),
+		"vp8l header only":    buildWebP(riffChunk("VP8L", vp8lPayload(300, 200)[:5])),
+		"vp8x without image":  buildWebP(riffChunk("VP8X", vp8xPayload(300, 200)), riffChunk("EXIF", []byte("x"))),
+		"vp8x size mismatch":  buildWebP(riffChunk("VP8X", vp8xPayload(300, 200)), riffChunk("VP8L", vp8lPayload(100, 100))),
+		"interframe":          buildWebP(riffChunk("VP8 ", append([]byte{1}, vp8Payload(300, 200, 4)[1:]...))),
+	}
+	for name, data := range invalid {
+		if w, h, ok := webpDimensions(data); ok {
+			t.Errorf("%s: accepted as %dx%d", name, w, h)
+		}
+	}
+}
+
+func TestValidateStickerImage(t *testing.T) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 64, 64))); err != nil {
+		t.Fatal(err)
+	}
+	pngData := buf.Bytes()
+
+	if mime, w, h, err := validateStickerImage(pngData, stickerKindEmoji); err != nil || mime != "image/png" || w != 64 || h != 64 {
+		t.Fatalf("png: %s %dx%d %v", mime, w, h, err)
+	}
+	if _, _, _, err := validateStickerImage(pngData[:len(pngData)-20], stickerKindEmoji); err != errInvalidStickerFile {
+		t.Fatalf("truncated png: %v", err)
+	}
+	large := buildWebP(riffChunk("VP8L", vp8lPayload(300, 200)))
+	if _, _, _, err := validateStickerImage(large, stickerKindEmoji); err != errInvalidStickerFile {
+		t.Fatalf("emoji larger than %dpx: %v", maxEmojiSide, err)
+	}
+	if mime, _, _, err := validateStickerImage(large, stickerKindSticker); err != nil || mime != "image/webp" {
+		t.Fatalf("webp sticker: %s %v", mime, err)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	maxAvatarSize     = 5 << 20   // Максимальный размер аватара пользователя или группы
+	maxAttachmentSize = 100 << 20 // Максимальный размер вложения сообщения
+)
+
+var (
+	errBlobNotFound = errors.New("blob not found")
+	errBlobTooLarge = errors.New("blob too large")
+)
+
+// Хранилище двоичных данных (аватары, вложения). Ключи не зависят от реализации
+type blobStore interface {
+	Put(key string, r io.Reader, size int64, contentType string) error
+	Open(key string) (blobObject, error)
+	Exists(key string) (bool, error)
+	Delete(key string) error
+}
+
+// Открытый для чтения объект хранилища с произвольным доступом (для Range-запросов)
+type blobObject interface {
+	io.ReadSeekCloser
+	Size() int64
+}
+
+// Текущее хранилище, выбирается при запуске
+var blobStorage blobStore
+
+// Выбор хранилища по переменным окружения:
+// BLOB_STORAGE=local (по умолчанию, каталог BLOB_DIR) или BLOB_STORAGE=s3
+// (S3_ENDPOINT, S3_BUCKET, S3_REGION, S3_ACCESS_KEY, S3_SECRET_KEY)
+func initBlobStorage() error {
+	switch os.Getenv("BLOB_STORAGE") {
+	case "", "local":
+		dir := os.Getenv("BLOB_DIR")
+		if dir == "" {
+			dir = "data/blobs"
+		}
+		store, err := newLocalBlobStore(dir)
+		if err != nil {
+			return err
+		}
+		blobStorage = store
+	case "s3":
+		store, err := newS3BlobStore(os.Getenv("S3_ENDPOINT"), os.Getenv("S3_BUCKET"), os.Getenv("S3_REGION"),
+			os.Getenv("S3_ACCESS_KEY"), os.Getenv("S3_SECRET_KEY"))
+		if err != nil {
+			return err
+		}
+		blobStorage = store
+	default:
+		return fmt.Errorf("неизвестное хранилище BLOB_STORAGE=%s", os.Getenv("BLOB_STORAGE"))
+	}
+	return nil
+}
+
+// Сведения о сохранённых данных
+type blobInfo struct {
+	Key      string
+	Size     int64
+	MimeType string
+}
+
+// Ключ по содержимому: одинаковые файлы хранятся один раз
+func blobKeyForHash(sum []byte) string {
+	h := hex.EncodeToString(sum)
+	return "sha256/" + h[:2] + "/" + h
+}
+
+// Потоковое сохранение данных в хранилище под ключом по SHA-256 содержимого.
+// Данные сначала пишутся во временный файл, чтобы не держать их в памяти и вычислить ключ;
+// если такой объект уже есть, повторная загрузка не выполняется
+func storeBlob(db dbExecutor, r io.Reader, maxSize int64, fileName string) (blobInfo, error) {
+	tmp, err := os.CreateTemp("", "blob-*")
+	if err != nil {
+		return blobInfo{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hasher := sha256.New()
+	head := &prefixBuffer{limit: 512}
+	size, err := io.Copy(io.MultiWriter(tmp, hasher, head), io.LimitReader(r, maxSize+1))
+	if err != nil {
+		return blobInfo{}, err
+	}
+	if size > maxSize {
+		return blobInfo{}, errBlobTooLarge
+	}
+
+	info := blobInfo{
+		Key:      blobKeyForHash(hasher.Sum(nil)),
+		Size:     size,
+		MimeType: detectMimeType(fileName, head.Bytes()),
+	}
+
+	// Запись о блобе обновляется до загрузки, чтобы очистка не удалила его в процессе
+	_, err = db.Exec(`
+        INSERT INTO blobs (key, size, mime_type) VALUES ($1, $2, $3)
+        ON CONFLICT (key) DO UPDATE SET last_stored_at = CURRENT_TIMESTAMP`,
+		info.Key, info.Size, info.MimeType,
+	)
+	if err != nil {
+		return blobInfo{}, err
+	}
+
+	exists, err := blobStorage.Exists(info.Key)
+	if err != nil {
+		return blobInfo{}, err
+	}
+	if !exists {
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return blobInfo{}, err
+		}
+		if err := blobStorage.Put(info.Key, tmp, size, info.MimeType); err != nil {
+			return blobInfo{}, err
+		}
+	}
+	return info, nil
+}
+
+// Сохранение данных, уже находящихся в памяти (перенос из BYTEA)
+func storeBlobBytes(db dbExecutor, data []byte, fileName string) (blobInfo, error) {
+	return storeBlob(db, bytes.NewReader(data), int64(len(data)), fileName)
+}
+
+// Отдача объекта хранилища клиенту с поддержкой Range и условных запросов
+func serveBlob(w http.ResponseWriter, r *http.Request, key string, modTime time.Time) {
+	object, err := blobStorage.Open(key)
+	if errors.Is(err, errBlobNotFound) {
+		log.Printf("Объект %s отсутствует в хранилище", key)
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка открытия объекта %s: %v", key, err)
+		http.Error(w, "Storage error", http.StatusInternalServerError)
+		return
+	}
+	defer object.Close()
+
+	http.ServeContent(w, r, "", modTime, object)
+}
+
+// Запоминает первые limit байт потока (для определения типа содержимого)
+type prefixBuffer struct {
+	bytes.Buffer
+	limit int
+}
+
+func (b *prefixBuffer) Write(p []byte) (int, error) {
+	if rest := b.limit - b.Len(); rest > 0 {
+		if len(p) < rest {
+			rest = len(p)
+		}
+		b.Buffer.Write(p[:rest])
+	}
+	return len(p), nil
+}
+
+// Локальное хранилище: файлы в каталоге, путь повторяет ключ
+type localBlobStore struct {
+	root string
+}
+
+func newLocalBlobStore(root string) (*localBlobStore, error) {
+	if err := os.MkdirAll(filepath.Join(root, "tmp"), 0o755); err != nil {
+		return nil, err
+	}
+	return &localBlobStore{root: root}, nil
+}
+
+func (s *localBlobStore) path(key string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(key))
+	if clean == "." || filepath.IsAbs(clean) || strings.HasPrefix(clean, "..") {
+		return "", fmt.Errorf("недопустимый ключ объекта: %s", key)
+	}
+	return filepath.Join(s.root, clean), nil
+}
+
+func (s *localBlobStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	target, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+		return err
+	}
+	// Запись во временный файл и переименование: недописанный объект не будет виден
+	tmp, err := os.CreateTemp(filepath.Join(s.root, "tmp"), "put-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	written, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if size >= 0 && written != size {
+		return fmt.Errorf("записано %d байт вместо %d", written, size)
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+func (s *localBlobStore) Open(key string) (blobObject, error) {
+	target, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(target)
+	if os.IsNotExist(err) {
+		return nil, errBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &localBlobObject{File: f, size: stat.Size()}, nil
+}
+
+func (s *localBlobStore) Exists(key string) (bool, error) {
+	target, err := s.path(key)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(target)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *localBlobStore) Delete(key string) error {
+	target, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(target)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+type localBlobObject struct {
+	*os.File
+	size int64
+}
+
+func (o *localBlobObject) Size() int64 { return o.size }
+
+// Удаление объектов, на которые больше нет ссылок
+func collectUnusedBlobs(db *sql.DB) error {
+	rows, err := db.Query(`
+        SELECT b.key FROM blobs b
+        WHERE NOT EXISTS (SELECT 1 FROM message_files f WHERE f.blob_key = b.key)
+          AND NOT EXISTS (SELECT 1 FROM users u WHERE u.image_key = b.key)
+          AND NOT EXISTS (SELECT 1 FROM group_chats gc WHERE gc.image_key = b.key)
+          AND NOT EXISTS (SELECT 1 FROM uploads up WHERE up.blob_key = b.key)
+          AND NOT EXISTS (SELECT 1 FROM blob_variants v WHERE v.variant_key = b.key)
+          AND NOT EXISTS (SELECT 1 FROM stickers s WHERE s.blob_key = b.key)
+          AND b.last_stored_at < CURRENT_TIMESTAMP - INTERVAL '1 hour'`)
+	if err != nil {
+		return err
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err == nil {
+			keys = append(keys, key)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, key := range keys {
+		// Сначала запись в БД: объект без записи будет загружен заново при следующем сохранении
+		result, err := db.Exec(`
+            DELETE FROM blobs b WHERE b.key = $1
+              AND NOT EXISTS (SELECT 1 FROM message_files f WHERE f.blob_key = b.key)
+              AND NOT EXISTS (SELECT 1 FROM users u WHERE u.image_key = b.key)
+              AND NOT EXISTS (SELECT 1 FROM group_chats gc WHERE gc.image_key = b.key)
+              AND NOT EXISTS (SELECT 1 FROM uploads up WHERE up.blob_key = b.key)
+              AND NOT EXISTS (SELECT 1 FROM blob_variants v WHERE v.variant_key = b.key)
+              AND NOT EXISTS (SELECT 1 FROM stickers s WHERE s.blob_key = b.key)
+              AND b.last_stored_at < CURRENT_TIMESTAMP - INTERVAL '1 hour'`, key)
+		if err != nil {
+			return err
+		}
+		if affected, _ := result.RowsAffected(); affected == 0 {
+			continue
+		}
+		if err := blobStorage.Delete(key); err != nil {
+			log.Printf("Ошибка удаления объекта %s: %v", key, err)
+			continue
+		}
+		removed++
+	}
+	log.Printf("Удалено неиспользуемых объектов: %d", removed)
+	return nil
+}
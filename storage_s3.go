@@ -0,0 +1,259 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Пустое тело запроса для подписи
+const emptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// S3-совместимое хранилище (AWS S3, MinIO и т.п.).
+// Используется адресация вида endpoint/bucket/key и подпись запросов AWS Signature V4
+type s3BlobStore struct {
+	endpoint  *url.URL
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3BlobStore(endpoint, bucket, region, accessKey, secretKey string) (*s3BlobStore, error) {
+	if endpoint == "" || bucket == "" {
+		return nil, errors.New("для S3 необходимо указать S3_ENDPOINT и S3_BUCKET")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("некорректный S3_ENDPOINT: %s", endpoint)
+	}
+	if region == "" {
+		region = "us-east-1"
+	}
+	return &s3BlobStore{
+		endpoint:  u,
+		bucket:    bucket,
+		region:    region,
+		accessKey: accessKey,
+		secretKey: secretKey,
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}, nil
+}
+
+// Адрес объекта в бакете
+func (s *s3BlobStore) objectURL(key string) string {
+	u := *s.endpoint
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.bucket + "/" + key
+	return u.String()
+}
+
+// Создание подписанного запроса к объекту
+func (s *s3BlobStore) newRequest(method, key string, body io.Reader, payloadHash string) (*http.Request, error) {
+	req, err := http.NewRequest(method, s.objectURL(key), body)
+	if err != nil {
+		return nil, err
+	}
+	s.sign(req, payloadHash, time.Now().UTC())
+	return req, nil
+}
+
+// Подпись запроса по схеме AWS Signature V4 (подписываются host, x-amz-content-sha256 и x-amz-date)
+func (s *s3BlobStore) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\n" +
+			"x-amz-content-sha256:" + payloadHash + "\n" +
+			"x-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Ошибка по ответу S3 (тело ответа содержит XML с описанием)
+func s3ResponseError(resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	return fmt.Errorf("S3 %s: %s", resp.Status, strings.TrimSpace(string(body)))
+}
+
+func (s *s3BlobStore) Put(key string, r io.Reader, size int64, contentType string) error {
+	// Тело передаётся потоком без вычисления хеша для подписи
+	req, err := s.newRequest("PUT", key, r, "UNSIGNED-PAYLOAD")
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return s3ResponseError(resp)
+	}
+	return nil
+}
+
+// Размер объекта по HEAD-запросу
+func (s *s3BlobStore) head(key string) (int64, error) {
+	req, err := s.newRequest("HEAD", key, nil, emptyPayloadHash)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return resp.ContentLength, nil
+	case http.StatusNotFound:
+		return 0, errBlobNotFound
+	default:
+		return 0, fmt.Errorf("S3 %s", resp.Status)
+	}
+}
+
+func (s *s3BlobStore) Open(key string) (blobObject, error) {
+	size, err := s.head(key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3BlobObject{store: s, key: key, size: size}, nil
+}
+
+func (s *s3BlobStore) Exists(key string) (bool, error) {
+	_, err := s.head(key)
+	if errors.Is(err, errBlobNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *s3BlobStore) Delete(key string) error {
+	req, err := s.newRequest("DELETE", key, nil, emptyPayloadHash)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return s3ResponseError(resp)
+	}
+	return nil
+}
+
+// Объект S3 с произвольным доступом: чтение после Seek запрашивает диапазон с нужного смещения
+type s3BlobObject struct {
+	store  *s3BlobStore
+	key    string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+func (o *s3BlobObject) Size() int64 { return o.size }
+
+func (o *s3BlobObject) Read(p []byte) (int, error) {
+	if o.offset >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		req, err := o.store.newRequest("GET", o.key, nil, emptyPayloadHash)
+		if err != nil {
+			return 0, err
+		}
+		req.Header.Set("Range", "bytes="+strconv.FormatInt(o.offset, 10)+"-")
+		resp, err := o.store.client.Do(req)
+		if err != nil {
+			return 0, err
+		}
+		if resp.StatusCode != http.StatusPartialContent && resp.StatusCode != http.StatusOK {
+			defer resp.Body.Close()
+			return 0, s3ResponseError(resp)
+		}
+		if resp.StatusCode == http.StatusOK && o.offset > 0 {
+			// Сервер проигнорировал Range — пропускаем начало
+			if _, err := io.CopyN(io.Discard, resp.Body, o.offset); err != nil {
+				resp.Body.Close()
+				return 0, err
+			}
+		}
+		o.body = resp.Body
+	}
+	n, err := o.body.Read(p)
+	o.offset += int64(n)
+	return n, err
+}
+
+func (o *s3BlobObject) Seek(offset int64, whence int) (int64, error) {
+	var target int64
+	switch whence {
+	case io.SeekStart:
+		target = offset
+	case io.SeekCurrent:
+		target = o.offset + offset
+	case io.SeekEnd:
+		target = o.size + offset
+	default:
+		return 0, errors.New("некорректный whence")
+	}
+	if target < 0 {
+		return 0, errors.New("отрицательное смещение")
+	}
+	if target != o.offset && o.body != nil {
+		o.body.Close()
+		o.body = nil
+	}
+	o.offset = target
+	return target, nil
+}
+
+func (o *s3BlobObject) Close() error {
+	if o.body != nil {
+		return o.body.Close()
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Минимальный S3: проверяет подпись V4 запроса и хранит объекты в памяти
+type fakeS3 struct {
+	t         *testing.T
+	region    string
+	accessKey string
+	secretKey string
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	ranges  []string
+}
+
+func (f *fakeS3) verify(r *http.Request) error {
+	amzDate := r.Header.Get("x-amz-date")
+	payloadHash := r.Header.Get("x-amz-content-sha256")
+	when, err := time.Parse("20060102T150405Z", amzDate)
+	if err != nil {
+		return fmt.Errorf("bad x-amz-date %q", amzDate)
+	}
+	if d := time.Since(when); d < -time.Minute || d > time.Minute {
+		return fmt.Errorf("x-amz-date is %v off", d)
+	}
+	if r.Method == "PUT" && payloadHash != "UNSIGNED-PAYLOAD" || r.Method != "PUT" && payloadHash != emptyPayloadHash {
+		return fmt.Errorf("unexpected payload hash %q", payloadHash)
+	}
+
+	scope := amzDate[:8] + "/" + f.region + "/s3/aws4_request"
+	canonical := r.Method + "\n" + r.URL.EscapedPath() + "\n" + r.URL.RawQuery + "\n" +
+		"host:" + r.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n\n" +
+		"host;x-amz-content-sha256;x-amz-date\n" + payloadHash
+	sum := sha256.Sum256([]byte(canonical))
+	key := hmacSHA256([]byte("AWS4"+f.secretKey), amzDate[:8])
+	for _, part := range []string{f.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, "AWS4-HMAC-SHA256\n"+amzDate+"\n"+scope+"\n"+hex.EncodeToString(sum[:])))
+
+	want := "AWS4-HMAC-SHA256 Credential=" + f.accessKey + "/" + scope +
+		", SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=" + signature
+	if got := r.Header.Get("Authorization"); got != want {
+		return fmt.Errorf("signature mismatch:\n got %s\nwant %s", got, want)
+	}
+	return nil
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f.verify(r); err != nil {
+		f.t.Log(err)
+		http.Error(w, "<Error><Code>SignatureDoesNotMatch</Code></Error>", http.StatusForbidden)
+		return
+	}
+	key := r.URL.Path
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[key]
+	switch r.Method {
+	case "PUT":
+		body, err := io.ReadAll(r.Body)
+		if err != nil || int64(len(body)) != r.ContentLength {
+			http.Error(w, "bad body", http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = body
+	case "HEAD":
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	case "GET":
+		if !ok {
+			http.Error(w, "<Error><Code>NoSuchKey</Code></Error>", http.StatusNotFound)
+			return
+		}
+		rng := r.Header.Get("Range")
+		f.ranges = append(f.ranges, rng)
+		start, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(rng, "bytes="), "-"))
+		if err != nil || start > len(data) {
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[start:])
+	case "DELETE":
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func newTestS3(t *testing.T) (*s3BlobStore, *fakeS3) {
+	fake := &fakeS3{t: t, region: "eu-central-1", accessKey: "AKIDEXAMPLE", secretKey: "secret", objects: make(map[string][]byte)}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+	store, err := newS3BlobStore(server.URL+"/base/", "media", fake.region, fake.accessKey, fake.secretKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, fake
+}
+
+func TestS3BlobStorePutOpenRange(t *testing.T) {
+	store, fake := newTestS3(t)
+	const key = "ab/cdef0123"
+	content := "hello, range requests"
+
+	if ok, err := store.Exists(key); err != nil || ok {
+		t.Fatalf("Exists before Put = %v, %v", ok, err)
+	}
+	if err := store.Put(key, strings.NewReader(content), int64(len(content)), "text/plain"); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+	if string(fake.objects["/base/media/"+key]) != content {
+		t.Fatalf("stored objects: %v", fake.objects)
+	}
+	if ok, err := store.Exists(key); err != nil || !ok {
+		t.Fatalf("Exists after Put = %v, %v", ok, err)
+	}
+
+	object, err := store.Open(key)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	defer object.Close()
+	if object.Size() != int64(len(content)) {
+		t.Fatalf("Size = %d, want %d", object.Size(), len(content))
+	}
+	all, err := io.ReadAll(object)
+	if err != nil || string(all) != content {
+		t.Fatalf("ReadAll = %q, %v", all, err)
+	}
+
+	if _, err := object.Seek(7, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	tail, err := io.ReadAll(object)
+	if err != nil || string(tail) != content[7:] {
+		t.Fatalf("read after Seek = %q, %v", tail, err)
+	}
+	if want := []string{"bytes=0-", "bytes=7-"}; strings.Join(fake.ranges, ",") != strings.Join(want, ",") {
+		t.Fatalf("ranges = %v, want %v", fake.ranges, want)
+	}
+
+	if err := store.Delete(key); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	if _, err := store.Open(key); err != errBlobNotFound {
+		t.Fatalf("Open after Delete: %v, want errBlobNotFound", err)
+	}
+}
+
+func TestS3BlobStoreRejectsBadSignature(t *testing.T) {
+	store, _ := newTestS3(t)
+	store.secretKey = "wrong"
+	err := store.Put("ab/cd", strings.NewReader("x"), 1, "")
+	if err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("Put with wrong secret: %v", err)
+	}
+	if _, err := store.Exists("ab/cd"); err == nil {
+		t.Fatal("Exists with wrong secret succeeded")
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+const (
+	maxMessageTTL    = 365 * 24 * 60 * 60 // Максимальное время жизни сообщения, секунд
+	reaperInterval   = 5 * time.Second    // Период удаления истёкших сообщений
+	reaperBatchLimit = 500                // Максимум сообщений за один проход
+)
+
+// SQL-выражение времени автоудаления для INSERT ... SELECT ... FROM chats c
+const messageExpirySQL = `CASE
+            WHEN c.message_ttl IS NULL THEN NULL
+            ELSE CURRENT_TIMESTAMP + c.message_ttl * INTERVAL '1 second'
+        END`
+
+// Человекочитаемое описание времени жизни для системных сообщений
+func describeTTL(seconds int) string {
+	switch {
+	case seconds%(24*60*60) == 0:
+		return fmt.Sprintf("%d дн.", seconds/(24*60*60))
+	case seconds%(60*60) == 0:
+		return fmt.Sprintf("%d ч.", seconds/(60*60))
+	case seconds%60 == 0:
+		return fmt.Sprintf("%d мин.", seconds/60)
+	default:
+		return fmt.Sprintf("%d сек.", seconds)
+	}
+}
+
+// chatTTLHandler включает, меняет или отключает автоудаление сообщений в чате
+func chatTTLHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var data struct {
+		ChatID     int `json:"chat_id"`
+		UserID     int `json:"user_id"`
+		TTLSeconds int `json:"ttl_seconds"` // 0 — отключить автоудаление
+	}
+	if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	if data.TTLSeconds < 0 || data.TTLSeconds > maxMessageTTL {
+		http.Error(w, "Invalid ttl_seconds", http.StatusBadRequest)
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	var isGroup bool
+	err = db.QueryRow(`
+        SELECT c.is_group FROM chats c
+        JOIN participants p ON p.chat_id = c.id AND p.user_id = $2
+        WHERE c.id = $1`, data.ChatID, data.UserID).Scan(&isGroup)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Chat not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+
+	// В личных чатах настройку меняет любой участник, в группах — только администраторы
+	if isGroup {
+		allowed, err := canManageGroup(db, data.ChatID, data.UserID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !allowed {
+			http.Error(w, "Only group admins can change message TTL", http.StatusForbidden)
+			return
+		}
+	}
+
+	var actorName string
+	if err := db.QueryRow("SELECT username FROM users WHERE id = $1", data.UserID).Scan(&actorName); err != nil {
+		actorName = "Unknown"
+	}
+
+	var ttl sql.NullInt64
+	notice := fmt.Sprintf("%s отключил(а) автоудаление сообщений", actorName)
+	if data.TTLSeconds > 0 {
+		ttl = sql.NullInt64{Int64: int64(data.TTLSeconds), Valid: true}
+		notice = fmt.Sprintf("%s включил(а) автоудаление сообщений через %s", actorName, describeTTL(data.TTLSeconds))
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, "Transaction error", http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE chats SET message_ttl = $2 WHERE id = $1", data.ChatID, ttl); err != nil {
+		log.Printf("Ошибка изменения TTL чата %d: %v", data.ChatID, err)
+		http.Error(w, "Failed to update chat", http.StatusInternalServerError)
+		return
+	}
+	// Системное сообщение о смене настройки само не исчезает
+	messageID, createdAt, err := insertSystemMessage(tx, data.ChatID, notice)
+	if err != nil {
+		http.Error(w, "Failed to create system message", http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, "Transaction commit failed", http.StatusInternalServerError)
+		return
+	}
+
+	participantIDs, err := getChatParticipantIDs(db, data.ChatID)
+	if err != nil {
+		log.Printf("Ошибка получения участников чата %d: %v", data.ChatID, err)
+	}
+	broadcastToUsers(participantIDs, systemMessagePayload(data.ChatID, messageID, notice, createdAt))
+	broadcastToUsers(participantIDs, map[string]interface{}{
+		"type":        "chat_ttl_updated",
+		"chat_id":     data.ChatID,
+		"ttl_seconds": data.TTLSeconds,
+		"updated_by":  data.UserID,
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"chat_id":     data.ChatID,
+		"ttl_seconds": data.TTLSeconds,
+	})
+}
+
+// Фоновое удаление истёкших сообщений
+func startMessageReaper() {
+	go func() {
+		ticker := time.NewTicker(reaperInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			reapExpiredMessages()
+		}
+	}()
+}
+
+// Удаление истёкших сообщений и уведомление участников чатов
+func reapExpiredMessages() {
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("Автоудаление: ошибка подключения к БД: %v", err)
+		return
+	}
+	defer db.Close()
+	reapExpiredBatch(db)
+}
+
+// Один проход автоудаления: не больше reaperBatchLimit самых давно истёкших сообщений
+func reapExpiredBatch(db *sql.DB) {
+	// Файлы и реакции удаляются каскадно вместе с сообщением
+	rows, err := db.Query(`
+        DELETE FROM messages
+        WHERE id IN (
+            SELECT id FROM messages
+            WHERE expires_at <= CURRENT_TIMESTAMP
+            ORDER BY expires_at
+            LIMIT $1
+        )
+        RETURNING id, chat_id`, reaperBatchLimit)
+	if err != nil {
+		log.Printf("Автоудаление: ошибка удаления сообщений: %v", err)
+		return
+	}
+
+	deletedByChat := make(map[int][]int)
+	for rows.Next() {
+		var messageID, chatID int
+		if err := rows.Scan(&messageID, &chatID); err != nil {
+			continue
+		}
+		deletedByChat[chatID] = append(deletedByChat[chatID], messageID)
+	}
+	rows.Close()
+
+	for chatID, messageIDs := range deletedByChat {
+		participantIDs, err := getChatParticipantIDs(db, chatID)
+		if err != nil {
+			log.Printf("Автоудаление: ошибка получения участников чата %d: %v", chatID, err)
+			continue
+		}
+		for _, messageID := range messageIDs {
+			broadcastToUsers(participantIDs, map[string]interface{}{
+				"type":    "message_deleted",
+				"id":      messageID,
+				"chat_id": chatID,
+				"expired": true,
+			})
+			emitWebhookEvent(db, chatID, webhookEventMessageDeleted, map[string]interface{}{
+				"id":      messageID,
+				"chat_id": chatID,
+				"expired": true,
+			})
+		}
+		log.Printf("Автоудаление: удалено %d сообщений в чате %d", len(messageIDs), chatID)
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDescribeTTL(t *testing.T) {
+	cases := map[int]string{
+		30:        "30 сек.",
+		90:        "90 сек.",
+		300:       "5 мин.",
+		7200:      "2 ч.",
+		86400:     "1 дн.",
+		7 * 86400: "7 дн.",
+	}
+	for seconds, want := range cases {
+		if got := describeTTL(seconds); got != want {
+			t.Errorf("describeTTL(%d) = %q, want %q", seconds, got, want)
+		}
+	}
+}
+
+func TestChatTTLHandlerValidation(t *testing.T) {
+	for _, body := range []string{`{"chat_id":1,"user_id":1,"ttl_seconds":-1}`, `{"chat_id":1,"user_id":1,"ttl_seconds":31536001}`, `{`} {
+		rec := httptest.NewRecorder()
+		chatTTLHandler(rec, httptest.NewRequest("POST", "/chatTTL", strings.NewReader(body)))
+		if rec.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want 400", body, rec.Code)
+		}
+	}
+}
+
+// Проход удаляет ограниченную пачку самых давно истёкших сообщений
+// и сообщает участникам каждого чата об удалённых сообщениях
+func TestReapExpiredBatch(t *testing.T) {
+	db, fake := newFakeDB(t)
+	fake.on("DELETE FROM messages", func([]driver.Value) fakeResult {
+		return fakeResult{rows: [][]driver.Value{
+			{int64(1), int64(10)},
+			{int64(2), int64(20)},
+			{int64(3), int64(10)},
+		}}
+	})
+	fake.on("SELECT user_id FROM participants", func(args []driver.Value) fakeResult {
+		if args[0] == int64(10) {
+			return fakeResult{rows: [][]driver.Value{{int64(1)}, {int64(2)}}}
+		}
+		return fakeResult{rows: [][]driver.Value{{int64(3)}}}
+	})
+	member := connectTestClient(t, 2, 0)
+	outsider := connectTestClient(t, 3, 0)
+
+	reapExpiredBatch(db)
+
+	deleted := fake.queries("DELETE FROM messages")
+	if len(deleted) != 1 || deleted[0].args[0] != int64(reaperBatchLimit) {
+		t.Fatalf("reaper query: %+v", deleted)
+	}
+	query := deleted[0].query
+	if !strings.Contains(query, "expires_at <= CURRENT_TIMESTAMP") || !strings.Contains(query, "ORDER BY expires_at") {
+		t.Fatalf("reaper does not select the oldest expired messages: %s", query)
+	}
+
+	for _, want := range []float64{1, 3} {
+		event := readTestEvent(t, member)
+		if event["type"] != "message_deleted" || event["id"] != want || event["chat_id"] != float64(10) || event["expired"] != true {
+			t.Fatalf("member event: %v, want message %v", event, want)
+		}
+	}
+	if event := readTestEvent(t, outsider); event["id"] != float64(2) || event["chat_id"] != float64(20) {
+		t.Fatalf("other chat event: %v", event)
+	}
+}
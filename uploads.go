@@ -0,0 +1,680 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Возобновляемая загрузка файлов по протоколу tus 1.0.0 (расширения creation, termination, checksum, expiration):
+//
+//	POST   /uploads?user_id=       — создание загрузки (Upload-Length, Upload-Metadata: filename, sha256, message_id, kind)
+//	HEAD   /uploads/{id}?user_id=  — текущее смещение
+//	PATCH  /uploads/{id}?user_id=  — очередная часть с Upload-Offset (и Upload-Checksum)
+//	DELETE /uploads/{id}?user_id=  — отмена загрузки
+//	GET    /uploads/{id}?user_id=  — состояние загрузки в JSON
+//
+// После получения последнего байта файл проверяется и переносится в хранилище
+const (
+	tusVersion          = "1.0.0"
+	uploadExpiry        = 24 * time.Hour   // Время жизни незавершённой загрузки с момента последней активности
+	uploadCleanupPeriod = 10 * time.Minute // Период удаления брошенных загрузок
+	maxActiveUploads    = 20               // Незавершённых загрузок на пользователя
+)
+
+// Ограничения загрузок, настраиваются переменными окружения
+var (
+	uploadMaxFileSize    = envInt64("UPLOAD_MAX_FILE_SIZE", 2<<30)     // Максимальный размер одного файла
+	uploadUserDailyQuota = envInt64("UPLOAD_USER_DAILY_QUOTA", 10<<30) // Объём загрузок пользователя за сутки
+)
+
+// Блокировки загрузок: одновременно принимается только одна часть файла
+var uploadLocks sync.Map
+
+// Числовая настройка из переменной окружения
+func envInt64(name string, def int64) int64 {
+	if value, err := strconv.ParseInt(os.Getenv(name), 10, 64); err == nil && value > 0 {
+		return value
+	}
+	return def
+}
+
+// Каталог для частично загруженных файлов
+func uploadDir() string {
+	if dir := os.Getenv("UPLOAD_DIR"); dir != "" {
+		return dir
+	}
+	return filepath.Join("data", "uploads")
+}
+
+func uploadPartPath(id string) string {
+	return filepath.Join(uploadDir(), id+".part")
+}
+
+// Случайный идентификатор загрузки
+func newUploadID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Разбор заголовка Upload-Metadata: "ключ base64,ключ base64"
+func parseUploadMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+	for _, pair := range strings.Split(header, ",") {
+		parts := strings.Fields(pair)
+		if len(parts) == 0 || len(parts) > 2 {
+			return nil, fmt.Errorf("некорректная пара метаданных: %q", pair)
+		}
+		value := ""
+		if len(parts) == 2 {
+			decoded, err := base64.StdEncoding.DecodeString(parts[1])
+			if err != nil {
+				return nil, err
+			}
+			value = string(decoded)
+		}
+		metadata[parts[0]] = value
+	}
+	return metadata, nil
+}
+
+// Общие заголовки tus и ответ на запрос возможностей сервера (OPTIONS)
+func withTusHeaders(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Method == "OPTIONS" {
+			w.Header().Set("Tus-Version", tusVersion)
+			w.Header().Set("Tus-Extension", "creation,termination,checksum,expiration")
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(uploadMaxFileSize, 10))
+			w.Header().Set("Tus-Checksum-Algorithm", "sha1,sha256")
+		} else if v := r.Header.Get("Tus-Resumable"); v != "" && v != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			http.Error(w, "Unsupported tus version", http.StatusPreconditionFailed)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Загрузка в БД
+type fileUpload struct {
+	ID        string
+	UserID    int
+	Kind      string // file или voice
+	FileName  string
+	Length    int64
+	Offset    int64
+	SHA256    string        // Ожидаемая контрольная сумма всего файла (необязательно)
+	MessageID sql.NullInt64 // Сообщение, к которому файл прикрепляется после загрузки
+	Status    string        // uploading, completed (ожидает отправки), attached
+	BlobKey   sql.NullString
+	MimeType  sql.NullString
+	ExpiresAt time.Time
+}
+
+func loadUpload(db queryRower, id string, userID int) (*fileUpload, error) {
+	var u fileUpload
+	err := db.QueryRow(`
+        SELECT id, user_id, kind, file_name, length, upload_offset, COALESCE(sha256, ''), message_id, status, blob_key, mime_type, expires_at
+        FROM uploads WHERE id = $1 AND user_id = $2`, id, userID,
+	).Scan(&u.ID, &u.UserID, &u.Kind, &u.FileName, &u.Length, &u.Offset, &u.SHA256, &u.MessageID, &u.Status, &u.BlobKey, &u.MimeType, &u.ExpiresAt)
+	if err != nil {
+		return nil, err
+	}
+	return &u, nil
+}
+
+// uploadsHandler — создание загрузки (POST /uploads)
+func uploadsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user_id", http.StatusBadRequest)
+		return
+	}
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Invalid Upload-Length", http.StatusBadRequest)
+		return
+	}
+	if length > uploadMaxFileSize {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	metadata, err := parseUploadMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		http.Error(w, "Invalid Upload-Metadata", http.StatusBadRequest)
+		return
+	}
+	fileName := clientFileName(metadata["filename"])
+	kind, ok := parseAttachmentKind(metadata["kind"])
+	if !ok {
+		http.Error(w, "Invalid kind metadata", http.StatusBadRequest)
+		return
+	}
+	if kind == attachmentKindVoice && length > maxVoiceSize {
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	expectedSHA := strings.ToLower(metadata["sha256"])
+	if expectedSHA != "" {
+		if decoded, err := hex.DecodeString(expectedSHA); err != nil || len(decoded) != sha256.Size {
+			http.Error(w, "Invalid sha256 metadata", http.StatusBadRequest)
+			return
+		}
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	// Файл можно сразу привязать к своему сообщению, как в /uploadFile
+	var messageID sql.NullInt64
+	if value := metadata["message_id"]; value != "" {
+		id, err := strconv.Atoi(value)
+		if err != nil {
+			http.Error(w, "Invalid message_id metadata", http.StatusBadRequest)
+			return
+		}
+		var own bool
+		err = db.QueryRow("SELECT EXISTS (SELECT 1 FROM messages WHERE id = $1 AND user_id = $2 AND NOT is_deleted)", id, userID).Scan(&own)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if !own {
+			http.Error(w, "Message not found", http.StatusNotFound)
+			return
+		}
+		messageID = sql.NullInt64{Int64: int64(id), Valid: true}
+	}
+
+	if err := checkUploadQuota(db, userID, length); err != nil {
+		writeUploadError(w, err)
+		return
+	}
+
+	id, err := newUploadID()
+	if err != nil {
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	if err := os.MkdirAll(uploadDir(), 0o755); err != nil {
+		log.Printf("Ошибка создания каталога загрузок: %v", err)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	part, err := os.OpenFile(uploadPartPath(id), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("Ошибка создания файла загрузки: %v", err)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+	part.Close()
+
+	var expiresAt time.Time
+	err = db.QueryRow(`
+        INSERT INTO uploads (id, user_id, kind, file_name, length, sha256, message_id, expires_at)
+        VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), $7, CURRENT_TIMESTAMP + $8 * INTERVAL '1 second')
+        RETURNING expires_at`,
+		id, userID, kind, fileName, length, expectedSHA, messageID, int(uploadExpiry.Seconds()),
+	).Scan(&expiresAt)
+	if err != nil {
+		os.Remove(uploadPartPath(id))
+		log.Printf("Ошибка сохранения загрузки: %v", err)
+		http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+		return
+	}
+
+	// Пустой файл завершается сразу
+	if length == 0 {
+		if _, err := completeUpload(db, &fileUpload{ID: id, UserID: userID, Kind: kind, FileName: fileName, SHA256: expectedSHA, MessageID: messageID}); err != nil {
+			writeUploadError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Location", fmt.Sprintf("/uploads/%s?user_id=%d", id, userID))
+	w.Header().Set("Upload-Expires", expiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// uploadHandler — работа с существующей загрузкой (/uploads/{id})
+func uploadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "OPTIONS" {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, "/uploads/")
+	if id == "" || strings.Contains(id, "/") {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+	if err != nil {
+		http.Error(w, "Invalid user_id", http.StatusBadRequest)
+		return
+	}
+
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	upload, err := loadUpload(db, id, userID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if upload.Status == "uploading" && upload.ExpiresAt.Before(time.Now()) {
+		http.Error(w, "Upload expired", http.StatusGone)
+		return
+	}
+
+	switch r.Method {
+	case "HEAD":
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		if upload.Status == "uploading" {
+			w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+		}
+		w.WriteHeader(http.StatusOK)
+
+	case "GET":
+		response := map[string]interface{}{
+			"id":        upload.ID,
+			"kind":      upload.Kind,
+			"file_name": upload.FileName,
+			"length":    upload.Length,
+			"offset":    upload.Offset,
+			"status":    upload.Status,
+		}
+		if upload.Status != "attached" {
+			response["expires_at"] = upload.ExpiresAt
+		}
+		if upload.MimeType.Valid {
+			response["mime_type"] = upload.MimeType.String
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(response)
+
+	case "PATCH":
+		patchUpload(w, r, db, upload)
+
+	case "DELETE":
+		if upload.Status == "attached" {
+			http.Error(w, "Upload already sent", http.StatusConflict)
+			return
+		}
+		lock := uploadLock(upload.ID)
+		if !lock.TryLock() {
+			http.Error(w, "Upload is in progress", http.StatusLocked)
+			return
+		}
+		defer lock.Unlock()
+		if _, err := db.Exec("DELETE FROM uploads WHERE id = $1 AND status != 'attached'", upload.ID); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		os.Remove(uploadPartPath(upload.ID))
+		uploadLocks.Delete(upload.ID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func uploadLock(id string) *sync.Mutex {
+	lock, _ := uploadLocks.LoadOrStore(id, &sync.Mutex{})
+	return lock.(*sync.Mutex)
+}
+
+// Квоты пользователя: число незавершённых загрузок и суточный объём вместе с новым файлом.
+// Проверяются и для загрузок по протоколу, и для вложений, загруженных одним запросом
+func checkUploadQuota(db queryRower, userID int, length int64) error {
+	var (
+		active    int
+		dailySize int64
+	)
+	err := db.QueryRow(`
+        SELECT COUNT(*) FILTER (WHERE status = 'uploading'),
+               COALESCE(SUM(length) FILTER (WHERE created_at > CURRENT_TIMESTAMP - INTERVAL '1 day'), 0)
+        FROM uploads WHERE user_id = $1`, userID).Scan(&active, &dailySize)
+	if err != nil {
+		return err
+	}
+	if active >= maxActiveUploads {
+		return errTooManyUploads
+	}
+	if dailySize+length > uploadUserDailyQuota {
+		return errUploadQuotaExceeded
+	}
+	return nil
+}
+
+// Ошибки проверки контрольной суммы (код 460 из расширения checksum) и квот
+var (
+	errUploadChecksum      = errors.New("checksum mismatch")
+	errUploadTooLarge      = errors.New("upload exceeds declared length")
+	errTooManyUploads      = errors.New("too many unfinished uploads")
+	errUploadQuotaExceeded = errors.New("upload quota exceeded")
+)
+
+const statusChecksumMismatch = 460
+
+func writeUploadError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUploadChecksum):
+		http.Error(w, "Checksum mismatch", statusChecksumMismatch)
+	case errors.Is(err, errUploadTooLarge), errors.Is(err, errBlobTooLarge):
+		http.Error(w, "File too large", http.StatusRequestEntityTooLarge)
+	case errors.Is(err, errInvalidVoice):
+		http.Error(w, "Voice message must be Opus/OGG or M4A audio", http.StatusUnsupportedMediaType)
+	case errors.Is(err, errTooManyUploads):
+		http.Error(w, "Too many unfinished uploads", http.StatusTooManyRequests)
+	case errors.Is(err, errUploadQuotaExceeded):
+		http.Error(w, "Upload quota exceeded", http.StatusRequestEntityTooLarge)
+	default:
+		log.Printf("Ошибка загрузки: %v", err)
+		http.Error(w, "Upload failed", http.StatusInternalServerError)
+	}
+}
+
+// Хеш для заголовка Upload-Checksum
+func uploadChecksumHash(header string) (hash.Hash, []byte, error) {
+	parts := strings.Fields(header)
+	if len(parts) != 2 {
+		return nil, nil, errors.New("некорректный Upload-Checksum")
+	}
+	expected, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, err
+	}
+	switch parts[0] {
+	case "sha1":
+		return sha1.New(), expected, nil
+	case "sha256":
+		return sha256.New(), expected, nil
+	}
+	return nil, nil, errors.New("неподдерживаемый алгоритм контрольной суммы")
+}
+
+// Приём очередной части файла
+func patchUpload(w http.ResponseWriter, r *http.Request, db *sql.DB, upload *fileUpload) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Invalid Content-Type", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid Upload-Offset", http.StatusBadRequest)
+		return
+	}
+
+	var (
+		checksum hash.Hash
+		expected []byte
+	)
+	if header := r.Header.Get("Upload-Checksum"); header != "" {
+		if checksum, expected, err = uploadChecksumHash(header); err != nil {
+			http.Error(w, "Invalid Upload-Checksum", http.StatusBadRequest)
+			return
+		}
+	}
+
+	lock := uploadLock(upload.ID)
+	if !lock.TryLock() {
+		http.Error(w, "Upload is in progress", http.StatusLocked)
+		return
+	}
+	defer lock.Unlock()
+
+	// Смещение перечитывается под блокировкой
+	current, err := loadUpload(db, upload.ID, upload.UserID)
+	if err != nil {
+		http.Error(w, "Upload not found", http.StatusNotFound)
+		return
+	}
+	if current.Status != "uploading" || offset != current.Offset {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(current.Offset, 10))
+		http.Error(w, "Upload-Offset mismatch", http.StatusConflict)
+		return
+	}
+
+	part, err := os.OpenFile(uploadPartPath(current.ID), os.O_WRONLY, 0o644)
+	if err != nil {
+		log.Printf("Ошибка открытия файла загрузки %s: %v", current.ID, err)
+		http.Error(w, "Upload data lost", http.StatusGone)
+		return
+	}
+	defer part.Close()
+	if _, err := part.Seek(offset, io.SeekStart); err != nil {
+		http.Error(w, "Upload failed", http.StatusInternalServerError)
+		return
+	}
+
+	// Принимается не больше объявленного размера; при обрыве сохраняется то, что дошло
+	remaining := current.Length - offset
+	var dst io.Writer = part
+	if checksum != nil {
+		dst = io.MultiWriter(part, checksum)
+	}
+	written, copyErr := io.Copy(dst, io.LimitReader(r.Body, remaining+1))
+	if written > remaining {
+		part.Truncate(offset)
+		writeUploadError(w, errUploadTooLarge)
+		return
+	}
+	if checksum != nil {
+		// Часть с неверной контрольной суммой отбрасывается целиком
+		if copyErr != nil || string(checksum.Sum(nil)) != string(expected) {
+			part.Truncate(offset)
+			if copyErr != nil {
+				http.Error(w, "Upload interrupted", http.StatusBadRequest)
+				return
+			}
+			writeUploadError(w, errUploadChecksum)
+			return
+		}
+	}
+	if err := part.Sync(); err != nil {
+		http.Error(w, "Upload failed", http.StatusInternalServerError)
+		return
+	}
+
+	newOffset := offset + written
+	var expiresAt time.Time
+	err = db.QueryRow(`
+        UPDATE uploads
+        SET upload_offset = $2, updated_at = CURRENT_TIMESTAMP,
+            expires_at = CURRENT_TIMESTAMP + $3 * INTERVAL '1 second'
+        WHERE id = $1
+        RETURNING expires_at`, current.ID, newOffset, int(uploadExpiry.Seconds())).Scan(&expiresAt)
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	if copyErr != nil {
+		log.Printf("Загрузка %s прервана на %d байтах: %v", current.ID, newOffset, copyErr)
+		return
+	}
+
+	if newOffset == current.Length {
+		current.Offset = newOffset
+		if _, err := completeUpload(db, current); err != nil {
+			writeUploadError(w, err)
+			return
+		}
+	} else {
+		w.Header().Set("Upload-Expires", expiresAt.UTC().Format(http.TimeFormat))
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Завершение загрузки: проверка контрольной суммы и перенос файла в хранилище
+func completeUpload(db *sql.DB, upload *fileUpload) (blobInfo, error) {
+	part, err := os.Open(uploadPartPath(upload.ID))
+	if err != nil {
+		return blobInfo{}, err
+	}
+	defer part.Close()
+
+	blob, err := storeBlob(db, part, uploadMaxFileSize, upload.FileName)
+	if err != nil {
+		return blobInfo{}, err
+	}
+	// Ключ хранилища — SHA-256 содержимого, поэтому ожидаемая сумма сравнивается с ним
+	if upload.SHA256 != "" && !strings.HasSuffix(blob.Key, "/"+upload.SHA256) {
+		// Файл повреждён: загрузку нужно начать заново
+		db.Exec("DELETE FROM uploads WHERE id = $1", upload.ID)
+		os.Remove(uploadPartPath(upload.ID))
+		return blobInfo{}, errUploadChecksum
+	}
+	if upload.Kind == attachmentKindVoice {
+		blob, err = processVoiceAttachment(db, blob)
+		if errors.Is(err, errInvalidVoice) {
+			db.Exec("DELETE FROM uploads WHERE id = $1", upload.ID)
+			os.Remove(uploadPartPath(upload.ID))
+		}
+	} else {
+		blob, err = processImageAttachment(db, blob, upload.FileName)
+	}
+	if err != nil {
+		return blobInfo{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return blobInfo{}, err
+	}
+	defer tx.Rollback()
+	// Файл без сообщения ждёт отправки как вложение до истечения срока
+	_, err = tx.Exec(`
+        UPDATE uploads
+        SET status = CASE WHEN message_id IS NULL THEN 'completed' ELSE 'attached' END,
+            blob_key = $2, mime_type = $3, completed_at = CURRENT_TIMESTAMP,
+            expires_at = CURRENT_TIMESTAMP + $4 * INTERVAL '1 second'
+        WHERE id = $1`, upload.ID, blob.Key, blob.MimeType, int(uploadExpiry.Seconds()))
+	if err != nil {
+		return blobInfo{}, err
+	}
+	if upload.MessageID.Valid {
+		_, err = tx.Exec(
+			"INSERT INTO message_files (message_id, kind, file_name, blob_key, file_size, mime_type) VALUES ($1, $2, $3, $4, $5, $6)",
+			upload.MessageID.Int64, upload.Kind, upload.FileName, blob.Key, blob.Size, blob.MimeType,
+		)
+		if err != nil {
+			return blobInfo{}, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return blobInfo{}, err
+	}
+	os.Remove(uploadPartPath(upload.ID))
+	uploadLocks.Delete(upload.ID)
+	log.Printf("Загрузка %s завершена: %s (%d байт)", upload.ID, upload.FileName, blob.Size)
+	return blob, nil
+}
+
+// Вложение, загруженное одним запросом (/uploadFile без message_id), в ожидании отправки
+func createPendingAttachment(db *sql.DB, userID int, kind, fileName string, blob blobInfo) (string, time.Time, error) {
+	id, err := newUploadID()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	var expiresAt time.Time
+	err = db.QueryRow(`
+        INSERT INTO uploads (id, user_id, kind, file_name, length, upload_offset, status, blob_key, mime_type, completed_at, expires_at)
+        VALUES ($1, $2, $3, $4, $5, $5, 'completed', $6, $7, CURRENT_TIMESTAMP, CURRENT_TIMESTAMP + $8 * INTERVAL '1 second')
+        RETURNING expires_at`,
+		id, userID, kind, fileName, blob.Size, blob.Key, blob.MimeType, int(uploadExpiry.Seconds()),
+	).Scan(&expiresAt)
+	return id, expiresAt, err
+}
+
+// Фоновое удаление брошенных загрузок: незавершённых и так и не отправленных вложений
+func startUploadCleaner() {
+	go func() {
+		ticker := time.NewTicker(uploadCleanupPeriod)
+		defer ticker.Stop()
+		for range ticker.C {
+			cleanupExpiredUploads()
+		}
+	}()
+}
+
+func cleanupExpiredUploads() {
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("Загрузки: ошибка подключения к БД: %v", err)
+		return
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`
+        DELETE FROM uploads
+        WHERE status IN ('uploading', 'completed') AND expires_at <= CURRENT_TIMESTAMP
+        RETURNING id`)
+	if err != nil {
+		log.Printf("Загрузки: ошибка удаления брошенных загрузок: %v", err)
+		return
+	}
+	removed := 0
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			continue
+		}
+		os.Remove(uploadPartPath(id))
+		uploadLocks.Delete(id)
+		removed++
+	}
+	rows.Close()
+	if removed > 0 {
+		log.Printf("Загрузки: удалено брошенных загрузок: %d", removed)
+	}
+}
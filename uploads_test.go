@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseUploadMetadata(t *testing.T) {
+	header := "filename " + base64.StdEncoding.EncodeToString([]byte("отчёт.pdf")) + ",kind dm9pY2U=, is_draft"
+	got, err := parseUploadMetadata(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"filename": "отчёт.pdf", "kind": "voice", "is_draft": ""}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("parseUploadMetadata = %v, want %v", got, want)
+	}
+	for _, bad := range []string{"filename !!!", "a b c", "a,,b"} {
+		if _, err := parseUploadMetadata(bad); err == nil {
+			t.Errorf("parseUploadMetadata(%q) accepted", bad)
+		}
+	}
+}
+
+func TestUploadChecksumHash(t *testing.T) {
+	if h, expected, err := uploadChecksumHash("sha256 " + base64.StdEncoding.EncodeToString([]byte{1, 2})); err != nil || h.Size() != sha256.Size || len(expected) != 2 {
+		t.Fatalf("sha256 checksum: %v", err)
+	}
+	if h, _, err := uploadChecksumHash("sha1 AAAA"); err != nil || h.Size() != 20 {
+		t.Fatalf("sha1 checksum: %v", err)
+	}
+	for _, bad := range []string{"md5 AAAA", "sha256", "sha256 !!!"} {
+		if _, _, err := uploadChecksumHash(bad); err == nil {
+			t.Errorf("uploadChecksumHash(%q) accepted", bad)
+		}
+	}
+}
+
+func TestWithTusHeaders(t *testing.T) {
+	called := false
+	handler := withTusHeaders(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("OPTIONS", "/uploads", nil))
+	if rec.Header().Get("Tus-Extension") == "" || rec.Header().Get("Tus-Version") != tusVersion {
+		t.Fatalf("OPTIONS headers: %v", rec.Header())
+	}
+
+	called = false
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("HEAD", "/uploads/x", nil)
+	req.Header.Set("Tus-Resumable", "0.2.2")
+	handler(rec, req)
+	if rec.Code != http.StatusPreconditionFailed || called {
+		t.Fatalf("unsupported version: status %d, handler called %v", rec.Code, called)
+	}
+}
+
+func TestCheckUploadQuota(t *testing.T) {
+	cases := []struct {
+		active    int64
+		dailySize int64
+		length    int64
+		want      error
+	}{
+		{0, 0, 1 << 20, nil},
+		{maxActiveUploads, 0, 1, errTooManyUploads},
+		{0, uploadUserDailyQuota - 10, 10, nil},
+		{0, uploadUserDailyQuota - 10, 11, errUploadQuotaExceeded},
+	}
+	for _, c := range cases {
+		db, fake := newFakeDB(t)
+		fake.on("FROM uploads WHERE user_id = $1", func([]driver.Value) fakeResult {
+			return fakeRow(c.active, c.dailySize)
+		})
+		if err := checkUploadQuota(db, 1, c.length); !errors.Is(err, c.want) {
+			t.Errorf("active %d, daily %d, new %d: %v, want %v", c.active, c.dailySize, c.length, err, c.want)
+		}
+	}
+}
+
+// Загрузка по частям: неверное смещение и неверная контрольная сумма части не меняют состояние,
+// последняя часть переносит файл в хранилище
+func TestPatchUpload(t *testing.T) {
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	store, err := newLocalBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := blobStorage
+	blobStorage = store
+	t.Cleanup(func() { blobStorage = previous })
+
+	content := []byte("первая часть|вторая часть")
+	sum := sha256.Sum256(content)
+	upload := &fileUpload{ID: "abc", UserID: 1, Kind: attachmentKindFile, FileName: "notes.txt",
+		Length: int64(len(content)), SHA256: hex.EncodeToString(sum[:]), Status: "uploading"}
+	if err := os.MkdirAll(uploadDir(), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(uploadPartPath(upload.ID), nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	db, fake := newFakeDB(t)
+	fake.on("FROM uploads WHERE id = $1 AND user_id = $2", func([]driver.Value) fakeResult {
+		return fakeRow(upload.ID, int64(upload.UserID), upload.Kind, upload.FileName, upload.Length, upload.Offset,
+			upload.SHA256, nil, upload.Status, nil, nil, time.Now().Add(uploadExpiry))
+	})
+	fake.on("SET upload_offset = $2", func(args []driver.Value) fakeResult {
+		upload.Offset = args[1].(int64)
+		return fakeRow(time.Now().Add(uploadExpiry))
+	})
+	fake.on("SET status = CASE", func([]driver.Value) fakeResult {
+		upload.Status = "completed"
+		return fakeResult{affected: 1}
+	})
+
+	patch := func(offset int, chunk []byte, checksum string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PATCH", "/uploads/abc", strings.NewReader(string(chunk)))
+		req.Header.Set("Content-Type", "application/offset+octet-stream")
+		req.Header.Set("Upload-Offset", strconv.Itoa(offset))
+		if checksum != "" {
+			req.Header.Set("Upload-Checksum", checksum)
+		}
+		rec := httptest.NewRecorder()
+		patchUpload(rec, req, db, upload)
+		return rec
+	}
+	split := len("первая часть|")
+
+	if rec := patch(5, content[:split], ""); rec.Code != http.StatusConflict || rec.Header().Get("Upload-Offset") != "0" {
+		t.Fatalf("wrong offset: %d, Upload-Offset %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	badSum := "sha256 " + base64.StdEncoding.EncodeToString(make([]byte, sha256.Size))
+	if rec := patch(0, content[:split], badSum); rec.Code != statusChecksumMismatch || upload.Offset != 0 {
+		t.Fatalf("bad checksum: %d, offset %d", rec.Code, upload.Offset)
+	}
+	if info, err := os.Stat(uploadPartPath(upload.ID)); err != nil || info.Size() != 0 {
+		t.Fatalf("rejected part kept on disk: %v", err)
+	}
+
+	partSum := sha256.Sum256(content[:split])
+	rec := patch(0, content[:split], "sha256 "+base64.StdEncoding.EncodeToString(partSum[:]))
+	if rec.Code != http.StatusNoContent || rec.Header().Get("Upload-Offset") != strconv.Itoa(split) || rec.Header().Get("Upload-Expires") == "" {
+		t.Fatalf("first part: %d, headers %v", rec.Code, rec.Header())
+	}
+	if rec := patch(split, append(content[split:], 'x'), ""); rec.Code != http.StatusRequestEntityTooLarge || upload.Offset != int64(split) {
+		t.Fatalf("part beyond the declared length: %d, offset %d", rec.Code, upload.Offset)
+	}
+	if rec := patch(split, content[split:], ""); rec.Code != http.StatusNoContent || upload.Status != "completed" {
+		t.Fatalf("last part: %d, status %s", rec.Code, upload.Status)
+	}
+
+	stored, err := blobStorage.Exists(blobKeyForHash(sum[:]))
+	if err != nil || !stored {
+		t.Fatalf("completed file not in storage: %v", err)
+	}
+	if _, err := os.Stat(uploadPartPath(upload.ID)); !os.IsNotExist(err) {
+		t.Fatal("part file left after completion")
+	}
+}
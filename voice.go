@@ -0,0 +1,522 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"math"
+
+	"github.com/gorilla/websocket"
+	"github.com/lib/pq"
+)
+
+// Голосовые сообщения: вложение вида voice в формате Opus/OGG или M4A.
+// Длительность и волна громкости вычисляются на сервере при загрузке
+const (
+	attachmentKindFile  = "file"
+	attachmentKindVoice = "voice"
+
+	maxVoiceSize          = 20 << 20                   // Максимальный размер голосового сообщения
+	maxVoiceDurationMs    = 30 * 60 * 1000             // Максимальная длительность — 30 минут
+	maxVoiceFrames        = maxVoiceDurationMs * 2 / 5 // Кадров по 2,5 мс (минимум Opus) в самой длинной записи
+	voiceWaveformSamples  = 64                         // Число столбцов волны
+	voiceWaveformMaxLevel = 31                         // Значения волны 0..31
+)
+
+var errInvalidVoice = errors.New("unsupported voice message format")
+
+// Метаданные голосового сообщения
+type voiceMetadata struct {
+	DurationMs int
+	Waveform   []byte
+	MimeType   string
+}
+
+// Фрагмент аудиопотока: время начала и длительность в миллисекундах, размер в байтах
+type voiceFrame struct {
+	start    float64
+	duration float64
+	size     int
+}
+
+// Вид вложения из параметра запроса (по умолчанию обычный файл)
+func parseAttachmentKind(kind string) (string, bool) {
+	switch kind {
+	case "", attachmentKindFile:
+		return attachmentKindFile, true
+	case attachmentKindVoice:
+		return attachmentKindVoice, true
+	default:
+		return "", false
+	}
+}
+
+// Проверка голосового сообщения и сохранение его длительности и волны в записи блоба
+func processVoiceAttachment(db dbExecutor, blob blobInfo) (blobInfo, error) {
+	if blob.Size > maxVoiceSize {
+		return blob, errInvalidVoice
+	}
+	object, err := blobStorage.Open(blob.Key)
+	if err != nil {
+		return blob, err
+	}
+	data, err := io.ReadAll(object)
+	object.Close()
+	if err != nil {
+		return blob, err
+	}
+
+	meta, err := analyzeVoice(data)
+	if err != nil {
+		return blob, err
+	}
+	_, err = db.Exec("UPDATE blobs SET mime_type = $2, duration_ms = $3, waveform = $4 WHERE key = $1",
+		blob.Key, meta.MimeType, meta.DurationMs, meta.Waveform)
+	if err != nil {
+		return blob, err
+	}
+	blob.MimeType = meta.MimeType
+	return blob, nil
+}
+
+// Определение формата по содержимому и извлечение метаданных
+func analyzeVoice(data []byte) (voiceMetadata, error) {
+	var (
+		meta voiceMetadata
+		err  error
+	)
+	switch {
+	case bytes.HasPrefix(data, []byte("OggS")):
+		meta, err = parseOggOpus(data)
+		meta.MimeType = "audio/ogg"
+	case len(data) >= 8 && string(data[4:8]) == "ftyp":
+		meta, err = parseM4A(data)
+		meta.MimeType = "audio/mp4"
+	default:
+		return voiceMetadata{}, errInvalidVoice
+	}
+	if err != nil {
+		return voiceMetadata{}, err
+	}
+	if meta.DurationMs <= 0 || meta.DurationMs > maxVoiceDurationMs {
+		return voiceMetadata{}, errInvalidVoice
+	}
+	return meta, nil
+}
+
+// Разбор Ogg-контейнера с потоком Opus. Длительность берётся из позиции последней страницы
+// с учётом pre-skip, волна строится по размерам пакетов: при переменном битрейте
+// громкие участки кодируются большим числом байт
+func parseOggOpus(data []byte) (voiceMetadata, error) {
+	var (
+		serial      uint32
+		started     bool
+		preSkip     int64
+		lastGranule int64 = -1
+		packetIndex int
+		packet      []byte
+		frames      []voiceFrame
+		position    float64
+	)
+	for pos := 0; pos < len(data); {
+		if pos+27 > len(data) || string(data[pos:pos+4]) != "OggS" {
+			return voiceMetadata{}, errInvalidVoice
+		}
+		granule := binary.LittleEndian.Uint64(data[pos+6:])
+		pageSerial := binary.LittleEndian.Uint32(data[pos+14:])
+		segments := int(data[pos+26])
+		headerEnd := pos + 27 + segments
+		if headerEnd > len(data) {
+			return voiceMetadata{}, errInvalidVoice
+		}
+		lacing := data[pos+27 : headerEnd]
+		bodyLen := 0
+		for _, l := range lacing {
+			bodyLen += int(l)
+		}
+		if headerEnd+bodyLen > len(data) {
+			return voiceMetadata{}, errInvalidVoice
+		}
+		if !started {
+			serial, started = pageSerial, true
+		}
+
+		// Другие логические потоки (если есть) пропускаются
+		if pageSerial == serial {
+			body := data[headerEnd : headerEnd+bodyLen]
+			offset := 0
+			for _, l := range lacing {
+				packet = append(packet, body[offset:offset+int(l)]...)
+				offset += int(l)
+				if l == 255 {
+					continue // Пакет продолжается в следующем сегменте
+				}
+				switch packetIndex {
+				case 0:
+					if len(packet) < 19 || !bytes.HasPrefix(packet, []byte("OpusHead")) {
+						return voiceMetadata{}, errInvalidVoice
+					}
+					preSkip = int64(binary.LittleEndian.Uint16(packet[10:]))
+				case 1:
+					// OpusTags — теги не используются
+				default:
+					// Пустые пакеты не занимают времени; число кадров ограничено длительностью записи
+					duration := opusPacketDuration(packet)
+					if duration > 0 {
+						if len(frames) >= maxVoiceFrames || position > maxVoiceDurationMs {
+							return voiceMetadata{}, errInvalidVoice
+						}
+						frames = append(frames, voiceFrame{start: position, duration: duration, size: len(packet)})
+						position += duration
+					}
+				}
+				packetIndex++
+				packet = packet[:0]
+			}
+			// Позиция -1 означает, что на странице не заканчивается ни один пакет
+			if granule != math.MaxUint64 && packetIndex > 2 {
+				lastGranule = int64(granule)
+			}
+		}
+		pos = headerEnd + bodyLen
+	}
+	if packetIndex < 2 {
+		return voiceMetadata{}, errInvalidVoice
+	}
+
+	// Позиция в Ogg Opus всегда считается в отсчётах 48 кГц
+	durationMs := int(position)
+	if lastGranule > preSkip {
+		durationMs = int((lastGranule - preSkip) / 48)
+	}
+	return voiceMetadata{DurationMs: durationMs, Waveform: buildWaveform(frames, position)}, nil
+}
+
+// Длительность пакета Opus в миллисекундах по байту TOC (RFC 6716, раздел 3.1)
+func opusPacketDuration(packet []byte) float64 {
+	if len(packet) == 0 {
+		return 0
+	}
+	config := int(packet[0] >> 3)
+	var frame float64
+	switch {
+	case config < 12: // SILK
+		frame = []float64{10, 20, 40, 60}[config%4]
+	case config < 16: // Hybrid
+		frame = []float64{10, 20}[config%2]
+	default: // CELT
+		frame = []float64{2.5, 5, 10, 20}[config%4]
+	}
+	count := 1
+	switch packet[0] & 3 {
+	case 1, 2:
+		count = 2
+	case 3:
+		if len(packet) < 2 {
+			return 0
+		}
+		count = int(packet[1] & 0x3F)
+	}
+	return frame * float64(count)
+}
+
+// Разбор MP4/M4A: длительность звуковой дорожки из mdhd, волна — по размерам отсчётов (stsz)
+// и их длительностям (stts)
+func parseM4A(data []byte) (voiceMetadata, error) {
+	moov, ok := findMP4Box(data, "moov")
+	if !ok {
+		return voiceMetadata{}, errInvalidVoice
+	}
+	var result *voiceMetadata
+	eachMP4Box(moov, func(boxType string, trak []byte) bool {
+		if boxType != "trak" {
+			return true
+		}
+		mdia, ok := findMP4Box(trak, "mdia")
+		if !ok {
+			return true
+		}
+		if hdlr, ok := findMP4Box(mdia, "hdlr"); !ok || len(hdlr) < 12 || string(hdlr[8:12]) != "soun" {
+			return true
+		}
+		mdhd, ok := findMP4Box(mdia, "mdhd")
+		if !ok {
+			return true
+		}
+		timescale, duration, ok := parseMP4MediaHeader(mdhd)
+		if !ok || timescale == 0 {
+			return true
+		}
+		meta := voiceMetadata{DurationMs: int(duration * 1000 / timescale)}
+		if stbl, ok := findMP4Box(mdia, "minf", "stbl"); ok {
+			frames := mp4SampleFrames(stbl, timescale, len(data))
+			if len(frames) > 0 {
+				last := frames[len(frames)-1]
+				meta.Waveform = buildWaveform(frames, last.start+last.duration)
+			}
+		}
+		if meta.Waveform == nil {
+			meta.Waveform = make([]byte, voiceWaveformSamples)
+		}
+		result = &meta
+		return false
+	})
+	if result == nil {
+		return voiceMetadata{}, errInvalidVoice
+	}
+	return *result, nil
+}
+
+// Перебор вложенных боксов MP4; fn возвращает false, чтобы остановить перебор
+func eachMP4Box(data []byte, fn func(boxType string, payload []byte) bool) {
+	for pos := 0; pos+8 <= len(data); {
+		size := uint64(binary.BigEndian.Uint32(data[pos:]))
+		boxType := string(data[pos+4 : pos+8])
+		header := uint64(8)
+		switch size {
+		case 0: // Бокс до конца данных
+			size = uint64(len(data) - pos)
+		case 1: // 64-битный размер
+			if pos+16 > len(data) {
+				return
+			}
+			size = binary.BigEndian.Uint64(data[pos+8:])
+			header = 16
+		}
+		if size < header || size > uint64(len(data)-pos) {
+			return
+		}
+		if !fn(boxType, data[pos+int(header):pos+int(size)]) {
+			return
+		}
+		pos += int(size)
+	}
+}
+
+// Поиск бокса по пути вложенности
+func findMP4Box(data []byte, path ...string) ([]byte, bool) {
+	for _, name := range path {
+		var (
+			found []byte
+			ok    bool
+		)
+		eachMP4Box(data, func(boxType string, payload []byte) bool {
+			if boxType == name {
+				found, ok = payload, true
+				return false
+			}
+			return true
+		})
+		if !ok {
+			return nil, false
+		}
+		data = found
+	}
+	return data, true
+}
+
+// Масштаб времени и длительность дорожки из mdhd (версии 0 и 1)
+func parseMP4MediaHeader(mdhd []byte) (timescale, duration uint64, ok bool) {
+	if len(mdhd) < 1 {
+		return 0, 0, false
+	}
+	if mdhd[0] == 1 {
+		if len(mdhd) < 32 {
+			return 0, 0, false
+		}
+		return uint64(binary.BigEndian.Uint32(mdhd[20:])), binary.BigEndian.Uint64(mdhd[24:]), true
+	}
+	if len(mdhd) < 20 {
+		return 0, 0, false
+	}
+	return uint64(binary.BigEndian.Uint32(mdhd[12:])), uint64(binary.BigEndian.Uint32(mdhd[16:])), true
+}
+
+// Отсчёты звуковой дорожки с размерами и временем начала. Число отсчётов из stsz не может
+// превышать размер файла (каждый отсчёт занимает хотя бы байт) и число кадров в самой длинной
+// записи: иначе заголовок в несколько байт заставил бы выделить память под миллиарды кадров
+func mp4SampleFrames(stbl []byte, timescale uint64, fileSize int) []voiceFrame {
+	stsz, ok := findMP4Box(stbl, "stsz")
+	if !ok || len(stsz) < 12 {
+		return nil
+	}
+	stts, ok := findMP4Box(stbl, "stts")
+	if !ok || len(stts) < 8 {
+		return nil
+	}
+	sampleSize := binary.BigEndian.Uint32(stsz[4:])
+	sampleCount := int(binary.BigEndian.Uint32(stsz[8:]))
+	if sampleCount > fileSize || sampleCount > maxVoiceFrames {
+		return nil
+	}
+	if sampleSize == 0 && len(stsz) < 12+sampleCount*4 {
+		return nil
+	}
+
+	frames := make([]voiceFrame, 0, sampleCount)
+	entries := int(binary.BigEndian.Uint32(stts[4:]))
+	var position float64
+	for e := 0; e < entries && len(frames) < sampleCount; e++ {
+		if 8+e*8+8 > len(stts) {
+			break
+		}
+		count := int(binary.BigEndian.Uint32(stts[8+e*8:]))
+		if count > sampleCount-len(frames) {
+			count = sampleCount - len(frames)
+		}
+		delta := float64(binary.BigEndian.Uint32(stts[12+e*8:])) * 1000 / float64(timescale)
+		for i := 0; i < count; i++ {
+			size := int(sampleSize)
+			if sampleSize == 0 {
+				size = int(binary.BigEndian.Uint32(stsz[12+len(frames)*4:]))
+			}
+			frames = append(frames, voiceFrame{start: position, duration: delta, size: size})
+			position += delta
+		}
+	}
+	return frames
+}
+
+// Волна громкости: средний битрейт на каждом из равных отрезков, нормированный к 0..31
+func buildWaveform(frames []voiceFrame, totalMs float64) []byte {
+	waveform := make([]byte, voiceWaveformSamples)
+	if len(frames) == 0 || totalMs <= 0 {
+		return waveform
+	}
+	var (
+		sizes     [voiceWaveformSamples]float64
+		durations [voiceWaveformSamples]float64
+	)
+	for _, f := range frames {
+		if f.duration <= 0 {
+			continue
+		}
+		i := int(f.start / totalMs * voiceWaveformSamples)
+		if i >= voiceWaveformSamples {
+			i = voiceWaveformSamples - 1
+		}
+		sizes[i] += float64(f.size)
+		durations[i] += f.duration
+	}
+
+	var levels [voiceWaveformSamples]float64
+	maxLevel := 0.0
+	for i := range levels {
+		if durations[i] > 0 {
+			levels[i] = sizes[i] / durations[i]
+			maxLevel = math.Max(maxLevel, levels[i])
+		}
+	}
+	if maxLevel == 0 {
+		return waveform
+	}
+	for i, level := range levels {
+		waveform[i] = byte(math.Round(level / maxLevel * voiceWaveformMaxLevel))
+	}
+	return waveform
+}
+
+// Значения волны для JSON (массив чисел, а не base64)
+func waveformValues(waveform []byte) []int {
+	if len(waveform) == 0 {
+		return nil
+	}
+	values := make([]int, len(waveform))
+	for i, v := range waveform {
+		values[i] = int(v)
+	}
+	return values
+}
+
+// Состояние прослушивания голосового сообщения
+type voiceListenState struct {
+	Listened   bool  // Текущий пользователь прослушал сообщение
+	ListenedBy []int // Кто прослушал (только для автора)
+}
+
+// Загрузка состояния прослушивания для голосовых сообщений из набора
+func loadVoiceListens(db *sql.DB, messageIDs []int, viewerID int) (map[int]voiceListenState, error) {
+	result := make(map[int]voiceListenState)
+	if len(messageIDs) == 0 {
+		return result, nil
+	}
+
+	// Автор видит список прослушавших, остальные — только свою отметку
+	rows, err := db.Query(`
+        SELECT m.id, m.user_id = $2,
+               COALESCE(array_agg(l.user_id ORDER BY l.listened_at) FILTER (WHERE l.user_id IS NOT NULL), '{}')
+        FROM messages m
+        LEFT JOIN voice_listens l ON l.message_id = m.id AND (m.user_id = $2 OR l.user_id = $2)
+        WHERE m.id = ANY($1) AND m.message_type = 'voice' AND NOT m.is_deleted
+        GROUP BY m.id`, pq.Array(intsToInt64(messageIDs)), viewerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			messageID int
+			isAuthor  bool
+			userIDs   pq.Int64Array
+		)
+		if err := rows.Scan(&messageID, &isAuthor, &userIDs); err != nil {
+			log.Printf("Ошибка чтения прослушиваний: %v", err)
+			continue
+		}
+		state := voiceListenState{}
+		if isAuthor {
+			state.ListenedBy = make([]int, len(userIDs))
+			for i, id := range userIDs {
+				state.ListenedBy[i] = int(id)
+			}
+		} else {
+			state.Listened = len(userIDs) > 0
+		}
+		result[messageID] = state
+	}
+	return result, rows.Err()
+}
+
+// WebSocket-команда mark_listened: получатель прослушал голосовое сообщение
+func handleMarkListenedCommand(conn *websocket.Conn, messageID, userID int) {
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("Ошибка подключения к БД: %v", err)
+		return
+	}
+	defer db.Close()
+
+	// Отметку ставят только участники чата, не являющиеся автором; повторная отметка игнорируется
+	var chatID int
+	err = db.QueryRow(`
+        INSERT INTO voice_listens (message_id, user_id)
+        SELECT m.id, $2
+        FROM messages m
+        JOIN participants p ON p.chat_id = m.chat_id AND p.user_id = $2
+        WHERE m.id = $1 AND m.message_type = 'voice' AND NOT m.is_deleted AND m.user_id != $2
+        ON CONFLICT (message_id, user_id) DO NOTHING
+        RETURNING (SELECT chat_id FROM messages WHERE id = $1)`, messageID, userID).Scan(&chatID)
+	if err == sql.ErrNoRows {
+		return
+	}
+	if err != nil {
+		log.Printf("Ошибка отметки прослушивания сообщения %d: %v", messageID, err)
+		return
+	}
+
+	participantIDs, err := getChatParticipantIDs(db, chatID)
+	if err != nil {
+		log.Printf("Ошибка получения участников чата %d: %v", chatID, err)
+		return
+	}
+	broadcastToUsers(participantIDs, map[string]interface{}{
+		"type":       "voice_listened",
+		"chat_id":    chatID,
+		"message_id": messageID,
+		"user_id":    userID,
+	})
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func mp4Box(boxType string, payload ...[]byte) []byte {
+	body := bytes.Join(payload, nil)
+	box := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(box, uint32(8+len(body)))
+	copy(box[4:], boxType)
+	return append(box, body...)
+}
+
+func be32(values ...uint32) []byte {
+	out := make([]byte, 4*len(values))
+	for i, v := range values {
+		binary.BigEndian.PutUint32(out[i*4:], v)
+	}
+	return out
+}
+
+// M4A с одной звуковой дорожкой: timescale 1000, заданные stsz и stts
+func buildTestM4A(durationMs uint32, stsz, stts []byte) []byte {
+	hdlr := mp4Box("hdlr", be32(0, 0), []byte("soun"), make([]byte, 12))
+	mdhd := mp4Box("mdhd", be32(0, 0, 0, 1000, durationMs, 0))
+	stbl := mp4Box("stbl", mp4Box("stsz", stsz), mp4Box("stts", stts))
+	mdia := mp4Box("mdia", hdlr, mdhd, mp4Box("minf", stbl))
+	return append(mp4Box("ftyp", []byte("M4A "), be32(0)), mp4Box("moov", mp4Box("trak", mdia))...)
+}
+
+func oggPage(granule uint64, packets ...[]byte) []byte {
+	var lacing, body []byte
+	for _, p := range packets {
+		n := len(p)
+		for ; n >= 255; n -= 255 {
+			lacing = append(lacing, 255)
+		}
+		lacing = append(lacing, byte(n))
+		body = append(body, p...)
+	}
+	header := make([]byte, 27)
+	copy(header, "OggS")
+	binary.LittleEndian.PutUint64(header[6:], granule)
+	binary.LittleEndian.PutUint32(header[14:], 1)
+	header[26] = byte(len(lacing))
+	return append(append(header, lacing...), body...)
+}
+
+func buildTestOgg(packets int) []byte {
+	head := append([]byte("OpusHead"), 1, 1, 0, 0, 0x80, 0xBB, 0, 0, 0, 0, 0)
+	data := append(oggPage(0, head), oggPage(0, []byte("OpusTags"))...)
+	for i := 0; i < packets; i++ {
+		// TOC 0x08: SILK, 20 мс, один кадр
+		data = append(data, oggPage(uint64(i+1)*960, append([]byte{0x08}, make([]byte, 10+i%30)...))...)
+	}
+	return data
+}
+
+func TestAnalyzeVoiceM4A(t *testing.T) {
+	data := buildTestM4A(2000, be32(0, 100, 100), be32(0, 1, 100, 20))
+	stbl, _ := findMP4Box(data, "moov", "trak", "mdia", "minf", "stbl")
+	if frames := mp4SampleFrames(stbl, 1000, len(data)); len(frames) != 100 {
+		t.Fatalf("got %d frames, want 100", len(frames))
+	}
+	meta, err := analyzeVoice(data)
+	if err != nil {
+		t.Fatalf("analyzeVoice: %v", err)
+	}
+	if meta.MimeType != "audio/mp4" || meta.DurationMs != 2000 || len(meta.Waveform) != voiceWaveformSamples {
+		t.Fatalf("unexpected metadata: %+v", meta)
+	}
+}
+
+func TestAnalyzeVoiceOgg(t *testing.T) {
+	meta, err := analyzeVoice(buildTestOgg(50))
+	if err != nil {
+		t.Fatalf("analyzeVoice: %v", err)
+	}
+	if meta.MimeType != "audio/ogg" || meta.DurationMs != 1000 || len(meta.Waveform) != voiceWaveformSamples {
+		t.Fatalf("unexpected metadata: %+v", meta)
+	}
+}
+
+// Заявленные в заголовке 4 млрд отсчётов не должны приводить к выделению памяти под них
+func TestMP4SampleFramesHugeCount(t *testing.T) {
+	cases := map[string][]byte{
+		"fixed size":    buildTestM4A(1000, be32(0, 1, 0xFFFFFFFF), be32(0, 1, 0xFFFFFFFF, 1)),
+		"fixed huge":    buildTestM4A(1000, be32(0, 1, maxVoiceFrames+1), be32(0, 1, maxVoiceFrames+1, 1)),
+		"variable size": buildTestM4A(1000, be32(0, 0, 0x3FFFFFFF), be32(0, 1, 0xFFFFFFFF, 1)),
+	}
+	for name, data := range cases {
+		stbl, ok := findMP4Box(data, "moov", "trak", "mdia", "minf", "stbl")
+		if !ok {
+			t.Fatalf("%s: stbl not found", name)
+		}
+		if frames := mp4SampleFrames(stbl, 1000, len(data)); frames != nil {
+			t.Errorf("%s: got %d frames, want none", name, len(frames))
+		}
+		if _, err := analyzeVoice(data); err != nil {
+			t.Errorf("%s: analyzeVoice: %v", name, err)
+		}
+	}
+}
+
+// Огромное число элементов stts обрезается по числу отсчётов из stsz
+func TestMP4SampleFramesClampsTimeToSample(t *testing.T) {
+	data := buildTestM4A(1000, be32(0, 10, 50), be32(0, 2, 0xFFFFFFFF, 20, 0xFFFFFFFF, 20))
+	stbl, _ := findMP4Box(data, "moov", "trak", "mdia", "minf", "stbl")
+	if frames := mp4SampleFrames(stbl, 1000, len(data)); len(frames) != 50 {
+		t.Fatalf("got %d frames, want 50", len(frames))
+	}
+}
+
+func TestParseOggOpusTooLong(t *testing.T) {
+	if _, err := parseOggOpus(buildTestOgg(maxVoiceDurationMs/20 + 2)); err != errInvalidVoice {
+		t.Fatalf("got %v, want errInvalidVoice", err)
+	}
+}
+
+func FuzzParseM4A(f *testing.F) {
+	f.Add(buildTestM4A(2000, be32(0, 100, 100), be32(0, 1, 100, 20)))
+	f.Add(buildTestM4A(1000, be32(0, 0, 0xFFFFFFFF), be32(0, 1, 0xFFFFFFFF, 1)))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		meta, err := parseM4A(data)
+		if err == nil && len(meta.Waveform) != voiceWaveformSamples {
+			t.Fatalf("waveform has %d samples", len(meta.Waveform))
+		}
+	})
+}
+
+func FuzzParseOggOpus(f *testing.F) {
+	f.Add(buildTestOgg(5))
+	f.Add(oggPage(0, []byte("OpusHead")))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		meta, err := parseOggOpus(data)
+		if err == nil && len(meta.Waveform) != voiceWaveformSamples {
+			t.Fatalf("waveform has %d samples", len(meta.Waveform))
+		}
+	})
+}
@@ -0,0 +1,758 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	mathrand "math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Исходящие вебхуки: события чатов ставятся в очередь доставки в БД, фоновый обработчик
+// отправляет их подписчикам JSON-запросом с подписью HMAC-SHA256 и повторяет неудачные
+// попытки с экспоненциальной задержкой; исчерпавшие попытки доставки помечаются как dead
+const (
+	webhookEventMessageCreated = "message.created"
+	webhookEventMessageEdited  = "message.edited"
+	webhookEventMessageDeleted = "message.deleted"
+	webhookEventReactionAdded  = "reaction.added"
+	webhookEventMemberJoined   = "member.joined"
+
+	webhookTimeout        = 10 * time.Second
+	webhookPollInterval   = 5 * time.Second
+	webhookBatchSize      = 20
+	webhookMaxAttempts    = 8                // После стольких неудач доставка попадает в dead-letter
+	webhookBaseRetryDelay = 10 * time.Second // Задержка перед второй попыткой, дальше удваивается
+	webhookMaxRetryDelay  = time.Hour
+	webhookLease          = time.Minute // Доставка, взятая в работу, не выбирается повторно до истечения срока
+	webhookRetention      = 7 * 24 * time.Hour
+	webhookMaxResponse    = 1024 // Сколько байт ответа подписчика сохраняется для диагностики
+	maxChatWebhooks       = 10
+	maxServerWebhooks     = 20
+	maxDeliveriesListed   = 100
+)
+
+var webhookEvents = []string{
+	webhookEventMessageCreated,
+	webhookEventMessageEdited,
+	webhookEventMessageDeleted,
+	webhookEventReactionAdded,
+	webhookEventMemberJoined,
+}
+
+// Клиент для доставки; nil — вебхуки отключены
+var webhookClient *http.Client
+
+// Сигнал обработчику о новых событиях, чтобы не ждать следующего тика
+var webhookWake = make(chan struct{}, 1)
+
+// Подписка на события чата (chat_id) или всего сервера
+type webhook struct {
+	ID        int       `json:"id"`
+	ChatID    *int      `json:"chat_id,omitempty"`
+	OwnerID   *int      `json:"owner_id,omitempty"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	IsActive  bool      `json:"is_active"`
+	Secret    string    `json:"secret,omitempty"` // Возвращается только при создании
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Доставка события и её попытки
+type webhookDelivery struct {
+	ID            int                    `json:"id"`
+	WebhookID     int                    `json:"webhook_id"`
+	Event         string                 `json:"event"`
+	Status        string                 `json:"status"` // pending, delivered, dead
+	Attempts      int                    `json:"attempts"`
+	NextAttemptAt *time.Time             `json:"next_attempt_at,omitempty"`
+	DeliveredAt   *time.Time             `json:"delivered_at,omitempty"`
+	CreatedAt     time.Time              `json:"created_at"`
+	AttemptLog    []webhookAttemptRecord `json:"attempt_log"`
+}
+
+type webhookAttemptRecord struct {
+	AttemptedAt time.Time `json:"attempted_at"`
+	StatusCode  int       `json:"status_code,omitempty"`
+	Error       string    `json:"error,omitempty"`
+	Response    string    `json:"response,omitempty"`
+	DurationMs  int       `json:"duration_ms"`
+}
+
+// Настройка по переменным окружения: WEBHOOKS=off отключает доставку,
+// WEBHOOK_ALLOWED_ADDRS — адреса ip:port, разрешённые несмотря на защиту от SSRF
+// (например, локальный приёмник для проверки)
+func initWebhooks() {
+	if os.Getenv("WEBHOOKS") == "off" {
+		return
+	}
+	webhookClient = &http.Client{
+		Transport: newRestrictedTransport(parseAllowedAddrs(os.Getenv("WEBHOOK_ALLOWED_ADDRS")), webhookTimeout),
+		Timeout:   webhookTimeout,
+		// Перенаправления не выполняются: подписчик должен указать конечный адрес
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// Постановка события в очередь доставки всем подходящим подпискам.
+// Серверные подписки не получают события чатов «Избранное»
+func emitWebhookEvent(db *sql.DB, chatID int, event string, data map[string]interface{}) {
+	if webhookClient == nil {
+		return
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		log.Printf("Вебхуки: ошибка сериализации события %s: %v", event, err)
+		return
+	}
+	result, err := db.Exec(`
+        INSERT INTO webhook_deliveries (webhook_id, event, chat_id, payload)
+        SELECT w.id, $2, $1, $3
+        FROM webhooks w
+        WHERE w.is_active AND $2 = ANY(w.events)
+          AND (w.chat_id = $1 OR (w.chat_id IS NULL AND NOT EXISTS (
+              SELECT 1 FROM chats c WHERE c.id = $1 AND c.is_saved)))`,
+		chatID, event, payload)
+	if err != nil {
+		log.Printf("Вебхуки: ошибка постановки события %s чата %d: %v", event, chatID, err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		select {
+		case webhookWake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Подпись тела запроса: HMAC-SHA256 от "<timestamp>.<body>" секретом подписки.
+// Метка времени в подписи не даёт повторно отправить перехваченный запрос позже
+func webhookSignature(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Тело запроса к подписчику
+func webhookBody(deliveryID int, event string, chatID int, createdAt time.Time, payload json.RawMessage) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"delivery_id": deliveryID,
+		"event":       event,
+		"chat_id":     chatID,
+		"created_at":  createdAt.UTC().Format(time.RFC3339),
+		"data":        payload,
+	})
+}
+
+// Одна попытка доставки. Успех — любой ответ 2xx
+func sendWebhook(client *http.Client, targetURL, secret string, deliveryID int, event string, body []byte) (int, string, error) {
+	req, err := http.NewRequest("POST", targetURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, "", err
+	}
+	timestamp := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "MessengerServer-Webhooks/1.0")
+	req.Header.Set("X-Webhook-Event", event)
+	req.Header.Set("X-Webhook-Delivery", strconv.Itoa(deliveryID))
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", webhookSignature(secret, timestamp, body))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	snippet, _ := io.ReadAll(io.LimitReader(resp.Body, webhookMaxResponse))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, string(snippet), fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, string(snippet), nil
+}
+
+// Задержка перед следующей попыткой: удвоение с каждой неудачей и случайный разброс до 20%,
+// чтобы повторы к одному подписчику не приходили пачкой
+func webhookRetryDelay(attempts int) time.Duration {
+	delay := time.Duration(float64(webhookBaseRetryDelay) * math.Pow(2, float64(attempts-1)))
+	if delay > webhookMaxRetryDelay || delay <= 0 {
+		delay = webhookMaxRetryDelay
+	}
+	return delay + time.Duration(mathrand.Int63n(int64(delay)/5+1))
+}
+
+// Фоновая доставка вебхуков
+func startWebhookDispatcher() {
+	if webhookClient == nil {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(webhookPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+			case <-webhookWake:
+			}
+			dispatchWebhooks()
+		}
+	}()
+}
+
+func dispatchWebhooks() {
+	db, err := connectDB()
+	if err != nil {
+		log.Printf("Вебхуки: ошибка подключения к БД: %v", err)
+		return
+	}
+	defer db.Close()
+
+	// Доставки берутся в работу с арендой: при падении сервера они будут выбраны снова
+	rows, err := db.Query(`
+        UPDATE webhook_deliveries d
+        SET attempts = d.attempts + 1,
+            next_attempt_at = CURRENT_TIMESTAMP + $2 * INTERVAL '1 second'
+        FROM webhooks w
+        WHERE w.id = d.webhook_id AND d.id IN (
+            SELECT id FROM webhook_deliveries
+            WHERE status = 'pending' AND next_attempt_at <= CURRENT_TIMESTAMP
+            ORDER BY next_attempt_at
+            LIMIT $1
+            FOR UPDATE SKIP LOCKED
+        )
+        RETURNING d.id, d.event, d.chat_id, d.payload, d.attempts, d.created_at, w.url, w.secret`,
+		webhookBatchSize, int(webhookLease.Seconds()))
+	if err != nil {
+		log.Printf("Вебхуки: ошибка выборки доставок: %v", err)
+		return
+	}
+	type job struct {
+		id, chatID, attempts int
+		event, url, secret   string
+		payload              []byte
+		createdAt            time.Time
+	}
+	var jobs []job
+	for rows.Next() {
+		var j job
+		if err := rows.Scan(&j.id, &j.event, &j.chatID, &j.payload, &j.attempts, &j.createdAt, &j.url, &j.secret); err != nil {
+			log.Printf("Вебхуки: ошибка чтения доставки: %v", err)
+			continue
+		}
+		jobs = append(jobs, j)
+	}
+	rows.Close()
+
+	var wg sync.WaitGroup
+	for _, j := range jobs {
+		wg.Add(1)
+		go func(j job) {
+			defer wg.Done()
+			body, err := webhookBody(j.id, j.event, j.chatID, j.createdAt, j.payload)
+			if err != nil {
+				log.Printf("Вебхуки: ошибка формирования доставки %d: %v", j.id, err)
+				return
+			}
+			started := time.Now()
+			status, response, sendErr := sendWebhook(webhookClient, j.url, j.secret, j.id, j.event, body)
+			recordWebhookAttempt(db, j.id, j.attempts, status, response, sendErr, time.Since(started))
+		}(j)
+	}
+	wg.Wait()
+
+	// Успешные и окончательно неудачные доставки хранятся ограниченное время
+	_, err = db.Exec(`
+        DELETE FROM webhook_deliveries
+        WHERE status <> 'pending' AND created_at < CURRENT_TIMESTAMP - $1 * INTERVAL '1 second'`,
+		int(webhookRetention.Seconds()))
+	if err != nil {
+		log.Printf("Вебхуки: ошибка очистки журнала доставок: %v", err)
+	}
+}
+
+// Состояние доставки после попытки с номером attempts: delivered, dead или pending
+// с задержкой до следующей попытки
+func webhookAttemptOutcome(attempts int, sendErr error) (string, time.Duration) {
+	switch {
+	case sendErr == nil:
+		return "delivered", 0
+	case attempts >= webhookMaxAttempts:
+		return "dead", 0
+	default:
+		return "pending", webhookRetryDelay(attempts)
+	}
+}
+
+// Запись результата попытки и перевод доставки в следующее состояние
+func recordWebhookAttempt(db *sql.DB, deliveryID, attempts, status int, response string, sendErr error, duration time.Duration) {
+	var errText sql.NullString
+	if sendErr != nil {
+		errText = sql.NullString{String: sendErr.Error(), Valid: true}
+	}
+	_, err := db.Exec(`
+        INSERT INTO webhook_attempts (delivery_id, status_code, error, response, duration_ms)
+        VALUES ($1, NULLIF($2, 0), $3, NULLIF($4, ''), $5)`,
+		deliveryID, status, errText, sanitizeMessageText(response), duration.Milliseconds())
+	if err != nil {
+		log.Printf("Вебхуки: ошибка записи попытки доставки %d: %v", deliveryID, err)
+	}
+
+	outcome, retryDelay := webhookAttemptOutcome(attempts, sendErr)
+	switch outcome {
+	case "delivered":
+		_, err = db.Exec(`
+            UPDATE webhook_deliveries
+            SET status = 'delivered', delivered_at = CURRENT_TIMESTAMP, next_attempt_at = NULL
+            WHERE id = $1`, deliveryID)
+	case "dead":
+		log.Printf("Вебхуки: доставка %d не удалась после %d попыток: %v", deliveryID, attempts, sendErr)
+		_, err = db.Exec("UPDATE webhook_deliveries SET status = 'dead', next_attempt_at = NULL WHERE id = $1", deliveryID)
+	default:
+		_, err = db.Exec(`
+            UPDATE webhook_deliveries
+            SET next_attempt_at = CURRENT_TIMESTAMP + $2 * INTERVAL '1 millisecond'
+            WHERE id = $1`, deliveryID, retryDelay.Milliseconds())
+	}
+	if err != nil {
+		log.Printf("Вебхуки: ошибка обновления доставки %d: %v", deliveryID, err)
+	}
+}
+
+// Управлять вебхуками чата могут администраторы группы или участники личного чата,
+// серверными — администраторы сервера
+func canManageWebhooks(db queryRower, chatID, userID int) (bool, error) {
+	if chatID == 0 {
+		return isServerAdmin(userID), nil
+	}
+	var isGroup bool
+	err := db.QueryRow(`
+        SELECT c.is_group FROM chats c
+        JOIN participants p ON p.chat_id = c.id AND p.user_id = $2
+        WHERE c.id = $1`, chatID, userID).Scan(&isGroup)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if isGroup {
+		return canManageGroup(db, chatID, userID)
+	}
+	return true, nil
+}
+
+// Проверка адреса подписчика: абсолютный http(s) без учётных данных
+func validWebhookURL(raw string) bool {
+	if len(raw) > maxEntityURLLength {
+		return false
+	}
+	u, err := url.Parse(raw)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" && u.User == nil
+}
+
+// Нормализация списка событий; пустой список — все события
+func normalizeWebhookEvents(events []string) ([]string, bool) {
+	if len(events) == 0 {
+		return append([]string(nil), webhookEvents...), true
+	}
+	var result []string
+	for _, event := range events {
+		if !containsString(webhookEvents, event) {
+			return nil, false
+		}
+		if !containsString(result, event) {
+			result = append(result, event)
+		}
+	}
+	return result, true
+}
+
+func newWebhookSecret() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// Чтение вебхука вместе с чатом для проверки прав
+func loadWebhook(db queryRower, webhookID int) (webhook, error) {
+	var (
+		hook    webhook
+		chatID  sql.NullInt64
+		ownerID sql.NullInt64
+	)
+	err := db.QueryRow(`
+        SELECT id, chat_id, owner_id, url, events, is_active, created_at
+        FROM webhooks WHERE id = $1`, webhookID,
+	).Scan(&hook.ID, &chatID, &ownerID, &hook.URL, pq.Array(&hook.Events), &hook.IsActive, &hook.CreatedAt)
+	if err != nil {
+		return webhook{}, err
+	}
+	if chatID.Valid {
+		id := int(chatID.Int64)
+		hook.ChatID = &id
+	}
+	if ownerID.Valid {
+		id := int(ownerID.Int64)
+		hook.OwnerID = &id
+	}
+	return hook, nil
+}
+
+func webhookChatID(hook webhook) int {
+	if hook.ChatID == nil {
+		return 0
+	}
+	return *hook.ChatID
+}
+
+// Вебхуки чата или сервера: список (GET ?user_id&chat_id), создание (POST), удаление (DELETE ?user_id&id).
+// Без chat_id запрос относится к серверным вебхукам
+func webhooksHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	switch r.Method {
+	case "GET":
+		userID, err := strconv.Atoi(r.URL.Query().Get("user_id"))
+		if err != nil {
+			http.Error(w, "User ID is required", http.StatusBadRequest)
+			return
+		}
+		chatID, _ := strconv.Atoi(r.URL.Query().Get("chat_id"))
+		if allowed, err := canManageWebhooks(db, chatID, userID); err != nil || !allowed {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		rows, err := db.Query(`
+            SELECT id FROM webhooks
+            WHERE chat_id IS NOT DISTINCT FROM NULLIF($1, 0)
+            ORDER BY id`, chatID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		var ids []int
+		for rows.Next() {
+			var id int
+			if rows.Scan(&id) == nil {
+				ids = append(ids, id)
+			}
+		}
+		rows.Close()
+
+		hooks := []webhook{}
+		for _, id := range ids {
+			if hook, err := loadWebhook(db, id); err == nil {
+				hooks = append(hooks, hook)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(hooks)
+
+	case "POST":
+		var data struct {
+			UserID int      `json:"user_id"`
+			ChatID int      `json:"chat_id"` // 0 — серверный вебхук
+			URL    string   `json:"url"`
+			Events []string `json:"events"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if !validWebhookURL(data.URL) {
+			http.Error(w, "Invalid URL", http.StatusBadRequest)
+			return
+		}
+		events, ok := normalizeWebhookEvents(data.Events)
+		if !ok {
+			http.Error(w, "Unknown event", http.StatusBadRequest)
+			return
+		}
+		if allowed, err := canManageWebhooks(db, data.ChatID, data.UserID); err != nil || !allowed {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		limit := maxChatWebhooks
+		if data.ChatID == 0 {
+			limit = maxServerWebhooks
+		}
+		var count int
+		err := db.QueryRow("SELECT COUNT(*) FROM webhooks WHERE chat_id IS NOT DISTINCT FROM NULLIF($1, 0)", data.ChatID).Scan(&count)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if count >= limit {
+			http.Error(w, "Too many webhooks", http.StatusConflict)
+			return
+		}
+
+		secret, err := newWebhookSecret()
+		if err != nil {
+			http.Error(w, "Internal error", http.StatusInternalServerError)
+			return
+		}
+		var webhookID int
+		err = db.QueryRow(`
+            INSERT INTO webhooks (chat_id, owner_id, url, secret, events)
+            VALUES (NULLIF($1, 0), $2, $3, $4, $5)
+            RETURNING id`, data.ChatID, data.UserID, data.URL, secret, pq.Array(events),
+		).Scan(&webhookID)
+		if err != nil {
+			log.Printf("Ошибка создания вебхука: %v", err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		hook, err := loadWebhook(db, webhookID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		// Секрет показывается один раз: подписчик проверяет им подпись X-Webhook-Signature
+		hook.Secret = secret
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(hook)
+
+	case "DELETE":
+		userID, errUser := strconv.Atoi(r.URL.Query().Get("user_id"))
+		webhookID, errHook := strconv.Atoi(r.URL.Query().Get("id"))
+		if errUser != nil || errHook != nil {
+			http.Error(w, "User ID and webhook ID are required", http.StatusBadRequest)
+			return
+		}
+		hook, err := loadWebhook(db, webhookID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if allowed, err := canManageWebhooks(db, webhookChatID(hook), userID); err != nil || !allowed {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if _, err := db.Exec("DELETE FROM webhooks WHERE id = $1", webhookID); err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Журнал доставок вебхука (GET ?user_id&webhook_id&status&limit) и повторная отправка
+// доставки из dead-letter (POST {user_id, delivery_id})
+func webhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	db, err := connectDB()
+	if err != nil {
+		http.Error(w, "Database error", http.StatusInternalServerError)
+		return
+	}
+	defer db.Close()
+
+	switch r.Method {
+	case "GET":
+		userID, errUser := strconv.Atoi(r.URL.Query().Get("user_id"))
+		webhookID, errHook := strconv.Atoi(r.URL.Query().Get("webhook_id"))
+		if errUser != nil || errHook != nil {
+			http.Error(w, "User ID and webhook ID are required", http.StatusBadRequest)
+			return
+		}
+		status := r.URL.Query().Get("status")
+		if status != "" && status != "pending" && status != "delivered" && status != "dead" {
+			http.Error(w, "Invalid status", http.StatusBadRequest)
+			return
+		}
+		limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+		if err != nil || limit <= 0 || limit > maxDeliveriesListed {
+			limit = maxDeliveriesListed / 2
+		}
+
+		hook, err := loadWebhook(db, webhookID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Webhook not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if allowed, err := canManageWebhooks(db, webhookChatID(hook), userID); err != nil || !allowed {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		deliveries, err := loadWebhookDeliveries(db, webhookID, status, limit)
+		if err != nil {
+			log.Printf("Ошибка загрузки доставок вебхука %d: %v", webhookID, err)
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(deliveries)
+
+	case "POST":
+		var data struct {
+			UserID     int `json:"user_id"`
+			DeliveryID int `json:"delivery_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&data); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if data.UserID <= 0 || data.DeliveryID <= 0 {
+			http.Error(w, "User ID and delivery ID are required", http.StatusBadRequest)
+			return
+		}
+		var webhookID int
+		err := db.QueryRow("SELECT webhook_id FROM webhook_deliveries WHERE id = $1", data.DeliveryID).Scan(&webhookID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "Delivery not found", http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		hook, err := loadWebhook(db, webhookID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if allowed, err := canManageWebhooks(db, webhookChatID(hook), data.UserID); err != nil || !allowed {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		// Доставка начинает новый цикл попыток; журнал прежних попыток сохраняется
+		result, err := db.Exec(`
+            UPDATE webhook_deliveries
+            SET status = 'pending', attempts = 0, next_attempt_at = CURRENT_TIMESTAMP, delivered_at = NULL
+            WHERE id = $1 AND status <> 'pending'`, data.DeliveryID)
+		if err != nil {
+			http.Error(w, "Database error", http.StatusInternalServerError)
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			http.Error(w, "Delivery is already pending", http.StatusConflict)
+			return
+		}
+		select {
+		case webhookWake <- struct{}{}:
+		default:
+		}
+		w.WriteHeader(http.StatusAccepted)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// Последние доставки вебхука с журналом попыток, новые первыми
+func loadWebhookDeliveries(db *sql.DB, webhookID int, status string, limit int) ([]webhookDelivery, error) {
+	rows, err := db.Query(`
+        SELECT id, webhook_id, event, status, attempts, next_attempt_at, delivered_at, created_at
+        FROM webhook_deliveries
+        WHERE webhook_id = $1 AND ($2 = '' OR status = $2)
+        ORDER BY id DESC
+        LIMIT $3`, webhookID, status, limit)
+	if err != nil {
+		return nil, err
+	}
+	deliveries := []webhookDelivery{}
+	index := make(map[int]int)
+	var ids []int
+	for rows.Next() {
+		var (
+			d             webhookDelivery
+			nextAttemptAt sql.NullTime
+			deliveredAt   sql.NullTime
+		)
+		if err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Status, &d.Attempts, &nextAttemptAt, &deliveredAt, &d.CreatedAt); err != nil {
+			log.Printf("Ошибка чтения доставки вебхука: %v", err)
+			continue
+		}
+		if nextAttemptAt.Valid {
+			d.NextAttemptAt = &nextAttemptAt.Time
+		}
+		if deliveredAt.Valid {
+			d.DeliveredAt = &deliveredAt.Time
+		}
+		d.AttemptLog = []webhookAttemptRecord{}
+		index[d.ID] = len(deliveries)
+		ids = append(ids, d.ID)
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(ids) == 0 {
+		return deliveries, nil
+	}
+
+	rows, err = db.Query(`
+        SELECT delivery_id, attempted_at, COALESCE(status_code, 0), COALESCE(error, ''), COALESCE(response, ''), duration_ms
+        FROM webhook_attempts
+        WHERE delivery_id = ANY($1)
+        ORDER BY id`, pq.Array(intsToInt64(ids)))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			deliveryID int
+			a          webhookAttemptRecord
+		)
+		if err := rows.Scan(&deliveryID, &a.AttemptedAt, &a.StatusCode, &a.Error, &a.Response, &a.DurationMs); err != nil {
+			log.Printf("Ошибка чтения попытки доставки: %v", err)
+			continue
+		}
+		if i, ok := index[deliveryID]; ok {
+			deliveries[i].AttemptLog = append(deliveries[i].AttemptLog, a)
+		}
+	}
+	return deliveries, rows.Err()
+}
+
+// Данные события о сообщении из полей, разосланных клиентам
+func webhookMessageData(message map[string]interface{}) map[string]interface{} {
+	data := make(map[string]interface{}, len(message))
+	for key, value := range message {
+		if key != "isMe" {
+			data[key] = value
+		}
+	}
+	return data
+}
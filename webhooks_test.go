@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Клиент доставки, настроенный как в initWebhooks, с разрешённым адресом тестового приёмника
+func newTestWebhookClient(t *testing.T, server *httptest.Server) *http.Client {
+	t.Setenv("WEBHOOKS", "")
+	t.Setenv("WEBHOOK_ALLOWED_ADDRS", server.Listener.Addr().String())
+	previous := webhookClient
+	t.Cleanup(func() { webhookClient = previous })
+	initWebhooks()
+	return webhookClient
+}
+
+func TestWebhookSignatureFormat(t *testing.T) {
+	got := webhookSignature("whsec_test", 1700000000, []byte(`{"event":"message.created"}`))
+	const want = "sha256=9884eb2fcc09ffc10f00127fff0a0c5686da2fef61d0363442271c6dfa1917eb"
+	if got != want {
+		t.Fatalf("webhookSignature = %s, want %s", got, want)
+	}
+}
+
+// Подписчик проверяет подпись по заголовкам запроса так, как описано в документации
+func TestSendWebhookSignedRequest(t *testing.T) {
+	const secret = "whsec_receiver"
+	var received http.Header
+	var receivedBody []byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Clone()
+		receivedBody, _ = io.ReadAll(r.Body)
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	client := newTestWebhookClient(t, server)
+
+	body, err := webhookBody(42, webhookEventMessageCreated, 7, time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC), []byte(`{"text":"hi"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, response, err := sendWebhook(client, server.URL+"/hook", secret, 42, webhookEventMessageCreated, body)
+	if err != nil || status != http.StatusOK || response != "ok" {
+		t.Fatalf("sendWebhook = %d, %q, %v", status, response, err)
+	}
+
+	if !bytes.Equal(receivedBody, body) {
+		t.Fatalf("body = %s, want %s", receivedBody, body)
+	}
+	if received.Get("X-Webhook-Event") != webhookEventMessageCreated || received.Get("X-Webhook-Delivery") != "42" ||
+		received.Get("Content-Type") != "application/json" {
+		t.Fatalf("unexpected headers %v", received)
+	}
+	timestamp, err := strconv.ParseInt(received.Get("X-Webhook-Timestamp"), 10, 64)
+	if err != nil || time.Since(time.Unix(timestamp, 0)) > time.Minute {
+		t.Fatalf("bad timestamp %q", received.Get("X-Webhook-Timestamp"))
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(received.Get("X-Webhook-Timestamp") + "."))
+	mac.Write(receivedBody)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); received.Get("X-Webhook-Signature") != want {
+		t.Fatalf("signature = %s, want %s", received.Get("X-Webhook-Signature"), want)
+	}
+}
+
+func TestSendWebhookRestrictions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://10.0.0.1/", http.StatusFound)
+	}))
+	defer server.Close()
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer other.Close()
+	client := newTestWebhookClient(t, server)
+
+	// Перенаправление не выполняется и считается неудачной попыткой
+	status, _, err := sendWebhook(client, server.URL, "s", 1, webhookEventMessageCreated, []byte("{}"))
+	if err == nil || status != http.StatusFound {
+		t.Fatalf("redirect: status %d, err %v", status, err)
+	}
+	// Локальный адрес вне WEBHOOK_ALLOWED_ADDRS заблокирован
+	if _, _, err := sendWebhook(client, other.URL, "s", 1, webhookEventMessageCreated, []byte("{}")); !errors.Is(err, errBlockedAddress) {
+		t.Fatalf("unlisted loopback: %v, want errBlockedAddress", err)
+	}
+}
+
+func TestWebhookRetryDelaySchedule(t *testing.T) {
+	for attempts := 1; attempts <= 20; attempts++ {
+		base := webhookBaseRetryDelay << (attempts - 1)
+		if attempts > 10 || base > webhookMaxRetryDelay {
+			base = webhookMaxRetryDelay
+		}
+		for i := 0; i < 50; i++ {
+			delay := webhookRetryDelay(attempts)
+			if delay < base || delay > base+base/5 {
+				t.Fatalf("webhookRetryDelay(%d) = %v, want %v..%v", attempts, delay, base, base+base/5)
+			}
+		}
+	}
+}
+
+// Доставка на неотвечающий приёмник: повторы с растущей задержкой, после
+// webhookMaxAttempts — dead; повторная отправка начинает цикл попыток заново
+func TestWebhookRetriesUntilDead(t *testing.T) {
+	var (
+		requests int32
+		healthy  atomic.Bool
+	)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if !healthy.Load() {
+			http.Error(w, strings.Repeat("x", 2*webhookMaxResponse), http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	client := newTestWebhookClient(t, server)
+
+	deliver := func(attempts int) (string, time.Duration, string) {
+		status, response, err := sendWebhook(client, server.URL, "s", 1, webhookEventMessageCreated, []byte("{}"))
+		if err == nil && status != http.StatusOK {
+			t.Fatalf("attempt %d: status %d without error", attempts, status)
+		}
+		outcome, delay := webhookAttemptOutcome(attempts, err)
+		return outcome, delay, response
+	}
+
+	var previous time.Duration
+	for attempts := 1; attempts <= webhookMaxAttempts; attempts++ {
+		outcome, delay, response := deliver(attempts)
+		if len(response) != webhookMaxResponse {
+			t.Fatalf("attempt %d: stored %d bytes of response", attempts, len(response))
+		}
+		if attempts < webhookMaxAttempts {
+			if outcome != "pending" || delay <= previous {
+				t.Fatalf("attempt %d: outcome %s, delay %v after %v", attempts, outcome, delay, previous)
+			}
+			previous = delay
+			continue
+		}
+		if outcome != "dead" || delay != 0 {
+			t.Fatalf("last attempt: outcome %s, delay %v, want dead", outcome, delay)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != webhookMaxAttempts {
+		t.Fatalf("receiver got %d requests, want %d", n, webhookMaxAttempts)
+	}
+
+	// Повторная отправка сбрасывает attempts в 0: первая новая попытка снова первая по счёту
+	healthy.Store(true)
+	if outcome, delay, _ := deliver(1); outcome != "delivered" || delay != 0 {
+		t.Fatalf("redelivery: outcome %s, delay %v, want delivered", outcome, delay)
+	}
+}
+
+func TestWebhookDeliveriesHandlerValidation(t *testing.T) {
+	cases := []struct {
+		method, body string
+		status       int
+	}{
+		{"POST", "not json", http.StatusBadRequest},
+		{"POST", `{"user_id": 1}`, http.StatusBadRequest},
+		{"POST", `{"delivery_id": 5}`, http.StatusBadRequest},
+		{"GET", "", http.StatusBadRequest},
+		{"DELETE", "", http.StatusMethodNotAllowed},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest(c.method, "/webhooks/deliveries", strings.NewReader(c.body))
+		rec := httptest.NewRecorder()
+		webhookDeliveriesHandler(rec, req)
+		if rec.Code != c.status {
+			t.Errorf("%s %q: status %d, want %d", c.method, c.body, rec.Code, c.status)
+		}
+	}
+}
@@ -2,9 +2,7 @@ package main
 
 import (
 	"database/sql"
-	"encoding/base64"
 	"encoding/json"
-	"io"
 	"log"
 	"net/http"
 	"strconv"
@@ -15,6 +13,10 @@ import (
 	"github.com/gorilla/websocket"
 )
 
+// Предел размера входящего сообщения WebSocket: команда с текстом максимальной длины,
+// экранированным в JSON, и сущностями форматирования
+const wsMaxMessageSize = 128 << 10
+
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -80,6 +82,7 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer conn.Close() // Гарантированное закрытие соединения при выходе
+	conn.SetReadLimit(wsMaxMessageSize)
 	// Получаем параметры из URL
 	userIDStr := r.URL.Query().Get("user_id")
 	userID, _ := strconv.Atoi(userIDStr)
@@ -105,10 +108,15 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 
 		// Пытаемся распарсить сообщение как команду
 		var command struct {
-			Type      string `json:"type"`
-			MessageID int    `json:"message_id"`
-			UserID    int    `json:"user_id"`
-			NewText   string `json:"new_text"`
+			Type      string          `json:"type"`
+			MessageID int             `json:"message_id"`
+			UserID    int             `json:"user_id"`
+			NewText   string          `json:"new_text"`
+			Mode      string          `json:"mode"`
+			Tags      []string        `json:"tags"`
+			ParseMode string          `json:"parse_mode"`
+			Entities  []messageEntity `json:"entities"`
+			Reaction  string          `json:"reaction"`
 		}
 
 		if err := json.Unmarshal(message, &command); err == nil && command.Type != "" {
@@ -120,133 +128,58 @@ func handleWebSocket(w http.ResponseWriter, r *http.Request) {
 				handleDeleteForEveryoneCommand(conn, command.MessageID, command.UserID)
 				continue
 			case "edit_message":
-				handleEditMessageCommand(conn, command.MessageID, command.UserID, command.NewText)
+				handleEditMessageCommand(conn, command.MessageID, command.UserID, command.NewText, command.ParseMode, command.Entities)
+				continue
+			case "save_message":
+				handleSaveMessageCommand(conn, command.MessageID, command.UserID, command.Mode, command.Tags)
+				continue
+			case "schedule_message", "edit_scheduled", "cancel_scheduled", "list_scheduled":
+				handleScheduledCommand(conn, command.Type, message)
+				continue
+			case "add_reaction", "remove_reaction":
+				handleReactionCommand(conn, command.Type, command.MessageID, command.UserID, command.Reaction)
+				continue
+			case "send_location", "update_live_location", "stop_live_location":
+				handleLocationCommand(conn, command.Type, message)
+				continue
+			case "send_contact":
+				handleSendContactCommand(conn, message)
+				continue
+			case "send_sticker":
+				handleSendStickerCommand(conn, message)
+				continue
+			case "callback_query":
+				handleCallbackQueryCommand(conn, message)
+				continue
+			case "mark_listened":
+				handleMarkListenedCommand(conn, command.MessageID, command.UserID)
+				continue
+			case "create_poll", "poll_vote", "poll_retract", "poll_close":
+				handlePollCommand(conn, command.Type, message)
 				continue
 			}
 		}
 
 		// Если не команда, обрабатываем как обычное сообщение
-		var msgData struct {
-			ChatID           int    `json:"chat_id"`
-			UserID           int    `json:"user_id"`
-			Text             string `json:"text"`
-			ParentMessageID  *int   `json:"parent_message_id"`
-			IsForwarded      bool   `json:"is_forwarded"`
-			OriginalSenderID *int   `json:"original_sender_id"`
-			OriginalChatID   *int   `json:"original_chat_id"`
-		}
+		var msgData chatMessage
 		if err := json.Unmarshal(message, &msgData); err != nil {
 			log.Printf("Ошибка парсинга сообщения WebSocket: %v", err)
 			continue
 		}
 
-		// Подключаемся к базе данных
-		db, err := connectDB()
-		if err != nil {
-			log.Printf("Ошибка подключения к БД в WebSocket: %v", err)
+		// Команды "/command args" выполняются сервером или ботами и не сохраняются как сообщения
+		if handleSlashCommand(conn, msgData) {
 			continue
 		}
-		// Подготовка данных для SQL-запроса
-		var parentMessageID sql.NullInt64
-		if msgData.ParentMessageID != nil {
-			parentMessageID.Int64 = int64(*msgData.ParentMessageID)
-			parentMessageID.Valid = true
-		}
-		var originalSenderID sql.NullInt64
-		if msgData.OriginalSenderID != nil {
-			originalSenderID.Int64 = int64(*msgData.OriginalSenderID)
-			originalSenderID.Valid = true
-		}
-		var originalChatID sql.NullInt64
-		if msgData.OriginalChatID != nil {
-			originalChatID.Int64 = int64(*msgData.OriginalChatID)
-			originalChatID.Valid = true
-		}
 
-		// Сохраняем сообщение в базу данных
-		var messageID int
-		err = db.QueryRow(
-			"INSERT INTO messages (chat_id, user_id, content, parent_message_id, is_forwarded, original_sender_id, original_chat_id) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING id",
-			msgData.ChatID, msgData.UserID, msgData.Text, parentMessageID, msgData.IsForwarded, originalSenderID, originalChatID,
-		).Scan(&messageID)
-		if err != nil {
-			log.Printf("Ошибка сохранения сообщения в БД: %v", err)
-			db.Close()
-			continue
+		if _, err := sendChatMessage(msgData, conn); err != nil && isMessageValidationError(err) {
+			// Отправитель узнаёт, почему сообщение не было принято
+			conn.WriteJSON(map[string]interface{}{
+				"type":    "message_rejected",
+				"chat_id": msgData.ChatID,
+				"error":   err.Error(),
+			})
 		}
-		// Получаем имя отправителя
-		var senderName string
-		err = db.QueryRow("SELECT username FROM users WHERE id = $1", msgData.UserID).Scan(&senderName)
-		if err != nil {
-			log.Printf("Ошибка получения имени отправителя: %v", err)
-			senderName = "Unknown"
-		}
-		// Формируем объект сообщения для рассылки
-		msgDataMap := map[string]interface{}{
-			"id":                 messageID,
-			"chat_id":            msgData.ChatID,
-			"user_id":            msgData.UserID,
-			"text":               msgData.Text,
-			"created_at":         time.Now().Format(time.RFC3339),
-			"isMe":               false,
-			"sender_name":        senderName,
-			"parent_message_id":  msgData.ParentMessageID,
-			"is_forwarded":       msgData.IsForwarded,
-			"original_sender_id": msgData.OriginalSenderID,
-			"original_chat_id":   msgData.OriginalChatID,
-		}
-		// Если есть родительское сообщение, получаем его текст
-		if msgData.ParentMessageID != nil {
-			var parentContent string
-			err := db.QueryRow("SELECT content FROM messages WHERE id = $1", *msgData.ParentMessageID).Scan(&parentContent)
-			if err == nil {
-				msgDataMap["parent_content"] = parentContent
-			} else {
-				log.Printf("Ошибка получения parent_content: %v", err)
-			}
-		}
-
-		// Получаем участников чата из базы данных
-		rows, err := db.Query("SELECT user_id FROM participants WHERE chat_id = $1", msgData.ChatID)
-		if err != nil {
-			log.Printf("Ошибка получения участников чата: %v", err)
-			db.Close()
-			continue
-		}
-		defer rows.Close()
-
-		var participantIDs []int // Создаем пустой срез для хранения ID участников чата
-		for rows.Next() {        // Итерируем по строкам результата SQL-запрос
-			var participantID int
-			if err := rows.Scan(&participantID); err != nil {
-				log.Printf("Ошибка сканирования participant_id: %v", err)
-				continue
-			}
-			participantIDs = append(participantIDs, participantID)
-		}
-		db.Close()
-
-		// Рассылка всем участникам чата
-		clientsMu.Lock()
-		log.Printf("Рассылка сообщения клиентам в чате %d (участники: %v)", msgData.ChatID, participantIDs)
-		for client, info := range clients {
-			// Проверяем, является ли клиент участником чата
-			for _, pid := range participantIDs {
-				if info.userID == pid {
-					isMe := (client == conn)
-					msgDataMap["isMe"] = isMe
-					messageWithIsMe, _ := json.Marshal(msgDataMap)
-					err := client.WriteMessage(websocket.TextMessage, messageWithIsMe)
-					if err != nil {
-						log.Printf("Ошибка отправки сообщения клиенту (user_id=%d): %v", info.userID, err)
-						client.Close()
-						delete(clients, client)
-					}
-					break // Прерываем внутренний цикл, так как сообщение уже отправлено этому клиенту
-				}
-			}
-		}
-		clientsMu.Unlock()
 	}
 
 	log.Printf("Клиент отключен: user_id=%d", userID)
@@ -277,14 +210,14 @@ func getUserStatusHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Функция для рассылки уведомления о создании группы
-func broadcastNewGroup(chatID int, chatName string, userIDs []int, groupImage string) {
+func broadcastNewGroup(chatID int, chatName string, userIDs []int, groupImageURL string) {
 	newGroupMessage := map[string]interface{}{
-		"type":        "new_group",
-		"chat_id":     chatID,
-		"chat_name":   chatName,
-		"is_group":    true,
-		"user_ids":    userIDs,
-		"group_image": groupImage, // Передаем изображение как base64 или другой формат
+		"type":            "new_group",
+		"chat_id":         chatID,
+		"chat_name":       chatName,
+		"is_group":        true,
+		"user_ids":        userIDs,
+		"group_image_url": groupImageURL, // Пустая строка, если фото не задано
 	}
 
 	clientsMu.Lock()
@@ -320,6 +253,11 @@ func createGroupChatHandler(w http.ResponseWriter, r *http.Request) {
 	description := r.FormValue("description")
 	createdBy := r.FormValue("created_by")
 	isGroup := r.FormValue("is_group") == "true"
+	// Личные чаты создаются через POST /chats: там они получают direct_key и не дублируются
+	if !isGroup {
+		http.Error(w, "Direct chats must be created via /chats", http.StatusBadRequest)
+		return
+	}
 
 	// Получаем user_ids как строку, разделенную запятыми
 	userIDsStr := r.FormValue("user_ids")
@@ -335,20 +273,6 @@ func createGroupChatHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Обработка изображения (только для группового чата)
-	var imageBytes []byte
-	if isGroup {
-		file, _, err := r.FormFile("image")
-		if err == nil {
-			defer file.Close()
-			imageBytes, err = io.ReadAll(file)
-			if err != nil {
-				http.Error(w, "Error reading image", http.StatusBadRequest)
-				return
-			}
-		}
-	}
-
 	// Подключаемся к базе данных
 	db, err := connectDB()
 	if err != nil {
@@ -357,6 +281,21 @@ func createGroupChatHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
+	// Обработка изображения (только для группового чата): файл сохраняется в хранилище
+	var imageKey sql.NullString
+	if isGroup {
+		file, handler, err := r.FormFile("image")
+		if err == nil && handler.Size > 0 {
+			defer file.Close()
+			blob, err := storeAvatarImage(db, file, handler.Filename)
+			if err != nil {
+				writeImageError(w, err)
+				return
+			}
+			imageKey = sql.NullString{String: blob.Key, Valid: true}
+		}
+	}
+
 	// Начинаем транзакцию
 	tx, err := db.Begin()
 	if err != nil {
@@ -376,8 +315,8 @@ func createGroupChatHandler(w http.ResponseWriter, r *http.Request) {
 	// Если это групповой чат, создаем запись в таблице group_chats
 	if isGroup {
 		_, err = tx.Exec(
-			"INSERT INTO group_chats (chat_id, name, description, created_by, image) VALUES ($1, $2, $3, $4, $5)",
-			chatID, name, description, createdBy, imageBytes,
+			"INSERT INTO group_chats (chat_id, name, description, created_by, image_key) VALUES ($1, $2, $3, $4, $5)",
+			chatID, name, description, createdBy, imageKey,
 		)
 		if err != nil {
 			tx.Rollback()
@@ -435,11 +374,18 @@ func createGroupChatHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Отправляем уведомление о новом групповом чате
 	if isGroup {
-		groupImageStr := ""
-		if len(imageBytes) > 0 {
-			groupImageStr = base64.StdEncoding.EncodeToString(imageBytes) // Передаем изображение как base64
+		imageURL := ""
+		if imageKey.Valid {
+			imageURL = groupImageURL(chatID, 1) // Новая группа начинается с первой версии изображения
 		}
-		broadcastNewGroup(chatID, name, userIDInts, groupImageStr)
+		broadcastNewGroup(chatID, name, userIDInts, imageURL)
+	}
+	for _, userID := range userIDInts {
+		emitWebhookEvent(db, chatID, webhookEventMemberJoined, map[string]interface{}{
+			"chat_id":  chatID,
+			"user_id":  userID,
+			"is_group": isGroup,
+		})
 	}
 
 	// Возвращаем успешный ответ
@@ -511,14 +457,45 @@ func createChatHandler(w http.ResponseWriter, r *http.Request) {
 	}
 	defer db.Close()
 
+	// Чат с самим собой — это "Избранное"
+	if currentUserID == targetUserID {
+		chatID, created, err := getOrCreateSavedChat(db, currentUserID)
+		if err != nil {
+			log.Printf("Ошибка получения избранного пользователя %d: %v", currentUserID, err)
+			http.Error(w, "Chat creation failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"chatId": chatID, "existing": !created, "is_saved": true})
+		return
+	}
+
 	tx, err := db.Begin()
 	if err != nil {
 		http.Error(w, "Transaction error", http.StatusInternalServerError)
 		return
 	}
-	// Создание чата (is_group=false по умолчанию)
+	// Создание чата (is_group=false по умолчанию).
+	// Уникальный ключ пары не даёт создать второй личный чат между теми же пользователями
 	var chatID int
-	if err := tx.QueryRow("INSERT INTO chats DEFAULT VALUES RETURNING id").Scan(&chatID); err != nil {
+	err = tx.QueryRow(
+		"INSERT INTO chats (direct_key) VALUES ($1) ON CONFLICT (direct_key) DO NOTHING RETURNING id",
+		directChatKey(currentUserID, targetUserID),
+	).Scan(&chatID)
+	if err == sql.ErrNoRows {
+		tx.Rollback()
+		// Чат уже существует: возвращаем его вместо создания нового
+		existingID, err := getExistingDirectChat(db, currentUserID, targetUserID)
+		if err != nil {
+			log.Printf("Ошибка получения существующего чата %d-%d: %v", currentUserID, targetUserID, err)
+			http.Error(w, "Chat lookup failed", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"chatId": existingID, "existing": true})
+		return
+	}
+	if err != nil {
 		tx.Rollback()
 		http.Error(w, "Chat creation failed", http.StatusInternalServerError)
 		return
@@ -548,10 +525,36 @@ func createChatHandler(w http.ResponseWriter, r *http.Request) {
 
 	// Отправляем уведомление о новом чате через WebSocket
 	broadcastNewChat(chatID, userIDs)
+	for _, userID := range userIDs {
+		emitWebhookEvent(db, chatID, webhookEventMemberJoined, map[string]interface{}{
+			"chat_id":  chatID,
+			"user_id":  userID,
+			"is_group": false,
+		})
+	}
 
 	// Возвращаем успешный ответ
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]int{"chatId": chatID})
+	json.NewEncoder(w).Encode(map[string]interface{}{"chatId": chatID, "existing": false})
+}
+
+// Канонический ключ личного чата: ID пользователей по возрастанию
+func directChatKey(userA, userB int) string {
+	if userA > userB {
+		userA, userB = userB, userA
+	}
+	return strconv.Itoa(userA) + ":" + strconv.Itoa(userB)
+}
+
+// Получение существующего личного чата пары; если пользователь скрывал его, чат снова становится видимым
+func getExistingDirectChat(db *sql.DB, currentUserID, targetUserID int) (int, error) {
+	var chatID int
+	err := db.QueryRow("SELECT id FROM chats WHERE direct_key = $1", directChatKey(currentUserID, targetUserID)).Scan(&chatID)
+	if err != nil {
+		return 0, err
+	}
+	_, err = db.Exec("UPDATE participants SET hidden_at = NULL WHERE chat_id = $1 AND user_id = $2", chatID, currentUserID)
+	return chatID, err
 }
 
 func getChatsHandler(w http.ResponseWriter, r *http.Request) {
@@ -574,9 +577,14 @@ func getChatsHandler(w http.ResponseWriter, r *http.Request) {
             c.id AS chat_id,
             c.last_message_at,
             p.unread_count,
-            m.content AS last_message,
+            p.unread_mentions,
+            CASE
+                WHEN p.history_cleared_at IS NOT NULL AND c.last_message_at <= p.history_cleared_at THEN NULL
+                ELSE m.content
+            END AS last_message,
             CASE
                 WHEN c.is_group THEN gc.name
+                WHEN c.is_saved THEN 'Избранное'
                 ELSE u.name
             END AS chat_name,
             CASE
@@ -584,8 +592,13 @@ func getChatsHandler(w http.ResponseWriter, r *http.Request) {
                 ELSE u.id
             END AS partner_id,
             c.is_group,
-            gc.image as group_image,
-            u.name as partner_name
+            c.is_saved,
+            c.message_ttl,
+            gc.image IS NOT NULL OR gc.image_key IS NOT NULL AS has_group_image,
+            gc.image_version,
+            u.name as partner_name,
+            u.image_key AS partner_image_key,
+            CASE WHEN u.image_key IS NULL THEN md5(u.image) END AS partner_image_hash
         FROM participants p
         JOIN chats c ON p.chat_id = c.id
         LEFT JOIN (
@@ -597,6 +610,8 @@ func getChatsHandler(w http.ResponseWriter, r *http.Request) {
         LEFT JOIN participants p2 ON p2.chat_id = c.id AND p2.user_id != $1 AND NOT c.is_group
         LEFT JOIN users u ON u.id = p2.user_id
         WHERE p.user_id = $1
+            -- Скрытый пользователем чат снова появляется после нового сообщения
+            AND (p.hidden_at IS NULL OR c.last_message_at > p.hidden_at)
         ORDER BY c.last_message_at DESC
     `, currentUserID)
 
@@ -613,45 +628,67 @@ func getChatsHandler(w http.ResponseWriter, r *http.Request) {
 			chatID      int
 			timestamp   sql.NullTime
 			unreadCount int
+			unreadMents int
 			lastMessage sql.NullString
 			chatName    sql.NullString
 			partnerID   sql.NullInt64
 			isGroup     bool
-			groupImage  []byte
+			isSaved     bool
+			messageTTL  sql.NullInt64
+			hasImage    sql.NullBool
+			imageVer    sql.NullInt64
 			partnerName sql.NullString
+			partnerKey  sql.NullString
+			partnerHash sql.NullString
 		)
 
 		if err := rows.Scan(
 			&chatID,
 			&timestamp,
 			&unreadCount,
+			&unreadMents,
 			&lastMessage,
 			&chatName,
 			&partnerID,
 			&isGroup,
-			&groupImage,
+			&isSaved,
+			&messageTTL,
+			&hasImage,
+			&imageVer,
 			&partnerName,
+			&partnerKey,
+			&partnerHash,
 		); err != nil {
 			log.Printf("Scan error: %v", err)
 			continue
 		}
 		// Формирование объекта чата
 		chatData := map[string]interface{}{
-			"id":          chatID,
-			"lastMessage": lastMessage.String,
-			"unread":      unreadCount,
-			"timestamp":   timestamp.Time,
-			"chat_name":   chatName.String,
-			"is_group":    isGroup,
+			"id":              chatID,
+			"lastMessage":     lastMessage.String,
+			"unread":          unreadCount,
+			"unread_mentions": unreadMents,
+			"timestamp":       timestamp.Time,
+			"chat_name":       chatName.String,
+			"is_group":        isGroup,
+			"is_saved":        isSaved,
+			"message_ttl":     messageTTL.Int64,
 		}
 
+		// Изображения передаются адресами с версией, а не данными
 		if isGroup {
-			if len(groupImage) > 0 {
-				chatData["group_image"] = groupImage
+			if imageVer.Valid {
+				chatData["group_image_version"] = imageVer.Int64
+				if hasImage.Bool {
+					chatData["group_image_url"] = groupImageURL(chatID, int(imageVer.Int64))
+				}
 			}
 		} else {
 			if partnerID.Valid {
 				chatData["partner_id"] = partnerID.Int64
+				if imageURL := userImageURL(int(partnerID.Int64), imageVersionToken(partnerKey, partnerHash)); imageURL != "" {
+					chatData["partner_image_url"] = imageURL
+				}
 			}
 			if partnerName.Valid {
 				chatData["partner_name"] = partnerName.String
@@ -693,12 +730,13 @@ func broadcastMessageDeletion(messageID int) {
 	}
 }
 
-func broadcastMessageEdit(chatID, messageID int, newText string, editedAt time.Time) {
+func broadcastMessageEdit(chatID, messageID int, newText string, entities []messageEntity, editedAt time.Time) {
 	editMsg := map[string]interface{}{
 		"type":      "message_edited",
 		"id":        messageID,
 		"chat_id":   chatID,
 		"new_text":  newText,
+		"entities":  entities,
 		"edited_at": editedAt.Format(time.RFC3339),
 	}
 
@@ -728,12 +766,18 @@ func handleDeleteForEveryoneCommand(conn *websocket.Conn, messageID, userID int)
 	}
 	defer db.Close()
 
+	if _, err := deleteMessageForEveryone(db, messageID, userID); err != nil {
+		log.Printf("Delete for everyone error: user %d, message %d: %v", userID, messageID, err)
+	}
+}
+
+// Удаление сообщения для всех. Удалять может только автор
+func deleteMessageForEveryone(db *sql.DB, messageID, userID int) (int, error) {
 	// Проверяем, что пользователь - автор сообщения
-	var authorID int
-	err = db.QueryRow("SELECT user_id FROM messages WHERE id = $1", messageID).Scan(&authorID)
+	var authorID, chatID int
+	err := db.QueryRow("SELECT user_id, chat_id FROM messages WHERE id = $1", messageID).Scan(&authorID, &chatID)
 	if err != nil || authorID != userID {
-		log.Printf("Unauthorized delete attempt: user %d tried to delete message %d", userID, messageID)
-		return
+		return 0, errNotMessageAuthor
 	}
 
 	// Обновление сообщения в БД
@@ -745,15 +789,21 @@ func handleDeleteForEveryoneCommand(conn *websocket.Conn, messageID, userID int)
 		messageID)
 
 	if err != nil {
-		log.Printf("Delete for everyone error: %v", err)
-		return
+		return 0, err
 	}
 
-	// Рассылаем уведомление об удалении
+	// Рассылаем уведомление об удалении; ещё не доставленные push-уведомления отзываются
 	broadcastMessageDeletion(messageID)
+	withdrawPushNotifications(db, messageID)
+	emitWebhookEvent(db, chatID, webhookEventMessageDeleted, map[string]interface{}{
+		"id":      messageID,
+		"chat_id": chatID,
+		"user_id": userID,
+	})
+	return chatID, nil
 }
 
-func handleEditMessageCommand(conn *websocket.Conn, messageID, userID int, newText string) {
+func handleEditMessageCommand(conn *websocket.Conn, messageID, userID int, newText, parseMode string, entities []messageEntity) {
 	db, err := connectDB()
 	if err != nil {
 		log.Printf("DB connection error: %v", err)
@@ -761,6 +811,25 @@ func handleEditMessageCommand(conn *websocket.Conn, messageID, userID int, newTe
 	}
 	defer db.Close()
 
+	if _, err := editChatMessage(db, messageID, userID, newText, parseMode, entities); err != nil {
+		log.Printf("Edit rejected: user %d, message %d: %v", userID, messageID, err)
+		if isMessageValidationError(err) {
+			conn.WriteJSON(map[string]interface{}{
+				"type":  "message_rejected",
+				"id":    messageID,
+				"error": err.Error(),
+			})
+		}
+	}
+}
+
+// Редактирование текста сообщения автором и рассылка изменения
+func editChatMessage(db *sql.DB, messageID, userID int, newText, parseMode string, entities []messageEntity) (int, error) {
+	newText, entities, err := prepareMessageText(newText, parseMode, entities)
+	if err != nil {
+		return 0, err
+	}
+
 	var chatID int
 	var authorID int
 	var editedAt time.Time
@@ -769,33 +838,65 @@ func handleEditMessageCommand(conn *websocket.Conn, messageID, userID int, newTe
 	err = db.QueryRow(`
         SELECT chat_id, user_id 
         FROM messages 
-        WHERE id = $1`,
+        WHERE id = $1 AND NOT is_deleted`,
 		messageID,
 	).Scan(&chatID, &authorID)
 
 	if err != nil || authorID != userID {
-		log.Printf("Unauthorized edit: user %d, message %d", userID, messageID)
-		return
+		return 0, errNotMessageAuthor
 	}
 
-	// Обновляем сообщение
-	err = db.QueryRow(`
+	// Обновляем сообщение вместе с упоминаниями, чтобы текст и сущности не разошлись
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`
         UPDATE messages 
         SET content = $1, 
+            entities = $3::jsonb,
             is_edited = TRUE,
             edited_at = CURRENT_TIMESTAMP
         WHERE id = $2
         RETURNING edited_at`,
-		newText, messageID,
+		newText, messageID, entitiesJSON(entities),
 	).Scan(&editedAt)
 
 	if err != nil {
-		log.Printf("Edit error: %v", err)
-		return
+		return 0, err
+	}
+
+	previous, err := deleteMessageMentions(tx, messageID)
+	if err != nil {
+		return 0, err
+	}
+	mentions, err := storeMessageMentions(tx, messageID, chatID, userID, newText, previous)
+	if err != nil {
+		return 0, err
+	}
+	if entities, err = attachMentionEntities(tx, messageID, entities, mentions); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
 	}
 
-	broadcastMessageEdit(chatID, messageID, newText, editedAt)
+	broadcastMessageEdit(chatID, messageID, newText, entities, editedAt)
+	edited := map[string]interface{}{
+		"id":        messageID,
+		"chat_id":   chatID,
+		"user_id":   userID,
+		"text":      newText,
+		"entities":  entities,
+		"edited_at": editedAt.Format(time.RFC3339),
+	}
+	emitWebhookEvent(db, chatID, webhookEventMessageEdited, edited)
+	queueChatBotUpdates(db, chatID, userID, botUpdateEditedMessage, edited)
+	return chatID, nil
 }
+
 func handleDeleteForMeCommand(conn *websocket.Conn, messageID, userID int) {
 	db, err := connectDB()
 	if err != nil {
@@ -825,3 +926,43 @@ func handleDeleteForMeCommand(conn *websocket.Conn, messageID, userID int) {
 
 	conn.WriteJSON(confirmMsg)
 }
+
+// Получение ID всех участников чата
+func getChatParticipantIDs(db *sql.DB, chatID int) ([]int, error) {
+	rows, err := db.Query("SELECT user_id FROM participants WHERE chat_id = $1", chatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var participantIDs []int
+	for rows.Next() {
+		var participantID int
+		if err := rows.Scan(&participantID); err != nil {
+			log.Printf("Ошибка сканирования participant_id: %v", err)
+			continue
+		}
+		participantIDs = append(participantIDs, participantID)
+	}
+	return participantIDs, rows.Err()
+}
+
+// Рассылка события всем подключениям указанных пользователей
+func broadcastToUsers(userIDs []int, payload interface{}) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	for client, info := range clients {
+		for _, userID := range userIDs {
+			if info.userID == userID {
+				err := client.WriteJSON(payload)
+				if err != nil {
+					log.Printf("Ошибка отправки события клиенту [%d]: %v", info.userID, err)
+					client.Close()
+					delete(clients, client)
+				}
+				break
+			}
+		}
+	}
+}